@@ -149,6 +149,10 @@ type Backend interface {
 	// ValidateStackName verifies that the string is a legal identifier for a (potentially qualified) stack.
 	// Will check for any backend-specific naming restrictions.
 	ValidateStackName(s string) error
+	// ValidateReference checks that the given stack reference is well-formed and that the current user may access the
+	// stack it refers to, returning an error suitable for display to the user if not. It does not check whether the
+	// stack exists.
+	ValidateReference(ctx context.Context, ref StackReference) error
 
 	// DoesProjectExist returns true if a project with the given name exists in this backend, or false otherwise.
 	DoesProjectExist(ctx context.Context, orgName string, projectName string) (bool, error)
@@ -201,6 +205,9 @@ type Backend interface {
 	// GetHistory returns all updates for the stack. The returned UpdateInfo slice will be in
 	// descending order (newest first).
 	GetHistory(ctx context.Context, stackRef StackReference, pageSize int, page int) ([]UpdateInfo, error)
+	// GetDeploymentVersion returns the stack's snapshot as it was after the given version in its history. The first
+	// update is version 1, the second version 2, and so on.
+	GetDeploymentVersion(ctx context.Context, stackRef StackReference, version int) (*deploy.Snapshot, error)
 	// GetLogs fetches a list of log entries for the given stack, with optional filtering/querying.
 	GetLogs(ctx context.Context, secretsProvider secrets.Provider, stack Stack, cfg StackConfiguration,
 		query operations.LogQuery) ([]operations.LogEntry, error)
@@ -291,6 +298,16 @@ type EnvironmentsBackend interface {
 		yaml []byte,
 		duration time.Duration,
 	) (*esc.Environment, apitype.EnvironmentDiagnostics, error)
+
+	// GetEnvironment returns the definition of an existing environment, or nil if there is no such environment. If
+	// decrypt is true, the values of any secrets in the definition are decrypted.
+	GetEnvironment(
+		ctx context.Context,
+		org string,
+		projectName string,
+		envName string,
+		decrypt bool,
+	) ([]byte, error)
 }
 
 // SpecificDeploymentExporter is an interface defining an additional capability of a Backend, specifically the
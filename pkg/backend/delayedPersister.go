@@ -0,0 +1,46 @@
+// Copyright 2016-2024, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"time"
+
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+)
+
+var (
+	_ = SnapshotPersister((*DelayedPersister)(nil))
+	_ = Syncer((*DelayedPersister)(nil))
+)
+
+// DelayedPersister is a SnapshotPersister that waits for Delay before handing each snapshot to Inner. It can be used
+// to limit the rate of writes to a backend that throttles them, or to simulate a slow backend in tests.
+type DelayedPersister struct {
+	Inner SnapshotPersister
+	Delay time.Duration
+}
+
+func (p *DelayedPersister) Save(snap *deploy.Snapshot) error {
+	time.Sleep(p.Delay)
+	return p.Inner.Save(snap)
+}
+
+// Sync syncs Inner if it is a Syncer, and does nothing otherwise.
+func (p *DelayedPersister) Sync() error {
+	if syncer, ok := p.Inner.(Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
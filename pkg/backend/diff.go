@@ -0,0 +1,172 @@
+// Copyright 2016-2024, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// SnapshotDiff describes how the resources in one version of a stack's deployment differ from those in another.
+// Each list is in the order the resources appear in the deployment they were taken from.
+type SnapshotDiff struct {
+	Added   []resource.URN // resources present only in the newer deployment.
+	Deleted []resource.URN // resources present only in the older deployment.
+	Updated []resource.URN // resources present in both deployments whose states differ.
+}
+
+// DiffSnapshots computes the differences between two deployments. Resources are matched by URN, and the states of
+// all of the resources sharing a URN (e.g. a resource and its pending deletions) are compared together, after
+// restoring any compressed properties. No secrets manager is needed, so secret values are not compared: only their
+// ciphertexts are available, and those change whenever a secret is re-encrypted by a manager that adds a nonce. A
+// resource whose only change is to the value of a secret is therefore not reported as updated.
+func DiffSnapshots(from, to *apitype.DeploymentV3) (SnapshotDiff, error) {
+	group := func(d *apitype.DeploymentV3) ([]resource.URN, map[resource.URN][]apitype.ResourceV3) {
+		var urns []resource.URN
+		states := make(map[resource.URN][]apitype.ResourceV3)
+		if d == nil {
+			return urns, states
+		}
+		for _, res := range d.Resources {
+			if _, has := states[res.URN]; !has {
+				urns = append(urns, res.URN)
+			}
+			states[res.URN] = append(states[res.URN], res)
+		}
+		return urns, states
+	}
+	fromURNs, fromStates := group(from)
+	toURNs, toStates := group(to)
+
+	var diff SnapshotDiff
+	for _, urn := range fromURNs {
+		if _, has := toStates[urn]; !has {
+			diff.Deleted = append(diff.Deleted, urn)
+		}
+	}
+	for _, urn := range toURNs {
+		old, has := fromStates[urn]
+		if !has {
+			diff.Added = append(diff.Added, urn)
+			continue
+		}
+		oldJSON, err := comparableStates(old)
+		if err != nil {
+			return SnapshotDiff{}, fmt.Errorf("serializing %s: %w", urn, err)
+		}
+		newJSON, err := comparableStates(toStates[urn])
+		if err != nil {
+			return SnapshotDiff{}, fmt.Errorf("serializing %s: %w", urn, err)
+		}
+		if !bytes.Equal(oldJSON, newJSON) {
+			diff.Updated = append(diff.Updated, urn)
+		}
+	}
+	return diff, nil
+}
+
+// comparableStates returns the JSON encoding of the given serialized states with any compressed properties restored
+// and every secret replaced by a placeholder, so that states which differ only in the ciphertexts of their secrets
+// encode identically.
+func comparableStates(states []apitype.ResourceV3) ([]byte, error) {
+	normalized := make([]interface{}, len(states))
+	for i, res := range states {
+		res, err := stack.DecompressResource(res)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := json.Marshal(res)
+		if err != nil {
+			return nil, err
+		}
+		var generic interface{}
+		if err := json.Unmarshal(encoded, &generic); err != nil {
+			return nil, err
+		}
+		normalized[i] = blindSecrets(generic)
+	}
+	return json.Marshal(normalized)
+}
+
+// blindSecrets returns the given JSON value with each serialized secret within it replaced by a placeholder.
+func blindSecrets(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if v[resource.SigKey] == resource.SecretSig {
+			return "[secret]"
+		}
+		blinded := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			blinded[k] = blindSecrets(e)
+		}
+		return blinded
+	case []interface{}:
+		blinded := make([]interface{}, len(v))
+		for i, e := range v {
+			blinded[i] = blindSecrets(e)
+		}
+		return blinded
+	default:
+		return v
+	}
+}
+
+// DiffDeployments returns the differences between the deployments at fromVersion and toVersion in the history of the
+// given stack. Both versions are exported and diffed locally, which requires the backend to be a
+// SpecificDeploymentExporter.
+func DiffDeployments(
+	ctx context.Context, b Backend, stackRef StackReference, fromVersion, toVersion int,
+) (SnapshotDiff, error) {
+	exporter, ok := b.(SpecificDeploymentExporter)
+	if !ok {
+		return SnapshotDiff{}, errors.New("the current backend does not support exporting previous deployments")
+	}
+	s, err := b.GetStack(ctx, stackRef)
+	if err != nil {
+		return SnapshotDiff{}, err
+	}
+	if s == nil {
+		return SnapshotDiff{}, fmt.Errorf("stack %s not found", stackRef)
+	}
+
+	export := func(version int) (*apitype.DeploymentV3, error) {
+		untyped, err := exporter.ExportDeploymentForVersion(ctx, s, strconv.Itoa(version))
+		if err != nil {
+			return nil, fmt.Errorf("exporting version %d: %w", version, err)
+		}
+		deployment, err := stack.UnmarshalUntypedDeployment(ctx, untyped)
+		if err != nil {
+			return nil, fmt.Errorf("reading version %d: %w", version, err)
+		}
+		return deployment, nil
+	}
+	from, err := export(fromVersion)
+	if err != nil {
+		return SnapshotDiff{}, err
+	}
+	to, err := export(toVersion)
+	if err != nil {
+		return SnapshotDiff{}, err
+	}
+	return DiffSnapshots(from, to)
+}
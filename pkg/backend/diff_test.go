@@ -0,0 +1,130 @@
+// Copyright 2016-2024, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// mockVersionedBackend is a backend that can export each of a fixed set of deployment versions.
+type mockVersionedBackend struct {
+	MockBackend
+	deployments map[string]*apitype.DeploymentV3
+}
+
+func (be *mockVersionedBackend) ExportDeploymentForVersion(
+	ctx context.Context, stack Stack, version string,
+) (*apitype.UntypedDeployment, error) {
+	deployment, has := be.deployments[version]
+	if !has {
+		return nil, fmt.Errorf("no version %s", version)
+	}
+	raw, err := json.Marshal(deployment)
+	if err != nil {
+		return nil, err
+	}
+	return &apitype.UntypedDeployment{Version: 3, Deployment: raw}, nil
+}
+
+func TestDiffDeployments(t *testing.T) {
+	t.Parallel()
+
+	urnA := resource.URN("urn:pulumi:test::test::pkg:index:type::a")
+	urnB := resource.URN("urn:pulumi:test::test::pkg:index:type::b")
+	urnC := resource.URN("urn:pulumi:test::test::pkg:index:type::c")
+	urnD := resource.URN("urn:pulumi:test::test::pkg:index:type::d")
+	res := func(urn resource.URN, outputs map[string]interface{}) apitype.ResourceV3 {
+		return apitype.ResourceV3{URN: urn, Type: "pkg:index:type", Custom: true, ID: "id", Outputs: outputs}
+	}
+	v1 := &apitype.DeploymentV3{Resources: []apitype.ResourceV3{
+		res(urnA, map[string]interface{}{"foo": "bar"}),
+		res(urnB, map[string]interface{}{"foo": "bar"}),
+		res(urnC, map[string]interface{}{"foo": "bar"}),
+	}}
+	v2 := &apitype.DeploymentV3{Resources: []apitype.ResourceV3{
+		res(urnA, map[string]interface{}{"foo": "bar"}),
+		res(urnB, map[string]interface{}{"foo": "baz"}),
+		res(urnD, map[string]interface{}{"foo": "bar"}),
+	}}
+	expected := SnapshotDiff{
+		Added:   []resource.URN{urnD},
+		Deleted: []resource.URN{urnC},
+		Updated: []resource.URN{urnB},
+	}
+
+	t.Run("local", func(t *testing.T) {
+		t.Parallel()
+
+		be := &mockVersionedBackend{
+			MockBackend: MockBackend{
+				GetStackF: func(ctx context.Context, stackRef StackReference) (Stack, error) {
+					return &MockStack{}, nil
+				},
+			},
+			deployments: map[string]*apitype.DeploymentV3{"1": v1, "2": v2},
+		}
+
+		diff, err := DiffDeployments(context.Background(), be, &MockStackReference{}, 1, 2)
+		require.NoError(t, err)
+		assert.Equal(t, expected, diff)
+
+		_, err = DiffDeployments(context.Background(), be, &MockStackReference{}, 1, 3)
+		assert.ErrorContains(t, err, "exporting version 3")
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := DiffDeployments(context.Background(), &MockBackend{}, &MockStackReference{}, 1, 2)
+		assert.ErrorContains(t, err, "does not support")
+	})
+}
+
+func TestDiffSnapshotsBlindsSecrets(t *testing.T) {
+	t.Parallel()
+
+	urn := resource.URN("urn:pulumi:test::test::pkg:index:type::a")
+	secret := func(ciphertext string) map[string]interface{} {
+		return map[string]interface{}{resource.SigKey: resource.SecretSig, "ciphertext": ciphertext}
+	}
+	deployment := func(outputs map[string]interface{}) *apitype.DeploymentV3 {
+		return &apitype.DeploymentV3{Resources: []apitype.ResourceV3{
+			{URN: urn, Type: "pkg:index:type", Custom: true, ID: "id", Outputs: outputs},
+		}}
+	}
+
+	// A secret that has only been re-encrypted is not reported as a change, and nor, as a consequence, is a change to
+	// a secret's value alone. Changes to other properties are still reported.
+	diff, err := DiffSnapshots(
+		deployment(map[string]interface{}{"foo": "bar", "password": secret("1:hunter2")}),
+		deployment(map[string]interface{}{"foo": "bar", "password": secret("2:hunter2")}))
+	require.NoError(t, err)
+	assert.Empty(t, diff.Updated)
+
+	diff, err = DiffSnapshots(
+		deployment(map[string]interface{}{"foo": "bar", "password": secret("1:hunter2")}),
+		deployment(map[string]interface{}{"foo": "baz", "password": secret("2:hunter2")}))
+	require.NoError(t, err)
+	assert.Equal(t, []resource.URN{urn}, diff.Updated)
+}
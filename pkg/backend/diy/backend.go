@@ -687,6 +687,15 @@ func (b *diyBackend) ValidateStackName(stackRef string) error {
 	return err
 }
 
+// ValidateReference checks that the reference was parsed by this backend. Access to a diy backend is governed by the
+// storage it is backed by, so there is nothing more to check up front.
+func (b *diyBackend) ValidateReference(ctx context.Context, ref backend.StackReference) error {
+	if _, ok := ref.(*diyBackendReference); !ok {
+		return fmt.Errorf("stack reference %v is not a reference to a stack in this backend", ref)
+	}
+	return nil
+}
+
 func (b *diyBackend) DoesProjectExist(ctx context.Context, _ string, projectName string) (bool, error) {
 	projStore, ok := b.store.(*projectReferenceStore)
 	if !ok {
@@ -987,8 +996,12 @@ func (b *diyBackend) renameStack(ctx context.Context, oldRef *diyBackendReferenc
 		return fmt.Errorf("marshalling checkpoint: %w", err)
 	}
 
+	version := apitype.DeploymentSchemaVersionCurrent
+	if chk != nil {
+		version = stack.DeploymentSchemaVersion(chk.Latest)
+	}
 	versionedCheckpoint := &apitype.VersionedCheckpoint{
-		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Version:    version,
 		Checkpoint: json.RawMessage(chkJSON),
 	}
 
@@ -1200,6 +1213,7 @@ func (b *diyBackend) apply(
 	if kind != apitype.PreviewUpdate && !opts.DryRun {
 		persister := b.newSnapshotPersister(ctx, diyStackRef)
 		manager = backend.NewSnapshotManager(persister, op.SecretsManager, update.Target.Snapshot)
+		manager.Language = op.Proj.Runtime.Name()
 	}
 	engineCtx := &engine.Context{
 		Cancel:          scope.Context(),
@@ -1353,6 +1367,25 @@ func (b *diyBackend) GetHistory(
 	return updates, nil
 }
 
+func (b *diyBackend) GetDeploymentVersion(
+	ctx context.Context,
+	stackRef backend.StackReference,
+	version int,
+) (*deploy.Snapshot, error) {
+	if version <= 0 {
+		return nil, fmt.Errorf("%d is not a valid stack version. It should be a positive integer", version)
+	}
+	diyStackRef, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint, err := b.getHistoricalCheckpoint(ctx, diyStackRef, version)
+	if err != nil {
+		return nil, err
+	}
+	return stack.DeserializeCheckpoint(ctx, stack.DefaultSecretsProvider, checkpoint)
+}
+
 func (b *diyBackend) GetLogs(ctx context.Context,
 	secretsProvider secrets.Provider, stack backend.Stack, cfg backend.StackConfiguration,
 	query operations.LogQuery,
@@ -1412,7 +1445,7 @@ func (b *diyBackend) ExportDeployment(ctx context.Context,
 	}
 
 	return &apitype.UntypedDeployment{
-		Version:    3,
+		Version:    stack.DeploymentSchemaVersion(chk.Latest),
 		Deployment: json.RawMessage(data),
 	}, nil
 }
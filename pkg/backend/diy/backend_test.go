@@ -699,6 +699,53 @@ func TestParseEmptyStackFails(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestGetDeploymentVersion(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(tmpDir), nil)
+	require.NoError(t, err)
+	lb := b.(*diyBackend)
+
+	aStackRef, err := lb.parseStackReference("organization/project/a")
+	require.NoError(t, err)
+	aStack, err := b.CreateStack(ctx, aStackRef, "", nil, nil)
+	require.NoError(t, err)
+
+	// Record two updates, each adding a resource to the stack.
+	var resources []*resource.State
+	for _, name := range []string{"first", "second"} {
+		resources = append(resources, &resource.State{
+			URN:  resource.NewURN("a", "proj", "", "a:b:c", name),
+			Type: "a:b:c",
+		})
+		snap := deploy.NewSnapshot(deploy.Manifest{}, nil, resources, nil, deploy.SnapshotMetadata{})
+		sdep, err := stack.SerializeDeployment(ctx, snap, false /* showSecrets */)
+		require.NoError(t, err)
+		data, err := encoding.JSON.Marshal(sdep)
+		require.NoError(t, err)
+		err = b.ImportDeployment(ctx, aStack, &apitype.UntypedDeployment{
+			Version:    3,
+			Deployment: json.RawMessage(data),
+		})
+		require.NoError(t, err)
+		err = lb.addToHistory(ctx, aStackRef, backend.UpdateInfo{Kind: apitype.UpdateUpdate})
+		require.NoError(t, err)
+	}
+
+	for version := 1; version <= 2; version++ {
+		snap, err := b.GetDeploymentVersion(ctx, aStackRef, version)
+		require.NoError(t, err)
+		assert.Len(t, snap.Resources, version)
+	}
+
+	_, err = b.GetDeploymentVersion(ctx, aStackRef, 3)
+	assert.ErrorContains(t, err, "has no version 3")
+	_, err = b.GetDeploymentVersion(ctx, aStackRef, 0)
+	assert.ErrorContains(t, err, "not a valid stack version")
+}
+
 // Regression test for https://github.com/pulumi/pulumi/issues/10439
 func TestHtmlEscaping(t *testing.T) {
 	t.Parallel()
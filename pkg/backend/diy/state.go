@@ -472,6 +472,43 @@ func (b *diyBackend) getHistory(
 	return updates, nil
 }
 
+// getHistoricalCheckpoint loads the copy of the checkpoint file that was made when the given version of the stack was
+// added to its history. Versions are numbered from 1 in the order in which the updates were made.
+func (b *diyBackend) getHistoricalCheckpoint(
+	ctx context.Context,
+	ref *diyBackendReference,
+	version int,
+) (*apitype.CheckpointV3, error) {
+	contract.Requiref(ref != nil, "ref", "must not be nil")
+
+	allFiles, err := listBucket(ctx, b.bucket, ref.HistoryDir())
+	if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		return nil, err
+	}
+
+	// listBucket returns the files sorted by name, which puts older updates first.
+	var historyFiles []string
+	for _, file := range allFiles {
+		if strings.HasSuffix(file.Key, ".history.json") || strings.HasSuffix(file.Key, ".history.json.gz") {
+			historyFiles = append(historyFiles, file.Key)
+		}
+	}
+	if version > len(historyFiles) {
+		return nil, fmt.Errorf("stack %s has no version %d", ref, version)
+	}
+
+	checkpointFile := strings.Replace(historyFiles[version-1], ".history.", ".checkpoint.", 1)
+	bytes, err := b.bucket.ReadAll(ctx, checkpointFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint for version %d: %w", version, err)
+	}
+	m := encoding.JSON
+	if encoding.IsCompressed(bytes) {
+		m = encoding.Gzip(m)
+	}
+	return stack.UnmarshalVersionedCheckpointToLatestCheckpoint(m, bytes)
+}
+
 func (b *diyBackend) renameHistory(ctx context.Context, oldName, newName *diyBackendReference) error {
 	contract.Requiref(oldName != nil, "oldName", "must not be nil")
 	contract.Requiref(newName != nil, "newName", "must not be nil")
@@ -0,0 +1,181 @@
+// Copyright 2016-2024, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/pkg/v3/secrets"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// EventLogPersister is an optional interface that a SnapshotPersister may implement in order to keep every version of
+// a stack's snapshot in an append-only log rather than overwriting a single stored snapshot, e.g. for auditing. If the
+// persister implements EventLogPersister, the SnapshotManager calls Append instead of Save, with a record of each
+// snapshot that it writes, i.e. at the beginning and end of each mutation that changes it. ReplayMutationLog rebuilds
+// the snapshot from the log.
+type EventLogPersister interface {
+	// Appends the given record to the log. Returns an error if the persistence failed.
+	Append(record MutationRecord) error
+}
+
+// MutationRecord describes a snapshot written by the SnapshotManager in terms of the snapshot described by the previous
+// record in the log, or the manager's base snapshot for the first record, so that resources which did not change need
+// not be recorded again.
+type MutationRecord struct {
+	// The position of the record in the log, starting at 1.
+	Sequence int
+	// The snapshot's manifest.
+	Manifest deploy.Manifest
+	// The snapshot's secrets manager.
+	SecretsManager secrets.Manager
+	// The snapshot's resources, in order.
+	Resources []MutationResource
+	// The secrets managers of those resources whose secrets are not managed by SecretsManager, by their index in
+	// Resources.
+	ResourceSecretsManagers map[int]secrets.Manager
+	// The snapshot's pending operations.
+	PendingOperations []resource.Operation
+	// The snapshot's pending imports.
+	PendingImports []deploy.PendingImport
+	// The snapshot's metadata.
+	Metadata deploy.SnapshotMetadata
+}
+
+// MutationResource is a resource of the snapshot described by a MutationRecord.
+type MutationResource struct {
+	// The state of the resource if it is new or has changed since the previous record, or nil if it is unchanged.
+	State *resource.State
+	// If State is nil, the index of the unchanged resource in the Resources of the previous record.
+	Previous int
+}
+
+// ReplayMutationLog rebuilds the snapshot described by the last of the given records, which must be the complete log
+// appended by a SnapshotManager whose base snapshot was base. If there are no records, base is returned.
+func ReplayMutationLog(base *deploy.Snapshot, records []MutationRecord) (*deploy.Snapshot, error) {
+	if len(records) == 0 {
+		return base, nil
+	}
+
+	var resources []*resource.State
+	if base != nil {
+		resources = base.Resources
+	}
+	for i, record := range records {
+		if record.Sequence != i+1 {
+			return nil, fmt.Errorf("expected mutation record %d, found %d", i+1, record.Sequence)
+		}
+
+		next := make([]*resource.State, len(record.Resources))
+		for j, entry := range record.Resources {
+			if entry.State != nil {
+				next[j] = entry.State
+				continue
+			}
+			if entry.Previous < 0 || entry.Previous >= len(resources) {
+				return nil, fmt.Errorf("mutation record %d refers to unknown resource %d", record.Sequence, entry.Previous)
+			}
+			next[j] = resources[entry.Previous]
+		}
+		resources = next
+	}
+
+	last := records[len(records)-1]
+	snap := deploy.NewSnapshot(last.Manifest, last.SecretsManager, resources, last.PendingOperations, last.Metadata)
+	snap.PendingImports = last.PendingImports
+	if len(last.ResourceSecretsManagers) != 0 {
+		snap.ResourceSecretsManagers = make(map[*resource.State]secrets.Manager, len(last.ResourceSecretsManagers))
+		for i, resSM := range last.ResourceSecretsManagers {
+			snap.ResourceSecretsManagers[resources[i]] = resSM
+		}
+	}
+	return snap, nil
+}
+
+// logBaseSnapshot remembers the resources of the base snapshot as they are when the manager is created, so that the
+// first record appended to an EventLogPersister can refer to those that it leaves unchanged.
+func (sm *SnapshotManager) logBaseSnapshot() {
+	if sm.baseSnapshot == nil {
+		return
+	}
+	sm.loggedStates = make([]*resource.State, len(sm.baseSnapshot.Resources))
+	sm.loggedCopies = make([]*resource.State, len(sm.baseSnapshot.Resources))
+	for i, res := range sm.baseSnapshot.Resources {
+		res.Lock.Lock()
+		sm.loggedStates[i], sm.loggedCopies[i] = res, res.Clone()
+		res.Lock.Unlock()
+	}
+}
+
+// appendMutationRecord appends a record of the given snapshot to the persister's log. The engine mutates some states in
+// place, so a resource is only recorded as unchanged if it is the same state as in the previous record and that state
+// still has the same contents.
+func (sm *SnapshotManager) appendMutationRecord(persister EventLogPersister, snap *deploy.Snapshot) error {
+	previous := make(map[*resource.State]int, len(sm.loggedStates))
+	for i, res := range sm.loggedStates {
+		previous[res] = i
+	}
+
+	states := make([]*resource.State, len(snap.Resources))
+	copies := make([]*resource.State, len(snap.Resources))
+	entries := make([]MutationResource, len(snap.Resources))
+	var resourceSecretsManagers map[int]secrets.Manager
+	for i, res := range snap.Resources {
+		res.Lock.Lock()
+		copied := res.Clone()
+		res.Lock.Unlock()
+
+		states[i] = res
+		if j, has := previous[res]; has && reflect.DeepEqual(copied, sm.loggedCopies[j]) {
+			copies[i], entries[i] = sm.loggedCopies[j], MutationResource{Previous: j}
+		} else {
+			copies[i], entries[i] = copied, MutationResource{State: copied}
+		}
+
+		if resSM, has := snap.ResourceSecretsManagers[res]; has {
+			if resourceSecretsManagers == nil {
+				resourceSecretsManagers = make(map[int]secrets.Manager)
+			}
+			resourceSecretsManagers[i] = resSM
+		}
+	}
+
+	operations := make([]resource.Operation, len(snap.PendingOperations))
+	for i, op := range snap.PendingOperations {
+		res := op.Resource
+		res.Lock.Lock()
+		op.Resource = res.Clone()
+		res.Lock.Unlock()
+		operations[i] = op
+	}
+
+	record := MutationRecord{
+		Sequence:                sm.logSequence + 1,
+		Manifest:                snap.Manifest,
+		SecretsManager:          snap.SecretsManager,
+		Resources:               entries,
+		ResourceSecretsManagers: resourceSecretsManagers,
+		PendingOperations:       operations,
+		PendingImports:          snap.PendingImports,
+		Metadata:                snap.Metadata,
+	}
+	if err := persister.Append(record); err != nil {
+		return err
+	}
+	sm.logSequence, sm.loggedStates, sm.loggedCopies = record.Sequence, states, copies
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2016-2024, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+var _ = SnapshotPersister((*FilePersister)(nil))
+
+// FilePersister is a SnapshotPersister that writes each snapshot to a local file, in the format read by
+// `pulumi stack import`. It is intended as a SnapshotManager's FallbackPersister.
+type FilePersister struct {
+	Path string
+}
+
+func (p *FilePersister) Save(snap *deploy.Snapshot) error {
+	contents, err := marshalUntypedDeployment(snap)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p.Path, contents, 0o600)
+}
+
+// marshalUntypedDeployment serializes the given snapshot in the format read by `pulumi stack import`.
+func marshalUntypedDeployment(snap *deploy.Snapshot) ([]byte, error) {
+	deployment, err := stack.SerializeDeployment(context.TODO(), snap, false /* showSecrets */)
+	if err != nil {
+		return nil, fmt.Errorf("serializing deployment: %w", err)
+	}
+	raw, err := json.Marshal(deployment)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling deployment: %w", err)
+	}
+	contents, err := json.MarshalIndent(apitype.UntypedDeployment{
+		Version:    stack.DeploymentSchemaVersion(deployment),
+		Deployment: raw,
+	}, "", "    ")
+	if err != nil {
+		return nil, fmt.Errorf("marshalling deployment: %w", err)
+	}
+	return contents, nil
+}
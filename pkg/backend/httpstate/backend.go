@@ -27,6 +27,7 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -44,6 +45,7 @@ import (
 	"github.com/pulumi/pulumi/pkg/v3/engine"
 	"github.com/pulumi/pulumi/pkg/v3/operations"
 	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
 	"github.com/pulumi/pulumi/pkg/v3/secrets"
 	"github.com/pulumi/pulumi/pkg/v3/util/nosleep"
 	pkgWorkspace "github.com/pulumi/pulumi/pkg/v3/workspace"
@@ -836,6 +838,34 @@ func (b *cloudBackend) ValidateStackName(s string) error {
 	return err
 }
 
+// ValidateReference checks that the reference is to a stack in an organization that the current user belongs to. If the
+// user's organizations are not known, only the form of the reference is checked.
+func (b *cloudBackend) ValidateReference(ctx context.Context, ref backend.StackReference) error {
+	cloudRef, ok := ref.(cloudBackendReference)
+	if !ok {
+		return fmt.Errorf("stack reference %v is not a reference to a stack in this backend", ref)
+	}
+	if err := validateOwnerName(cloudRef.owner); err != nil {
+		return fmt.Errorf("%w %q in stack reference %v", err, cloudRef.owner, ref)
+	}
+
+	username, orgs, tokenInfo, err := b.currentUser(ctx)
+	if err != nil {
+		return fmt.Errorf("getting current user: %w", err)
+	}
+	switch {
+	case tokenInfo != nil && tokenInfo.Organization != "":
+		if cloudRef.owner != tokenInfo.Organization {
+			return fmt.Errorf("stack %v is not in organization %q, which the current access token is for",
+				ref, tokenInfo.Organization)
+		}
+	case cloudRef.owner != username && len(orgs) != 0 && !slices.Contains(orgs, cloudRef.owner):
+		return fmt.Errorf("user %q is not a member of organization %q, which owns stack %v", username,
+			cloudRef.owner, ref)
+	}
+	return nil
+}
+
 // validateOwnerName checks if a stack owner name is valid. An "owner" is simply the namespace
 // a stack may exist within, which for the Pulumi Service is the user account or organization.
 func validateOwnerName(s string) error {
@@ -1649,6 +1679,7 @@ func (b *cloudBackend) runEngineAction(
 	if kind != apitype.PreviewUpdate && !dryRun {
 		persister := b.newSnapshotPersister(ctx, update, tokenSource)
 		snapshotManager = backend.NewSnapshotManager(persister, op.SecretsManager, u.Target.Snapshot)
+		snapshotManager.Language = op.Proj.Runtime.Name()
 	}
 
 	// Depending on the action, kick off the relevant engine activity.  Note that we don't immediately check and
@@ -1882,6 +1913,20 @@ func (b *cloudBackend) ExportDeploymentForVersion(
 	return b.exportDeployment(ctx, stack.Ref(), &versionNumber)
 }
 
+func (b *cloudBackend) GetDeploymentVersion(
+	ctx context.Context, stackRef backend.StackReference, version int,
+) (*deploy.Snapshot, error) {
+	if version <= 0 {
+		return nil, fmt.Errorf("%d is not a valid stack version. It should be a positive integer", version)
+	}
+
+	deployment, err := b.exportDeployment(ctx, stackRef, &version)
+	if err != nil {
+		return nil, err
+	}
+	return stack.DeserializeUntypedDeployment(ctx, deployment, stack.DefaultSecretsProvider)
+}
+
 // exportDeployment exports the checkpoint file for a stack, optionally getting a previous version.
 func (b *cloudBackend) exportDeployment(
 	ctx context.Context, stackRef backend.StackReference, version *int,
@@ -1144,9 +1144,10 @@ func (pc *Client) RenewUpdateLease(ctx context.Context, update UpdateIdentifier,
 	return resp.Token, nil
 }
 
-// PatchUpdateCheckpoint patches the checkpoint for the indicated update with the given contents.
+// PatchUpdateCheckpoint patches the checkpoint for the indicated update with the given contents, which have the given
+// deployment schema version.
 func (pc *Client) PatchUpdateCheckpoint(ctx context.Context, update UpdateIdentifier, deployment *apitype.DeploymentV3,
-	token UpdateTokenSource,
+	version int, token UpdateTokenSource,
 ) error {
 	rawDeployment, err := json.Marshal(deployment)
 	if err != nil {
@@ -1154,7 +1155,7 @@ func (pc *Client) PatchUpdateCheckpoint(ctx context.Context, update UpdateIdenti
 	}
 
 	req := apitype.PatchUpdateCheckpointRequest{
-		Version:    3,
+		Version:    version,
 		Deployment: rawDeployment,
 	}
 
@@ -179,7 +179,7 @@ func TestGzip(t *testing.T) {
 	// PATCH /checkpoint
 	err = client.PatchUpdateCheckpoint(context.Background(), UpdateIdentifier{
 		StackIdentifier: identifier,
-	}, nil, tok)
+	}, nil, apitype.DeploymentSchemaVersionCurrent, tok)
 	assert.NoError(t, err)
 
 	// POST /events/batch
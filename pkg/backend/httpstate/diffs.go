@@ -27,6 +27,7 @@ import (
 	"github.com/hexops/gotextdiff/span"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pgavlin/diff/lcs"
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/promise"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/slice"
@@ -195,7 +196,7 @@ func marshalSpannedDeployment(b *bytes.Buffer, d *apitype.DeploymentV3) (spans,
 	encoder := segmentio_json.NewEncoder(spanner)
 	encoder.SetAppendNewline(false)
 
-	spanner.WriteString(`{"version":3,"deployment":{"manifest":`)
+	spanner.WriteString(fmt.Sprintf(`{"version":%d,"deployment":{"manifest":`, stack.DeploymentSchemaVersion(d)))
 	if err := encoder.Encode(d.Manifest); err != nil {
 		return spans{}, err
 	}
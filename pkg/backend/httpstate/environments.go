@@ -77,3 +77,17 @@ func (b *cloudBackend) OpenYAMLEnvironment(
 	env, err := b.escClient.GetAnonymousOpenEnvironment(ctx, org, id)
 	return env, nil, err
 }
+
+func (b *cloudBackend) GetEnvironment(
+	ctx context.Context,
+	org string,
+	projectName string,
+	envName string,
+	decrypt bool,
+) ([]byte, error) {
+	yaml, _, _, err := b.escClient.GetEnvironment(ctx, org, projectName, envName, "", decrypt)
+	if client.IsNotFound(err) {
+		return nil, nil
+	}
+	return yaml, err
+}
@@ -46,8 +46,8 @@ func (persister *cloudSnapshotPersister) Save(snapshot *deploy.Snapshot) error {
 	// Diff capability can be nil because of feature flagging.
 	if persister.deploymentDiffState == nil {
 		// Continue with how deployments were saved before diff.
-		return persister.backend.client.PatchUpdateCheckpoint(
-			persister.context, persister.update, deploymentV3, persister.tokenSource)
+		return persister.backend.client.PatchUpdateCheckpoint(persister.context, persister.update, deploymentV3,
+			stack.DeploymentSchemaVersion(deploymentV3), persister.tokenSource)
 	}
 
 	differ := persister.deploymentDiffState
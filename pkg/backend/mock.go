@@ -55,6 +55,7 @@ type MockBackend struct {
 	ParseStackReferenceF   func(s string) (StackReference, error)
 	SupportsDeploymentsF   func() bool
 	ValidateStackNameF     func(s string) error
+	ValidateReferenceF     func(context.Context, StackReference) error
 	DoesProjectExistF      func(context.Context, string, string) (bool, error)
 	GetStackF              func(context.Context, StackReference) (Stack, error)
 	CreateStackF           func(
@@ -73,6 +74,7 @@ type MockBackend struct {
 	GetStackCrypterF                      func(StackReference) (config.Crypter, error)
 	GetLatestConfigurationF               func(context.Context, Stack) (config.Map, error)
 	GetHistoryF                           func(context.Context, StackReference, int, int) ([]UpdateInfo, error)
+	GetDeploymentVersionF                 func(context.Context, StackReference, int) (*deploy.Snapshot, error)
 	UpdateStackTagsF                      func(context.Context, Stack, map[apitype.StackTagName]string) error
 	ExportDeploymentF                     func(context.Context, Stack) (*apitype.UntypedDeployment, error)
 	ImportDeploymentF                     func(context.Context, Stack, *apitype.UntypedDeployment) error
@@ -230,6 +232,13 @@ func (be *MockBackend) ValidateStackName(s string) error {
 	panic("not implemented")
 }
 
+func (be *MockBackend) ValidateReference(ctx context.Context, ref StackReference) error {
+	if be.ValidateReferenceF != nil {
+		return be.ValidateReferenceF(ctx, ref)
+	}
+	panic("not implemented")
+}
+
 func (be *MockBackend) DoesProjectExist(ctx context.Context, orgName string, projectName string) (bool, error) {
 	if be.DoesProjectExistF != nil {
 		return be.DoesProjectExistF(ctx, orgName, projectName)
@@ -363,6 +372,16 @@ func (be *MockBackend) GetHistory(ctx context.Context,
 	panic("not implemented")
 }
 
+func (be *MockBackend) GetDeploymentVersion(ctx context.Context,
+	stackRef StackReference,
+	version int,
+) (*deploy.Snapshot, error) {
+	if be.GetDeploymentVersionF != nil {
+		return be.GetDeploymentVersionF(ctx, stackRef, version)
+	}
+	panic("not implemented")
+}
+
 func (be *MockBackend) GetLogs(
 	ctx context.Context, secretsProvider secrets.Provider, stack Stack,
 	cfg StackConfiguration, query operations.LogQuery,
@@ -532,6 +551,14 @@ type MockEnvironmentsBackend struct {
 		yaml []byte,
 		duration time.Duration,
 	) (*esc.Environment, apitype.EnvironmentDiagnostics, error)
+
+	GetEnvironmentF func(
+		ctx context.Context,
+		org string,
+		projectName string,
+		envName string,
+		decrypt bool,
+	) ([]byte, error)
 }
 
 func (be *MockEnvironmentsBackend) CreateEnvironment(
@@ -570,6 +597,19 @@ func (be *MockEnvironmentsBackend) OpenYAMLEnvironment(
 	panic("not implemented")
 }
 
+func (be *MockEnvironmentsBackend) GetEnvironment(
+	ctx context.Context,
+	org string,
+	projectName string,
+	envName string,
+	decrypt bool,
+) ([]byte, error) {
+	if be.GetEnvironmentF != nil {
+		return be.GetEnvironmentF(ctx, org, projectName, envName, decrypt)
+	}
+	panic("not implemented")
+}
+
 //
 // Mock stack.
 //
@@ -0,0 +1,196 @@
+// Copyright 2016-2024, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/pkg/v3/secrets/b64"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+)
+
+// RandomStepsError is returned by ApplyRandomSteps when a generated deployment could not be applied or produced a
+// snapshot that fails its integrity check. It records the steps that were applied, in order, so that the failure can be
+// reproduced as a regular test.
+type RandomStepsError struct {
+	Seed  int64    // the seed that the deployment was generated from.
+	Steps []string // the steps applied before the failure, including the failing step if there was one.
+	Err   error    // the underlying error.
+}
+
+func (e *RandomStepsError) Error() string {
+	return fmt.Sprintf("random steps with seed %d failed after:\n  %s\n%v", e.Seed, strings.Join(e.Steps, "\n  "), e.Err)
+}
+
+func (e *RandomStepsError) Unwrap() error {
+	return e.Err
+}
+
+// randomStepsType is the type of every resource generated by ApplyRandomSteps. The resources are components so that
+// the steps need no providers or IDs.
+const randomStepsType = tokens.Type("pkg:index:Component")
+
+// ApplyRandomSteps generates a pseudo-random but valid deployment from the given seed and applies it to a
+// SnapshotManager, returning the final snapshot that the manager wrote. The same seed always produces the same
+// deployment, so this may be used to fuzz the manager's merge of a deployment's steps into its base snapshot.
+//
+// The deployment starts from a randomly generated base snapshot and registers count resources in an order that the
+// engine could have produced: existing resources are same'd, updated or replaced in the order they appear in the base
+// snapshot, interleaved with the creation of new resources, and anything not registered is deleted at the end. Every
+// snapshot written along the way is checked for integrity by the manager, and the final snapshot is checked again. A
+// failure is returned as a *RandomStepsError.
+func ApplyRandomSteps(seed int64, count int) (*deploy.Snapshot, error) {
+	rng := rand.New(rand.NewSource(seed)) //nolint:gosec // the steps must be reproducible from the seed
+
+	newURN := func(name string) resource.URN {
+		return resource.NewURN("stack", "project", "", randomStepsType, name)
+	}
+	newState := func(urn resource.URN, value int, deps []resource.URN) *resource.State {
+		inputs := resource.PropertyMap{"value": resource.NewNumberProperty(float64(value))}
+		return &resource.State{
+			Type:         randomStepsType,
+			URN:          urn,
+			Inputs:       inputs,
+			Outputs:      inputs.Copy(),
+			Dependencies: deps,
+		}
+	}
+	// randomDeps picks a random subset of the given resources as dependencies.
+	randomDeps := func(states []*resource.State) []resource.URN {
+		deps := []resource.URN{}
+		for _, s := range states {
+			if rng.Intn(4) == 0 {
+				deps = append(deps, s.URN)
+			}
+		}
+		return deps
+	}
+
+	// Generate the base snapshot. Each resource may only depend on those that come before it.
+	olds := make([]*resource.State, rng.Intn(count+1))
+	for i := range olds {
+		olds[i] = newState(newURN(fmt.Sprintf("old-%d", i)), rng.Intn(3), randomDeps(olds[:i]))
+	}
+	base := deploy.NewSnapshot(deploy.Manifest{Time: time.Unix(0, 0)}, b64.NewBase64SecretsManager(),
+		slices.Clone(olds), nil, deploy.SnapshotMetadata{})
+
+	persister := &InMemoryPersister{}
+	manager := NewSnapshotManager(persister, base.SecretsManager, base)
+
+	var applied []string
+	fail := func(err error) error {
+		return &RandomStepsError{Seed: seed, Steps: applied, Err: err}
+	}
+	apply := func(step deploy.Step) error {
+		applied = append(applied, fmt.Sprintf("%s %s", step.Op(), step.URN()))
+		mutation, err := manager.BeginMutation(step)
+		if err != nil {
+			return err
+		}
+		return mutation.End(step, true)
+	}
+
+	// news are the resources registered by the program so far; condemned are the old resources that must be deleted
+	// once the program has finished, identified by their index in the base snapshot.
+	var news []*resource.State
+	condemned := map[int]bool{}
+	reg := randomStepsRegisterEvent{}
+	next, created := 0, 0
+	for len(news) < count {
+		// The program may no longer register the next existing resource, in which case it will be deleted.
+		if next < len(olds) && rng.Intn(4) == 0 {
+			condemned[next] = true
+			next++
+			continue
+		}
+
+		var err error
+		if next < len(olds) && rng.Intn(2) == 0 {
+			old := olds[next]
+			new := newState(old.URN, rng.Intn(3), randomDeps(news))
+			switch {
+			case new.Inputs.DeepEquals(old.Inputs):
+				err = apply(deploy.NewSameStep(nil, reg, old, new))
+			case rng.Intn(2) == 0:
+				err = apply(deploy.NewUpdateStep(nil, reg, old, new, nil, nil, nil, nil, nil))
+			default:
+				// A create-before-delete replacement, as the engine would issue it. The old state is deleted at the end.
+				createReplacement := deploy.NewCreateReplacementStep(nil, reg, old, new, nil, nil, nil, true)
+				replace := deploy.NewReplaceStep(nil, old, new, nil, nil, nil, true)
+				old.Delete = true
+				condemned[next] = true
+				if err = apply(createReplacement); err == nil {
+					err = apply(replace)
+				}
+			}
+			news = append(news, new)
+			next++
+		} else {
+			new := newState(newURN(fmt.Sprintf("new-%d", created)), rng.Intn(3), randomDeps(news))
+			err = apply(deploy.NewCreateStep(nil, reg, new))
+			news = append(news, new)
+			created++
+		}
+		if err != nil {
+			return nil, fail(err)
+		}
+	}
+	for ; next < len(olds); next++ {
+		condemned[next] = true
+	}
+
+	// Delete the condemned resources in reverse order so that dependents are always deleted before their dependencies.
+	for i := len(olds) - 1; i >= 0; i-- {
+		if !condemned[i] {
+			continue
+		}
+		var step deploy.Step
+		if olds[i].Delete {
+			step = deploy.NewDeleteReplacementStep(nil, map[resource.URN]bool{}, olds[i], false, nil)
+		} else {
+			step = deploy.NewDeleteStep(nil, map[resource.URN]bool{}, olds[i], nil)
+		}
+		if err := apply(step); err != nil {
+			return nil, fail(err)
+		}
+	}
+
+	if err := manager.Close(); err != nil {
+		return nil, fail(err)
+	}
+	snap := persister.Snap
+	if snap == nil {
+		snap = base
+	}
+	if err := snap.VerifyIntegrity(); err != nil {
+		return nil, fail(err)
+	}
+	return snap, nil
+}
+
+// randomStepsRegisterEvent is the registration that each generated step claims to have come from. The steps are never
+// executed, so the event is never used.
+type randomStepsRegisterEvent struct {
+	deploy.SourceEvent
+}
+
+func (randomStepsRegisterEvent) Goal() *resource.Goal               { return nil }
+func (randomStepsRegisterEvent) Done(result *deploy.RegisterResult) {}
@@ -0,0 +1,69 @@
+// Copyright 2016-2024, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"slices"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+// SchemaValidator checks the outputs of resources against the current schemas of their providers. Outputs that a
+// schema does not describe, e.g. because a property was removed in a newer version of the provider, are a sign that a
+// resource's state has drifted from what its provider now expects.
+type SchemaValidator interface {
+	// ValidateOutputs returns a message describing each problem with the given outputs of a resource of the given type,
+	// such as an output property that the type's schema does not define. It returns nil if the outputs are valid.
+	ValidateOutputs(typ tokens.Type, outputs resource.PropertyMap) []string
+}
+
+// SchemaWarning is a problem found by a SchemaValidator with the outputs of a resource written by a SnapshotManager.
+type SchemaWarning struct {
+	URN     resource.URN // The URN of the resource.
+	Type    tokens.Type  // The type of the resource.
+	Message string       // The problem reported by the validator.
+}
+
+// SchemaWarnings returns the problems that the manager's SchemaValidator has found so far, in the order in which they
+// were found. It may be called at any time, including after Close.
+func (sm *SnapshotManager) SchemaWarnings() []SchemaWarning {
+	sm.schemaWarningsLock.Lock()
+	defer sm.schemaWarningsLock.Unlock()
+	return slices.Clone(sm.schemaWarnings)
+}
+
+// validateOutputs checks the outputs of the given state with the manager's SchemaValidator, if it has one, and records
+// any problems it finds. The state is still written whether or not it is valid.
+func (sm *SnapshotManager) validateOutputs(state *resource.State) {
+	if sm.SchemaValidator == nil {
+		return
+	}
+
+	state.Lock.Lock()
+	messages := sm.SchemaValidator.ValidateOutputs(state.Type, state.Outputs)
+	state.Lock.Unlock()
+	if len(messages) == 0 {
+		return
+	}
+
+	sm.schemaWarningsLock.Lock()
+	defer sm.schemaWarningsLock.Unlock()
+	for _, message := range messages {
+		logging.V(5).Infof("SnapshotManager: outputs of %v do not match its schema: %v", state.URN, message)
+		sm.schemaWarnings = append(sm.schemaWarnings, SchemaWarning{URN: state.URN, Type: state.Type, Message: message})
+	}
+}
@@ -16,9 +16,12 @@ package backend
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
+	"sync"
 
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
 	"github.com/pulumi/pulumi/pkg/v3/secrets"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
 )
@@ -153,3 +156,141 @@ func (m *errorCatchingSecretsManager) BatchDecrypt(ctx context.Context, cipherte
 
 	return results, nil
 }
+
+// stableCiphertextSecretsManager decorates a secrets.Manager such that encrypting a plaintext that has previously been
+// encrypted by this manager, or that the delegate manager decrypted when the snapshot was loaded, returns the previous
+// ciphertext rather than a freshly encrypted one. Many secrets managers add a nonce to each encryption, so without this
+// re-serializing an unchanged snapshot would produce a different state file every time. Ciphertexts are cached keyed by
+// a hash of their plaintext, so plaintexts are not retained. Batch encryption is supported, so that the ciphertexts
+// which are not cached are still encrypted in as few requests as possible.
+type stableCiphertextSecretsManager struct {
+	// The underlying secrets.Manager that will be used to perform actual operations.
+	delegateManager secrets.Manager
+
+	// A cache of the ciphertext written for each secret, used by batch encryption.
+	secretCache stack.SecretCache
+
+	// A map from the SHA-256 hash of a plaintext to the ciphertext previously produced for it.
+	lock        sync.Mutex
+	ciphertexts map[[sha256.Size]byte]string
+}
+
+var _ stack.BatchingSecretsManager = (*stableCiphertextSecretsManager)(nil)
+
+// newStableCiphertextSecretsManager creates a new stableCiphertextSecretsManager that wraps the given delegate
+// secrets.Manager.
+func newStableCiphertextSecretsManager(delegate secrets.Manager) *stableCiphertextSecretsManager {
+	return &stableCiphertextSecretsManager{
+		delegateManager: delegate,
+		secretCache:     stack.NewSecretCache(),
+		ciphertexts:     make(map[[sha256.Size]byte]string),
+	}
+}
+
+func (m *stableCiphertextSecretsManager) Type() string {
+	return m.delegateManager.Type()
+}
+
+func (m *stableCiphertextSecretsManager) State() json.RawMessage {
+	return m.delegateManager.State()
+}
+
+func (m *stableCiphertextSecretsManager) Encrypter() config.Encrypter {
+	return m
+}
+
+func (m *stableCiphertextSecretsManager) Decrypter() config.Decrypter {
+	return m.delegateManager.Decrypter()
+}
+
+func (m *stableCiphertextSecretsManager) BeginBatchEncryption() (stack.BatchEncrypter, stack.CompleteCrypterBatch) {
+	return stack.BeginBatchEncryptionWithCache(m, m.secretCache)
+}
+
+func (m *stableCiphertextSecretsManager) BeginBatchDecryption() (stack.BatchDecrypter, stack.CompleteCrypterBatch) {
+	if batching, ok := m.delegateManager.(stack.BatchingSecretsManager); ok {
+		return batching.BeginBatchDecryption()
+	}
+	return stack.BeginDecryptionBatch(m.delegateManager.Decrypter())
+}
+
+// lookup returns the ciphertext previously produced for the plaintext with the given hash, or failing that the
+// ciphertext from which the delegate decrypted the plaintext. The caller must hold the lock.
+func (m *stableCiphertextSecretsManager) lookup(key [sha256.Size]byte, plaintext string) (string, bool) {
+	if ciphertext, has := m.ciphertexts[key]; has {
+		return ciphertext, true
+	}
+	if decrypted, ok := m.delegateManager.(stack.DecryptedCiphertexts); ok {
+		if ciphertext, has := decrypted.DecryptedCiphertext(plaintext); has {
+			m.ciphertexts[key] = ciphertext
+			return ciphertext, true
+		}
+	}
+	return "", false
+}
+
+func (m *stableCiphertextSecretsManager) EncryptValue(ctx context.Context, plaintext string) (string, error) {
+	key := sha256.Sum256([]byte(plaintext))
+
+	m.lock.Lock()
+	ciphertext, has := m.lookup(key, plaintext)
+	m.lock.Unlock()
+	if has {
+		return ciphertext, nil
+	}
+
+	enc := m.delegateManager.Encrypter()
+	if enc == nil {
+		return "", errors.New("stable ciphertext secrets manager delegate returned a nil encrypter")
+	}
+	ciphertext, err := enc.EncryptValue(ctx, plaintext)
+	if err != nil {
+		return "", err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.ciphertexts[key] = ciphertext
+	return ciphertext, nil
+}
+
+func (m *stableCiphertextSecretsManager) BatchEncrypt(ctx context.Context, plaintexts []string) ([]string, error) {
+	keys := make([][sha256.Size]byte, len(plaintexts))
+	results := make([]string, len(plaintexts))
+
+	// Work out which plaintexts we have not seen before, so that we only send those to the delegate.
+	var misses []int
+	var missPlaintexts []string
+	m.lock.Lock()
+	for i, plaintext := range plaintexts {
+		keys[i] = sha256.Sum256([]byte(plaintext))
+		if ciphertext, has := m.lookup(keys[i], plaintext); has {
+			results[i] = ciphertext
+		} else {
+			misses = append(misses, i)
+			missPlaintexts = append(missPlaintexts, plaintext)
+		}
+	}
+	m.lock.Unlock()
+
+	if len(misses) == 0 {
+		return results, nil
+	}
+
+	enc := m.delegateManager.Encrypter()
+	if enc == nil {
+		return nil, errors.New("stable ciphertext secrets manager delegate returned a nil encrypter")
+	}
+	ciphertexts, err := enc.BatchEncrypt(ctx, missPlaintexts)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for j, i := range misses {
+		results[i] = ciphertexts[j]
+		m.ciphertexts[keys[i]] = ciphertexts[j]
+	}
+	return results, nil
+}
@@ -15,20 +15,34 @@
 package backend
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"golang.org/x/exp/slices"
 
 	"github.com/pulumi/pulumi/pkg/v3/engine"
 	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy/providers"
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
 	"github.com/pulumi/pulumi/pkg/v3/secrets"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/env"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/slice"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/version"
@@ -47,6 +61,165 @@ type SnapshotPersister interface {
 	Save(snapshot *deploy.Snapshot) error
 }
 
+// Syncer is an optional interface that a SnapshotPersister may implement in order to guarantee that persisted
+// snapshots have been flushed to stable storage. If the persister implements Syncer, the SnapshotManager calls Sync
+// after every successful Save and before reporting the write as complete to the engine.
+type Syncer interface {
+	// Flushes any previously saved snapshots to stable storage. Returns an error if the flush failed.
+	Sync() error
+}
+
+// CanonicalSnapshotPersister is an optional interface that a SnapshotPersister may implement in order to receive each
+// snapshot together with its canonical serialization (see stack.MarshalOptions), e.g. so that it can store a detached
+// signature of the snapshot alongside it. If the persister implements CanonicalSnapshotPersister, the SnapshotManager
+// calls SaveCanonical instead of Save.
+type CanonicalSnapshotPersister interface {
+	// Persists the given snapshot, whose canonical serialization is canonical. Returns an error if the persistence
+	// failed.
+	SaveCanonical(snapshot *deploy.Snapshot, canonical []byte) error
+}
+
+// ChunkedPersister is an optional interface that a SnapshotPersister may implement in order to receive each snapshot
+// as a stream of its serialized form, e.g. so that a persister backed by an object store can upload large snapshots in
+// parts. If the persister implements ChunkedPersister, the SnapshotManager serializes each snapshot itself using its
+// ChunkedCodec and calls SaveChunked instead of Save.
+type ChunkedPersister interface {
+	// Persists the snapshot whose serialization is read from r, which yields exactly size bytes. Returns an error if
+	// the persistence failed.
+	SaveChunked(r io.Reader, size int64) error
+}
+
+// SnapshotCodec converts snapshots to and from a serialized form, so that the format of the snapshots handed to a
+// ChunkedPersister can be chosen independently of where they are stored. Other persisters are handed snapshots rather
+// than bytes, and serialize them in their own format. The SnapshotManager only ever calls Marshal, since it never loads
+// the snapshots that it writes; Unmarshal is for the code that reads the stored snapshots back, such as a backend
+// loading its stack state.
+type SnapshotCodec interface {
+	// Serializes the given snapshot.
+	Marshal(snapshot *deploy.Snapshot) ([]byte, error)
+	// Deserializes a snapshot serialized by Marshal.
+	Unmarshal(data []byte) (*deploy.Snapshot, error)
+}
+
+// JSONSnapshotCodec is the default SnapshotCodec, which serializes snapshots as the JSON form of an
+// apitype.DeploymentV3.
+type JSONSnapshotCodec struct {
+	// The provider used to restore the secrets manager of each deserialized snapshot. It may be nil if no deserialized
+	// snapshot uses a secrets manager.
+	SecretsProvider secrets.Provider
+}
+
+var _ SnapshotCodec = JSONSnapshotCodec{}
+
+func (c JSONSnapshotCodec) Marshal(snapshot *deploy.Snapshot) ([]byte, error) {
+	deployment, err := stack.SerializeDeployment(context.TODO(), snapshot, false /* showSecrets */)
+	if err != nil {
+		return nil, fmt.Errorf("serializing deployment: %w", err)
+	}
+	serialized, err := stack.MarshalDeployment(deployment, stack.MarshalOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("marshalling deployment: %w", err)
+	}
+	return serialized, nil
+}
+
+func (c JSONSnapshotCodec) Unmarshal(data []byte) (*deploy.Snapshot, error) {
+	var deployment apitype.DeploymentV3
+	if err := json.Unmarshal(data, &deployment); err != nil {
+		return nil, fmt.Errorf("unmarshalling deployment: %w", err)
+	}
+	return stack.DeserializeDeploymentV3(context.TODO(), deployment, c.SecretsProvider)
+}
+
+// GenerationalSnapshotPersister is an optional interface that a SnapshotPersister may implement in order to detect
+// concurrent writes to the same stack, e.g. by two processes that both believe they hold the stack's lock. Each stored
+// snapshot has a generation token, such as an etag, which changes on every write. If the persister implements
+// GenerationalSnapshotPersister, the SnapshotManager calls SaveIfGeneration instead of Save, and fails with a
+// SnapshotConflictError rather than overwrite a snapshot that it did not write itself.
+type GenerationalSnapshotPersister interface {
+	// Returns the generation of the snapshot currently in storage.
+	Generation() (string, error)
+	// Persists the given snapshot if and only if the generation of the snapshot currently in storage is expected, which
+	// must be checked atomically with the write. Returns the generation in storage after the call and whether the
+	// snapshot was written, or an error if the persistence failed.
+	SaveIfGeneration(snapshot *deploy.Snapshot, expected string) (generation string, saved bool, err error)
+}
+
+// SnapshotConflictError is returned by the SnapshotManager when the stack's stored snapshot has been written by someone
+// else since the manager last read or wrote it.
+type SnapshotConflictError struct {
+	Expected string // The generation that the manager expected to overwrite.
+	Actual   string // The generation that was found in storage.
+}
+
+func (e SnapshotConflictError) Error() string {
+	return fmt.Sprintf("the stack's state was modified concurrently by another process "+
+		"(expected generation %q, found %q)", e.Expected, e.Actual)
+}
+
+// FallbackSaveError is returned by SnapshotManager.Close when the final snapshot could not be written by the manager's
+// persister, but was written by its FallbackPersister instead.
+type FallbackSaveError struct {
+	Err      error             // The error returned when writing the snapshot with the primary persister.
+	Fallback SnapshotPersister // The persister that the snapshot was written to instead.
+}
+
+func (e FallbackSaveError) Error() string {
+	if file, ok := e.Fallback.(*FilePersister); ok {
+		return fmt.Sprintf("%v; the final state of the stack was saved to %s instead, and can be restored "+
+			"once the backend is reachable with `pulumi stack import --file %s`", e.Err, file.Path, file.Path)
+	}
+	return fmt.Sprintf("%v; the final state of the stack was saved to a fallback location instead", e.Err)
+}
+
+func (e FallbackSaveError) Unwrap() error {
+	return e.Err
+}
+
+// TruncatedPropertyKey is the key that marks an object as standing in for a property value that was too large to
+// persist (see SnapshotManager.MaxPropertyValueBytes). The marker also has a "size" property holding the size in bytes
+// of the original value's JSON encoding, and a "sha256" property holding the hex-encoded SHA-256 hash of it.
+const TruncatedPropertyKey resource.PropertyKey = "__pulumiTruncated"
+
+// StorageKeyFunc maps a resource's URN to the key under which its state is stored by a ShardedSnapshotPersister.
+// Distinct URNs must map to distinct keys, and a given URN must always map to the same key.
+type StorageKeyFunc func(urn resource.URN) string
+
+// DefaultStorageKey is the StorageKeyFunc used for persisters that do not supply their own. It returns the
+// hex-encoded SHA-256 hash of the URN, which is safe to use as a path segment or object name.
+func DefaultStorageKey(urn resource.URN) string {
+	sum := sha256.Sum256([]byte(urn))
+	return hex.EncodeToString(sum[:])
+}
+
+// ShardedSnapshotPersister is an optional interface that a SnapshotPersister may implement in order to store the
+// state of each resource separately, e.g. as one object per resource in an object store. If the persister implements
+// ShardedSnapshotPersister, the SnapshotManager calls SaveShards instead of Save.
+//
+// Each shard holds the JSON-encoded list of serialized resources (apitype.ResourceV3) that share a URN, in snapshot
+// order, and is keyed by the result of applying the persister's StorageKeyFunc to that URN. Writes are incremental:
+// only shards whose contents have changed since the last successful SaveShards are passed, along with the keys of any
+// shards that are no longer part of the snapshot.
+type ShardedSnapshotPersister interface {
+	// StorageKeyFunc returns the function used to derive the storage key for each resource. If it returns nil,
+	// DefaultStorageKey is used.
+	StorageKeyFunc() StorageKeyFunc
+	// Persists the given snapshot, of which changed holds the changed shards and deleted the keys of removed shards.
+	// The persister remains responsible for storing the remainder of the snapshot, such as its manifest and pending
+	// operations. Returns an error if the persistence failed.
+	SaveShards(snapshot *deploy.Snapshot, changed map[string][]byte, deleted []string) error
+}
+
+// CheckpointPersister is an optional interface that a SnapshotPersister may implement in order to store named
+// checkpoints of a stack, e.g. as restore points between the phases of a long migration. Checkpoints are stored
+// alongside the stack's current snapshot rather than replacing it. SnapshotManager.Checkpoint requires that its
+// persister implements CheckpointPersister.
+type CheckpointPersister interface {
+	// Persists the given snapshot as the checkpoint with the given name, replacing any existing checkpoint of that
+	// name. Returns an error if the persistence failed.
+	SaveCheckpoint(name string, snapshot *deploy.Snapshot) error
+}
+
 // SnapshotManager is an implementation of engine.SnapshotManager that inspects steps and performs
 // mutations on the global snapshot object serially. This implementation maintains two bits of state: the "base"
 // snapshot, which is completely immutable and represents the state of the world prior to the application
@@ -79,10 +252,399 @@ type SnapshotManager struct {
 	done             <-chan error             // A channel that sends a single result when the manager has shut down.
 
 	refreshDeletes map[resource.URN]bool // The set of resources that have been deleted by a refresh in this plan.
+
+	// MutationGuard, if set, is called at the start of BeginMutation with the step about to be applied. Returning a
+	// non-nil error vetoes the mutation: nothing is recorded in the snapshot and the error is returned to the engine.
+	// This acts as a state-layer backstop for policy that the engine may have missed.
+	MutationGuard func(step deploy.Step) error
+
+	// InputValidator, if set, is called with the URN and inputs of each resource state that a successful create or
+	// update would record. Returning a non-nil error rejects the state: the step's operation is left pending in the
+	// snapshot, as if the step had been interrupted, and the error, together with the rejected inputs with their secrets
+	// redacted, is returned from the mutation's End. This acts as a backstop against providers that return malformed
+	// inputs from Check.
+	InputValidator func(urn resource.URN, inputs resource.PropertyMap) error
+
+	// AllowProtectedDeletes, if true, disables the check in BeginMutation that rejects the deletion of a resource that
+	// is marked as protected. The engine is responsible for refusing such deletions; the check is only a backstop.
+	AllowProtectedDeletes bool
+
+	// StableSecretCiphertexts, if true, causes secrets whose plaintext is unchanged to keep the ciphertext they were
+	// loaded or first written with, rather than being re-encrypted on every write. This avoids spurious changes to the
+	// persisted state when using secrets managers that add a nonce to each encryption. It is opt-in because some
+	// managers rely on re-encryption for key rotation. It must be set before the first mutation.
+	StableSecretCiphertexts bool
+
+	// RedactPendingOperationInputs, if set, is applied to the inputs of the resource of each pending operation
+	// recorded by this plan before the snapshot is persisted. A pending operation can be written before its resource's
+	// inputs have been encrypted, so this gives callers a chance to strip sensitive values that would otherwise be
+	// left in the state file if the operation never completes. The hook must not modify the map it is given. If
+	// unset, pending operation inputs are persisted as-is.
+	RedactPendingOperationInputs func(inputs resource.PropertyMap) resource.PropertyMap
+
+	// LazySecretsMigration, if true, allows the stack to move to a new secrets manager gradually. If the secrets manager
+	// given to NewSnapshotManager differs from that of the base snapshot, resources are only re-encrypted with the new
+	// manager once they are touched by this plan; until then they continue to be written with the base snapshot's
+	// manager, which is recorded alongside each such resource in the persisted state.
+	LazySecretsMigration bool
+
+	// SerializeProgress, if set, is called while each snapshot is serialized for persistence with the number of
+	// resources and pending operations written so far and the total to write. Large stacks can take a noticeable time
+	// to serialize, and this lets the CLI show progress during the write. It must be set before the first mutation.
+	SerializeProgress func(done, total int)
+
+	// SkipIdenticalWrites, if true, causes the manager to skip persisting a snapshot whose serialized form is identical
+	// to that of the last snapshot it persisted, or to that of the base snapshot if it has not yet persisted anything.
+	// This happens when the changes made by a number of mutations cancel each other out. Detecting this costs an extra
+	// serialization of every snapshot. It must be set before the first mutation.
+	SkipIdenticalWrites bool
+
+	// MaxPropertyValueBytes, if positive, limits the size of the output property values that are persisted for
+	// component resources. Any top-level output whose JSON encoding is larger than this many bytes is replaced in the
+	// persisted snapshot by a marker object (see TruncatedPropertyKey) recording the original size and SHA-256 hash of
+	// the encoding. Only component outputs are truncated because the engine never passes them back to a provider or
+	// diffs against them: the inputs and outputs of custom resources are used by later updates, and the outputs of the
+	// root stack resource are read by stack references, so none of those are truncated. Secret values are never
+	// truncated either. The resource states held by the engine are not modified. It must be set before the first
+	// mutation.
+	MaxPropertyValueBytes int
+
+	// MaxAliases, if positive, limits the number of aliases persisted for each resource to the MaxAliases most recently
+	// added. Aliases are always deduplicated when persisted, whether or not this is set. As with MaxPropertyValueBytes,
+	// only the persisted snapshot is affected, so alias matching during the current deployment still sees every alias.
+	// It must be set before the first mutation.
+	MaxAliases int
+
+	// FallbackPersister, if set, is used by Close to persist the final snapshot if the manager's persister fails to do
+	// so, for instance because the backend is unreachable. This keeps the final state of the stack, which would
+	// otherwise be lost along with any pending operations it resolved. Close then returns a FallbackSaveError. It must
+	// be set before Close is called.
+	FallbackPersister SnapshotPersister
+
+	// WriteAheadLog, if set, is the log in which each snapshot is recorded before it is handed to the persister, and
+	// from which it is removed once the persister has saved it. A snapshot that is lost because the process dies while
+	// it is being written can then be recovered with WriteAheadLog.Replay. A snapshot is not handed to the persister if
+	// it cannot be recorded. It must be set before the first mutation.
+	WriteAheadLog *WriteAheadLog
+
+	// RecordStepIDs, if true, causes the manager to assign each step a unique ID when its mutation begins and to record
+	// that ID in the StepID field of the step's new state when the step completes successfully, so that the snapshot
+	// shows which step last wrote each resource. A change in StepID alone is not meaningful and does not force a write.
+	// It must be set before the first mutation.
+	RecordStepIDs bool
+
+	// StepTimeout, if positive, is how long a step may run before the manager flags its pending operation as timed out
+	// (see resource.Operation.TimedOut). The operation is not cleared, since the step may yet complete, but a hung
+	// provider no longer leaves an operation that is indistinguishable from one in progress. It must be set before the
+	// first mutation.
+	StepTimeout time.Duration
+
+	// PreserveReadOutputs lists output properties that survive a successful read of an external resource that was
+	// already in the snapshot. Read replaces a resource's state wholesale with what the provider returns, which discards
+	// outputs that were set by the client rather than the provider; the old values of these keys are copied over the
+	// newly read outputs instead. It must be set before the first mutation.
+	PreserveReadOutputs []resource.PropertyKey
+
+	// DeduplicateProviders, if true, collapses provider resources whose type and inputs are identical into the first of
+	// them when the snapshot is persisted, so that stacks which instantiate the same provider many times do not
+	// accumulate copies of it. References to each removed provider, whether by provider reference or by URN, are
+	// rewritten to refer to the one that is kept. Only the persisted snapshot is affected. It must be set before the
+	// first mutation.
+	DeduplicateProviders bool
+
+	// SnapshotSaved, if set, is called after each snapshot is persisted successfully with its size and the number of
+	// resources in it, so that the growth of a stack's state can be tracked as it is written rather than by polling.
+	// Measuring the size costs an extra serialization of every snapshot. It must be set before the first mutation.
+	SnapshotSaved func(event SnapshotSavedEvent)
+
+	// ResourceReordered, if set, is called after each snapshot is persisted successfully for each resource that the
+	// merge of the base and current snapshots has moved relative to the others since the last snapshot was written (or,
+	// for the first write, since the base snapshot). Resources that were merely shifted by the addition or removal of
+	// others are not reported, and where a change in order could be explained by moving either of two resources only
+	// one of them is. Resources that share a URN are matched in the order in which they appear. It must be set before
+	// the first mutation.
+	ResourceReordered func(event ResourceReorderedEvent)
+
+	// DeferIntegrityUntilClose, if true, skips the verification of the snapshot's integrity that is otherwise done
+	// before every write, which can be costly for large stacks. Close always writes the final snapshot when this is set,
+	// and verifies it in full first, so an integrity error is still recorded in the snapshot's metadata and returned,
+	// but only once the deployment has finished. It must be set before the first mutation.
+	DeferIntegrityUntilClose bool
+
+	// SchemaValidator, if set, is used to check the outputs of each resource state that the manager records as the
+	// result of a successful step against the schema of the resource's provider. Any problems it finds are recorded
+	// (see SchemaWarnings) but do not prevent the state from being written. It must be set before the first mutation.
+	SchemaValidator SchemaValidator
+
+	// Annotate, if set, is called with the URN and current annotations of each resource state that the manager records
+	// as the result of a successful step, and returns the annotations to record in its place. The annotations given are
+	// a copy that the hook may modify. A state's annotations are carried over from the state it replaces unless the
+	// step set its own. It must be set before the first mutation.
+	Annotate func(urn resource.URN, annotations map[string]string) map[string]string
+
+	// ChunkedCodec, if set, is used to serialize the snapshots handed to a ChunkedPersister in place of
+	// JSONSnapshotCodec. It has no effect on other persisters. It must be set before the first mutation.
+	ChunkedCodec SnapshotCodec
+
+	// Language and Runtime, if set, are recorded in the manifest of each snapshot written by the manager. Language is
+	// the name of the language runtime of the program being deployed, and Runtime a description of the runtime that
+	// executes it. They are informational only and play no part in the snapshot's integrity. They must be set before
+	// the first mutation.
+	Language string
+	Runtime  string
+
+	// RedactIntegrityErrorSecrets, if true, replaces the plaintext of every secret string held by the snapshot with
+	// "[secret]" wherever it appears in the command and error recorded in the snapshot's integrity error metadata. An
+	// integrity error names the resources involved, and their URNs and IDs are often derived from secret inputs, so
+	// without this the metadata can expose those values when a corrupted snapshot is shared for support. Secret
+	// numbers and bools are not redacted, since their text forms (such as "1" or "true") would match unrelated parts
+	// of the metadata. It must be set before the first mutation.
+	RedactIntegrityErrorSecrets bool
+
+	// CompressResourcesAbove, if positive, causes each resource whose serialized form is larger than this many bytes to
+	// be persisted with its inputs and outputs gzipped behind a marker (see stack.CompressedPropertiesKey) that tells
+	// deserialization to expand them again. Stacks tend to hold a few very large resources among many small ones, and
+	// compressing only the former saves most of the space for a fraction of the CPU time. The root stack resource and
+	// provider resources are never compressed, since tools such as stack references read their outputs directly, and
+	// a deployment holding compressed resources is written as apitype.DeploymentSchemaVersionCompressedResources so
+	// that older versions of the CLI refuse to read it. It must be set before the first mutation.
+	CompressResourcesAbove int
+
+	// The caching secrets manager used when StableSecretCiphertexts is enabled. Only accessed by the service loop.
+	stableSecretsManager *stableCiphertextSecretsManager
+
+	// The checksum of the last snapshot persisted when SkipIdenticalWrites is enabled. Only accessed by the service
+	// loop.
+	lastChecksum []byte
+
+	// The checksums of the shards last saved by a ShardedSnapshotPersister, by storage key. Only accessed by the
+	// service loop.
+	shardChecksums map[string][sha256.Size]byte
+
+	// The generation of the snapshot last read or written by a GenerationalSnapshotPersister, and any error reading
+	// it when the manager was created. Only accessed by the service loop once the manager has been created.
+	generation    string
+	generationErr error
+
+	// The URNs of the resources in the last snapshot written, in order, when ResourceReordered is set. Only accessed by
+	// the service loop.
+	lastOrder []resource.URN
+
+	// The error returned by the persister for the last snapshot written, if any. Only accessed by the service loop.
+	persistErr error
+
+	// The resources removed from the stack without being deleted because they were retained on delete, in addition to
+	// those recorded in the base snapshot's metadata. Only accessed by the service loop.
+	retained []deploy.RetainedResource
+
+	// The states of the resources described by the last record appended to an EventLogPersister, together with the
+	// copies of them that were recorded, and the sequence number of that record. Only accessed by the service loop once
+	// the manager has been created.
+	loggedStates []*resource.State
+	loggedCopies []*resource.State
+	logSequence  int
+
+	// The URNs of the base snapshot's pending imports that have been completed by a read or import. Only accessed by the
+	// service loop.
+	completedImports map[resource.URN]bool
+
+	// True once the manager is writing its final snapshot. Only accessed by the service loop.
+	closing bool
+
+	// The URNs of the resources that have been added to or removed from the snapshot, or that have started or finished
+	// an operation, since its integrity was last verified, and whether that verification succeeded. If it did, the
+	// next write only needs to verify the resources affected by these changes. Only accessed by the service loop.
+	integrityChanged  map[resource.URN]bool
+	integrityVerified bool
+
+	// The problems found by SchemaValidator. Written by the service loop and read from any goroutine.
+	schemaWarnings     []SchemaWarning
+	schemaWarningsLock sync.Mutex
+
+	// Counters reported by Stats. Written by the service loop and read from any goroutine.
+	mutations       atomic.Int64
+	writesPerformed atomic.Int64
+	writesSkipped   atomic.Int64
+}
+
+// ManagerStats reports how effective a SnapshotManager has been at avoiding writes of the snapshot.
+type ManagerStats struct {
+	Mutations       int64 // The number of mutations processed.
+	WritesPerformed int64 // The number of snapshots persisted.
+	WritesSkipped   int64 // The number of writes elided or skipped because they were unnecessary.
+}
+
+// SnapshotSavedEvent describes a snapshot persisted by a SnapshotManager.
+type SnapshotSavedEvent struct {
+	Bytes     int // The size of the snapshot serialized as a deployment, in bytes.
+	Resources int // The number of resources in the snapshot.
+}
+
+// ResourceReorderedEvent describes a resource that a SnapshotManager has moved relative to the other resources in the
+// snapshot.
+type ResourceReorderedEvent struct {
+	URN      resource.URN // The URN of the resource.
+	OldIndex int          // The index of the resource in the last snapshot written, or in the base snapshot.
+	NewIndex int          // The index of the resource in the snapshot just written.
+}
+
+// Stats returns the counts of mutations processed and of writes performed and skipped by the manager so far. It may be
+// called at any time, including after Close.
+func (sm *SnapshotManager) Stats() ManagerStats {
+	return ManagerStats{
+		Mutations:       sm.mutations.Load(),
+		WritesPerformed: sm.writesPerformed.Load(),
+		WritesSkipped:   sm.writesSkipped.Load(),
+	}
 }
 
 var _ engine.SnapshotManager = (*SnapshotManager)(nil)
 
+// Checkpoint persists the current snapshot as the checkpoint with the given name, without waiting for the next
+// mutation that would write it. Any writes elided since the last one are flushed to the persister at the same time, so
+// that the stack's current snapshot is never behind its latest checkpoint. The persister must implement
+// CheckpointPersister.
+func (sm *SnapshotManager) Checkpoint(name string) error {
+	if name == "" {
+		return errors.New("checkpoint name must not be empty")
+	}
+	persister, ok := sm.persister.(CheckpointPersister)
+	if !ok {
+		return errors.New("snapshot persister does not support checkpoints")
+	}
+
+	var checkpointErr error
+	err := sm.mutate(func() bool {
+		snap, err := sm.snap().NormalizeURNReferences()
+		if err != nil {
+			checkpointErr = fmt.Errorf("failed to normalize URN references: %w", err)
+			return false
+		}
+		if err := persister.SaveCheckpoint(name, snap); err != nil {
+			checkpointErr = fmt.Errorf("failed to save checkpoint %q: %w", name, err)
+			return false
+		}
+		return true
+	})
+	if checkpointErr != nil {
+		return checkpointErr
+	}
+	return err
+}
+
+// PruneUnreferencedProviders removes from the snapshot every provider resource to which no other resource or pending
+// operation refers, whether as its provider or through its parent, dependencies, property dependencies or DeletedWith,
+// and writes the result. Protected providers are always kept. It returns the URNs of the removed providers. Since the
+// engine may yet register resources that use a provider that is unreferenced so far, it must only be called while no
+// deployment is in progress, i.e. before the first mutation or after the last.
+func (sm *SnapshotManager) PruneUnreferencedProviders() ([]resource.URN, error) {
+	var removed []resource.URN
+	err := sm.mutate(func() bool {
+		var live []*resource.State
+		for _, res := range sm.resources {
+			if !sm.dones[res] {
+				live = append(live, res)
+			}
+		}
+		var operations []*resource.State
+		for _, op := range sm.operations {
+			if !sm.completeOps[op.Resource] {
+				operations = append(operations, op.Resource)
+			}
+		}
+		if base := sm.baseSnapshot; base != nil {
+			for _, res := range base.Resources {
+				if !sm.dones[res] {
+					live = append(live, res)
+				}
+			}
+			for _, op := range base.PendingOperations {
+				operations = append(operations, op.Resource)
+			}
+		}
+
+		referenced := make(map[resource.URN]bool)
+		for _, res := range append(slices.Clip(live), operations...) {
+			res.Lock.Lock()
+			provider, deps := res.GetAllDependencies()
+			res.Lock.Unlock()
+
+			if ref, err := providers.ParseReference(provider); err == nil {
+				referenced[ref.URN()] = true
+			}
+			for _, dep := range deps {
+				referenced[dep.URN] = true
+			}
+		}
+
+		for _, res := range live {
+			if providers.IsProviderType(res.Type) && !res.Protect && !referenced[res.URN] {
+				sm.markDone(res)
+				removed = append(removed, res.URN)
+			}
+		}
+		return len(removed) != 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+// ReplaceSnapshot replaces the whole of the snapshot held by the manager with the given one and writes it through the
+// manager's persister as usual. This lets tools that edit state build a new snapshot and still have it verified and
+// persisted in the same way as the engine's changes. The given snapshot's integrity is verified first; if it is invalid,
+// or it cannot be persisted, an error is returned and the manager keeps its current snapshot. The manager takes
+// ownership of the given snapshot, which must not be modified afterwards. Like PruneUnreferencedProviders, it must only
+// be called while no deployment is in progress.
+func (sm *SnapshotManager) ReplaceSnapshot(snap *deploy.Snapshot) error {
+	contract.Requiref(snap != nil, "snap", "must not be nil")
+
+	type managerState struct {
+		baseSnapshot     *deploy.Snapshot
+		resources        []*resource.State
+		operations       []resource.Operation
+		dones            map[*resource.State]bool
+		completeOps      map[*resource.State]bool
+		retained         []deploy.RetainedResource
+		completedImports map[resource.URN]bool
+	}
+	var previous managerState
+
+	var verifyErr error
+	err := sm.mutate(func() bool {
+		if err := snap.VerifyIntegrity(); err != nil {
+			verifyErr = fmt.Errorf("replacement snapshot is invalid: %w", err)
+			return false
+		}
+
+		previous = managerState{
+			sm.baseSnapshot, sm.resources, sm.operations, sm.dones, sm.completeOps, sm.retained, sm.completedImports,
+		}
+		sm.baseSnapshot = snap
+		sm.resources, sm.operations = nil, nil
+		sm.dones, sm.completeOps = make(map[*resource.State]bool), make(map[*resource.State]bool)
+		sm.retained, sm.completedImports = nil, nil
+		sm.integrityVerified = false
+		return true
+	})
+	if verifyErr != nil {
+		return verifyErr
+	}
+	if err != nil && previous.dones != nil {
+		// The replacement could not be persisted, so go back to the snapshot that was.
+		restoreErr := sm.mutate(func() bool {
+			sm.baseSnapshot, sm.resources, sm.operations = previous.baseSnapshot, previous.resources, previous.operations
+			sm.dones, sm.completeOps = previous.dones, previous.completeOps
+			sm.retained, sm.completedImports = previous.retained, previous.completedImports
+			sm.integrityVerified = false
+			return false
+		})
+		return errors.Join(err, restoreErr)
+	}
+	return err
+}
+
 type mutationRequest struct {
 	mutator func() bool
 	result  chan<- error
@@ -101,6 +663,9 @@ func (sm *SnapshotManager) Close() error {
 //
 // Serialization is performed by pushing the mutator function onto a channel, where another
 // goroutine is polling the channel and executing the mutation functions as they come.
+// Since that goroutine also merges and persists the snapshot after each mutation, at most one
+// mutation is ever being merged or persisted, however many steps the engine runs in parallel;
+// persisters need no concurrency limit of their own.
 // This function optionally verifies the integrity of the snapshot before and after mutation.
 //
 // The mutator may indicate that its corresponding checkpoint write may be safely elided by
@@ -150,25 +715,186 @@ func (sm *SnapshotManager) BeginMutation(step deploy.Step) (engine.SnapshotMutat
 	contract.Requiref(step != nil, "step", "cannot be nil")
 	logging.V(9).Infof("SnapshotManager: Beginning mutation for step `%s` on resource `%s`", step.Op(), step.URN())
 
+	if err := sm.checkProtectedDelete(step); err != nil {
+		return nil, err
+	}
+	if err := sm.checkMutationGuard(step); err != nil {
+		return nil, err
+	}
+
+	mutation, err := sm.beginMutation(step, sm.mutate)
+	if err != nil {
+		return nil, err
+	}
+	if sm.StepTimeout > 0 {
+		mutation = sm.withStepTimeout(step, mutation)
+	}
+	if sm.RecordStepIDs {
+		mutation = &stepIDMutation{SnapshotMutation: mutation, id: uuid.NewString()}
+	}
+	return mutation, nil
+}
+
+// withStepTimeout wraps the given mutation so that the pending operations for its step are flagged as timed out if
+// the mutation does not end within StepTimeout.
+func (sm *SnapshotManager) withStepTimeout(step deploy.Step, mutation engine.SnapshotMutation) engine.SnapshotMutation {
+	timer := time.AfterFunc(sm.StepTimeout, func() {
+		err := sm.mutate(func() bool {
+			return sm.markOperationTimedOut(step.Old(), step.New())
+		})
+		if err != nil {
+			logging.V(9).Infof("SnapshotManager: failed to mark operation for %s as timed out: %v", step.URN(), err)
+		}
+	})
+	return &timeoutMutation{SnapshotMutation: mutation, timer: timer}
+}
+
+// timeoutMutation stops the timer that flags a step's pending operations as timed out when the step ends.
+type timeoutMutation struct {
+	engine.SnapshotMutation
+	timer *time.Timer
+}
+
+func (m *timeoutMutation) End(step deploy.Step, successful bool) error {
+	m.timer.Stop()
+	return m.SnapshotMutation.End(step, successful)
+}
+
+// ApplyBatch applies the mutations for the given steps in order, with the same semantics as calling BeginMutation and
+// then End for each step in turn, where success[i] is the result of steps[i]. Rather than retiring each mutation as a
+// separate request, the whole batch is applied as a single request to the manager and the snapshot is persisted once
+// at the end. This is intended for engines that compute many steps up front, e.g. the destroy of an entire stack.
+//
+// Every step is checked as it would be by BeginMutation, including by the MutationGuard if one is set, and the inputs
+// of every successful create or update are checked by the InputValidator if one is set, before any mutation is
+// applied, so a rejected batch leaves the snapshot untouched.
+func (sm *SnapshotManager) ApplyBatch(steps []deploy.Step, success []bool) error {
+	contract.Requiref(len(steps) == len(success), "success", "must have the same length as steps")
+	if len(steps) == 0 {
+		return nil
+	}
+
+	for i, step := range steps {
+		contract.Requiref(step != nil, "steps", "cannot contain nil")
+		if err := sm.checkProtectedDelete(step); err != nil {
+			return err
+		}
+		if err := sm.checkMutationGuard(step); err != nil {
+			return err
+		}
+		switch step.Op() {
+		case deploy.OpCreate, deploy.OpCreateReplacement, deploy.OpUpdate:
+			if success[i] {
+				if err := sm.checkInputs(step.New()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Within the batch we are already running on the service loop, so each of the individual mutations is applied
+	// inline. Whether or not the individual mutations would have elided their writes, we always write once at the end.
+	inline := func(mutator func() bool) error {
+		mutator()
+		return nil
+	}
+	return sm.mutate(func() bool {
+		for i, step := range steps {
+			logging.V(9).Infof("SnapshotManager: Applying batched mutation for step `%s` on resource `%s`",
+				step.Op(), step.URN())
+			mutation, err := sm.beginMutation(step, inline)
+			contract.AssertNoErrorf(err, "inline mutations cannot fail")
+			if sm.RecordStepIDs {
+				mutation = &stepIDMutation{SnapshotMutation: mutation, id: uuid.NewString()}
+			}
+			err = mutation.End(step, success[i])
+			contract.AssertNoErrorf(err, "inline mutations cannot fail")
+		}
+		return true
+	})
+}
+
+// stepIDMutation records the ID assigned to a step on the step's new state when the step completes successfully.
+type stepIDMutation struct {
+	engine.SnapshotMutation
+	id string
+}
+
+func (m *stepIDMutation) End(step deploy.Step, successful bool) error {
+	if new := step.New(); successful && new != nil {
+		new.Lock.Lock()
+		new.StepID = m.id
+		new.Lock.Unlock()
+	}
+	return m.SnapshotMutation.End(step, successful)
+}
+
+// checkProtectedDelete rejects a delete step whose resource is protected, unless AllowProtectedDeletes is set. Only
+// plain deletes are checked: the engine allows a resource to be unprotected and replaced in a single update, so the
+// deletion of the replaced resource (OpDeleteReplaced or OpDiscardReplaced) must go ahead even though its old state
+// is still protected.
+func (sm *SnapshotManager) checkProtectedDelete(step deploy.Step) error {
+	if sm.AllowProtectedDeletes {
+		return nil
+	}
+	if step.Op() == deploy.OpDelete && step.Old() != nil && step.Old().Protect {
+		return fmt.Errorf("resource %s is protected and cannot be deleted", step.URN())
+	}
+	return nil
+}
+
+// checkMutationGuard consults the MutationGuard, if any, about the given step.
+func (sm *SnapshotManager) checkMutationGuard(step deploy.Step) error {
+	if sm.MutationGuard == nil {
+		return nil
+	}
+	if err := sm.MutationGuard(step); err != nil {
+		return fmt.Errorf("mutation for step `%s` on resource `%s` rejected: %w", step.Op(), step.URN(), err)
+	}
+	return nil
+}
+
+// checkInputs consults the InputValidator, if any, about the inputs of the given state. The inputs are included in the
+// error if they are rejected, with their secrets redacted, since the error is shown to the user.
+func (sm *SnapshotManager) checkInputs(state *resource.State) error {
+	if sm.InputValidator == nil {
+		return nil
+	}
+	state.Lock.Lock()
+	urn, inputs := state.URN, state.Inputs
+	state.Lock.Unlock()
+	if err := sm.InputValidator(urn, inputs); err != nil {
+		return fmt.Errorf("inputs of resource `%s` rejected: %w (inputs were %v)", urn, err, inputs.Redacted())
+	}
+	return nil
+}
+
+// mutateFunc is the signature of SnapshotManager.mutate. Mutations are parameterized by it so that they can either be
+// retired individually by the service loop or applied inline as part of a batch.
+type mutateFunc func(mutator func() bool) error
+
+// beginMutation records the intent to perform the given step, using the given function to apply any mutations to the
+// snapshot both now and when the returned mutation is ended.
+func (sm *SnapshotManager) beginMutation(step deploy.Step, mutate mutateFunc) (engine.SnapshotMutation, error) {
 	switch step.Op() {
 	case deploy.OpSame:
-		return &sameSnapshotMutation{sm}, nil
+		return &sameSnapshotMutation{sm, mutate}, nil
 	case deploy.OpCreate, deploy.OpCreateReplacement:
-		return sm.doCreate(step)
+		return sm.doCreate(step, mutate)
 	case deploy.OpUpdate:
-		return sm.doUpdate(step)
+		return sm.doUpdate(step, mutate)
 	case deploy.OpDelete, deploy.OpDeleteReplaced, deploy.OpReadDiscard, deploy.OpDiscardReplaced:
-		return sm.doDelete(step)
+		return sm.doDelete(step, mutate)
 	case deploy.OpReplace:
-		return &replaceSnapshotMutation{sm}, nil
+		return &replaceSnapshotMutation{sm, mutate}, nil
 	case deploy.OpRead, deploy.OpReadReplacement:
-		return sm.doRead(step)
+		return sm.doRead(step, mutate)
 	case deploy.OpRefresh:
-		return &refreshSnapshotMutation{sm}, nil
+		return &refreshSnapshotMutation{sm, mutate}, nil
 	case deploy.OpRemovePendingReplace:
-		return &removePendingReplaceSnapshotMutation{sm}, nil
+		return &removePendingReplaceSnapshotMutation{sm, mutate}, nil
 	case deploy.OpImport, deploy.OpImportReplacement:
-		return sm.doImport(step)
+		return sm.doImport(step, mutate)
 	}
 
 	contract.Failf("unknown StepOp: %s", step.Op())
@@ -186,6 +912,7 @@ func (sm *SnapshotManager) BeginMutation(step deploy.Step) (engine.SnapshotMutat
 
 type sameSnapshotMutation struct {
 	manager *SnapshotManager
+	mutate  mutateFunc
 }
 
 // mustWrite returns true if any semantically meaningful difference exists between the old and new states of a same
@@ -260,6 +987,12 @@ func (ssm *sameSnapshotMutation) mustWrite(step deploy.Step) bool {
 		return true
 	}
 
+	// If the resource has become (or stopped being) a view of another resource, we must write the checkpoint.
+	if old.ViewOf != new.ViewOf {
+		logging.V(9).Infof("SnapshotManager: mustWrite() true because of ViewOf")
+		return true
+	}
+
 	// If the protection attribute of this resource has changed, we must write the checkpoint.
 	if old.Protect != new.Protect {
 		logging.V(9).Infof("SnapshotManager: mustWrite() true because of Protect")
@@ -268,8 +1001,9 @@ func (ssm *sameSnapshotMutation) mustWrite(step deploy.Step) bool {
 
 	// If the inputs or outputs of this resource have changed, we must write the checkpoint. Note that it is possible
 	// for the inputs of a "same" resource to have changed even if the contents of the input bags are different if the
-	// resource's provider deems the physical change to be semantically irrelevant.
-	if !old.Inputs.DeepEquals(new.Inputs) {
+	// resource's provider deems the physical change to be semantically irrelevant. An input that has only been wrapped
+	// in (or unwrapped from) a secret is not a meaningful change; it will be written with the next write or on Close.
+	if !old.Inputs.DeepEquals(new.Inputs) && resource.DiffProperties(old.Inputs, new.Inputs) != nil {
 		logging.V(9).Infof("SnapshotManager: mustWrite() true because of Inputs")
 		return true
 	}
@@ -281,12 +1015,13 @@ func (ssm *sameSnapshotMutation) mustWrite(step deploy.Step) bool {
 	// reflect.DeepEqual does not treat `nil` and `[]URN{}` as equal, so we must check for both
 	// lists being empty ourselves.
 	if len(old.Dependencies) != 0 || len(new.Dependencies) != 0 {
-		// Sort dependencies before comparing them. If the dependencies have changed, we must write the checkpoint.
+		// Dependencies are a set, so neither their order nor any duplicates are meaningful: sort and deduplicate them
+		// before comparing them. If the dependencies have changed, we must write the checkpoint.
 		sortDeps := func(deps []resource.URN) []resource.URN {
 			result := make([]resource.URN, len(deps))
 			copy(result, deps)
 			slices.Sort(result)
-			return result
+			return slices.Compact(result)
 		}
 		oldDeps := sortDeps(old.Dependencies)
 		newDeps := sortDeps(new.Dependencies)
@@ -296,6 +1031,13 @@ func (ssm *sameSnapshotMutation) mustWrite(step deploy.Step) bool {
 		}
 	}
 
+	// Annotations are never seen by the provider, but they are part of the resource's state and so must be written
+	// if they have changed. maps.Equal treats a nil and an empty set of annotations as equal.
+	if !maps.Equal(old.Annotations, new.Annotations) {
+		logging.V(9).Infof("SnapshotManager: mustWrite() true because of Annotations")
+		return true
+	}
+
 	// Init errors are strictly advisory, so we do not consider them when deciding whether or not to write the
 	// checkpoint. Likewise source positions are purely metadata and do not affect the system correctness, so
 	// for performance we elide those as well. This prevents _every_ resource needing a snapshot write when
@@ -309,7 +1051,7 @@ func (ssm *sameSnapshotMutation) End(step deploy.Step, successful bool) error {
 	contract.Requiref(step != nil, "step", "must not be nil")
 	contract.Requiref(step.Op() == deploy.OpSame, "step.Op()", "must be %q, got %q", deploy.OpSame, step.Op())
 	logging.V(9).Infof("SnapshotManager: sameSnapshotMutation.End(..., %v)", successful)
-	return ssm.manager.mutate(func() bool {
+	return ssm.mutate(func() bool {
 		sameStep, isSameStep := step.(*deploy.SameStep)
 
 		ssm.manager.markOperationComplete(step.New())
@@ -324,6 +1066,7 @@ func (ssm *sameSnapshotMutation) End(step deploy.Step, successful bool) error {
 				return false
 			}
 
+			ssm.manager.annotate(step.Old(), step.New())
 			ssm.manager.markNew(step.New())
 
 			// Note that "Same" steps only consider input and provider diffs, so it is possible to see a same step for a
@@ -342,9 +1085,20 @@ func (ssm *sameSnapshotMutation) End(step deploy.Step, successful bool) error {
 	})
 }
 
-func (sm *SnapshotManager) doCreate(step deploy.Step) (engine.SnapshotMutation, error) {
+func (sm *SnapshotManager) doCreate(step deploy.Step, mutate mutateFunc) (engine.SnapshotMutation, error) {
 	logging.V(9).Infof("SnapshotManager.doCreate(%s)", step.URN())
-	err := sm.mutate(func() bool {
+	err := mutate(func() bool {
+		// A replacement is the next in the sequence of resources that have had this URN. The sequence number is only
+		// recorded in the snapshot; it is not passed to the provider.
+		if step.Op() == deploy.OpCreateReplacement && step.Old() != nil {
+			old, new := step.Old(), step.New()
+			old.Lock.Lock()
+			sequenceNumber := old.SequenceNumber + 1
+			old.Lock.Unlock()
+			new.Lock.Lock()
+			new.SequenceNumber = sequenceNumber
+			new.Lock.Unlock()
+		}
 		sm.markOperationPending(step.New(), resource.OperationTypeCreating)
 		return true
 	})
@@ -352,17 +1106,24 @@ func (sm *SnapshotManager) doCreate(step deploy.Step) (engine.SnapshotMutation,
 		return nil, err
 	}
 
-	return &createSnapshotMutation{sm}, nil
+	return &createSnapshotMutation{sm, mutate}, nil
 }
 
 type createSnapshotMutation struct {
 	manager *SnapshotManager
+	mutate  mutateFunc
 }
 
 func (csm *createSnapshotMutation) End(step deploy.Step, successful bool) error {
 	contract.Requiref(step != nil, "step", "must not be nil")
 	logging.V(9).Infof("SnapshotManager: createSnapshotMutation.End(..., %v)", successful)
-	return csm.manager.mutate(func() bool {
+	var rejected error
+	err := csm.mutate(func() bool {
+		if successful {
+			if rejected = csm.manager.checkInputs(step.New()); rejected != nil {
+				return false
+			}
+		}
 		csm.manager.markOperationComplete(step.New())
 		if successful {
 			// There is some very subtle behind-the-scenes magic here that
@@ -374,6 +1135,7 @@ func (csm *createSnapshotMutation) End(step deploy.Step, successful bool) error
 			// Since we are storing the base snapshot and all resources by reference
 			// (we have pointers to engine-allocated objects), this transparently
 			// "just works" for the SnapshotManager.
+			csm.manager.annotate(step.Old(), step.New())
 			csm.manager.markNew(step.New())
 
 			// If we had an old state that was marked as pending-replacement, mark its replacement as complete such
@@ -384,11 +1146,15 @@ func (csm *createSnapshotMutation) End(step deploy.Step, successful bool) error
 		}
 		return true
 	})
+	if err != nil {
+		return err
+	}
+	return rejected
 }
 
-func (sm *SnapshotManager) doUpdate(step deploy.Step) (engine.SnapshotMutation, error) {
+func (sm *SnapshotManager) doUpdate(step deploy.Step, mutate mutateFunc) (engine.SnapshotMutation, error) {
 	logging.V(9).Infof("SnapshotManager.doUpdate(%s)", step.URN())
-	err := sm.mutate(func() bool {
+	err := mutate(func() bool {
 		sm.markOperationPending(step.New(), resource.OperationTypeUpdating)
 		return true
 	})
@@ -396,29 +1162,48 @@ func (sm *SnapshotManager) doUpdate(step deploy.Step) (engine.SnapshotMutation,
 		return nil, err
 	}
 
-	return &updateSnapshotMutation{sm}, nil
+	return &updateSnapshotMutation{sm, mutate}, nil
 }
 
 type updateSnapshotMutation struct {
 	manager *SnapshotManager
+	mutate  mutateFunc
 }
 
 func (usm *updateSnapshotMutation) End(step deploy.Step, successful bool) error {
 	contract.Requiref(step != nil, "step", "must not be nil")
 	logging.V(9).Infof("SnapshotManager: updateSnapshotMutation.End(..., %v)", successful)
-	return usm.manager.mutate(func() bool {
+	var rejected error
+	err := usm.mutate(func() bool {
+		if successful {
+			if rejected = usm.manager.checkInputs(step.New()); rejected != nil {
+				return false
+			}
+		}
 		usm.manager.markOperationComplete(step.New())
 		if successful {
 			usm.manager.markDone(step.Old())
+			usm.manager.annotate(step.Old(), step.New())
 			usm.manager.markNew(step.New())
 		}
 		return true
 	})
+	if err != nil {
+		return err
+	}
+	return rejected
 }
 
-func (sm *SnapshotManager) doDelete(step deploy.Step) (engine.SnapshotMutation, error) {
+func (sm *SnapshotManager) doDelete(step deploy.Step, mutate mutateFunc) (engine.SnapshotMutation, error) {
 	logging.V(9).Infof("SnapshotManager.doDelete(%s)", step.URN())
-	err := sm.mutate(func() bool {
+
+	// Deleting a resource that is retained on delete does not touch the resource itself, so there is nothing that
+	// could be left half-done and no need to record a pending operation.
+	if isRetainedDelete(step) {
+		return &deleteSnapshotMutation{sm, mutate}, nil
+	}
+
+	err := mutate(func() bool {
 		sm.markOperationPending(step.Old(), resource.OperationTypeDeleting)
 		return true
 	})
@@ -426,21 +1211,23 @@ func (sm *SnapshotManager) doDelete(step deploy.Step) (engine.SnapshotMutation,
 		return nil, err
 	}
 
-	return &deleteSnapshotMutation{sm}, nil
+	return &deleteSnapshotMutation{sm, mutate}, nil
 }
 
 type deleteSnapshotMutation struct {
 	manager *SnapshotManager
+	mutate  mutateFunc
 }
 
 func (dsm *deleteSnapshotMutation) End(step deploy.Step, successful bool) error {
 	contract.Requiref(step != nil, "step", "must not be nil")
 	logging.V(9).Infof("SnapshotManager: deleteSnapshotMutation.End(..., %v)", successful)
-	return dsm.manager.mutate(func() bool {
+	return dsm.mutate(func() bool {
 		dsm.manager.markOperationComplete(step.Old())
 		if successful {
 			contract.Assertf(
 				!step.Old().Protect ||
+					dsm.manager.AllowProtectedDeletes ||
 					step.Op() == deploy.OpDiscardReplaced ||
 					step.Op() == deploy.OpDeleteReplaced,
 				"Old must be unprotected (got %v) or the operation must be a replace (got %q)",
@@ -449,13 +1236,30 @@ func (dsm *deleteSnapshotMutation) End(step deploy.Step, successful bool) error
 			if !step.Old().PendingReplacement {
 				dsm.manager.markDone(step.Old())
 			}
+			if isRetainedDelete(step) {
+				old := step.Old()
+				dsm.manager.retained = append(dsm.manager.retained, deploy.RetainedResource{
+					URN:  old.URN,
+					Type: old.Type,
+					ID:   old.ID,
+				})
+			}
 		}
 		return true
 	})
 }
 
+// isRetainedDelete returns true if the given delete step removes its resource from the stack without deleting it,
+// because the resource is marked RetainOnDelete.
+func isRetainedDelete(step deploy.Step) bool {
+	old := step.Old()
+	return (step.Op() == deploy.OpDelete || step.Op() == deploy.OpDeleteReplaced) &&
+		old.RetainOnDelete && !old.External && !old.PendingReplacement
+}
+
 type replaceSnapshotMutation struct {
 	manager *SnapshotManager
+	mutate  mutateFunc
 }
 
 func (rsm *replaceSnapshotMutation) End(step deploy.Step, successful bool) error {
@@ -463,9 +1267,9 @@ func (rsm *replaceSnapshotMutation) End(step deploy.Step, successful bool) error
 	return nil
 }
 
-func (sm *SnapshotManager) doRead(step deploy.Step) (engine.SnapshotMutation, error) {
+func (sm *SnapshotManager) doRead(step deploy.Step, mutate mutateFunc) (engine.SnapshotMutation, error) {
 	logging.V(9).Infof("SnapshotManager.doRead(%s)", step.URN())
-	err := sm.mutate(func() bool {
+	err := mutate(func() bool {
 		sm.markOperationPending(step.New(), resource.OperationTypeReading)
 		return true
 	})
@@ -473,38 +1277,68 @@ func (sm *SnapshotManager) doRead(step deploy.Step) (engine.SnapshotMutation, er
 		return nil, err
 	}
 
-	return &readSnapshotMutation{sm}, nil
+	return &readSnapshotMutation{sm, mutate}, nil
 }
 
 type readSnapshotMutation struct {
 	manager *SnapshotManager
+	mutate  mutateFunc
 }
 
 func (rsm *readSnapshotMutation) End(step deploy.Step, successful bool) error {
 	contract.Requiref(step != nil, "step", "must not be nil")
 	logging.V(9).Infof("SnapshotManager: readSnapshotMutation.End(..., %v)", successful)
-	return rsm.manager.mutate(func() bool {
+	return rsm.mutate(func() bool {
 		rsm.manager.markOperationComplete(step.New())
 		if successful {
 			if step.Old() != nil {
 				rsm.manager.markDone(step.Old())
+				if step.Op() == deploy.OpRead {
+					preserveOutputs(step.Old(), step.New(), rsm.manager.PreserveReadOutputs)
+				}
 			}
 
 			rsm.manager.markNew(step.New())
+			rsm.manager.markImportComplete(step.URN())
 		}
 		return true
 	})
 }
 
+// preserveOutputs copies the values of the given output keys from old to new, replacing any values read into new. Keys
+// that old does not have are left as they are.
+func preserveOutputs(old, new *resource.State, keys []resource.PropertyKey) {
+	if len(keys) == 0 {
+		return
+	}
+
+	old.Lock.Lock()
+	defer old.Lock.Unlock()
+	new.Lock.Lock()
+	defer new.Lock.Unlock()
+
+	for _, k := range keys {
+		v, has := old.Outputs[k]
+		if !has {
+			continue
+		}
+		if new.Outputs == nil {
+			new.Outputs = resource.PropertyMap{}
+		}
+		new.Outputs[k] = v
+	}
+}
+
 type refreshSnapshotMutation struct {
 	manager *SnapshotManager
+	mutate  mutateFunc
 }
 
 func (rsm *refreshSnapshotMutation) End(step deploy.Step, successful bool) error {
 	contract.Requiref(step != nil, "step", "must not be nil")
 	contract.Requiref(step.Op() == deploy.OpRefresh, "step.Op", "must be %q, got %q", deploy.OpRefresh, step.Op())
 	logging.V(9).Infof("SnapshotManager: refreshSnapshotMutation.End(..., %v)", successful)
-	return rsm.manager.mutate(func() bool {
+	return rsm.mutate(func() bool {
 		// We normally elide refreshes. The expectation is that all of these run before any actual mutations and that
 		// some other component will rewrite the base snapshot in-memory, so there's no action the snapshot
 		// manager needs to take other than to remember that the base snapshot--and therefore the actual snapshot--may
@@ -531,13 +1365,14 @@ func (rsm *refreshSnapshotMutation) End(step deploy.Step, successful bool) error
 
 type removePendingReplaceSnapshotMutation struct {
 	manager *SnapshotManager
+	mutate  mutateFunc
 }
 
 func (rsm *removePendingReplaceSnapshotMutation) End(step deploy.Step, successful bool) error {
 	contract.Requiref(step != nil, "step", "must not be nil")
 	contract.Requiref(step.Op() == deploy.OpRemovePendingReplace, "step.Op",
 		"must be %q, got %q", deploy.OpRemovePendingReplace, step.Op())
-	return rsm.manager.mutate(func() bool {
+	return rsm.mutate(func() bool {
 		res := step.Old()
 		contract.Assertf(res.PendingReplacement, "resource %q must be pending replacement", res.URN)
 		rsm.manager.markDone(res)
@@ -545,9 +1380,9 @@ func (rsm *removePendingReplaceSnapshotMutation) End(step deploy.Step, successfu
 	})
 }
 
-func (sm *SnapshotManager) doImport(step deploy.Step) (engine.SnapshotMutation, error) {
+func (sm *SnapshotManager) doImport(step deploy.Step, mutate mutateFunc) (engine.SnapshotMutation, error) {
 	logging.V(9).Infof("SnapshotManager.doImport(%s)", step.URN())
-	err := sm.mutate(func() bool {
+	err := mutate(func() bool {
 		sm.markOperationPending(step.New(), resource.OperationTypeImporting)
 		return true
 	})
@@ -555,11 +1390,12 @@ func (sm *SnapshotManager) doImport(step deploy.Step) (engine.SnapshotMutation,
 		return nil, err
 	}
 
-	return &importSnapshotMutation{sm}, nil
+	return &importSnapshotMutation{sm, mutate}, nil
 }
 
 type importSnapshotMutation struct {
 	manager *SnapshotManager
+	mutate  mutateFunc
 }
 
 func (ism *importSnapshotMutation) End(step deploy.Step, successful bool) error {
@@ -567,20 +1403,31 @@ func (ism *importSnapshotMutation) End(step deploy.Step, successful bool) error
 	contract.Requiref(step.Op() == deploy.OpImport || step.Op() == deploy.OpImportReplacement, "step.Op",
 		"must be %q or %q, got %q", deploy.OpImport, deploy.OpImportReplacement, step.Op())
 
-	return ism.manager.mutate(func() bool {
+	return ism.mutate(func() bool {
 		ism.manager.markOperationComplete(step.New())
 		if successful {
 			ism.manager.markNew(step.New())
+			ism.manager.markImportComplete(step.URN())
 		}
 		return true
 	})
 }
 
+// markImportComplete records that the resource with the given URN has been read or imported, so that any pending
+// import of it is no longer pending.
+func (sm *SnapshotManager) markImportComplete(urn resource.URN) {
+	if sm.completedImports == nil {
+		sm.completedImports = make(map[resource.URN]bool)
+	}
+	sm.completedImports[urn] = true
+}
+
 // markDone marks a resource as having been processed. Resources that have been marked
 // in this manner won't be persisted in the snapshot.
 func (sm *SnapshotManager) markDone(state *resource.State) {
 	contract.Requiref(state != nil, "state", "must not be nil")
 	sm.dones[state] = true
+	sm.markIntegrityChanged(state.URN)
 	logging.V(9).Infof("Marked old state snapshot as done: %v", state.URN)
 }
 
@@ -590,20 +1437,71 @@ func (sm *SnapshotManager) markDone(state *resource.State) {
 func (sm *SnapshotManager) markNew(state *resource.State) {
 	contract.Requiref(state != nil, "state", "must not be nil")
 	sm.resources = append(sm.resources, state)
+	sm.markIntegrityChanged(state.URN)
+	sm.validateOutputs(state)
 	logging.V(9).Infof("Appended new state snapshot to be written: %v", state.URN)
 }
 
+// annotate sets the annotations of a resource's new state before it is recorded. The new state inherits the
+// annotations of the old state, if any, unless it already has its own, and the manager's Annotate hook, if set, then
+// decides the final set.
+func (sm *SnapshotManager) annotate(old, new *resource.State) {
+	if old != nil && old != new {
+		old.Lock.Lock()
+		inherited := old.Annotations
+		old.Lock.Unlock()
+
+		new.Lock.Lock()
+		if new.Annotations == nil {
+			new.Annotations = maps.Clone(inherited)
+		}
+		new.Lock.Unlock()
+	}
+
+	if sm.Annotate != nil {
+		new.Lock.Lock()
+		new.Annotations = sm.Annotate(new.URN, maps.Clone(new.Annotations))
+		new.Lock.Unlock()
+	}
+}
+
+// markIntegrityChanged records that the resource with the given URN must be checked when the integrity of the next
+// snapshot is verified.
+func (sm *SnapshotManager) markIntegrityChanged(urn resource.URN) {
+	if sm.integrityChanged == nil {
+		sm.integrityChanged = make(map[resource.URN]bool)
+	}
+	sm.integrityChanged[urn] = true
+}
+
 // markOperationPending marks a resource as undergoing an operation that will now be considered pending.
 func (sm *SnapshotManager) markOperationPending(state *resource.State, op resource.OperationType) {
 	contract.Requiref(state != nil, "state", "must not be nil")
 	sm.operations = append(sm.operations, resource.NewOperation(state, op))
+	sm.markIntegrityChanged(state.URN)
 	logging.V(9).Infof("SnapshotManager.markPendingOperation(%s, %s)", state.URN, string(op))
 }
 
+// markOperationTimedOut flags any outstanding operations on the given resources as having timed out, returning true if
+// there were any.
+func (sm *SnapshotManager) markOperationTimedOut(states ...*resource.State) bool {
+	marked := false
+	for i, op := range sm.operations {
+		if op.TimedOut || sm.completeOps[op.Resource] || !slices.Contains(states, op.Resource) {
+			continue
+		}
+		sm.operations[i].TimedOut = true
+		marked = true
+		logging.V(9).Infof("SnapshotManager.markOperationTimedOut(%s, %s)", op.Resource.URN, string(op.Type))
+	}
+	return marked
+}
+
 // markOperationComplete marks a resource as having completed the operation that it previously was performing.
 func (sm *SnapshotManager) markOperationComplete(state *resource.State) {
 	contract.Requiref(state != nil, "state", "must not be nil")
 	sm.completeOps[state] = true
+	sm.markIntegrityChanged(state.URN)
 	logging.V(9).Infof("SnapshotManager.markOperationComplete(%s)", state.URN)
 }
 
@@ -659,8 +1557,12 @@ func (sm *SnapshotManager) snap() *deploy.Snapshot {
 		}
 	}
 
-	// Filter any refresh deletes
+	// Filter any refresh deletes. This may remove dependencies from any resource, so the next snapshot must be verified
+	// in full.
 	engine.FilterRefreshDeletes(sm.refreshDeletes, resources)
+	if len(sm.refreshDeletes) != 0 {
+		sm.integrityVerified = false
+	}
 
 	// Record any pending operations, if there are any outstanding that have not completed yet.
 	var operations []resource.Operation
@@ -670,6 +1572,8 @@ func (sm *SnapshotManager) snap() *deploy.Snapshot {
 		}
 	}
 
+	ownOperations := len(operations)
+
 	// Track pending create operations from the base snapshot
 	// and propagate them to the new snapshot: we don't want to clear pending CREATE operations
 	// because these must require user intervention to be cleared or resolved.
@@ -682,8 +1586,10 @@ func (sm *SnapshotManager) snap() *deploy.Snapshot {
 	}
 
 	manifest := deploy.Manifest{
-		Time:    time.Now(),
-		Version: version.Version,
+		Time:     time.Now(),
+		Version:  version.Version,
+		Language: sm.Language,
+		Runtime:  sm.Runtime,
 		// Plugins: sm.plugins, - Explicitly dropped, since we don't use the plugin list in the manifest anymore.
 	}
 
@@ -694,14 +1600,332 @@ func (sm *SnapshotManager) snap() *deploy.Snapshot {
 	if sm.baseSnapshot != nil && secrets.AreCompatible(secretsManager, sm.baseSnapshot.SecretsManager) {
 		secretsManager = sm.baseSnapshot.SecretsManager
 	}
+	if sm.StableSecretCiphertexts && secretsManager != nil {
+		if sm.stableSecretsManager == nil || sm.stableSecretsManager.delegateManager != secretsManager {
+			sm.stableSecretsManager = newStableCiphertextSecretsManager(secretsManager)
+		}
+		secretsManager = sm.stableSecretsManager
+	}
 
 	var metadata deploy.SnapshotMetadata
 	if sm.baseSnapshot != nil {
 		metadata = sm.baseSnapshot.Metadata
 	}
+	if len(sm.retained) != 0 {
+		retained := make([]deploy.RetainedResource, 0, len(metadata.RetainedResources)+len(sm.retained))
+		retained = append(retained, metadata.RetainedResources...)
+		metadata.RetainedResources = append(retained, sm.retained...)
+	}
 
 	manifest.Magic = manifest.NewMagic()
-	return deploy.NewSnapshot(manifest, secretsManager, resources, operations, metadata)
+	snap := deploy.NewSnapshot(manifest, secretsManager, resources, operations, metadata)
+	snap.ResourceSecretsManagers = sm.resourceSecretsManagers(resources, operations)
+	if sm.RedactPendingOperationInputs != nil {
+		sm.redactPendingOperationInputs(snap, ownOperations)
+	}
+	snap.SerializeProgress = sm.SerializeProgress
+	snap.CompressResourcesAbove = sm.CompressResourcesAbove
+	if base := sm.baseSnapshot; base != nil {
+		for _, pending := range base.PendingImports {
+			if !sm.completedImports[pending.URN] {
+				snap.PendingImports = append(snap.PendingImports, pending)
+			}
+		}
+	}
+	if sm.MaxPropertyValueBytes > 0 {
+		truncateLargeProperties(snap, sm.MaxPropertyValueBytes)
+	}
+	if sm.DeduplicateProviders {
+		deduplicateProviders(snap)
+	}
+	compactAliases(snap, sm.MaxAliases)
+	return snap
+}
+
+// deduplicateProviders removes from the given snapshot each provider resource whose type and inputs are identical to
+// those of a provider that precedes it, and replaces each resource or pending operation that refers to a removed
+// provider with a copy that refers to the preceding provider instead. Since the kept provider precedes the removed
+// one, it also precedes everything that referred to the removed one, so the snapshot remains topologically sorted.
+// Providers that are pending deletion or replacement, that have a pending operation or that share their URN with
+// another resource are never removed.
+func deduplicateProviders(snap *deploy.Snapshot) {
+	urns := make(map[resource.URN]int, len(snap.Resources))
+	for _, res := range snap.Resources {
+		urns[res.URN]++
+	}
+	for _, op := range snap.PendingOperations {
+		urns[op.Resource.URN]++
+	}
+
+	// Map the URN of each duplicate provider to the provider that replaces it.
+	replacements := make(map[resource.URN]*resource.State)
+	var kept []*resource.State
+	for _, res := range snap.Resources {
+		if !providers.IsProviderType(res.Type) || res.Delete || res.PendingReplacement || urns[res.URN] > 1 ||
+			res.ID == "" || res.ID == providers.UnknownID {
+			continue
+		}
+		i := slices.IndexFunc(kept, func(provider *resource.State) bool {
+			return provider.Type == res.Type && provider.Inputs.DeepEquals(res.Inputs)
+		})
+		if i == -1 {
+			kept = append(kept, res)
+		} else {
+			replacements[res.URN] = kept[i]
+		}
+	}
+	if len(replacements) == 0 {
+		return
+	}
+
+	rewrite := func(res *resource.State) *resource.State {
+		res.Lock.Lock()
+		defer res.Lock.Unlock()
+		copied, changed := replaceProviderReferences(res, replacements)
+		if !changed {
+			return res
+		}
+		if resSM, has := snap.ResourceSecretsManagers[res]; has {
+			delete(snap.ResourceSecretsManagers, res)
+			snap.ResourceSecretsManagers[copied] = resSM
+		}
+		return copied
+	}
+
+	resources := make([]*resource.State, 0, len(snap.Resources)-len(replacements))
+	for _, res := range snap.Resources {
+		if _, has := replacements[res.URN]; has {
+			delete(snap.ResourceSecretsManagers, res)
+			continue
+		}
+		resources = append(resources, rewrite(res))
+	}
+	snap.Resources = resources
+	for i := range snap.PendingOperations {
+		snap.PendingOperations[i].Resource = rewrite(snap.PendingOperations[i].Resource)
+	}
+}
+
+// replaceProviderReferences returns a copy of the given state in which every reference to a provider in replacements
+// is replaced by a reference to the provider that replaces it. It returns false, and no copy, if the state has no such
+// references.
+func replaceProviderReferences(
+	res *resource.State, replacements map[resource.URN]*resource.State,
+) (*resource.State, bool) {
+	replaceURNs := func(urns []resource.URN) ([]resource.URN, bool) {
+		if !slices.ContainsFunc(urns, func(urn resource.URN) bool { return replacements[urn] != nil }) {
+			return urns, false
+		}
+		replaced := make([]resource.URN, 0, len(urns))
+		for _, urn := range urns {
+			if provider, has := replacements[urn]; has {
+				urn = provider.URN
+			}
+			if !slices.Contains(replaced, urn) {
+				replaced = append(replaced, urn)
+			}
+		}
+		return replaced, true
+	}
+
+	copied := res.Copy()
+	changed := false
+	if ref, err := providers.ParseReference(res.Provider); err == nil {
+		if provider, has := replacements[ref.URN()]; has {
+			newRef, err := providers.NewReference(provider.URN, provider.ID)
+			contract.AssertNoErrorf(err, "could not create reference to provider %v", provider.URN)
+			copied.Provider, changed = newRef.String(), true
+		}
+	}
+	if provider, has := replacements[res.Parent]; has {
+		copied.Parent, changed = provider.URN, true
+	}
+	if provider, has := replacements[res.DeletedWith]; has {
+		copied.DeletedWith, changed = provider.URN, true
+	}
+	if deps, replaced := replaceURNs(res.Dependencies); replaced {
+		copied.Dependencies, changed = deps, true
+	}
+	var propertyDeps map[resource.PropertyKey][]resource.URN
+	for k, deps := range res.PropertyDependencies {
+		if deps, replaced := replaceURNs(deps); replaced {
+			if propertyDeps == nil {
+				propertyDeps = make(map[resource.PropertyKey][]resource.URN, len(res.PropertyDependencies))
+				for k, deps := range res.PropertyDependencies {
+					propertyDeps[k] = deps
+				}
+			}
+			propertyDeps[k] = deps
+		}
+	}
+	if propertyDeps != nil {
+		copied.PropertyDependencies, changed = propertyDeps, true
+	}
+	return copied, changed
+}
+
+// compactAliases replaces each resource in the given snapshot that has duplicate aliases, or more than limit aliases if
+// limit is positive, with a copy whose aliases are deduplicated and limited to the last limit. Aliases are kept in
+// their original order, and a duplicated alias is kept at the position of its last occurrence.
+func compactAliases(snap *deploy.Snapshot, limit int) {
+	compact := func(aliases []resource.URN) ([]resource.URN, bool) {
+		seen := make(map[resource.URN]bool, len(aliases))
+		var kept []resource.URN
+		for i := len(aliases) - 1; i >= 0; i-- {
+			if limit > 0 && len(kept) == limit {
+				break
+			}
+			if !seen[aliases[i]] {
+				seen[aliases[i]] = true
+				kept = append(kept, aliases[i])
+			}
+		}
+		if len(kept) == len(aliases) {
+			return nil, false
+		}
+		slices.Reverse(kept)
+		return kept, true
+	}
+
+	for i, res := range snap.Resources {
+		res.Lock.Lock()
+		if len(res.Aliases) < 2 && limit <= 0 {
+			res.Lock.Unlock()
+			continue
+		}
+		aliases, changed := compact(res.Aliases)
+		if !changed {
+			res.Lock.Unlock()
+			continue
+		}
+		copied := res.Copy()
+		res.Lock.Unlock()
+
+		copied.Aliases = aliases
+		snap.Resources[i] = copied
+		if resSM, has := snap.ResourceSecretsManagers[res]; has {
+			delete(snap.ResourceSecretsManagers, res)
+			snap.ResourceSecretsManagers[copied] = resSM
+		}
+	}
+}
+
+// truncateLargeProperties replaces each component resource in the given snapshot, other than the root stack, that has
+// a non-secret output property value whose JSON encoding is larger than limit bytes with a copy in which those values
+// are replaced by markers. Inputs, and the properties of custom resources, are never truncated, since later updates
+// rely on them.
+func truncateLargeProperties(snap *deploy.Snapshot, limit int) {
+	truncate := func(props resource.PropertyMap) resource.PropertyMap {
+		var truncated resource.PropertyMap
+		for k, v := range props {
+			if v.ContainsSecrets() {
+				continue
+			}
+			encoded, err := json.Marshal(v.Mappable())
+			if err != nil || len(encoded) <= limit {
+				continue
+			}
+			if truncated == nil {
+				truncated = props.Copy()
+			}
+			sum := sha256.Sum256(encoded)
+			truncated[k] = resource.NewObjectProperty(resource.PropertyMap{
+				TruncatedPropertyKey: resource.NewBoolProperty(true),
+				"size":               resource.NewNumberProperty(float64(len(encoded))),
+				"sha256":             resource.NewStringProperty(hex.EncodeToString(sum[:])),
+			})
+		}
+		return truncated
+	}
+
+	for i, res := range snap.Resources {
+		if res.Custom || res.Type == resource.RootStackType {
+			continue
+		}
+		res.Lock.Lock()
+		outputs := truncate(res.Outputs)
+		if outputs == nil {
+			res.Lock.Unlock()
+			continue
+		}
+		copied := res.Copy()
+		res.Lock.Unlock()
+
+		copied.Outputs = outputs
+		snap.Resources[i] = copied
+		if resSM, has := snap.ResourceSecretsManagers[res]; has {
+			delete(snap.ResourceSecretsManagers, res)
+			snap.ResourceSecretsManagers[copied] = resSM
+		}
+	}
+}
+
+// redactPendingOperationInputs replaces the resource of each of the first n of the snapshot's pending operations, which
+// are those begun by this manager, with a copy whose inputs have been passed through RedactPendingOperationInputs. The
+// copy keeps the secrets manager of the resource it was made from. The original is left in the map, since it may also
+// be one of the snapshot's resources.
+func (sm *SnapshotManager) redactPendingOperationInputs(snap *deploy.Snapshot, n int) {
+	for i, op := range snap.PendingOperations[:n] {
+		redacted := op.Resource.Copy()
+		redacted.Inputs = sm.RedactPendingOperationInputs(op.Resource.Inputs)
+		if resSM, has := snap.ResourceSecretsManagers[op.Resource]; has {
+			snap.ResourceSecretsManagers[redacted] = resSM
+		}
+		snap.PendingOperations[i].Resource = redacted
+	}
+}
+
+// resourceSecretsManagers returns the per-resource secrets managers for the given resources and pending operations that
+// are about to be written. Only resources carried over untouched from the base snapshot keep a secrets manager of their
+// own: any resource that has been operated upon by this plan is a new state and is therefore encrypted with the
+// snapshot's secrets manager, which lazily migrates resources to it as they are touched. The same holds for the
+// resources of pending operations, which may be carried over from the base snapshot or refer to one of its resources.
+func (sm *SnapshotManager) resourceSecretsManagers(
+	resources []*resource.State,
+	operations []resource.Operation,
+) map[*resource.State]secrets.Manager {
+	base := sm.baseSnapshot
+	if base == nil {
+		return nil
+	}
+
+	migrating := sm.LazySecretsMigration && !secrets.AreCompatible(sm.secretsManager, base.SecretsManager) &&
+		base.SecretsManager != nil
+	if len(base.ResourceSecretsManagers) == 0 && !migrating {
+		return nil
+	}
+
+	baseResources := make(map[*resource.State]bool, len(base.Resources)+len(base.PendingOperations))
+	for _, res := range base.Resources {
+		baseResources[res] = true
+	}
+	for _, op := range base.PendingOperations {
+		baseResources[op.Resource] = true
+	}
+
+	written := slices.Clip(resources)
+	for _, op := range operations {
+		written = append(written, op.Resource)
+	}
+
+	var result map[*resource.State]secrets.Manager
+	for _, res := range written {
+		if !baseResources[res] {
+			continue
+		}
+
+		resSM, has := base.ResourceSecretsManagers[res]
+		if !has && migrating {
+			resSM, has = base.SecretsManager, true
+		}
+		if has {
+			if result == nil {
+				result = make(map[*resource.State]secrets.Manager)
+			}
+			result[res] = resSM
+		}
+	}
+	return result
 }
 
 // saveSnapshot persists the current snapshot. If integrity checking is enabled,
@@ -710,6 +1934,16 @@ func (sm *SnapshotManager) snap() *deploy.Snapshot {
 // written, in order to aid debugging should future operations fail with an
 // error.
 func (sm *SnapshotManager) saveSnapshot() error {
+	// Quarantined resources are not part of the snapshot, so writing it would silently drop them from the stack.
+	if base := sm.baseSnapshot; base != nil && len(base.QuarantinedResources) != 0 {
+		urns := slice.Prealloc[string](len(base.QuarantinedResources))
+		for _, q := range base.QuarantinedResources {
+			urns = append(urns, string(q.URN))
+		}
+		return fmt.Errorf("refusing to overwrite %d quarantined resource(s) that could not be loaded: %s",
+			len(urns), strings.Join(urns, ", "))
+	}
+
 	snap, err := sm.snap().NormalizeURNReferences()
 	if err != nil {
 		return fmt.Errorf("failed to normalize URN references: %w", err)
@@ -728,19 +1962,77 @@ func (sm *SnapshotManager) saveSnapshot() error {
 	//
 	// Metadata will be cleared out by a successful operation (even if integrity
 	// checking is being enforced).
-	integrityError := snap.VerifyIntegrity()
-	if integrityError == nil {
-		snap.Metadata.IntegrityErrorMetadata = nil
-	} else {
-		snap.Metadata.IntegrityErrorMetadata = &deploy.SnapshotIntegrityErrorMetadata{
-			Version: version.Version,
-			Command: strings.Join(os.Args, " "),
-			Error:   integrityError.Error(),
+	//
+	// If verification is deferred until Close, intermediate writes keep whatever metadata the snapshot already has.
+	var integrityError error
+	if sm.closing || !sm.DeferIntegrityUntilClose {
+		integrityError = sm.verifyIntegrity(snap)
+		if errors.Is(integrityError, deploy.ErrOutOfOrder) {
+			integrityError = sm.reorderResources(snap, integrityError)
+		}
+		if integrityError == nil {
+			snap.Metadata.IntegrityErrorMetadata = nil
+		} else {
+			metadata := &deploy.SnapshotIntegrityErrorMetadata{
+				Version: version.Version,
+				Command: strings.Join(os.Args, " "),
+				Error:   integrityError.Error(),
+			}
+			if sm.RedactIntegrityErrorSecrets {
+				redactor := newSecretRedactor(snap)
+				metadata.Command = redactor.Replace(metadata.Command)
+				metadata.Error = redactor.Replace(metadata.Error)
+			}
+			snap.Metadata.IntegrityErrorMetadata = metadata
+		}
+	}
+
+	var checksum []byte
+	if sm.SkipIdenticalWrites {
+		if sm.lastChecksum == nil && sm.baseSnapshot != nil {
+			if sm.lastChecksum, err = snapshotChecksum(sm.baseSnapshot); err != nil {
+				return fmt.Errorf("failed to checksum base snapshot: %w", err)
+			}
+		}
+		if checksum, err = snapshotChecksum(snap); err != nil {
+			return fmt.Errorf("failed to checksum snapshot: %w", err)
 		}
 	}
 
-	if err := sm.persister.Save(snap); err != nil {
-		return fmt.Errorf("failed to save snapshot: %w", err)
+	if checksum != nil && bytes.Equal(checksum, sm.lastChecksum) {
+		logging.V(9).Infof("SnapshotManager: skipping write of snapshot identical to the last one persisted")
+		sm.writesSkipped.Add(1)
+	} else {
+		if sm.WriteAheadLog != nil {
+			if err := sm.WriteAheadLog.record(snap); err != nil {
+				return fmt.Errorf("failed to record snapshot in write-ahead log: %w", err)
+			}
+		}
+		if err := sm.persist(snap); err != nil {
+			sm.persistErr = err
+			return fmt.Errorf("failed to save snapshot: %w", err)
+		}
+		if syncer, ok := sm.persister.(Syncer); ok {
+			if err := syncer.Sync(); err != nil {
+				sm.persistErr = err
+				return fmt.Errorf("failed to sync snapshot: %w", err)
+			}
+		}
+		sm.persistErr = nil
+		sm.lastChecksum = checksum
+		sm.writesPerformed.Add(1)
+		if sm.SnapshotSaved != nil {
+			sm.notifySnapshotSaved(snap)
+		}
+		if sm.ResourceReordered != nil {
+			sm.notifyResourcesReordered(snap)
+		}
+		// The snapshot has been saved, so failing to clear the log only means that it will be replayed needlessly.
+		if sm.WriteAheadLog != nil {
+			if err := sm.WriteAheadLog.clear(); err != nil {
+				logging.Warningf("SnapshotManager: %v", err)
+			}
+		}
 	}
 	if !DisableIntegrityChecking && integrityError != nil {
 		return fmt.Errorf("failed to verify snapshot: %w", integrityError)
@@ -748,6 +2040,337 @@ func (sm *SnapshotManager) saveSnapshot() error {
 	return nil
 }
 
+// verifyIntegrity checks the integrity of the given snapshot before it is written. If the last snapshot to be verified
+// was valid, only the resources that have changed since then are checked. The whole snapshot is checked otherwise, when
+// the manager is closing, and when DeduplicateProviders may have rewritten references anywhere in the snapshot.
+func (sm *SnapshotManager) verifyIntegrity(snap *deploy.Snapshot) error {
+	var err error
+	if sm.integrityVerified && !sm.closing && !sm.DeduplicateProviders {
+		changed := make([]resource.URN, 0, len(sm.integrityChanged))
+		for urn := range sm.integrityChanged {
+			changed = append(changed, urn)
+		}
+		err = snap.VerifyIntegrityDelta(changed)
+	} else {
+		err = snap.VerifyIntegrity()
+	}
+	sm.integrityVerified = err == nil
+	clear(sm.integrityChanged)
+	return err
+}
+
+// reorderResources moves each resource of the given snapshot, which has failed verification with the given ordering
+// error, after the resources it depends on, and returns the result of verifying the snapshot again. The merge done by
+// snap relies on the engine recording resources in a valid order, so such an error points to a bug in the engine; it
+// is repaired so that the stack remains usable, but logged as a warning rather than silently. A cycle cannot be fixed
+// by reordering, in which case the snapshot is left as it is and the original error returned.
+func (sm *SnapshotManager) reorderResources(snap *deploy.Snapshot, orderErr error) error {
+	logging.Warningf("SnapshotManager: reordering the resources of the snapshot to be written: %v", orderErr)
+	if err := snap.Reorder(); err != nil {
+		return orderErr
+	}
+	return sm.verifyIntegrity(snap)
+}
+
+// saveFinalSnapshot writes the snapshot when the manager is closed. If the persister fails to write it and a
+// FallbackPersister is configured, the snapshot is written to that instead.
+func (sm *SnapshotManager) saveFinalSnapshot() error {
+	sm.closing = true
+	err := sm.saveSnapshot()
+	if err == nil || sm.FallbackPersister == nil || sm.persistErr == nil {
+		return err
+	}
+
+	snap, normalizeErr := sm.snap().NormalizeURNReferences()
+	if normalizeErr != nil {
+		return err
+	}
+	if fallbackErr := sm.FallbackPersister.Save(snap); fallbackErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to save snapshot to fallback: %w", fallbackErr))
+	}
+	return FallbackSaveError{Err: err, Fallback: sm.FallbackPersister}
+}
+
+// notifyResourcesReordered reports to ResourceReordered each resource that has moved relative to the others between
+// the last snapshot written and the given one, which has just been persisted. The resources in both snapshots that
+// kept their relative order are those of a longest increasing subsequence of their old indices taken in their new
+// order; every other resource in both snapshots is reported.
+func (sm *SnapshotManager) notifyResourcesReordered(snap *deploy.Snapshot) {
+	oldOrder := sm.lastOrder
+	if oldOrder == nil && sm.baseSnapshot != nil {
+		for _, res := range sm.baseSnapshot.Resources {
+			oldOrder = append(oldOrder, res.URN)
+		}
+	}
+	newOrder := make([]resource.URN, len(snap.Resources))
+	for i, res := range snap.Resources {
+		newOrder[i] = res.URN
+	}
+	sm.lastOrder = newOrder
+
+	// Match the occurrences of each URN in the two snapshots in turn.
+	oldIndices := make(map[resource.URN][]int)
+	for i, urn := range oldOrder {
+		oldIndices[urn] = append(oldIndices[urn], i)
+	}
+	var matchedNew, matchedOld []int
+	for i, urn := range newOrder {
+		if indices := oldIndices[urn]; len(indices) != 0 {
+			matchedNew, matchedOld = append(matchedNew, i), append(matchedOld, indices[0])
+			oldIndices[urn] = indices[1:]
+		}
+	}
+
+	// Find a longest increasing subsequence of the old indices. tails[k] is the position in matchedOld of the smallest
+	// index that ends an increasing subsequence of length k+1, and prev links each position to its predecessor.
+	var tails []int
+	prev := make([]int, len(matchedOld))
+	for i, old := range matchedOld {
+		k, _ := slices.BinarySearchFunc(tails, old, func(t, old int) int { return matchedOld[t] - old })
+		prev[i] = -1
+		if k > 0 {
+			prev[i] = tails[k-1]
+		}
+		if k == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[k] = i
+		}
+	}
+	kept := make([]bool, len(matchedOld))
+	if len(tails) != 0 {
+		for i := tails[len(tails)-1]; i != -1; i = prev[i] {
+			kept[i] = true
+		}
+	}
+
+	for i := range matchedOld {
+		if !kept[i] {
+			sm.ResourceReordered(ResourceReorderedEvent{
+				URN:      newOrder[matchedNew[i]],
+				OldIndex: matchedOld[i],
+				NewIndex: matchedNew[i],
+			})
+		}
+	}
+}
+
+// notifySnapshotSaved measures the given snapshot, which has just been persisted, and reports it to SnapshotSaved. The
+// snapshot has already been written, so a failure to measure it is logged rather than returned.
+func (sm *SnapshotManager) notifySnapshotSaved(snap *deploy.Snapshot) {
+	deployment, err := stack.SerializeDeployment(context.TODO(), snap, false /* showSecrets */)
+	if err != nil {
+		logging.V(5).Infof("SnapshotManager: failed to serialize saved snapshot: %v", err)
+		return
+	}
+	serialized, err := stack.MarshalDeployment(deployment, stack.MarshalOptions{})
+	if err != nil {
+		logging.V(5).Infof("SnapshotManager: failed to marshal saved snapshot: %v", err)
+		return
+	}
+	sm.SnapshotSaved(SnapshotSavedEvent{Bytes: len(serialized), Resources: len(snap.Resources)})
+}
+
+// newSecretRedactor returns a replacer that replaces the plaintext of each secret string held by the given snapshot's
+// resources and pending operations with "[secret]". Longer secrets are replaced first, so that a secret containing
+// another is not left partially exposed. Only string secrets are collected: a secret number or bool is rendered as
+// text that is too common to redact safely.
+func newSecretRedactor(snap *deploy.Snapshot) *strings.Replacer {
+	seen := map[string]bool{}
+	var collect func(v resource.PropertyValue, secret bool)
+	collect = func(v resource.PropertyValue, secret bool) {
+		switch {
+		case v.IsSecret():
+			collect(v.SecretValue().Element, true)
+		case v.IsComputed():
+			collect(v.Input().Element, secret)
+		case v.IsOutput():
+			out := v.OutputValue()
+			collect(out.Element, secret || out.Secret)
+		case v.IsArray():
+			for _, e := range v.ArrayValue() {
+				collect(e, secret)
+			}
+		case v.IsObject():
+			for _, e := range v.ObjectValue() {
+				collect(e, secret)
+			}
+		case v.IsString():
+			if secret && v.StringValue() != "" {
+				seen[v.StringValue()] = true
+			}
+		}
+	}
+	collectState := func(state *resource.State) {
+		collect(resource.NewObjectProperty(state.Inputs), false)
+		collect(resource.NewObjectProperty(state.Outputs), false)
+	}
+	for _, res := range snap.Resources {
+		collectState(res)
+	}
+	for _, op := range snap.PendingOperations {
+		collectState(op.Resource)
+	}
+
+	plaintexts := make([]string, 0, len(seen))
+	for secret := range seen {
+		plaintexts = append(plaintexts, secret)
+	}
+	slices.SortFunc(plaintexts, func(a, b string) int {
+		if len(a) != len(b) {
+			return len(b) - len(a)
+		}
+		return strings.Compare(a, b)
+	})
+	oldnew := make([]string, 0, 2*len(plaintexts))
+	for _, secret := range plaintexts {
+		oldnew = append(oldnew, secret, "[secret]")
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+// snapshotChecksum returns a checksum of the serialized form of the given snapshot, ignoring its manifest, which
+// records when the snapshot was taken and so differs between every write.
+func snapshotChecksum(snap *deploy.Snapshot) ([]byte, error) {
+	deployment, err := stack.SerializeDeployment(context.TODO(), snap, false /* showSecrets */)
+	if err != nil {
+		return nil, err
+	}
+	deployment.Manifest = apitype.ManifestV1{}
+	canonical, err := stack.MarshalDeployment(deployment, stack.MarshalOptions{Canonical: true})
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(canonical)
+	return sum[:], nil
+}
+
+// persist hands the given snapshot to the persister, serializing it canonically first if the persister asks for it.
+func (sm *SnapshotManager) persist(snap *deploy.Snapshot) error {
+	if generationalPersister, ok := sm.persister.(GenerationalSnapshotPersister); ok {
+		return sm.persistGeneration(generationalPersister, snap)
+	}
+
+	if shardedPersister, ok := sm.persister.(ShardedSnapshotPersister); ok {
+		return sm.persistShards(shardedPersister, snap)
+	}
+
+	if eventLogPersister, ok := sm.persister.(EventLogPersister); ok {
+		return sm.appendMutationRecord(eventLogPersister, snap)
+	}
+
+	if chunkedPersister, ok := sm.persister.(ChunkedPersister); ok {
+		var codec SnapshotCodec = JSONSnapshotCodec{}
+		if sm.ChunkedCodec != nil {
+			codec = sm.ChunkedCodec
+		}
+		serialized, err := codec.Marshal(snap)
+		if err != nil {
+			return err
+		}
+		return chunkedPersister.SaveChunked(bytes.NewReader(serialized), int64(len(serialized)))
+	}
+
+	canonicalPersister, ok := sm.persister.(CanonicalSnapshotPersister)
+	if !ok {
+		return sm.persister.Save(snap)
+	}
+
+	deployment, err := stack.SerializeDeployment(context.TODO(), snap, false /* showSecrets */)
+	if err != nil {
+		return fmt.Errorf("serializing deployment: %w", err)
+	}
+	canonical, err := stack.MarshalDeployment(deployment, stack.MarshalOptions{Canonical: true})
+	if err != nil {
+		return fmt.Errorf("marshalling deployment: %w", err)
+	}
+	return canonicalPersister.SaveCanonical(snap, canonical)
+}
+
+// persistGeneration persists the given snapshot, provided that the stored snapshot has not been written by anyone else
+// since this manager was created or last wrote it.
+func (sm *SnapshotManager) persistGeneration(persister GenerationalSnapshotPersister, snap *deploy.Snapshot) error {
+	if sm.generationErr != nil {
+		return fmt.Errorf("reading snapshot generation: %w", sm.generationErr)
+	}
+
+	generation, saved, err := persister.SaveIfGeneration(snap, sm.generation)
+	if err != nil {
+		return err
+	}
+	if !saved {
+		return SnapshotConflictError{Expected: sm.generation, Actual: generation}
+	}
+	sm.generation = generation
+	return nil
+}
+
+// persistShards splits the given snapshot into shards by storage key and hands those that have changed since the last
+// write to the persister.
+func (sm *SnapshotManager) persistShards(persister ShardedSnapshotPersister, snap *deploy.Snapshot) error {
+	storageKey := persister.StorageKeyFunc()
+	if storageKey == nil {
+		storageKey = DefaultStorageKey
+	}
+
+	// The first write must remove the shards of any resources in the base snapshot that are no longer present, so seed
+	// the last known shards with them. A zero checksum never matches, so all of them are also written.
+	if sm.shardChecksums == nil {
+		sm.shardChecksums = make(map[string][sha256.Size]byte)
+		if sm.baseSnapshot != nil {
+			for _, res := range sm.baseSnapshot.Resources {
+				sm.shardChecksums[storageKey(res.URN)] = [sha256.Size]byte{}
+			}
+		}
+	}
+
+	deployment, err := stack.SerializeDeployment(context.TODO(), snap, false /* showSecrets */)
+	if err != nil {
+		return fmt.Errorf("serializing deployment: %w", err)
+	}
+
+	var keys []string
+	urns := make(map[string]resource.URN)
+	shards := make(map[string][]apitype.ResourceV3)
+	for _, res := range deployment.Resources {
+		key := storageKey(res.URN)
+		if urn, has := urns[key]; !has {
+			keys = append(keys, key)
+			urns[key] = res.URN
+		} else if urn != res.URN {
+			return fmt.Errorf("resources %s and %s have the same storage key %q", urn, res.URN, key)
+		}
+		shards[key] = append(shards[key], res)
+	}
+
+	changed := make(map[string][]byte)
+	checksums := make(map[string][sha256.Size]byte, len(keys))
+	for _, key := range keys {
+		shard, err := json.Marshal(shards[key])
+		if err != nil {
+			return fmt.Errorf("marshalling shard for %s: %w", urns[key], err)
+		}
+		checksums[key] = sha256.Sum256(shard)
+		if last, has := sm.shardChecksums[key]; !has || last != checksums[key] {
+			changed[key] = shard
+		}
+	}
+
+	var deleted []string
+	for key := range sm.shardChecksums {
+		if _, has := checksums[key]; !has {
+			deleted = append(deleted, key)
+		}
+	}
+	slices.Sort(deleted)
+
+	if err := persister.SaveShards(snap, changed, deleted); err != nil {
+		return err
+	}
+	sm.shardChecksums = checksums
+	return nil
+}
+
 // defaultServiceLoop saves a Snapshot whenever a mutation occurs
 func (sm *SnapshotManager) defaultServiceLoop(mutationRequests chan mutationRequest, done chan error) {
 	// True if we have elided writes since the last actual write.
@@ -759,10 +2382,12 @@ serviceLoop:
 		select {
 		case request := <-mutationRequests:
 			var err error
+			sm.mutations.Add(1)
 			if request.mutator() {
 				err = sm.saveSnapshot()
 				hasElidedWrites = false
 			} else {
+				sm.writesSkipped.Add(1)
 				hasElidedWrites = true
 			}
 			request.result <- err
@@ -771,11 +2396,13 @@ serviceLoop:
 		}
 	}
 
-	// If we still have elided writes once the channel has closed, flush the snapshot.
+	// If we still have elided writes once the channel has closed, flush the snapshot. Likewise, if the last write
+	// failed and we have somewhere else to put the snapshot, try once more so that the final state is not lost. If
+	// integrity checks were deferred, the final snapshot must be written in any case so that it is verified.
 	var err error
-	if hasElidedWrites {
+	if hasElidedWrites || sm.DeferIntegrityUntilClose || (sm.FallbackPersister != nil && sm.persistErr != nil) {
 		logging.V(9).Infof("SnapshotManager: flushing elided writes...")
-		err = sm.saveSnapshot()
+		err = sm.saveFinalSnapshot()
 	}
 	done <- err
 }
@@ -787,10 +2414,12 @@ func (sm *SnapshotManager) unsafeServiceLoop(mutationRequests chan mutationReque
 	for {
 		select {
 		case request := <-mutationRequests:
+			sm.mutations.Add(1)
 			request.mutator()
+			sm.writesSkipped.Add(1)
 			request.result <- nil
 		case <-sm.cancel:
-			done <- sm.saveSnapshot()
+			done <- sm.saveFinalSnapshot()
 			return
 		}
 	}
@@ -821,6 +2450,16 @@ func NewSnapshotManager(
 		refreshDeletes:   make(map[resource.URN]bool),
 	}
 
+	// Remember the generation of the stored snapshot now, so that a write made by anyone else before our first write
+	// is detected.
+	if generationalPersister, ok := persister.(GenerationalSnapshotPersister); ok {
+		manager.generation, manager.generationErr = generationalPersister.Generation()
+	}
+
+	if _, ok := persister.(EventLogPersister); ok {
+		manager.logBaseSnapshot()
+	}
+
 	serviceLoop := manager.defaultServiceLoop
 
 	if env.SkipCheckpoints.Value() {
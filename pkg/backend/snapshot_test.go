@@ -15,15 +15,31 @@
 package backend
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slices"
 
 	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
 	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/pkg/v3/secrets"
 	"github.com/pulumi/pulumi/pkg/v3/secrets/b64"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/env"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
@@ -155,6 +171,106 @@ func TestSamesWithEmptyDependencies(t *testing.T) {
 	assert.Len(t, sp.SavedSnapshots, 0, "expected no snapshots to be saved for same step")
 }
 
+func TestSamesWithTimestampChanges(t *testing.T) {
+	t.Parallel()
+
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	modified := created.Add(time.Hour)
+
+	res := NewResource(aUniqueUrnResourceA)
+	res.Created, res.Modified = &created, &created
+	snap := NewSnapshot([]*resource.State{
+		res,
+	})
+	manager, sp := MockSetup(t, snap)
+
+	// Timestamps alone are not a meaningful change, so the write is elided...
+	resUpdated := NewResource(res.URN)
+	resUpdated.Created, resUpdated.Modified = &created, &modified
+	same := deploy.NewSameStep(nil, nil, res, resUpdated)
+	mutation, err := manager.BeginMutation(same)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(same, true))
+	assert.Empty(t, sp.SavedSnapshots)
+
+	// ...but the new timestamps are still flushed on close, with Created preserved and Modified advanced.
+	require.NoError(t, manager.Close())
+	require.Len(t, sp.SavedSnapshots, 1)
+	written := sp.LastSnap().Resources[0]
+	assert.Equal(t, created, *written.Created)
+	assert.Equal(t, modified, *written.Modified)
+}
+
+func TestSamesWithCustomTimeoutChanges(t *testing.T) {
+	t.Parallel()
+
+	timeouts := resource.CustomTimeouts{Create: 60, Update: 120, Delete: 180}
+	res := NewResource(aUniqueUrnResourceA)
+	res.CustomTimeouts = timeouts
+	snap := NewSnapshot([]*resource.State{
+		res,
+	})
+	manager, sp := MockSetup(t, snap)
+
+	// Unchanged timeouts are carried over by the same step without forcing a write...
+	resSame := NewResource(res.URN)
+	resSame.CustomTimeouts = timeouts
+	same := deploy.NewSameStep(nil, nil, res, resSame)
+	mutation, err := manager.BeginMutation(same)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(same, true))
+	assert.Empty(t, sp.SavedSnapshots)
+
+	// ...but a changed timeout is a meaningful change, and is written immediately.
+	resChanged := NewResource(res.URN)
+	resChanged.CustomTimeouts = resource.CustomTimeouts{Create: 60, Update: 300, Delete: 180}
+	same = deploy.NewSameStep(nil, nil, resSame, resChanged)
+	mutation, err = manager.BeginMutation(same)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(same, true))
+	require.Len(t, sp.SavedSnapshots, 1)
+	assert.Equal(t, resChanged.CustomTimeouts, sp.LastSnap().Resources[0].CustomTimeouts)
+	require.NoError(t, manager.Close())
+}
+
+func TestSamesWithAnnotationChanges(t *testing.T) {
+	t.Parallel()
+
+	res := NewResource(aUniqueUrnResourceA)
+	res.Annotations = map[string]string{"owner": "platform"}
+	snap := NewSnapshot([]*resource.State{
+		res,
+	})
+	manager, sp := MockSetup(t, snap)
+	manager.Annotate = func(urn resource.URN, annotations map[string]string) map[string]string {
+		if urn == aUniqueUrnResourceA && annotations["owner"] == "platform" {
+			return annotations
+		}
+		annotations["cost-center"] = "1234"
+		return annotations
+	}
+
+	// The new state of a same step carries over the old state's annotations without forcing a write...
+	resSame := NewResource(res.URN)
+	same := deploy.NewSameStep(nil, nil, res, resSame)
+	mutation, err := manager.BeginMutation(same)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(same, true))
+	assert.Empty(t, sp.SavedSnapshots)
+	assert.Equal(t, map[string]string{"owner": "platform"}, resSame.Annotations)
+
+	// ...but a changed annotation is written immediately.
+	resChanged := NewResource(res.URN)
+	resChanged.Annotations = map[string]string{"owner": "data"}
+	same = deploy.NewSameStep(nil, nil, resSame, resChanged)
+	mutation, err = manager.BeginMutation(same)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(same, true))
+	require.Len(t, sp.SavedSnapshots, 1)
+	assert.Equal(t, map[string]string{"owner": "data", "cost-center": "1234"}, sp.LastSnap().Resources[0].Annotations)
+	require.NoError(t, manager.Close())
+}
+
 func TestSamesWithEmptyArraysInInputs(t *testing.T) {
 	t.Parallel()
 
@@ -254,6 +370,37 @@ func TestSamesWithDependencyChanges(t *testing.T) {
 	assert.Equal(t, resourceB.URN, secondSnap.Resources[1].Dependencies[0])
 }
 
+func TestSamesWithReorderedDependencies(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResource(aUniqueUrnResourceA)
+	resourceB := NewResource(aUniqueUrnResourceB)
+	resourceC := NewResource(aUniqueUrnResourceP, resourceA.URN, resourceB.URN)
+	snap := NewSnapshot([]*resource.State{
+		resourceA,
+		resourceB,
+		resourceC,
+	})
+	manager, sp := MockSetup(t, snap)
+
+	// Dependencies are a set, so reporting them in a different order, or more than once, is not a meaningful change.
+	resourceCUpdated := NewResource(resourceC.URN, resourceB.URN, resourceA.URN, resourceB.URN)
+	same := deploy.NewSameStep(nil, nil, resourceC, resourceCUpdated)
+	mutation, err := manager.BeginMutation(same)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(same, true))
+	assert.Empty(t, sp.SavedSnapshots)
+
+	// Dropping one of them is, though.
+	manager, sp = MockSetup(t, snap)
+	resourceCDropped := NewResource(resourceC.URN, resourceA.URN, resourceA.URN)
+	same = deploy.NewSameStep(nil, nil, resourceC, resourceCDropped)
+	mutation, err = manager.BeginMutation(same)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(same, true))
+	assert.Len(t, sp.SavedSnapshots, 1)
+}
+
 // This test checks that we only write the Checkpoint once whether or
 // not there are important changes when asked to via
 // env.SkipCheckpoints.
@@ -311,6 +458,37 @@ func TestWriteCheckpointOnceUnsafe(t *testing.T) {
 	// DEFAULT behavior would cause more than 1 snapshot to be written,
 	// but the provided flag should only create 1 Snapshot
 	assert.Len(t, sp.SavedSnapshots, 1)
+
+	// Each of the three mutations skipped its write, leaving only the write on Close.
+	assert.Equal(t, ManagerStats{Mutations: 3, WritesPerformed: 1, WritesSkipped: 3}, manager.Stats())
+}
+
+func TestManagerStats(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResource(aUniqueUrnResourceA)
+	snap := NewSnapshot([]*resource.State{resourceA})
+	manager, sp := MockSetup(t, snap)
+	assert.Equal(t, ManagerStats{}, manager.Stats())
+
+	// A create writes both when it begins and when it ends.
+	resourceB := NewResource(aUniqueUrnResourceB)
+	create := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceB)
+	mutation, err := manager.BeginMutation(create)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(create, true))
+	assert.Equal(t, ManagerStats{Mutations: 2, WritesPerformed: 2}, manager.Stats())
+
+	// A same with no meaningful changes elides its write until Close.
+	same := deploy.NewSameStep(nil, nil, resourceA, NewResource(resourceA.URN))
+	mutation, err = manager.BeginMutation(same)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(same, true))
+	assert.Equal(t, ManagerStats{Mutations: 3, WritesPerformed: 2, WritesSkipped: 1}, manager.Stats())
+
+	require.NoError(t, manager.Close())
+	assert.Equal(t, ManagerStats{Mutations: 3, WritesPerformed: 3, WritesSkipped: 1}, manager.Stats())
+	assert.Len(t, sp.SavedSnapshots, 3)
 }
 
 // This test exercises same steps with meaningful changes to properties _other_ than `Dependencies` in order to ensure
@@ -332,10 +510,7 @@ func TestSamesWithOtherMeaningfulChanges(t *testing.T) {
 
 	// Change the parent, this also has to change the URN.
 	changes = append(changes, NewResource(resourceA.URN))
-	changes[1].URN = resource.NewURN(
-		resourceA.URN.Stack(), resourceA.URN.Project(),
-		resourceP.URN.QualifiedType(), resourceA.URN.Type(),
-		resourceA.URN.Name())
+	changes[1].URN = resourceA.URN.WithParent(resourceP.URN.QualifiedType())
 	changes[1].Parent = resourceP.URN
 
 	// Change the "protect" bit.
@@ -346,6 +521,10 @@ func TestSamesWithOtherMeaningfulChanges(t *testing.T) {
 	changes = append(changes, NewResource(resourceA.URN))
 	changes[3].Outputs = resource.PropertyMap{"foo": resource.NewStringProperty("bar")}
 
+	// Turn the resource into a view of p.
+	changes = append(changes, NewResource(resourceA.URN))
+	changes[4].ViewOf = resourceP.URN
+
 	snap := NewSnapshot([]*resource.State{
 		provider,
 		resourceP,
@@ -481,6 +660,30 @@ func TestSamesWithOtherMeaningfulChanges(t *testing.T) {
 	}
 }
 
+// This test exercises same steps whose only input changes are values becoming secret (or no longer being secret) in
+// order to ensure that the write is elided until the next write or Close.
+func TestSamesWithSecretWrappedInputs(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResourceWithInputs("a", resource.PropertyMap{"key": resource.NewStringProperty("value")})
+	snap := NewSnapshot([]*resource.State{resourceA})
+	manager, sp := MockSetup(t, snap)
+
+	aUpdated := NewResourceWithInputs("a", resource.PropertyMap{
+		"key": resource.MakeSecret(resource.NewStringProperty("value")),
+	})
+	aSame := deploy.NewSameStep(nil, nil, resourceA, aUpdated)
+	mutation, err := manager.BeginMutation(aSame)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(aSame, true))
+	assert.Empty(t, sp.SavedSnapshots)
+
+	// The secret-wrapped inputs are still flushed on close.
+	require.NoError(t, manager.Close())
+	require.Len(t, sp.SavedSnapshots, 1)
+	assert.True(t, sp.LastSnap().Resources[0].Inputs["key"].IsSecret())
+}
+
 // This test exercises the merge operation with a particularly vexing deployment
 // state that was useful in shaking out bugs.
 func TestVexingDeployment(t *testing.T) {
@@ -624,6 +827,57 @@ func TestVexingDeployment(t *testing.T) {
 	assert.Equal(t, c.URN, res[5].Dependencies[0])
 }
 
+func TestVexingDeploymentReportsReordering(t *testing.T) {
+	t.Parallel()
+
+	// The same deployment as TestVexingDeployment: B is kept, C is replaced and D updated, while A and E are not
+	// touched by the current plan.
+	a := NewResource("a")
+	b := NewResource("b", a.URN)
+	c := NewResource("c", a.URN, b.URN)
+	d := NewResource("d", c.URN)
+	e := NewResource("e", c.URN)
+	snap := NewSnapshot([]*resource.State{a, b, c, d, e})
+
+	manager, sp := MockSetup(t, snap)
+	var events [][]ResourceReorderedEvent
+	manager.ResourceReordered = func(event ResourceReorderedEvent) {
+		events[len(events)-1] = append(events[len(events)-1], event)
+	}
+	applyStep := func(step deploy.Step) {
+		events = append(events, nil)
+		mutation, err := manager.BeginMutation(step)
+		require.NoError(t, err)
+		require.NoError(t, mutation.End(step, true))
+	}
+
+	bPrime := NewResource(b.URN)
+	applyStep(deploy.NewSameStep(nil, MockRegisterResourceEvent{}, b, bPrime))
+	cPrime := NewResource(c.URN, bPrime.URN)
+	createReplacement := deploy.NewCreateReplacementStep(nil, MockRegisterResourceEvent{}, c, cPrime, nil, nil, nil, true)
+	replace := deploy.NewReplaceStep(nil, c, cPrime, nil, nil, nil, true)
+	c.Delete = true
+	applyStep(createReplacement)
+	applyStep(replace)
+	dPrime := NewResource(d.URN, cPrime.URN)
+	applyStep(deploy.NewUpdateStep(nil, MockRegisterResourceEvent{}, d, dPrime, nil, nil, nil, nil, nil))
+
+	// Each resource written by the current plan, including the replacement of C, moves ahead of A, which the plan has
+	// not yet seen. Marking the old C for deletion moves nothing.
+	assert.Equal(t, [][]ResourceReorderedEvent{
+		{{URN: b.URN, OldIndex: 1, NewIndex: 0}},
+		{{URN: c.URN, OldIndex: 2, NewIndex: 1}},
+		nil,
+		{{URN: d.URN, OldIndex: 4, NewIndex: 2}},
+	}, events)
+
+	// The final order matches that checked by TestVexingDeployment.
+	lastSnap := sp.LastSnap()
+	require.Len(t, lastSnap.Resources, 6)
+	assert.Equal(t, a.URN, lastSnap.Resources[3].URN)
+	assert.True(t, lastSnap.Resources[4].Delete)
+}
+
 func TestDeletion(t *testing.T) {
 	t.Parallel()
 
@@ -650,6 +904,47 @@ func TestDeletion(t *testing.T) {
 	assert.Len(t, lastSnap.Resources, 0)
 }
 
+func TestRetainOnDeleteDeletion(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResource("a")
+	resourceA.RetainOnDelete = true
+	resourceA.ID = "id-a"
+	snap := NewSnapshot([]*resource.State{
+		resourceA,
+	})
+
+	manager, sp := MockSetup(t, snap)
+	step := deploy.NewDeleteStep(nil, map[resource.URN]bool{}, resourceA, nil)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+
+	// Retaining a resource doesn't touch the provider, so no pending operation should have been recorded.
+	for _, saved := range sp.SavedSnapshots {
+		assert.Empty(t, saved.PendingOperations)
+	}
+
+	err = mutation.End(step, true)
+	require.NoError(t, err)
+
+	// The resource should be gone from the snapshot, with a record that it was retained rather than deleted.
+	lastSnap := sp.SavedSnapshots[len(sp.SavedSnapshots)-1]
+	assert.Len(t, lastSnap.Resources, 0)
+	assert.Empty(t, lastSnap.PendingOperations)
+	assert.Equal(t, []deploy.RetainedResource{{
+		URN:  resourceA.URN,
+		Type: resourceA.Type,
+		ID:   "id-a",
+	}}, lastSnap.Metadata.RetainedResources)
+
+	// The record should survive a round trip through the deployment format.
+	deployment, err := stack.SerializeDeployment(context.Background(), lastSnap, false)
+	require.NoError(t, err)
+	deserialized, err := stack.DeserializeDeploymentV3(context.Background(), *deployment, b64.Base64SecretsProvider)
+	require.NoError(t, err)
+	assert.Equal(t, lastSnap.Metadata.RetainedResources, deserialized.Metadata.RetainedResources)
+}
+
 func TestFailedDelete(t *testing.T) {
 	t.Parallel()
 
@@ -677,6 +972,147 @@ func TestFailedDelete(t *testing.T) {
 	assert.Equal(t, resourceA.URN, lastSnap.Resources[0].URN)
 }
 
+func TestPropertyDependenciesOnlyOrdering(t *testing.T) {
+	t.Parallel()
+
+	// B depends on A solely through a property dependency.
+	resourceA := NewResource("a")
+	resourceB := NewResource("b")
+	resourceB.PropertyDependencies = map[resource.PropertyKey][]resource.URN{
+		"input": {resourceA.URN},
+	}
+	snap := NewSnapshot([]*resource.State{resourceA, resourceB})
+	manager, sp := MockSetup(t, snap)
+
+	// Retire B before A has been touched, so that B comes first in the list of resources operated upon by the plan.
+	resourceBUpdated := NewResource("b")
+	resourceBUpdated.PropertyDependencies = resourceB.PropertyDependencies
+	same := deploy.NewSameStep(nil, nil, resourceB, resourceBUpdated)
+	mutation, err := manager.BeginMutation(same)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(same, true))
+	require.NoError(t, manager.Close())
+
+	// A must still precede B.
+	written := sp.LastSnap()
+	require.Len(t, written.Resources, 2)
+	assert.Same(t, resourceA, written.Resources[0])
+	assert.Same(t, resourceBUpdated, written.Resources[1])
+	assert.NoError(t, written.VerifyIntegrity())
+}
+
+func TestDeletedWithOnlyOrdering(t *testing.T) {
+	t.Parallel()
+
+	// B is deleted with A, but has no other relationship to it.
+	resourceA := NewResource("a")
+	resourceB := NewResource("b")
+	resourceB.DeletedWith = resourceA.URN
+	snap := NewSnapshot([]*resource.State{resourceA, resourceB})
+	manager, sp := MockSetup(t, snap)
+
+	resourceBUpdated := NewResource("b")
+	resourceBUpdated.DeletedWith = resourceA.URN
+	same := deploy.NewSameStep(nil, nil, resourceB, resourceBUpdated)
+	mutation, err := manager.BeginMutation(same)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(same, true))
+	require.NoError(t, manager.Close())
+
+	written := sp.LastSnap()
+	require.Len(t, written.Resources, 2)
+	assert.Same(t, resourceA, written.Resources[0])
+	assert.Same(t, resourceBUpdated, written.Resources[1])
+	assert.NoError(t, written.VerifyIntegrity())
+}
+
+func TestMutationGuardBlocksProtectedDelete(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResource("a")
+	resourceA.Protect = true
+	snap := NewSnapshot([]*resource.State{
+		resourceA,
+	})
+
+	manager, sp := MockSetup(t, snap)
+	// Exercise the guard rather than the manager's own protected delete check.
+	manager.AllowProtectedDeletes = true
+	manager.MutationGuard = func(step deploy.Step) error {
+		if step.Op() == deploy.OpDelete && step.Old().Protect {
+			return fmt.Errorf("resource %s is protected", step.URN())
+		}
+		return nil
+	}
+
+	step := deploy.NewDeleteStep(nil, map[resource.URN]bool{}, resourceA, nil)
+	mutation, err := manager.BeginMutation(step)
+	assert.ErrorContains(t, err, "resource a is protected")
+	assert.Nil(t, mutation)
+
+	// The vetoed mutation should not have recorded a pending operation.
+	assert.Empty(t, sp.SavedSnapshots)
+
+	err = manager.Close()
+	require.NoError(t, err)
+
+	// The protected resource must still be in the snapshot.
+	lastSnap := sp.LastSnap()
+	assert.Len(t, lastSnap.Resources, 1)
+	assert.Len(t, lastSnap.PendingOperations, 0)
+	assert.Equal(t, resourceA.URN, lastSnap.Resources[0].URN)
+}
+
+func TestProtectedDeleteRejected(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResource("a")
+	resourceA.Protect = true
+	snap := NewSnapshot([]*resource.State{
+		resourceA,
+	})
+
+	manager, sp := MockSetup(t, snap)
+
+	step := deploy.NewDeleteStep(nil, map[resource.URN]bool{}, resourceA, nil)
+	mutation, err := manager.BeginMutation(step)
+	assert.ErrorContains(t, err, "resource a is protected and cannot be deleted")
+	assert.Nil(t, mutation)
+	assert.Empty(t, sp.SavedSnapshots)
+
+	// With the override set, the delete goes ahead.
+	manager.AllowProtectedDeletes = true
+	mutation, err = manager.BeginMutation(step)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(step, true))
+	require.NoError(t, manager.Close())
+
+	assert.Empty(t, sp.LastSnap().Resources)
+}
+
+func TestUnprotectAndReplaceAllowed(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResource("a")
+	resourceA.Protect = true
+	resourceA.Delete = true
+	snap := NewSnapshot([]*resource.State{
+		resourceA,
+	})
+
+	manager, sp := MockSetup(t, snap)
+
+	// Deleting the replaced resource is allowed even though its old state is still protected.
+	step := deploy.NewDeleteReplacementStep(nil, map[resource.URN]bool{}, resourceA, false, nil)
+	assert.Equal(t, deploy.OpDeleteReplaced, step.Op())
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(step, true))
+	require.NoError(t, manager.Close())
+
+	assert.Empty(t, sp.LastSnap().Resources)
+}
+
 func TestRecordingCreateSuccess(t *testing.T) {
 	t.Parallel()
 
@@ -742,51 +1178,167 @@ func TestRecordingCreateFailure(t *testing.T) {
 	assert.Len(t, snap.PendingOperations, 0)
 }
 
-func TestRecordingUpdateSuccess(t *testing.T) {
+func TestRecordingInitErrors(t *testing.T) {
 	t.Parallel()
 
 	resourceA := NewResource("a")
-	resourceA.Inputs["key"] = resource.NewStringProperty("old")
-	resourceANew := NewResource("a")
-	resourceANew.Inputs["key"] = resource.NewStringProperty("new")
-	snap := NewSnapshot([]*resource.State{
-		resourceA,
-	})
+	manager, sp := MockSetup(t, NewSnapshot(nil))
 
-	manager, sp := MockSetup(t, snap)
-	step := deploy.NewUpdateStep(nil, &MockRegisterResourceEvent{}, resourceA, resourceANew, nil, nil, nil, nil, nil)
-	mutation, err := manager.BeginMutation(step)
-	if !assert.NoError(t, err) {
-		t.FailNow()
-	}
+	// A create that fails to initialize the resource is a partial failure: the resource exists, so it is recorded
+	// along with the errors reported by its provider.
+	resourceA.InitErrors = []string{"init failed"}
+	create := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceA)
+	mutation, err := manager.BeginMutation(create)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(create, true /* successful */))
 
-	// Beginning the update mutation should have placed a pending "updating" operation into
-	// the operations list, with the resource's new inputs.
-	snap = sp.LastSnap()
-	assert.Len(t, snap.Resources, 1)
-	assert.Len(t, snap.PendingOperations, 1)
-	assert.Equal(t, resourceA.URN, snap.PendingOperations[0].Resource.URN)
-	assert.Equal(t, resource.OperationTypeUpdating, snap.PendingOperations[0].Type)
-	assert.Equal(t, resource.NewStringProperty("new"), snap.PendingOperations[0].Resource.Inputs["key"])
+	snap := sp.LastSnap()
+	require.Len(t, snap.Resources, 1)
+	assert.Equal(t, []string{"init failed"}, snap.Resources[0].InitErrors)
 
-	err = mutation.End(step, true /* successful */)
-	if !assert.NoError(t, err) {
-		t.FailNow()
-	}
+	// The errors survive serialization, so that the next deployment knows to retry the initialization.
+	deployment, err := stack.SerializeDeployment(context.Background(), snap, false /* showSecrets */)
+	require.NoError(t, err)
+	bytes, err := json.Marshal(deployment)
+	require.NoError(t, err)
+	var persisted apitype.DeploymentV3
+	require.NoError(t, json.Unmarshal(bytes, &persisted))
+	deserialized, err := stack.DeserializeDeploymentV3(context.Background(), persisted, b64.Base64SecretsProvider)
+	require.NoError(t, err)
+	require.Len(t, deserialized.Resources, 1)
+	assert.Equal(t, []string{"init failed"}, deserialized.Resources[0].InitErrors)
+
+	// A subsequent update that initializes the resource successfully clears them.
+	resourceAPrime := NewResource(resourceA.URN)
+	update := deploy.NewUpdateStep(nil, &MockRegisterResourceEvent{}, resourceA, resourceAPrime, nil, nil, nil, nil, nil)
+	mutation, err = manager.BeginMutation(update)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(update, true /* successful */))
 
-	// Completing the update should place the resource with the new inputs into the snapshot and clear the in
-	// flight operation.
 	snap = sp.LastSnap()
-	assert.Len(t, snap.Resources, 1)
-	assert.Len(t, snap.PendingOperations, 0)
-	assert.Equal(t, resourceA.URN, snap.Resources[0].URN)
-	assert.Equal(t, resource.NewStringProperty("new"), snap.Resources[0].Inputs["key"])
+	require.Len(t, snap.Resources, 1)
+	assert.Empty(t, snap.Resources[0].InitErrors)
 }
 
-func TestRecordingUpdateFailure(t *testing.T) {
+func TestRecordingCreateRedactsPendingOperationInputs(t *testing.T) {
 	t.Parallel()
 
-	resourceA := NewResource("a")
+	resourceA := NewResourceWithInputs("a", resource.PropertyMap{
+		"name":     resource.NewStringProperty("a"),
+		"password": resource.MakeSecret(resource.NewStringProperty("hunter2")),
+	})
+	snap := NewSnapshot(nil)
+	manager, sp := MockSetup(t, snap)
+	manager.RedactPendingOperationInputs = func(inputs resource.PropertyMap) resource.PropertyMap {
+		redacted := make(resource.PropertyMap, len(inputs))
+		for k, v := range inputs {
+			if v.ContainsSecrets() {
+				v = resource.NewStringProperty("[redacted]")
+			}
+			redacted[k] = v
+		}
+		return redacted
+	}
+	step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceA)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+
+	// The pending "creating" operation should have its secret input redacted, while the resource itself (which
+	// belongs to the engine) is left untouched.
+	snap = sp.LastSnap()
+	require.Len(t, snap.PendingOperations, 1)
+	assert.Equal(t, resource.PropertyMap{
+		"name":     resource.NewStringProperty("a"),
+		"password": resource.NewStringProperty("[redacted]"),
+	}, snap.PendingOperations[0].Resource.Inputs)
+	assert.True(t, resourceA.Inputs["password"].IsSecret())
+
+	err = mutation.End(step, true /* successful */)
+	require.NoError(t, err)
+
+	// Once the create has completed, the resource is persisted with its inputs intact.
+	snap = sp.LastSnap()
+	assert.Len(t, snap.PendingOperations, 0)
+	require.Len(t, snap.Resources, 1)
+	assert.True(t, snap.Resources[0].Inputs["password"].IsSecret())
+}
+
+func TestRedactedPendingOperationKeepsSecretsManager(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResourceWithInputs("a", resource.PropertyMap{
+		"password": resource.MakeSecret(resource.NewStringProperty("hunter2")),
+	})
+	snap := NewSnapshot([]*resource.State{resourceA})
+
+	sp := &MockStackPersister{}
+	manager := NewSnapshotManager(sp, &nonceSecretsManager{}, snap)
+	manager.LazySecretsMigration = true
+	manager.RedactPendingOperationInputs = func(inputs resource.PropertyMap) resource.PropertyMap {
+		return resource.PropertyMap{}
+	}
+
+	step := deploy.NewDeleteStep(nil, map[resource.URN]bool{}, resourceA, nil)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+
+	// The redacted copy of a, which has not yet been migrated, is still encrypted with the old secrets manager.
+	written := sp.LastSnap()
+	require.Len(t, written.PendingOperations, 1)
+	op := written.PendingOperations[0]
+	assert.NotSame(t, resourceA, op.Resource)
+	assert.Empty(t, op.Resource.Inputs)
+	assert.Equal(t, snap.SecretsManager, written.ResourceSecretsManagers[op.Resource])
+
+	require.NoError(t, mutation.End(step, true))
+	require.NoError(t, manager.Close())
+}
+
+func TestRecordingUpdateSuccess(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResource("a")
+	resourceA.Inputs["key"] = resource.NewStringProperty("old")
+	resourceANew := NewResource("a")
+	resourceANew.Inputs["key"] = resource.NewStringProperty("new")
+	snap := NewSnapshot([]*resource.State{
+		resourceA,
+	})
+
+	manager, sp := MockSetup(t, snap)
+	step := deploy.NewUpdateStep(nil, &MockRegisterResourceEvent{}, resourceA, resourceANew, nil, nil, nil, nil, nil)
+	mutation, err := manager.BeginMutation(step)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// Beginning the update mutation should have placed a pending "updating" operation into
+	// the operations list, with the resource's new inputs.
+	snap = sp.LastSnap()
+	assert.Len(t, snap.Resources, 1)
+	assert.Len(t, snap.PendingOperations, 1)
+	assert.Equal(t, resourceA.URN, snap.PendingOperations[0].Resource.URN)
+	assert.Equal(t, resource.OperationTypeUpdating, snap.PendingOperations[0].Type)
+	assert.Equal(t, resource.NewStringProperty("new"), snap.PendingOperations[0].Resource.Inputs["key"])
+
+	err = mutation.End(step, true /* successful */)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// Completing the update should place the resource with the new inputs into the snapshot and clear the in
+	// flight operation.
+	snap = sp.LastSnap()
+	assert.Len(t, snap.Resources, 1)
+	assert.Len(t, snap.PendingOperations, 0)
+	assert.Equal(t, resourceA.URN, snap.Resources[0].URN)
+	assert.Equal(t, resource.NewStringProperty("new"), snap.Resources[0].Inputs["key"])
+}
+
+func TestRecordingUpdateFailure(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResource("a")
 	resourceA.Inputs["key"] = resource.NewStringProperty("old")
 	resourceANew := NewResource("a")
 	resourceANew.Inputs["key"] = resource.NewStringProperty("new")
@@ -920,6 +1472,75 @@ func TestRecordingReadSuccessNoPreviousResource(t *testing.T) {
 	assert.Len(t, snap.Resources, 1)
 	assert.Len(t, snap.PendingOperations, 0)
 	assert.Equal(t, resourceA.URN, snap.Resources[0].URN)
+
+	// A read resource is external to the stack; it has not been imported.
+	assert.False(t, snap.Resources[0].Imported)
+	assert.Empty(t, snap.Resources[0].ImportID)
+}
+
+func TestRecordingImportSuccess(t *testing.T) {
+	t.Parallel()
+
+	provider := NewResource("urn:pulumi:foo::bar::pulumi:providers:pkgA::provider")
+	provider.Custom, provider.Type, provider.ID = true, "pulumi:providers:pkgA", "id"
+	providerRef := "urn:pulumi:foo::bar::pulumi:providers:pkgA::provider::id"
+
+	// sameProvider registers the provider unchanged.
+	sameProvider := func(manager *SnapshotManager) {
+		providerUpdated := NewResource(provider.URN)
+		providerUpdated.Custom, providerUpdated.Type = true, provider.Type
+		step := deploy.NewSameStep(nil, nil, provider, providerUpdated)
+		mutation, err := manager.BeginMutation(step)
+		require.NoError(t, err)
+		_, _, err = step.Apply()
+		require.NoError(t, err)
+		require.NoError(t, mutation.End(step, true))
+	}
+
+	resourceA := NewResource(aUniqueUrnResourceA)
+	resourceA.Custom, resourceA.Provider = true, providerRef
+	resourceA.ImportID = "some-a"
+	snap := NewSnapshot([]*resource.State{provider})
+	manager, sp := MockSetup(t, snap)
+	sameProvider(manager)
+	step := deploy.NewImportStep(nil, nil, resourceA, nil, []byte{}, nil)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+
+	// Applying the import assigns the resource its ID and marks it as imported (see TestImportedFlag in the
+	// lifecycle tests). Here we stand in for it, and only check that the manager persists the flag.
+	resourceA.ID = "some-a"
+	resourceA.Imported = true
+	require.NoError(t, mutation.End(step, true))
+	require.NoError(t, manager.Close())
+
+	snap = sp.LastSnap()
+	require.Len(t, snap.Resources, 2)
+	assert.Empty(t, snap.PendingOperations)
+	imported := snap.Resources[1]
+	assert.True(t, imported.Imported)
+	assert.Equal(t, resource.ID("some-a"), imported.ImportID)
+
+	// The provenance survives serialization.
+	serialized, err := stack.SerializeResource(context.Background(), imported, config.NopEncrypter, false)
+	require.NoError(t, err)
+	deserialized, err := stack.DeserializeResource(serialized, config.NopDecrypter)
+	require.NoError(t, err)
+	assert.True(t, deserialized.Imported)
+	assert.Equal(t, resource.ID("some-a"), deserialized.ImportID)
+
+	// Provenance alone is not a meaningful change.
+	manager, sp = MockSetup(t, snap)
+	sameProvider(manager)
+	resourceAUpdated := NewResource(resourceA.URN)
+	resourceAUpdated.Custom, resourceAUpdated.Provider = true, providerRef
+	same := deploy.NewSameStep(nil, nil, imported, resourceAUpdated)
+	mutation, err = manager.BeginMutation(same)
+	require.NoError(t, err)
+	_, _, err = same.Apply()
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(same, true))
+	assert.Empty(t, sp.SavedSnapshots)
 }
 
 func TestRecordingReadSuccessPreviousResource(t *testing.T) {
@@ -969,6 +1590,90 @@ func TestRecordingReadSuccessPreviousResource(t *testing.T) {
 	assert.Equal(t, resource.NewStringProperty("new"), snap.Resources[0].Inputs["key"])
 }
 
+func TestRecordingReadPreserveOutputs(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResource("c")
+	resourceA.ID = "some-c"
+	resourceA.External = true
+	resourceA.Custom = true
+	resourceA.Outputs = resource.PropertyMap{
+		"clientTag": resource.NewStringProperty("mine"),
+		"status":    resource.NewStringProperty("old"),
+	}
+	resourceANew := NewResource("c")
+	resourceANew.ID = "some-c"
+	resourceANew.External = true
+	resourceANew.Custom = true
+	resourceANew.Outputs = resource.PropertyMap{
+		"clientTag": resource.NewStringProperty("theirs"),
+		"status":    resource.NewStringProperty("new"),
+	}
+
+	snap := NewSnapshot([]*resource.State{
+		resourceA,
+	})
+	manager, sp := MockSetup(t, snap)
+	manager.PreserveReadOutputs = []resource.PropertyKey{"clientTag", "missing"}
+	step := deploy.NewReadStep(nil, nil, resourceA, resourceANew)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+	err = mutation.End(step, true /* successful */)
+	require.NoError(t, err)
+
+	// The preserved key keeps its old value, while everything else is replaced by what was read. Keys that the old
+	// state didn't have are not introduced.
+	snap = sp.LastSnap()
+	require.Len(t, snap.Resources, 1)
+	assert.Equal(t, resource.PropertyMap{
+		"clientTag": resource.NewStringProperty("mine"),
+		"status":    resource.NewStringProperty("new"),
+	}, snap.Resources[0].Outputs)
+}
+
+func TestRecordingReadCompletesPendingImport(t *testing.T) {
+	t.Parallel()
+
+	resourceC := NewResource(aUniqueUrnResourceB)
+	resourceC.ID = "some-c"
+	resourceC.External = true
+	resourceC.Custom = true
+
+	// The pending imports name resources that are not yet in the snapshot, which the integrity check must allow.
+	snap := NewSnapshot(nil)
+	snap.PendingImports = []deploy.PendingImport{
+		{URN: resourceC.URN, Type: resourceC.Type, ID: resourceC.ID},
+		{URN: aUniqueUrnResourceA, Type: "pkg:typ", ID: "some-a"},
+	}
+	manager, sp := MockSetup(t, snap)
+
+	step := deploy.NewReadStep(nil, nil, nil, resourceC)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+
+	// The import remains pending while the read is in flight.
+	assert.Equal(t, snap.PendingImports, sp.LastSnap().PendingImports)
+
+	err = mutation.End(step, true /* successful */)
+	require.NoError(t, err)
+
+	// Once the read succeeds, the resource is in the snapshot and its import is no longer pending.
+	written := sp.LastSnap()
+	require.NoError(t, written.VerifyIntegrity())
+	require.Len(t, written.Resources, 1)
+	assert.Equal(t, resourceC.URN, written.Resources[0].URN)
+	assert.Equal(t, []deploy.PendingImport{
+		{URN: aUniqueUrnResourceA, Type: "pkg:typ", ID: "some-a"},
+	}, written.PendingImports)
+
+	// The remaining pending import survives serialization, so the import can be resumed later.
+	deployment, err := stack.SerializeDeployment(context.Background(), written, false)
+	require.NoError(t, err)
+	deserialized, err := stack.DeserializeDeploymentV3(context.Background(), *deployment, b64.Base64SecretsProvider)
+	require.NoError(t, err)
+	assert.Equal(t, written.PendingImports, deserialized.PendingImports)
+}
+
 func TestRecordingReadFailureNoPreviousResource(t *testing.T) {
 	t.Parallel()
 
@@ -1130,6 +1835,34 @@ func TestSnapshotIntegrityErrorMetadataIsWrittenForInvalidSnapshots(t *testing.T
 	assert.NotNil(t, sp.LastSnap().Metadata.IntegrityErrorMetadata)
 }
 
+func TestSnapshotIntegrityErrorMetadataRedactsSecrets(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	//
+	// The resource's name is also one of its secret inputs, so it appears in the missing dependency error by way of
+	// the resource's URN.
+	r := NewResource("hunter2", "b")
+	r.Inputs = resource.PropertyMap{
+		"name": resource.MakeSecret(resource.NewStringProperty("hunter2")),
+	}
+	snap := NewSnapshot([]*resource.State{r})
+	sp := &MockStackPersister{}
+	sm := NewSnapshotManager(sp, snap.SecretsManager, snap)
+	sm.RedactIntegrityErrorSecrets = true
+
+	// Act.
+	err := sm.saveSnapshot()
+
+	// Assert.
+	assert.ErrorContains(t, err, "failed to verify snapshot")
+	metadata := sp.LastSnap().Metadata.IntegrityErrorMetadata
+	require.NotNil(t, metadata)
+	assert.NotContains(t, metadata.Error, "hunter2")
+	assert.Contains(t, metadata.Error, "[secret]")
+	assert.NotContains(t, metadata.Command, "hunter2")
+}
+
 func TestSnapshotIntegrityErrorMetadataIsClearedForValidSnapshots(t *testing.T) {
 	t.Parallel()
 
@@ -1195,3 +1928,1953 @@ func TestSnapshotIntegrityErrorMetadataIsClearedForValidSnapshotsChecksDisabled(
 	assert.NoError(t, err)
 	assert.Nil(t, sp.LastSnap().Metadata.IntegrityErrorMetadata)
 }
+
+func TestDeferIntegrityUntilClose(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	resourceA := NewResource(aUniqueUrnResourceA)
+	snap := NewSnapshot([]*resource.State{resourceA})
+	manager, sp := MockSetup(t, snap)
+	manager.DeferIntegrityUntilClose = true
+
+	// Act.
+	//
+	// The dependency of resourceB does not exist in the snapshot, so every snapshot written once it has been created is
+	// corrupt, but the corruption is only caught when the manager is closed.
+	resourceB := NewResource(aUniqueUrnResourceB, "urn:pulumi:foo::bar::pkgA:m:typA::missing")
+	step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceB)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(step, true))
+	require.Len(t, sp.SavedSnapshots, 2)
+	assert.Nil(t, sp.LastSnap().Metadata.IntegrityErrorMetadata)
+
+	err = manager.Close()
+
+	// Assert.
+	assert.ErrorContains(t, err, "failed to verify snapshot")
+	require.Len(t, sp.SavedSnapshots, 3)
+	assert.NotNil(t, sp.LastSnap().Metadata.IntegrityErrorMetadata)
+}
+
+func TestIncrementalIntegrityVerification(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	resourceA := NewResource(aUniqueUrnResourceA)
+	snap := NewSnapshot([]*resource.State{resourceA})
+	manager, sp := MockSetup(t, snap)
+	applyStep := func(step deploy.Step) {
+		mutation, err := manager.BeginMutation(step)
+		require.NoError(t, err)
+		require.NoError(t, mutation.End(step, true))
+	}
+
+	// The first write verifies the whole snapshot.
+	resourceB := NewResource(aUniqueUrnResourceB)
+	applyStep(deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceB))
+
+	// Act.
+	//
+	// Corrupt a resource that the next write does not touch. Only the changed resource is verified, so the corruption
+	// goes unnoticed...
+	resourceA.Dependencies = []resource.URN{"urn:pulumi:foo::bar::pkgA:m:typA::missing"}
+	resourceP := NewResource(aUniqueUrnResourceP)
+	applyStep(deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceP))
+	assert.Nil(t, sp.LastSnap().Metadata.IntegrityErrorMetadata)
+
+	// ...until the snapshot is verified in full when the manager is closed.
+	same := deploy.NewSameStep(nil, &MockRegisterResourceEvent{}, resourceB, NewResource(aUniqueUrnResourceB))
+	applyStep(same)
+	err := manager.Close()
+
+	// Assert.
+	assert.ErrorContains(t, err, "failed to verify snapshot")
+	assert.NotNil(t, sp.LastSnap().Metadata.IntegrityErrorMetadata)
+}
+
+type MockSyncingStackPersister struct {
+	MockStackPersister
+
+	// The number of saved snapshots at the time of each call to Sync.
+	Syncs []int
+}
+
+func (m *MockSyncingStackPersister) Sync() error {
+	m.Syncs = append(m.Syncs, len(m.SavedSnapshots))
+	return nil
+}
+
+func TestSyncCalledAfterEachWrite(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResource("a")
+	resourceB := NewResource("b")
+	replacementA := NewResource("a")
+	snap := NewSnapshot([]*resource.State{
+		resourceA,
+	})
+
+	sp := &MockSyncingStackPersister{}
+	manager := NewSnapshotManager(sp, snap.SecretsManager, snap)
+
+	applyStep := func(step deploy.Step) {
+		mutation, err := manager.BeginMutation(step)
+		require.NoError(t, err)
+		err = mutation.End(step, true)
+		require.NoError(t, err)
+	}
+
+	applyStep(deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceB))
+	// As the engine does for a create-before-delete replacement, the old resource is marked for deletion when its
+	// replacement is created.
+	createReplacement := deploy.NewCreateReplacementStep(
+		nil, &MockRegisterResourceEvent{}, resourceA, replacementA, nil, nil, nil, true)
+	resourceA.Delete = true
+	applyStep(createReplacement)
+	applyStep(deploy.NewDeleteReplacementStep(nil, map[resource.URN]bool{}, resourceA, false, nil))
+
+	err := manager.Close()
+	require.NoError(t, err)
+
+	// Every write must have been followed by exactly one sync, before the next write.
+	require.NotEmpty(t, sp.SavedSnapshots)
+	expected := make([]int, len(sp.SavedSnapshots))
+	for i := range expected {
+		expected[i] = i + 1
+	}
+	assert.Equal(t, expected, sp.Syncs)
+}
+
+type failingSyncer struct {
+	MockStackPersister
+}
+
+func (*failingSyncer) Sync() error {
+	return errors.New("disk on fire")
+}
+
+func TestSyncErrorIsReturned(t *testing.T) {
+	t.Parallel()
+
+	snap := NewSnapshot([]*resource.State{NewResource("a")})
+	sp := &failingSyncer{}
+	sm := NewSnapshotManager(sp, snap.SecretsManager, snap)
+
+	err := sm.saveSnapshot()
+	assert.ErrorContains(t, err, "failed to sync snapshot: disk on fire")
+	assert.Len(t, sp.SavedSnapshots, 1)
+}
+
+// nonceSecretsManager is a secrets.Manager that, like many real managers, produces a different ciphertext every time
+// it encrypts a value.
+type nonceSecretsManager struct {
+	nonce int
+}
+
+func (m *nonceSecretsManager) Type() string                { return "nonce" }
+func (m *nonceSecretsManager) State() json.RawMessage      { return nil }
+func (m *nonceSecretsManager) Encrypter() config.Encrypter { return m }
+func (m *nonceSecretsManager) Decrypter() config.Decrypter { return m }
+func (m *nonceSecretsManager) EncryptValue(_ context.Context, plaintext string) (string, error) {
+	m.nonce++
+	return fmt.Sprintf("%d:%s", m.nonce, plaintext), nil
+}
+
+func (m *nonceSecretsManager) BatchEncrypt(ctx context.Context, plaintexts []string) ([]string, error) {
+	return config.DefaultBatchEncrypt(ctx, m, plaintexts)
+}
+
+func (m *nonceSecretsManager) DecryptValue(_ context.Context, ciphertext string) (string, error) {
+	_, plaintext, _ := strings.Cut(ciphertext, ":")
+	return plaintext, nil
+}
+
+func (m *nonceSecretsManager) BatchDecrypt(ctx context.Context, ciphertexts []string) ([]string, error) {
+	return config.DefaultBatchDecrypt(ctx, m, ciphertexts)
+}
+
+// MockSerializingStackPersister serializes each saved snapshot, recording the ciphertext of the "password" output of
+// the first resource.
+type MockSerializingStackPersister struct {
+	Ciphertexts []string
+}
+
+func (m *MockSerializingStackPersister) Save(snap *deploy.Snapshot) error {
+	deployment, err := stack.SerializeDeployment(context.Background(), snap, false /* showSecrets */)
+	if err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(deployment.Resources[0].Outputs["password"])
+	if err != nil {
+		return err
+	}
+	var secret apitype.SecretV1
+	if err := json.Unmarshal(bytes, &secret); err != nil {
+		return err
+	}
+	m.Ciphertexts = append(m.Ciphertexts, secret.Ciphertext)
+	return nil
+}
+
+func TestStableSecretCiphertexts(t *testing.T) {
+	t.Parallel()
+
+	setup := func(stable bool) (*SnapshotManager, *MockSerializingStackPersister, *resource.State) {
+		r := NewResource("a")
+		r.Outputs["password"] = resource.MakeSecret(resource.NewStringProperty("hunter2"))
+		snap := NewSnapshot([]*resource.State{r})
+		snap.SecretsManager = &nonceSecretsManager{}
+
+		sp := &MockSerializingStackPersister{}
+		sm := NewSnapshotManager(sp, snap.SecretsManager, snap)
+		sm.StableSecretCiphertexts = stable
+		return sm, sp, r
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		t.Parallel()
+
+		sm, sp, r := setup(true)
+		require.NoError(t, sm.saveSnapshot())
+		require.NoError(t, sm.saveSnapshot())
+
+		// Unchanged secrets must keep the same ciphertext across writes.
+		require.Len(t, sp.Ciphertexts, 2)
+		assert.Equal(t, sp.Ciphertexts[0], sp.Ciphertexts[1])
+
+		// A changed secret must be re-encrypted.
+		r.Outputs["password"] = resource.MakeSecret(resource.NewStringProperty("hunter3"))
+		require.NoError(t, sm.saveSnapshot())
+		require.Len(t, sp.Ciphertexts, 3)
+		assert.NotEqual(t, sp.Ciphertexts[1], sp.Ciphertexts[2])
+		assert.Contains(t, sp.Ciphertexts[2], "hunter3")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+
+		sm, sp, _ := setup(false)
+		require.NoError(t, sm.saveSnapshot())
+		require.NoError(t, sm.saveSnapshot())
+
+		// Without the option, every write re-encrypts and so the ciphertext churns.
+		require.Len(t, sp.Ciphertexts, 2)
+		assert.NotEqual(t, sp.Ciphertexts[0], sp.Ciphertexts[1])
+	})
+}
+
+func TestStableSecretCiphertextsAcrossLoad(t *testing.T) {
+	t.Parallel()
+
+	// Arrange: persist a snapshot with a secret output and load it back as a backend would, through a batching
+	// caching secrets manager. The manager that wrote the snapshot has a different nonce to the one that loads it, so
+	// a re-encrypted secret can be told apart from the original.
+	r := NewResource("a")
+	r.Outputs["password"] = resource.MakeSecret(resource.NewStringProperty("hunter2"))
+	original := NewSnapshot([]*resource.State{r})
+	original.SecretsManager = stack.NewBatchingCachingSecretsManager(&nonceSecretsManager{nonce: 100})
+	deployment, err := stack.SerializeDeployment(context.Background(), original, false /* showSecrets */)
+	require.NoError(t, err)
+	var secret apitype.SecretV1
+	encoded, err := json.Marshal(deployment.Resources[0].Outputs["password"])
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(encoded, &secret))
+
+	provider := b64.Base64SecretsProvider.Add("nonce", func(json.RawMessage) (secrets.Manager, error) {
+		return stack.NewBatchingCachingSecretsManager(&nonceSecretsManager{}), nil
+	})
+
+	write := func(stable bool) string {
+		loaded, err := stack.DeserializeDeploymentV3(context.Background(), *deployment, provider)
+		require.NoError(t, err)
+
+		// Act: the program registers a with an unchanged secret, which the engine holds in a fresh state.
+		sp := &MockSerializingStackPersister{}
+		manager := NewSnapshotManager(sp, loaded.SecretsManager, loaded)
+		manager.StableSecretCiphertexts = stable
+		updated := NewResource("a")
+		updated.Outputs["password"] = resource.MakeSecret(resource.NewStringProperty("hunter2"))
+		step := deploy.NewSameStep(nil, nil, loaded.Resources[0], updated)
+		mutation, err := manager.BeginMutation(step)
+		require.NoError(t, err)
+		require.NoError(t, mutation.End(step, true))
+		require.NoError(t, manager.Close())
+
+		require.NotEmpty(t, sp.Ciphertexts)
+		return sp.Ciphertexts[len(sp.Ciphertexts)-1]
+	}
+
+	// Assert: with the option, the secret keeps the ciphertext it was loaded with; without it, it is re-encrypted.
+	assert.Equal(t, secret.Ciphertext, write(true))
+	assert.NotEqual(t, secret.Ciphertext, write(false))
+}
+
+func TestApplyBatchDestroyMatchesStepByStep(t *testing.T) {
+	t.Parallel()
+
+	// Build the vexing graph from TestVexingDeployment afresh for each manager, since the engine's steps refer to the
+	// states in the base snapshot by pointer.
+	newSnap := func() *deploy.Snapshot {
+		a := NewResource("a")
+		b := NewResource("b", a.URN)
+		c := NewResource("c", a.URN, b.URN)
+		d := NewResource("d", c.URN)
+		e := NewResource("e", c.URN)
+		return NewSnapshot([]*resource.State{a, b, c, d, e})
+	}
+
+	// Destroy everything in reverse dependency order, with the final deletion of a failing.
+	newSteps := func(snap *deploy.Snapshot) ([]deploy.Step, []bool) {
+		var steps []deploy.Step
+		var success []bool
+		for i := len(snap.Resources) - 1; i >= 0; i-- {
+			res := snap.Resources[i]
+			steps = append(steps, deploy.NewDeleteStep(nil, map[resource.URN]bool{}, res, nil))
+			success = append(success, res.URN != "a")
+		}
+		return steps, success
+	}
+
+	stepManager, stepPersister := MockSetup(t, newSnap())
+	steps, success := newSteps(stepManager.baseSnapshot)
+	for i, step := range steps {
+		mutation, err := stepManager.BeginMutation(step)
+		require.NoError(t, err)
+		require.NoError(t, mutation.End(step, success[i]))
+	}
+	require.NoError(t, stepManager.Close())
+
+	batchManager, batchPersister := MockSetup(t, newSnap())
+	steps, success = newSteps(batchManager.baseSnapshot)
+	require.NoError(t, batchManager.ApplyBatch(steps, success))
+	assert.Len(t, batchPersister.SavedSnapshots, 1)
+	require.NoError(t, batchManager.Close())
+
+	urns := func(snap *deploy.Snapshot) []resource.URN {
+		var result []resource.URN
+		for _, res := range snap.Resources {
+			result = append(result, res.URN)
+		}
+		return result
+	}
+	stepSnap, batchSnap := stepPersister.LastSnap(), batchPersister.LastSnap()
+	assert.Equal(t, []resource.URN{"a"}, urns(batchSnap))
+	assert.Equal(t, urns(stepSnap), urns(batchSnap))
+	assert.Equal(t, stepSnap.PendingOperations, batchSnap.PendingOperations)
+}
+
+func TestApplyBatchInputValidatorRejects(t *testing.T) {
+	t.Parallel()
+
+	manager, sp := MockSetup(t, NewSnapshot(nil))
+	manager.InputValidator = func(urn resource.URN, inputs resource.PropertyMap) error {
+		if urn == "b" {
+			return errors.New("bad inputs")
+		}
+		return nil
+	}
+
+	steps := []deploy.Step{
+		deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, NewResource("a")),
+		deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, NewResource("b")),
+	}
+	err := manager.ApplyBatch(steps, []bool{true, true})
+	assert.ErrorContains(t, err, "inputs of resource `b` rejected: bad inputs")
+
+	// The rejected batch leaves the snapshot untouched.
+	assert.Empty(t, sp.SavedSnapshots)
+	require.NoError(t, manager.Close())
+	assert.Empty(t, sp.LastSnap().Resources)
+}
+
+func TestLazySecretsMigration(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResource("a")
+	resourceA.Outputs["password"] = resource.MakeSecret(resource.NewStringProperty("hunter2"))
+	resourceB := NewResource("b")
+	resourceB.Outputs["password"] = resource.MakeSecret(resource.NewStringProperty("hunter3"))
+	snap := NewSnapshot([]*resource.State{resourceA, resourceB})
+
+	newSecretsManager := &nonceSecretsManager{}
+	sp := &MockStackPersister{}
+	manager := NewSnapshotManager(sp, newSecretsManager, snap)
+	manager.LazySecretsMigration = true
+
+	// Touch a, but leave b alone.
+	aUpdated := NewResource("a")
+	aUpdated.Outputs["password"] = resource.MakeSecret(resource.NewStringProperty("hunter4"))
+	step := deploy.NewSameStep(nil, nil, resourceA, aUpdated)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(step, true))
+	require.NoError(t, manager.Close())
+
+	// The new snapshot uses the new secrets manager, except for b, which must stay with the old one until it is
+	// touched.
+	written := sp.LastSnap()
+	assert.Equal(t, newSecretsManager, written.SecretsManager)
+	require.Len(t, written.Resources, 2)
+	assert.Equal(t, map[*resource.State]secrets.Manager{
+		resourceB: snap.SecretsManager,
+	}, written.ResourceSecretsManagers)
+	assert.NoError(t, written.VerifyIntegrity())
+}
+
+func TestLazySecretsMigrationPendingOperations(t *testing.T) {
+	t.Parallel()
+
+	// Arrange: a create of b was left pending under the old secrets manager.
+	resourceA := NewResource("a")
+	resourceB := NewResource("b")
+	resourceB.Inputs["password"] = resource.MakeSecret(resource.NewStringProperty("hunter2"))
+	snap := NewSnapshot([]*resource.State{resourceA})
+	snap.PendingOperations = []resource.Operation{
+		resource.NewOperation(resourceB, resource.OperationTypeCreating),
+	}
+
+	newSecretsManager := &nonceSecretsManager{}
+	sp := &MockStackPersister{}
+	manager := NewSnapshotManager(sp, newSecretsManager, snap)
+	manager.LazySecretsMigration = true
+
+	// Act: swap to the new secrets manager by writing the snapshot.
+	step := deploy.NewSameStep(nil, nil, resourceA, NewResource("a"))
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(step, true))
+	require.NoError(t, manager.Close())
+
+	// Assert: the pending operation records the manager it is encrypted with.
+	written := sp.LastSnap()
+	require.Len(t, written.PendingOperations, 1)
+	assert.Equal(t, map[*resource.State]secrets.Manager{
+		resourceB: snap.SecretsManager,
+	}, written.ResourceSecretsManagers)
+
+	deployment, err := stack.SerializeDeployment(context.Background(), written, false /* showSecrets */)
+	require.NoError(t, err)
+	require.Len(t, deployment.PendingOperations, 1)
+	require.NotNil(t, deployment.PendingOperations[0].Resource.SecretsProviders)
+	assert.Equal(t, b64.Type, deployment.PendingOperations[0].Resource.SecretsProviders.Type)
+
+	// Both full and partial deserialization of the persisted form decrypt the operation through its provenance.
+	provider := b64.Base64SecretsProvider.Add("nonce", func(json.RawMessage) (secrets.Manager, error) {
+		return &nonceSecretsManager{}, nil
+	})
+	bytes, err := json.Marshal(deployment)
+	require.NoError(t, err)
+	var persisted apitype.DeploymentV3
+	require.NoError(t, json.Unmarshal(bytes, &persisted))
+
+	deserialized, err := stack.DeserializeDeploymentV3(context.Background(), persisted, provider)
+	require.NoError(t, err)
+	require.Len(t, deserialized.PendingOperations, 1)
+	op := deserialized.PendingOperations[0]
+	assert.Equal(t, resourceB.Inputs, op.Resource.Inputs)
+	assert.Equal(t, b64.Type, deserialized.ResourceSecretsManagers[op.Resource].Type())
+
+	ops, err := stack.DeserializePendingOperations(context.Background(), &apitype.UntypedDeployment{
+		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Deployment: bytes,
+	}, provider)
+	require.NoError(t, err)
+	require.Len(t, ops, 1)
+	assert.Equal(t, resourceB.Inputs, ops[0].Resource.Inputs)
+}
+
+// MockCanonicalStackPersister records the canonical serialization of each saved snapshot.
+type MockCanonicalStackPersister struct {
+	MockStackPersister
+	Canonical [][]byte
+}
+
+func (m *MockCanonicalStackPersister) SaveCanonical(snap *deploy.Snapshot, canonical []byte) error {
+	m.Canonical = append(m.Canonical, canonical)
+	return m.Save(snap)
+}
+
+func TestCanonicalSnapshotPersister(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResource("a")
+	snap := NewSnapshot(nil)
+	sp := &MockCanonicalStackPersister{}
+	manager := NewSnapshotManager(sp, snap.SecretsManager, snap)
+
+	step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceA)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(step, true))
+	require.NoError(t, manager.Close())
+
+	// Every write should have been handed to SaveCanonical, along with the canonical form of the saved snapshot.
+	require.Len(t, sp.Canonical, len(sp.SavedSnapshots))
+	for i, saved := range sp.SavedSnapshots {
+		deployment, err := stack.SerializeDeployment(context.Background(), saved, false /* showSecrets */)
+		require.NoError(t, err)
+		expected, err := stack.MarshalDeployment(deployment, stack.MarshalOptions{Canonical: true})
+		require.NoError(t, err)
+		assert.Equal(t, string(expected), string(sp.Canonical[i]))
+	}
+}
+
+func TestSerializeProgress(t *testing.T) {
+	t.Parallel()
+
+	snap := NewSnapshot([]*resource.State{
+		NewResource("a"),
+		NewResource("b"),
+		NewResource("c"),
+	})
+	sp := &MockCanonicalStackPersister{}
+	manager := NewSnapshotManager(sp, snap.SecretsManager, snap)
+
+	type call struct{ done, total int }
+	var calls []call
+	manager.SerializeProgress = func(done, total int) {
+		calls = append(calls, call{done, total})
+	}
+
+	// Beginning the create writes the three resources along with a pending operation for d.
+	resourceD := NewResource("d")
+	step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceD)
+	_, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+
+	require.Len(t, sp.Canonical, 1)
+	require.Len(t, calls, 4)
+	for i, c := range calls {
+		assert.Equal(t, i+1, c.done)
+		assert.Equal(t, 4, c.total)
+	}
+}
+
+func TestSkipIdenticalWrites(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResource("a")
+	resourceB := NewResource("b")
+	snap := NewSnapshot([]*resource.State{resourceA, resourceB})
+	manager, sp := MockSetup(t, snap)
+	manager.SkipIdenticalWrites = true
+
+	// A failed create records a pending operation and then removes it again, leaving the snapshot exactly as it was.
+	resourceC := NewResource("c")
+	create := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceC)
+	require.NoError(t, manager.ApplyBatch([]deploy.Step{create}, []bool{false}))
+	assert.Empty(t, sp.SavedSnapshots)
+
+	// A real change must still be written, but only once.
+	resourceAUpdated := NewResource("a")
+	resourceAUpdated.Protect = true
+	same := deploy.NewSameStep(nil, nil, resourceA, resourceAUpdated)
+	mutation, err := manager.BeginMutation(same)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(same, true))
+	require.NoError(t, manager.Close())
+
+	require.Len(t, sp.SavedSnapshots, 1)
+	assert.True(t, sp.LastSnap().Resources[0].Protect)
+}
+
+func TestMaxPropertyValueBytes(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResource("a")
+	snap := NewSnapshot([]*resource.State{resourceA})
+	manager, sp := MockSetup(t, snap)
+	manager.MaxPropertyValueBytes = 64
+
+	large := strings.Repeat("x", 100)
+	resourceAUpdated := NewResource("a")
+	resourceAUpdated.Outputs = resource.PropertyMap{
+		"large": resource.NewStringProperty(large),
+		"small": resource.NewStringProperty("small"),
+	}
+	same := deploy.NewSameStep(nil, nil, resourceA, resourceAUpdated)
+	mutation, err := manager.BeginMutation(same)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(same, true))
+
+	written := sp.LastSnap()
+	require.NoError(t, written.VerifyIntegrity())
+	require.Len(t, written.Resources, 1)
+
+	encoded, err := json.Marshal(large)
+	require.NoError(t, err)
+	sum := sha256.Sum256(encoded)
+	assert.Equal(t, resource.NewObjectProperty(resource.PropertyMap{
+		TruncatedPropertyKey: resource.NewBoolProperty(true),
+		"size":               resource.NewNumberProperty(float64(len(encoded))),
+		"sha256":             resource.NewStringProperty(hex.EncodeToString(sum[:])),
+	}), written.Resources[0].Outputs["large"])
+	assert.Equal(t, resource.NewStringProperty("small"), written.Resources[0].Outputs["small"])
+
+	// The state held by the engine must be left alone.
+	assert.Equal(t, resource.NewStringProperty(large), resourceAUpdated.Outputs["large"])
+}
+
+func TestMaxPropertyValueBytesKeepsRediffableState(t *testing.T) {
+	t.Parallel()
+
+	large := resource.NewStringProperty(strings.Repeat("x", 100))
+	props := func() resource.PropertyMap { return resource.PropertyMap{"large": large} }
+
+	// A custom resource and the root stack, neither of whose properties may be truncated.
+	custom := NewResourceWithInputs("a", props())
+	custom.Custom, custom.ID = true, "id"
+	custom.Outputs = props()
+	root := NewResourceWithInputs("root", props())
+	root.Type = resource.RootStackType
+	root.Outputs = props()
+
+	manager, sp := MockSetup(t, NewSnapshot([]*resource.State{root, custom}))
+	manager.MaxPropertyValueBytes = 64
+	require.NoError(t, manager.saveSnapshot())
+
+	// Re-diffing the persisted states against the same goal finds no changes, so the next update does not touch them,
+	// and the root stack's outputs are intact for stack references.
+	written := sp.LastSnap()
+	require.Len(t, written.Resources, 2)
+	for _, res := range written.Resources {
+		assert.Nil(t, res.Inputs.Diff(props()), "inputs of %s", res.URN)
+		assert.Nil(t, res.Outputs.Diff(props()), "outputs of %s", res.URN)
+	}
+}
+
+func TestCompressResourcesAbove(t *testing.T) {
+	t.Parallel()
+
+	small := []*resource.State{NewResource("a"), NewResource("b"), NewResource("c")}
+	for _, res := range small {
+		res.Outputs = resource.PropertyMap{"name": resource.NewStringProperty(string(res.URN))}
+	}
+	snap := NewSnapshot(small)
+	manager, sp := MockSetup(t, snap)
+	manager.CompressResourcesAbove = 1024
+
+	large := NewResource("large")
+	large.Inputs = resource.PropertyMap{"blob": resource.NewStringProperty(strings.Repeat("x", 4096))}
+	large.Outputs = resource.PropertyMap{
+		"blob":     resource.NewStringProperty(strings.Repeat("x", 4096)),
+		"password": resource.MakeSecret(resource.NewStringProperty("hunter2")),
+	}
+	step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, large)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(step, true /* successful */))
+	require.NoError(t, manager.Close())
+
+	written := sp.LastSnap()
+	require.Len(t, written.Resources, 4)
+	deployment, err := stack.SerializeDeployment(context.Background(), written, false /* showSecrets */)
+	require.NoError(t, err)
+
+	// Only the large resource is compressed, and its secret is encrypted before it is compressed.
+	for _, res := range deployment.Resources {
+		if res.URN != large.URN {
+			assert.Equal(t, map[string]interface{}{"name": string(res.URN)}, res.Outputs)
+			continue
+		}
+		assert.Nil(t, res.Inputs)
+		require.Len(t, res.Outputs, 1)
+		require.Contains(t, res.Outputs, stack.CompressedPropertiesKey)
+		assert.Less(t, len(res.Outputs[stack.CompressedPropertiesKey].(string)), 1024)
+	}
+	marshalled, err := json.Marshal(deployment)
+	require.NoError(t, err)
+	assert.NotContains(t, string(marshalled), "hunter2")
+
+	// Every resource survives the round trip intact.
+	deserialized, err := stack.DeserializeDeploymentV3(context.Background(), *deployment, b64.Base64SecretsProvider)
+	require.NoError(t, err)
+	require.Len(t, deserialized.Resources, 4)
+	for i, res := range written.Resources {
+		assert.Equal(t, res.URN, deserialized.Resources[i].URN)
+		assert.True(t, res.Inputs.DeepEquals(deserialized.Resources[i].Inputs), "inputs of %v", res.URN)
+		assert.True(t, res.Outputs.DeepEquals(deserialized.Resources[i].Outputs), "outputs of %v", res.URN)
+	}
+}
+
+func TestReplacementSequenceNumber(t *testing.T) {
+	t.Parallel()
+
+	// replace replaces the only resource in the given snapshot in a deployment of its own, returning the snapshot that
+	// the deployment wrote.
+	replace := func(snap *deploy.Snapshot) *deploy.Snapshot {
+		manager, sp := MockSetup(t, snap)
+		applyStep := func(step deploy.Step) {
+			mutation, err := manager.BeginMutation(step)
+			require.NoError(t, err)
+			require.NoError(t, mutation.End(step, true))
+		}
+
+		old := snap.Resources[0]
+		createReplacement := deploy.NewCreateReplacementStep(
+			nil, &MockRegisterResourceEvent{}, old, NewResource(old.URN), nil, nil, nil, true)
+		old.Delete = true
+		applyStep(createReplacement)
+		applyStep(deploy.NewDeleteReplacementStep(nil, map[resource.URN]bool{}, old, false, nil))
+		require.NoError(t, manager.Close())
+		return sp.LastSnap()
+	}
+
+	// Each replacement takes the next sequence number.
+	first := replace(NewSnapshot([]*resource.State{NewResource("a")}))
+	require.Len(t, first.Resources, 1)
+	assert.Equal(t, 1, first.Resources[0].SequenceNumber)
+	written := replace(first)
+	require.Len(t, written.Resources, 1)
+	assert.Equal(t, 2, written.Resources[0].SequenceNumber)
+
+	// The sequence number survives serialization.
+	deployment, err := stack.SerializeDeployment(context.Background(), written, false)
+	require.NoError(t, err)
+	deserialized, err := stack.DeserializeDeploymentV3(context.Background(), *deployment, b64.Base64SecretsProvider)
+	require.NoError(t, err)
+	require.Len(t, deserialized.Resources, 1)
+	assert.Equal(t, 2, deserialized.Resources[0].SequenceNumber)
+}
+
+// notifyingPersister sends each snapshot it is asked to save on a channel.
+type notifyingPersister struct {
+	saved chan *deploy.Snapshot
+}
+
+func (p *notifyingPersister) Save(snap *deploy.Snapshot) error {
+	p.saved <- snap
+	return nil
+}
+
+func TestStepTimeout(t *testing.T) {
+	t.Parallel()
+
+	snap := NewSnapshot(nil)
+	sp := &notifyingPersister{saved: make(chan *deploy.Snapshot, 16)}
+	manager := NewSnapshotManager(sp, snap.SecretsManager, snap)
+	manager.StepTimeout = 10 * time.Millisecond
+
+	// Begin a create that never ends.
+	resourceA := NewResource("a")
+	step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceA)
+	_, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+
+	// The pending create is written first as usual, and then again once the timeout has elapsed, flagged as timed out
+	// but not cleared.
+	pending := <-sp.saved
+	require.Len(t, pending.PendingOperations, 1)
+	assert.False(t, pending.PendingOperations[0].TimedOut)
+
+	var timedOut *deploy.Snapshot
+	select {
+	case timedOut = <-sp.saved:
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "timed out waiting for the pending operation to be flagged")
+	}
+	require.Len(t, timedOut.PendingOperations, 1)
+	assert.Equal(t, resourceA.URN, timedOut.PendingOperations[0].Resource.URN)
+	assert.Equal(t, resource.OperationTypeCreating, timedOut.PendingOperations[0].Type)
+	assert.True(t, timedOut.PendingOperations[0].TimedOut)
+	assert.Empty(t, timedOut.Resources)
+
+	// The flag survives serialization, so that recovery tooling can see it.
+	deployment, err := stack.SerializeDeployment(context.Background(), timedOut, false)
+	require.NoError(t, err)
+	require.Len(t, deployment.PendingOperations, 1)
+	assert.True(t, deployment.PendingOperations[0].TimedOut)
+
+	require.NoError(t, manager.Close())
+}
+
+func TestStepTimeoutNotReachedWhenEnded(t *testing.T) {
+	t.Parallel()
+
+	snap := NewSnapshot(nil)
+	sp := &notifyingPersister{saved: make(chan *deploy.Snapshot, 16)}
+	manager := NewSnapshotManager(sp, snap.SecretsManager, snap)
+	manager.StepTimeout = 50 * time.Millisecond
+
+	resourceA := NewResource("a")
+	step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceA)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(step, true))
+
+	// Once the step has ended there is nothing left to flag, so no further snapshots are written.
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, manager.Close())
+	close(sp.saved)
+	for saved := range sp.saved {
+		for _, op := range saved.PendingOperations {
+			assert.False(t, op.TimedOut)
+		}
+	}
+}
+
+// Aliases are compacted in the snapshot that the manager hands to URN normalization, which currently drops them from
+// the written snapshot altogether, so compactAliases is tested directly.
+func TestCompactAliases(t *testing.T) {
+	t.Parallel()
+
+	alias := func(i int) resource.URN {
+		return resource.URN(fmt.Sprintf("urn:pulumi:test::test::pkg:index:type::old%d", i))
+	}
+	var aliases []resource.URN
+	for i := 0; i < 50; i++ {
+		aliases = append(aliases, alias(i%5))
+	}
+
+	cases := []struct {
+		name     string
+		limit    int
+		expected []resource.URN
+	}{
+		{name: "dedup", expected: []resource.URN{alias(0), alias(1), alias(2), alias(3), alias(4)}},
+		{name: "limit", limit: 2, expected: []resource.URN{alias(3), alias(4)}},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Arrange.
+			resourceA := NewResource("a")
+			resourceA.Aliases = slices.Clone(aliases)
+			snap := NewSnapshot([]*resource.State{resourceA})
+
+			// Act.
+			compactAliases(snap, c.limit)
+
+			// Assert.
+			require.Len(t, snap.Resources, 1)
+			assert.Equal(t, c.expected, snap.Resources[0].Aliases)
+
+			// The state held by the engine must be left alone, so that matching during this deployment is unaffected.
+			assert.NotSame(t, resourceA, snap.Resources[0])
+			assert.Equal(t, aliases, resourceA.Aliases)
+		})
+	}
+}
+
+// MockShardedStackPersister records the shards changed and deleted by each saved snapshot.
+type MockShardedStackPersister struct {
+	MockStackPersister
+	Changed []map[string][]byte
+	Deleted [][]string
+}
+
+func (m *MockShardedStackPersister) StorageKeyFunc() StorageKeyFunc {
+	return nil
+}
+
+func (m *MockShardedStackPersister) SaveShards(snap *deploy.Snapshot, changed map[string][]byte, deleted []string,
+) error {
+	m.Changed = append(m.Changed, changed)
+	m.Deleted = append(m.Deleted, deleted)
+	return m.Save(snap)
+}
+
+func TestShardedSnapshotPersister(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResource("a")
+	resourceB := NewResource("b")
+	resourceC := NewResource("c")
+	snap := NewSnapshot([]*resource.State{resourceA, resourceB, resourceC})
+
+	// Each resource must map to a stable, distinct key.
+	keyA := DefaultStorageKey(resourceA.URN)
+	keyB := DefaultStorageKey(resourceB.URN)
+	keyC := DefaultStorageKey(resourceC.URN)
+	assert.Equal(t, keyA, DefaultStorageKey(resourceA.URN))
+	assert.NotEqual(t, keyA, keyB)
+	assert.NotEqual(t, keyA, keyC)
+	assert.NotEqual(t, keyB, keyC)
+
+	sp := &MockShardedStackPersister{}
+	manager := NewSnapshotManager(sp, snap.SecretsManager, snap)
+
+	// The first write contains every shard.
+	resourceAUpdated := NewResource("a")
+	resourceAUpdated.Protect = true
+	same := deploy.NewSameStep(nil, nil, resourceA, resourceAUpdated)
+	mutation, err := manager.BeginMutation(same)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(same, true))
+	require.Len(t, sp.Changed, 1)
+	var changed []string
+	for key := range sp.Changed[0] {
+		changed = append(changed, key)
+	}
+	assert.ElementsMatch(t, []string{keyA, keyB, keyC}, changed)
+	assert.Empty(t, sp.Deleted[0])
+
+	var shard []apitype.ResourceV3
+	require.NoError(t, json.Unmarshal(sp.Changed[0][keyA], &shard))
+	require.Len(t, shard, 1)
+	assert.Equal(t, resourceA.URN, shard[0].URN)
+	assert.True(t, shard[0].Protect)
+
+	// Deleting c only removes its shard.
+	del := deploy.NewDeleteStep(nil, map[resource.URN]bool{}, resourceC, nil)
+	mutation, err = manager.BeginMutation(del)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(del, true))
+	require.NoError(t, manager.Close())
+
+	last := len(sp.Changed) - 1
+	assert.Empty(t, sp.Changed[last])
+	assert.Equal(t, []string{keyC}, sp.Deleted[last])
+}
+
+func TestQuarantinedResourcesBlockWrites(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResource("a")
+	snap := NewSnapshot([]*resource.State{resourceA})
+	snap.QuarantinedResources = []deploy.QuarantinedResource{{
+		URN: "b",
+		Raw: json.RawMessage(`{"urn":"b"}`),
+		Err: errors.New("malformed secret value"),
+	}}
+	manager, sp := MockSetup(t, snap)
+
+	resourceC := NewResource("c")
+	step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceC)
+	_, err := manager.BeginMutation(step)
+	assert.ErrorContains(t, err, "refusing to overwrite 1 quarantined resource(s) that could not be loaded: b")
+	assert.Empty(t, sp.SavedSnapshots)
+	require.NoError(t, manager.Close())
+
+	// Once the quarantined resources are resolved, writes go ahead.
+	snap.QuarantinedResources = nil
+	manager, sp = MockSetup(t, snap)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(step, true))
+	require.NoError(t, manager.Close())
+	assert.Len(t, sp.LastSnap().Resources, 2)
+}
+
+// MockGenerationalStackPersister numbers each stored snapshot with a generation, which can also be bumped out-of-band
+// to simulate a write by another process.
+type MockGenerationalStackPersister struct {
+	MockStackPersister
+	generation int
+}
+
+func (m *MockGenerationalStackPersister) Generation() (string, error) {
+	return strconv.Itoa(m.generation), nil
+}
+
+func (m *MockGenerationalStackPersister) SaveIfGeneration(snap *deploy.Snapshot, expected string) (string, bool, error) {
+	if current := strconv.Itoa(m.generation); current != expected {
+		return current, false, nil
+	}
+	if err := m.Save(snap); err != nil {
+		return "", false, err
+	}
+	m.generation++
+	return strconv.Itoa(m.generation), true, nil
+}
+
+func TestSnapshotConflict(t *testing.T) {
+	t.Parallel()
+
+	snap := NewSnapshot(nil)
+	sp := &MockGenerationalStackPersister{generation: 7}
+	manager := NewSnapshotManager(sp, snap.SecretsManager, snap)
+
+	// Our own writes advance the generation without conflict.
+	resourceA := NewResource("a")
+	step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceA)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(step, true))
+	require.Len(t, sp.SavedSnapshots, 2)
+
+	// Another process writes the stack behind our back.
+	sp.generation++
+
+	resourceB := NewResource("b")
+	step = deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceB)
+	_, err = manager.BeginMutation(step)
+	var conflict SnapshotConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, SnapshotConflictError{Expected: "9", Actual: "10"}, conflict)
+	assert.Len(t, sp.SavedSnapshots, 2)
+	require.NoError(t, manager.Close())
+}
+
+func TestDelayedPersisterPreservesWriteOrder(t *testing.T) {
+	t.Parallel()
+
+	snap := NewSnapshot(nil)
+	inner := &MockStackPersister{}
+	sp := &DelayedPersister{Inner: inner, Delay: 10 * time.Millisecond}
+	manager := NewSnapshotManager(sp, snap.SecretsManager, snap)
+
+	// Create a chain of resources, each depending on the last.
+	var urns []resource.URN
+	for i := 0; i < 5; i++ {
+		res := NewResource(resource.URN(fmt.Sprintf("r%d", i)), urns...)
+		urns = append(urns, res.URN)
+
+		step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, res)
+		mutation, err := manager.BeginMutation(step)
+		require.NoError(t, err)
+		require.NoError(t, mutation.End(step, true))
+	}
+	require.NoError(t, manager.Close())
+
+	// Each create is written twice, once when it begins and once when it ends, and every write must land in order
+	// despite the delay.
+	require.Len(t, inner.SavedSnapshots, 10)
+	for i, saved := range inner.SavedSnapshots {
+		assert.Len(t, saved.Resources, (i+1)/2, "write %d", i)
+		assert.Len(t, saved.PendingOperations, (i+1)%2, "write %d", i)
+		assert.NoError(t, saved.VerifyIntegrity(), "write %d", i)
+	}
+}
+
+// unreachablePersister is a SnapshotPersister whose backing store cannot be reached.
+type unreachablePersister struct{}
+
+func (unreachablePersister) Save(snap *deploy.Snapshot) error {
+	return errors.New("connection refused")
+}
+
+// uncleanablePersister saves snapshots like MockStackPersister, but replaces the file at path with a non-empty
+// directory each time, so that the file cannot be removed afterwards.
+type uncleanablePersister struct {
+	MockStackPersister
+	path string
+}
+
+func (p *uncleanablePersister) Save(snap *deploy.Snapshot) error {
+	if err := os.RemoveAll(p.path); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(p.path, "entry"), 0o700); err != nil {
+		return err
+	}
+	return p.MockStackPersister.Save(snap)
+}
+
+func TestFallbackPersister(t *testing.T) {
+	t.Parallel()
+
+	snap := NewSnapshot([]*resource.State{NewResource("a")})
+	manager := NewSnapshotManager(unreachablePersister{}, snap.SecretsManager, snap)
+	path := filepath.Join(t.TempDir(), "fallback.json")
+	fallback := &FilePersister{Path: path}
+	manager.FallbackPersister = fallback
+
+	// The pending create is recorded in the snapshot even though it cannot be written.
+	step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, NewResource("b"))
+	_, err := manager.BeginMutation(step)
+	assert.ErrorContains(t, err, "connection refused")
+
+	err = manager.Close()
+	var fallbackErr FallbackSaveError
+	require.ErrorAs(t, err, &fallbackErr)
+	assert.Equal(t, fallback, fallbackErr.Fallback)
+	assert.ErrorContains(t, err, "connection refused")
+	assert.ErrorContains(t, err, "pulumi stack import --file "+path)
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var untyped apitype.UntypedDeployment
+	require.NoError(t, json.Unmarshal(contents, &untyped))
+	deployment, err := stack.UnmarshalUntypedDeployment(context.Background(), &untyped)
+	require.NoError(t, err)
+	require.Len(t, deployment.Resources, 1)
+	assert.Equal(t, resource.URN("a"), deployment.Resources[0].URN)
+	require.Len(t, deployment.PendingOperations, 1)
+	assert.Equal(t, resource.URN("b"), deployment.PendingOperations[0].Resource.URN)
+}
+
+func TestWriteAheadLog(t *testing.T) {
+	t.Parallel()
+
+	t.Run("cleared after save", func(t *testing.T) {
+		t.Parallel()
+
+		snap := NewSnapshot([]*resource.State{NewResource("a")})
+		manager, sp := MockSetup(t, snap)
+		wal := &WriteAheadLog{Path: filepath.Join(t.TempDir(), "wal.json")}
+		manager.WriteAheadLog = wal
+
+		step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, NewResource("b"))
+		mutation, err := manager.BeginMutation(step)
+		require.NoError(t, err)
+		require.NoError(t, mutation.End(step, true /* successful */))
+		require.NoError(t, manager.Close())
+
+		assert.Len(t, sp.LastSnap().Resources, 2)
+		assert.NoFileExists(t, wal.Path)
+		assert.NoFileExists(t, wal.Path+".tmp")
+
+		// There is nothing to replay.
+		replayed, err := wal.Replay(context.Background(), sp, b64.Base64SecretsProvider)
+		require.NoError(t, err)
+		assert.False(t, replayed)
+	})
+
+	t.Run("clear failure after save", func(t *testing.T) {
+		t.Parallel()
+
+		// The persister turns the log into a non-empty directory as it saves, so that clearing the log fails. Only
+		// one snapshot is written, as the log cannot be recorded again either.
+		snap := NewSnapshot([]*resource.State{NewResource("a")})
+		wal := &WriteAheadLog{Path: filepath.Join(t.TempDir(), "wal.json")}
+		sp := &uncleanablePersister{path: wal.Path}
+		manager := NewSnapshotManager(sp, snap.SecretsManager, snap)
+		manager.WriteAheadLog = wal
+		var saved int
+		manager.SnapshotSaved = func(SnapshotSavedEvent) { saved++ }
+
+		step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, NewResource("b"))
+		_, err := manager.BeginMutation(step)
+		require.NoError(t, err)
+
+		// The save is still counted and reported.
+		require.Len(t, sp.SavedSnapshots, 1)
+		assert.Len(t, sp.LastSnap().PendingOperations, 1)
+		assert.Equal(t, int64(1), manager.Stats().WritesPerformed)
+		assert.Equal(t, 1, saved)
+		assert.DirExists(t, wal.Path)
+	})
+
+	t.Run("replayed after crash", func(t *testing.T) {
+		t.Parallel()
+
+		// The persister never saves anything, as if the process died while writing each snapshot, so the last
+		// snapshot is left in the log.
+		snap := NewSnapshot([]*resource.State{NewResource("a")})
+		manager := NewSnapshotManager(unreachablePersister{}, snap.SecretsManager, snap)
+		wal := &WriteAheadLog{Path: filepath.Join(t.TempDir(), "wal.json")}
+		manager.WriteAheadLog = wal
+
+		step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, NewResource("b"))
+		_, err := manager.BeginMutation(step)
+		assert.ErrorContains(t, err, "connection refused")
+		require.FileExists(t, wal.Path)
+
+		// On the next start, the logged snapshot is replayed to the persister and the log cleared.
+		sp := &MockStackPersister{}
+		replayed, err := wal.Replay(context.Background(), sp, b64.Base64SecretsProvider)
+		require.NoError(t, err)
+		assert.True(t, replayed)
+		assert.NoFileExists(t, wal.Path)
+
+		recovered := sp.LastSnap()
+		require.Len(t, recovered.Resources, 1)
+		assert.Equal(t, resource.URN("a"), recovered.Resources[0].URN)
+		require.Len(t, recovered.PendingOperations, 1)
+		assert.Equal(t, resource.URN("b"), recovered.PendingOperations[0].Resource.URN)
+		assert.Equal(t, resource.OperationTypeCreating, recovered.PendingOperations[0].Type)
+	})
+
+	t.Run("kept if replay fails", func(t *testing.T) {
+		t.Parallel()
+
+		wal := &WriteAheadLog{Path: filepath.Join(t.TempDir(), "wal.json")}
+		require.NoError(t, wal.record(NewSnapshot([]*resource.State{NewResource("a")})))
+
+		replayed, err := wal.Replay(context.Background(), unreachablePersister{}, b64.Base64SecretsProvider)
+		assert.True(t, replayed)
+		assert.ErrorContains(t, err, "connection refused")
+		assert.FileExists(t, wal.Path)
+	})
+}
+
+func TestTeePersister(t *testing.T) {
+	t.Parallel()
+
+	t.Run("writes to both", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		snap := NewSnapshot([]*resource.State{NewResource("a")})
+		primary, secondary := &MockStackPersister{}, &MockStackPersister{}
+		manager := NewSnapshotManager(
+			&TeePersister{Primary: primary, Secondary: secondary}, snap.SecretsManager, snap)
+
+		// Act.
+		step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, NewResource("b"))
+		mutation, err := manager.BeginMutation(step)
+		require.NoError(t, err)
+		require.NoError(t, mutation.End(step, true))
+		require.NoError(t, manager.Close())
+
+		// Assert.
+		require.Len(t, primary.SavedSnapshots, 2)
+		assert.Equal(t, primary.SavedSnapshots, secondary.SavedSnapshots)
+	})
+
+	t.Run("secondary failure", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		snap := NewSnapshot([]*resource.State{NewResource("a")})
+		primary := &MockStackPersister{}
+		manager := NewSnapshotManager(
+			&TeePersister{Primary: primary, Secondary: unreachablePersister{}}, snap.SecretsManager, snap)
+
+		// Act.
+		step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, NewResource("b"))
+		mutation, err := manager.BeginMutation(step)
+		require.NoError(t, err)
+		require.NoError(t, mutation.End(step, true))
+		require.NoError(t, manager.Close())
+
+		// Assert.
+		require.Len(t, primary.SavedSnapshots, 2)
+		assert.Len(t, primary.LastSnap().Resources, 2)
+	})
+
+	t.Run("primary failure", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		snap := NewSnapshot([]*resource.State{NewResource("a")})
+		secondary := &MockStackPersister{}
+		manager := NewSnapshotManager(
+			&TeePersister{Primary: unreachablePersister{}, Secondary: secondary}, snap.SecretsManager, snap)
+
+		// Act.
+		step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, NewResource("b"))
+		_, err := manager.BeginMutation(step)
+
+		// Assert.
+		assert.ErrorContains(t, err, "connection refused")
+		assert.Len(t, secondary.SavedSnapshots, 1)
+	})
+}
+
+func TestRecordStepIDs(t *testing.T) {
+	t.Parallel()
+
+	resourceA := NewResource(aUniqueUrnResourceA)
+	snap := NewSnapshot([]*resource.State{resourceA})
+	manager, sp := MockSetup(t, snap)
+	manager.RecordStepIDs = true
+
+	// Each step that writes a resource records its own ID on it.
+	resourceB := NewResource(aUniqueUrnResourceB)
+	create := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceB)
+	mutation, err := manager.BeginMutation(create)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(create, true))
+
+	resourceAUpdated := NewResource(resourceA.URN)
+	same := deploy.NewSameStep(nil, nil, resourceA, resourceAUpdated)
+	mutation, err = manager.BeginMutation(same)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(same, true))
+
+	// The new step ID alone is not a meaningful change, so the same step's write is elided until Close.
+	assert.Len(t, sp.SavedSnapshots, 2)
+	require.NoError(t, manager.Close())
+	require.Len(t, sp.SavedSnapshots, 3)
+
+	written := sp.LastSnap().Resources
+	require.Len(t, written, 2)
+	assert.NotEmpty(t, written[0].StepID)
+	assert.NotEmpty(t, written[1].StepID)
+	assert.NotEqual(t, written[0].StepID, written[1].StepID)
+
+	// The step ID survives serialization.
+	for _, res := range written {
+		serialized, err := stack.SerializeResource(context.Background(), res, config.NopEncrypter, false)
+		require.NoError(t, err)
+		deserialized, err := stack.DeserializeResource(serialized, config.NopDecrypter)
+		require.NoError(t, err)
+		assert.Equal(t, res.StepID, deserialized.StepID)
+	}
+}
+
+// MockChunkedStackPersister reassembles each snapshot it is sent from small chunks.
+type MockChunkedStackPersister struct {
+	MockStackPersister
+	Uploads [][]byte
+}
+
+func (m *MockChunkedStackPersister) SaveChunked(r io.Reader, size int64) error {
+	var upload []byte
+	chunk := make([]byte, 16)
+	for {
+		n, err := r.Read(chunk)
+		upload = append(upload, chunk[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if int64(len(upload)) != size {
+		return fmt.Errorf("expected %d bytes, read %d", size, len(upload))
+	}
+	m.Uploads = append(m.Uploads, upload)
+	return nil
+}
+
+func TestChunkedPersister(t *testing.T) {
+	t.Parallel()
+
+	snap := NewSnapshot([]*resource.State{NewResource(aUniqueUrnResourceA)})
+	sp := &MockChunkedStackPersister{}
+	manager := NewSnapshotManager(sp, snap.SecretsManager, snap)
+
+	resourceB := NewResource(aUniqueUrnResourceB)
+	step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceB)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(step, true))
+	require.NoError(t, manager.Close())
+
+	// Every write is streamed rather than saved, and each reassembles to the complete snapshot at that point.
+	assert.Empty(t, sp.SavedSnapshots)
+	require.Len(t, sp.Uploads, 2)
+
+	var pending apitype.DeploymentV3
+	require.NoError(t, json.Unmarshal(sp.Uploads[0], &pending))
+	require.Len(t, pending.Resources, 1)
+	assert.Equal(t, aUniqueUrnResourceA, pending.Resources[0].URN)
+	require.Len(t, pending.PendingOperations, 1)
+	assert.Equal(t, aUniqueUrnResourceB, pending.PendingOperations[0].Resource.URN)
+
+	var done apitype.DeploymentV3
+	require.NoError(t, json.Unmarshal(sp.Uploads[1], &done))
+	require.Len(t, done.Resources, 2)
+	assert.Equal(t, aUniqueUrnResourceB, done.Resources[0].URN)
+	assert.Equal(t, aUniqueUrnResourceA, done.Resources[1].URN)
+	assert.Empty(t, done.PendingOperations)
+}
+
+// MockCheckpointStackPersister records each checkpoint it is asked to save, by name.
+type MockCheckpointStackPersister struct {
+	MockStackPersister
+	Checkpoints map[string]*deploy.Snapshot
+}
+
+func (m *MockCheckpointStackPersister) SaveCheckpoint(name string, snap *deploy.Snapshot) error {
+	if m.Checkpoints == nil {
+		m.Checkpoints = make(map[string]*deploy.Snapshot)
+	}
+	m.Checkpoints[name] = snap
+	return nil
+}
+
+func TestCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	t.Run("saves a labeled snapshot on demand", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		resourceA := NewResource(aUniqueUrnResourceA)
+		snap := NewSnapshot([]*resource.State{resourceA})
+		sp := &MockCheckpointStackPersister{}
+		manager := NewSnapshotManager(sp, snap.SecretsManager, snap)
+
+		// A same step with no changes elides its write.
+		step := deploy.NewSameStep(nil, &MockRegisterResourceEvent{}, resourceA, resourceA.Copy())
+		mutation, err := manager.BeginMutation(step)
+		require.NoError(t, err)
+		require.NoError(t, mutation.End(step, true))
+		require.Empty(t, sp.SavedSnapshots)
+
+		// Act.
+		err = manager.Checkpoint("before-migration")
+
+		// Assert.
+		require.NoError(t, err)
+		require.Contains(t, sp.Checkpoints, "before-migration")
+		checkpoint := sp.Checkpoints["before-migration"]
+		require.Len(t, checkpoint.Resources, 1)
+		assert.Equal(t, aUniqueUrnResourceA, checkpoint.Resources[0].URN)
+
+		// The elided write is flushed along with the checkpoint.
+		require.Len(t, sp.SavedSnapshots, 1)
+		assert.Equal(t, checkpoint.Resources, sp.LastSnap().Resources)
+		require.NoError(t, manager.Close())
+	})
+
+	t.Run("requires a checkpoint persister", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		manager, sp := MockSetup(t, NewSnapshot(nil))
+
+		// Act.
+		err := manager.Checkpoint("before-migration")
+
+		// Assert.
+		assert.ErrorContains(t, err, "does not support checkpoints")
+		require.NoError(t, manager.Close())
+		assert.Len(t, sp.SavedSnapshots, 1)
+	})
+}
+
+func TestDeduplicateProviders(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	newProvider := func(name, region string) *resource.State {
+		provider := NewResourceWithInputs(
+			resource.URN("urn:pulumi:foo::bar::pulumi:providers:pkgA::"+name),
+			resource.PropertyMap{"region": resource.NewStringProperty(region)})
+		provider.Type, provider.Custom, provider.ID = "pulumi:providers:pkgA", true, resource.ID(name+"-id")
+		return provider
+	}
+	newResource := func(name string, provider *resource.State) *resource.State {
+		res := NewResource(resource.URN("urn:pulumi:foo::bar::pkgA:m:typA::"+name), provider.URN)
+		res.Custom, res.ID = true, resource.ID(name+"-id")
+		res.Provider = string(provider.URN) + "::" + string(provider.ID)
+		return res
+	}
+
+	provider1 := newProvider("provider1", "us-west-2")
+	provider2 := newProvider("provider2", "us-west-2")
+	provider3 := newProvider("provider3", "eu-west-1")
+	resourceA := newResource("a", provider1)
+	resourceB := newResource("b", provider2)
+	resourceC := newResource("c", provider3)
+	snap := NewSnapshot([]*resource.State{provider1, provider2, provider3, resourceA, resourceB, resourceC})
+	manager, sp := MockSetup(t, snap)
+	manager.DeduplicateProviders = true
+
+	// Act.
+	require.NoError(t, manager.Close())
+
+	// Assert.
+	written := sp.LastSnap()
+	require.NoError(t, written.VerifyIntegrity())
+	var urns []resource.URN
+	for _, res := range written.Resources {
+		urns = append(urns, res.URN)
+	}
+	assert.Equal(t, []resource.URN{
+		provider1.URN, provider3.URN, resourceA.URN, resourceB.URN, resourceC.URN,
+	}, urns)
+
+	// b now refers to the provider that was kept, while c's provider differs and so is untouched.
+	writtenB := written.Resources[3]
+	assert.Equal(t, resourceA.Provider, writtenB.Provider)
+	assert.Equal(t, []resource.URN{provider1.URN}, writtenB.Dependencies)
+	assert.Same(t, resourceC, written.Resources[4])
+
+	// The engine's state is not modified.
+	assert.Equal(t, string(provider2.URN)+"::provider2-id", resourceB.Provider)
+}
+
+// headerSnapshotCodec is a trivial alternate codec that wraps the JSON codec's output in a header.
+type headerSnapshotCodec struct {
+	JSONSnapshotCodec
+}
+
+const snapshotCodecHeader = "SNAPSHOT v1\n"
+
+func (c headerSnapshotCodec) Marshal(snap *deploy.Snapshot) ([]byte, error) {
+	serialized, err := c.JSONSnapshotCodec.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(snapshotCodecHeader), serialized...), nil
+}
+
+func (c headerSnapshotCodec) Unmarshal(data []byte) (*deploy.Snapshot, error) {
+	serialized, ok := strings.CutPrefix(string(data), snapshotCodecHeader)
+	if !ok {
+		return nil, errors.New("missing snapshot header")
+	}
+	return c.JSONSnapshotCodec.Unmarshal([]byte(serialized))
+}
+
+func TestSnapshotCodec(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	snap := NewSnapshot([]*resource.State{NewResource(aUniqueUrnResourceA)})
+	sp := &MockChunkedStackPersister{}
+	manager := NewSnapshotManager(sp, snap.SecretsManager, snap)
+	codec := headerSnapshotCodec{JSONSnapshotCodec{SecretsProvider: b64.Base64SecretsProvider}}
+	manager.ChunkedCodec = codec
+
+	// Act.
+	resourceB := NewResource(aUniqueUrnResourceB)
+	step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceB)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(step, true))
+	require.NoError(t, manager.Close())
+
+	// Assert.
+	require.Len(t, sp.Uploads, 2)
+	for _, upload := range sp.Uploads {
+		assert.True(t, strings.HasPrefix(string(upload), snapshotCodecHeader))
+	}
+
+	final, err := codec.Unmarshal(sp.Uploads[1])
+	require.NoError(t, err)
+	require.Len(t, final.Resources, 2)
+	assert.Equal(t, aUniqueUrnResourceB, final.Resources[0].URN)
+	assert.Equal(t, aUniqueUrnResourceA, final.Resources[1].URN)
+	assert.Empty(t, final.PendingOperations)
+	assert.NoError(t, final.VerifyIntegrity())
+}
+
+// MockEventLogPersister records each mutation record appended to it.
+type MockEventLogPersister struct {
+	MockStackPersister
+	Records []MutationRecord
+}
+
+func (m *MockEventLogPersister) Append(record MutationRecord) error {
+	m.Records = append(m.Records, record)
+	return nil
+}
+
+func TestEventLogPersister(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	resourceA := NewResource(aUniqueUrnResourceA)
+	base := NewSnapshot([]*resource.State{resourceA})
+	sp := &MockEventLogPersister{}
+	manager := NewSnapshotManager(sp, base.SecretsManager, base)
+
+	// Act.
+	resourceB := NewResource(aUniqueUrnResourceB)
+	create := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceB)
+	mutation, err := manager.BeginMutation(create)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(create, true))
+
+	resourceAUpdated := NewResourceWithInputs(aUniqueUrnResourceA, resource.PropertyMap{
+		"key": resource.NewStringProperty("value"),
+	})
+	update := deploy.NewUpdateStep(nil, &MockRegisterResourceEvent{}, resourceA, resourceAUpdated, nil, nil, nil, nil, nil)
+	mutation, err = manager.BeginMutation(update)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(update, true))
+
+	resourceP := NewResource(aUniqueUrnResourceP)
+	unfinished := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceP)
+	_, err = manager.BeginMutation(unfinished)
+	require.NoError(t, err)
+	require.NoError(t, manager.Close())
+
+	// Assert.
+	assert.Empty(t, sp.SavedSnapshots)
+	require.Len(t, sp.Records, 5)
+	for i, record := range sp.Records {
+		assert.Equal(t, i+1, record.Sequence)
+	}
+
+	// Beginning the create only adds a pending operation, so a is recorded as unchanged from the base snapshot.
+	assert.Equal(t, []MutationResource{{Previous: 0}}, sp.Records[0].Resources)
+	require.Len(t, sp.Records[0].PendingOperations, 1)
+
+	// Ending it records b, which is new, and refers to a in the previous record.
+	require.Len(t, sp.Records[1].Resources, 2)
+	require.NotNil(t, sp.Records[1].Resources[0].State)
+	assert.Equal(t, aUniqueUrnResourceB, sp.Records[1].Resources[0].State.URN)
+	assert.Equal(t, MutationResource{Previous: 0}, sp.Records[1].Resources[1])
+
+	// Replaying the log rebuilds the final snapshot, with the unfinished create still pending.
+	final, err := ReplayMutationLog(base, sp.Records)
+	require.NoError(t, err)
+	require.NoError(t, final.VerifyIntegrity())
+	require.Len(t, final.Resources, 2)
+	assert.Equal(t, aUniqueUrnResourceB, final.Resources[0].URN)
+	assert.Equal(t, aUniqueUrnResourceA, final.Resources[1].URN)
+	assert.Equal(t, resourceAUpdated.Inputs, final.Resources[1].Inputs)
+	require.Len(t, final.PendingOperations, 1)
+	assert.Equal(t, aUniqueUrnResourceP, final.PendingOperations[0].Resource.URN)
+
+	// A log with a missing record cannot be replayed.
+	_, err = ReplayMutationLog(base, append(sp.Records[:1:1], sp.Records[2:]...))
+	assert.ErrorContains(t, err, "expected mutation record 2, found 3")
+}
+
+func TestPruneUnreferencedProviders(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	newProvider := func(name string) *resource.State {
+		provider := NewResource(resource.URN("urn:pulumi:foo::bar::pulumi:providers:pkgA::" + name))
+		provider.Type, provider.Custom, provider.ID = "pulumi:providers:pkgA", true, resource.ID(name+"-id")
+		return provider
+	}
+	used := newProvider("used")
+	orphaned := newProvider("orphaned")
+	protected := newProvider("protected")
+	protected.Protect = true
+	resourceA := NewResource("urn:pulumi:foo::bar::pkgA:m:typA::a")
+	resourceA.Custom, resourceA.ID = true, "a-id"
+	resourceA.Provider = string(used.URN) + "::used-id"
+	snap := NewSnapshot([]*resource.State{used, orphaned, protected, resourceA})
+	manager, sp := MockSetup(t, snap)
+
+	// Act.
+	removed, err := manager.PruneUnreferencedProviders()
+
+	// Assert.
+	require.NoError(t, err)
+	assert.Equal(t, []resource.URN{orphaned.URN}, removed)
+	require.Len(t, sp.SavedSnapshots, 1)
+	written := sp.LastSnap()
+	require.NoError(t, written.VerifyIntegrity())
+	assert.Equal(t, []*resource.State{used, protected, resourceA}, written.Resources)
+
+	// Pruning again finds nothing to remove, and so writes nothing.
+	removed, err = manager.PruneUnreferencedProviders()
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+	assert.Len(t, sp.SavedSnapshots, 1)
+	require.NoError(t, manager.Close())
+}
+
+// failingPersister is a SnapshotPersister that fails to save while fail is set, and records what it saves otherwise.
+type failingPersister struct {
+	MockStackPersister
+	fail bool
+}
+
+func (p *failingPersister) Save(snap *deploy.Snapshot) error {
+	if p.fail {
+		return errors.New("connection refused")
+	}
+	return p.MockStackPersister.Save(snap)
+}
+
+func TestReplaceSnapshot(t *testing.T) {
+	t.Parallel()
+
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		resourceA := NewResource(aUniqueUrnResourceA)
+		manager, sp := MockSetup(t, NewSnapshot([]*resource.State{resourceA}))
+		resourceB := NewResource(aUniqueUrnResourceB)
+		resourceP := NewResource(aUniqueUrnResourceP, aUniqueUrnResourceB)
+
+		// Act.
+		err := manager.ReplaceSnapshot(NewSnapshot([]*resource.State{resourceB, resourceP}))
+
+		// Assert.
+		require.NoError(t, err)
+		require.Len(t, sp.SavedSnapshots, 1)
+		assert.Equal(t, []*resource.State{resourceB, resourceP}, sp.LastSnap().Resources)
+
+		// Later mutations apply to the replacement.
+		step := deploy.NewDeleteStep(nil, map[resource.URN]bool{}, resourceP, nil)
+		mutation, err := manager.BeginMutation(step)
+		require.NoError(t, err)
+		require.NoError(t, mutation.End(step, true))
+		require.NoError(t, manager.Close())
+		assert.Equal(t, []*resource.State{resourceB}, sp.LastSnap().Resources)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		resourceA := NewResource(aUniqueUrnResourceA)
+		manager, sp := MockSetup(t, NewSnapshot([]*resource.State{resourceA}))
+
+		// Act: the replacement has a resource whose dependency is missing.
+		err := manager.ReplaceSnapshot(NewSnapshot([]*resource.State{
+			NewResource(aUniqueUrnResourceP, aUniqueUrnResourceB),
+		}))
+
+		// Assert.
+		assert.ErrorContains(t, err, "replacement snapshot is invalid")
+		assert.Empty(t, sp.SavedSnapshots)
+		require.NoError(t, manager.Close())
+		assert.Equal(t, []*resource.State{resourceA}, sp.LastSnap().Resources)
+	})
+
+	t.Run("persist failure", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		resourceA := NewResource(aUniqueUrnResourceA)
+		snap := NewSnapshot([]*resource.State{resourceA})
+		persister := &failingPersister{fail: true}
+		manager := NewSnapshotManager(persister, snap.SecretsManager, snap)
+
+		// Act.
+		err := manager.ReplaceSnapshot(NewSnapshot([]*resource.State{NewResource(aUniqueUrnResourceB)}))
+
+		// Assert: the manager keeps its snapshot, which is written once the persister recovers.
+		assert.ErrorContains(t, err, "connection refused")
+		persister.fail = false
+		require.NoError(t, manager.Close())
+		assert.Equal(t, []*resource.State{resourceA}, persister.LastSnap().Resources)
+	})
+}
+
+// concurrencyCheckingPersister records the largest number of calls to Save that were in progress at once.
+type concurrencyCheckingPersister struct {
+	MockStackPersister
+	active    atomic.Int32
+	maxActive atomic.Int32
+	saves     atomic.Int32
+}
+
+func (p *concurrencyCheckingPersister) Save(snap *deploy.Snapshot) error {
+	active := p.active.Add(1)
+	defer p.active.Add(-1)
+	for {
+		maxActive := p.maxActive.Load()
+		if active <= maxActive || p.maxActive.CompareAndSwap(maxActive, active) {
+			break
+		}
+	}
+	p.saves.Add(1)
+
+	// Give any concurrent save a chance to overlap this one.
+	time.Sleep(time.Millisecond)
+	return nil
+}
+
+func TestConcurrentMutationsPersistSerially(t *testing.T) {
+	t.Parallel()
+
+	sp := &concurrencyCheckingPersister{}
+	manager := NewSnapshotManager(sp, b64.NewBase64SecretsManager(), NewSnapshot(nil))
+
+	const n = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := NewResource(resource.URN(fmt.Sprintf("r%d", i)))
+			step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, res)
+			mutation, err := manager.BeginMutation(step)
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- mutation.End(step, true /* successful */)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.NoError(t, manager.Close())
+
+	// Every begin and end was persisted, but never more than one at a time.
+	assert.GreaterOrEqual(t, sp.saves.Load(), int32(2*n))
+	assert.Equal(t, int32(1), sp.maxActive.Load())
+}
+
+func TestSnapshotSavedEvent(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	resourceA := NewResource(aUniqueUrnResourceA)
+	snap := NewSnapshot([]*resource.State{resourceA})
+	manager, sp := MockSetup(t, snap)
+	var events []SnapshotSavedEvent
+	manager.SnapshotSaved = func(event SnapshotSavedEvent) {
+		events = append(events, event)
+	}
+
+	// Act.
+	resourceB := NewResourceWithInputs(aUniqueUrnResourceB, resource.PropertyMap{
+		"value": resource.NewStringProperty(strings.Repeat("x", 1000)),
+	})
+	step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceB)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(step, true))
+	require.NoError(t, manager.Close())
+
+	// Assert.
+	require.NotEmpty(t, sp.SavedSnapshots)
+	require.Len(t, events, len(sp.SavedSnapshots))
+	for i, event := range events {
+		assert.Equal(t, len(sp.SavedSnapshots[i].Resources), event.Resources)
+	}
+
+	// Both snapshots hold resourceB's inputs, whether in its pending operation or in the resource itself, along with
+	// a little metadata.
+	require.Len(t, events, 2)
+	assert.Equal(t, 1, events[0].Resources)
+	assert.Equal(t, 2, events[1].Resources)
+	for _, event := range events {
+		assert.Greater(t, event.Bytes, 1000)
+		assert.Less(t, event.Bytes, 4000)
+	}
+}
+
+// outputKeysValidator is a SchemaValidator that only allows the given output keys for each type.
+type outputKeysValidator map[tokens.Type][]resource.PropertyKey
+
+func (v outputKeysValidator) ValidateOutputs(typ tokens.Type, outputs resource.PropertyMap) []string {
+	var messages []string
+	for _, k := range outputs.StableKeys() {
+		if !slices.Contains(v[typ], k) {
+			messages = append(messages, fmt.Sprintf("unknown output property %q", k))
+		}
+	}
+	return messages
+}
+
+func TestSchemaValidator(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	resourceA := NewResource(aUniqueUrnResourceA)
+	snap := NewSnapshot(nil)
+	manager, sp := MockSetup(t, snap)
+	manager.SchemaValidator = outputKeysValidator{"test": {"known"}}
+
+	// Act.
+	resourceA.Outputs = resource.PropertyMap{
+		"known":   resource.NewStringProperty("a"),
+		"removed": resource.NewStringProperty("b"),
+	}
+	step := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceA)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(step, true))
+	require.NoError(t, manager.Close())
+
+	// Assert.
+	assert.Equal(t, []SchemaWarning{{
+		URN:     aUniqueUrnResourceA,
+		Type:    "test",
+		Message: `unknown output property "removed"`,
+	}}, manager.SchemaWarnings())
+
+	// The resource is still written with all of its outputs.
+	require.Len(t, sp.LastSnap().Resources, 1)
+	assert.Equal(t, resourceA.Outputs, sp.LastSnap().Resources[0].Outputs)
+}
+
+func TestInputValidator(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	resourceA := NewResource(aUniqueUrnResourceA)
+	snap := NewSnapshot([]*resource.State{resourceA})
+	manager, sp := MockSetup(t, snap)
+	manager.InputValidator = func(urn resource.URN, inputs resource.PropertyMap) error {
+		if inputs["size"].IsString() && inputs["size"].StringValue() == "huge" {
+			return errors.New(`"huge" is not a valid size`)
+		}
+		return nil
+	}
+
+	// Act: an update with valid inputs and a create with invalid ones.
+	updated := resourceA.Copy()
+	updated.Inputs = resource.PropertyMap{"size": resource.NewStringProperty("small")}
+	update := deploy.NewUpdateStep(nil, &MockRegisterResourceEvent{}, resourceA, updated, nil, nil, nil, nil, nil)
+	mutation, err := manager.BeginMutation(update)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(update, true))
+
+	resourceB := NewResource(aUniqueUrnResourceB)
+	resourceB.Inputs = resource.PropertyMap{
+		"size":     resource.NewStringProperty("huge"),
+		"password": resource.MakeSecret(resource.NewStringProperty("hunter2")),
+	}
+	create := deploy.NewCreateStep(nil, &MockRegisterResourceEvent{}, resourceB)
+	mutation, err = manager.BeginMutation(create)
+	require.NoError(t, err)
+	err = mutation.End(create, true)
+	require.NoError(t, manager.Close())
+
+	// Assert.
+	assert.ErrorContains(t, err, fmt.Sprintf("inputs of resource `%s` rejected: \"huge\" is not a valid size",
+		aUniqueUrnResourceB))
+
+	// The error shows the rejected inputs, but not their secrets.
+	assert.ErrorContains(t, err, "size:{huge}")
+	assert.ErrorContains(t, err, "password:{"+resource.RedactedSecret+"}")
+	assert.NotContains(t, err.Error(), "hunter2")
+
+	// The rejected resource is not recorded, and its create is left pending.
+	last := sp.LastSnap()
+	require.Len(t, last.Resources, 1)
+	assert.Equal(t, updated, last.Resources[0])
+	require.Len(t, last.PendingOperations, 1)
+	assert.Equal(t, aUniqueUrnResourceB, last.PendingOperations[0].Resource.URN)
+	assert.Equal(t, resource.OperationTypeCreating, last.PendingOperations[0].Type)
+}
+
+func TestManifestLanguageAndRuntime(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	resourceA := NewResource(aUniqueUrnResourceA)
+	snap := NewSnapshot([]*resource.State{resourceA})
+	manager, sp := MockSetup(t, snap)
+	manager.Language = "nodejs"
+	manager.Runtime = "node v20.11.0"
+
+	// Act.
+	updated := resourceA.Copy()
+	updated.Inputs = resource.PropertyMap{"key": resource.NewStringProperty("value")}
+	step := deploy.NewUpdateStep(nil, &MockRegisterResourceEvent{}, resourceA, updated, nil, nil, nil, nil, nil)
+	mutation, err := manager.BeginMutation(step)
+	require.NoError(t, err)
+	require.NoError(t, mutation.End(step, true))
+	require.NoError(t, manager.Close())
+
+	// Assert.
+	lastSnap := sp.LastSnap()
+	assert.Equal(t, "nodejs", lastSnap.Manifest.Language)
+	assert.Equal(t, "node v20.11.0", lastSnap.Manifest.Runtime)
+	require.NoError(t, lastSnap.VerifyIntegrity())
+
+	// The fields should survive a round trip through the deployment format without affecting the magic cookie.
+	deployment, err := stack.SerializeDeployment(context.Background(), lastSnap, false)
+	require.NoError(t, err)
+	deserialized, err := stack.DeserializeDeploymentV3(context.Background(), *deployment, b64.Base64SecretsProvider)
+	require.NoError(t, err)
+	assert.Equal(t, "nodejs", deserialized.Manifest.Language)
+	assert.Equal(t, "node v20.11.0", deserialized.Manifest.Runtime)
+	assert.Equal(t, deploy.Manifest{Version: lastSnap.Manifest.Version}.NewMagic(), deserialized.Manifest.Magic)
+	require.NoError(t, deserialized.VerifyIntegrity())
+}
+
+func TestApplyRandomSteps(t *testing.T) {
+	t.Parallel()
+
+	for seed := int64(0); seed < 50; seed++ {
+		snap, err := ApplyRandomSteps(seed, 20)
+		require.NoError(t, err, "seed %d", seed)
+		require.NoError(t, snap.VerifyIntegrity(), "seed %d", seed)
+	}
+
+	// The same seed always produces the same snapshot.
+	urns := func(snap *deploy.Snapshot) []resource.URN {
+		var result []resource.URN
+		for _, res := range snap.Resources {
+			result = append(result, res.URN)
+		}
+		return result
+	}
+	first, err := ApplyRandomSteps(42, 20)
+	require.NoError(t, err)
+	second, err := ApplyRandomSteps(42, 20)
+	require.NoError(t, err)
+	assert.Equal(t, urns(first), urns(second))
+}
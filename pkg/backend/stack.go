@@ -22,8 +22,10 @@ import (
 	"github.com/pulumi/pulumi/pkg/v3/engine"
 	"github.com/pulumi/pulumi/pkg/v3/operations"
 	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
 	"github.com/pulumi/pulumi/pkg/v3/secrets"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
@@ -133,6 +135,20 @@ func ExportStackDeployment(
 	return s.Backend().ExportDeployment(ctx, s)
 }
 
+// GetStackPendingOperations returns the operations that were in flight when the given stack's state was last written.
+// Only the pending operations are deserialized, so this is cheaper than loading the stack's snapshot.
+func GetStackPendingOperations(
+	ctx context.Context,
+	s Stack,
+	secretsProvider secrets.Provider,
+) ([]resource.Operation, error) {
+	deployment, err := s.Backend().ExportDeployment(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	return stack.DeserializePendingOperations(ctx, deployment, secretsProvider)
+}
+
 // ImportStackDeployment imports the given deployment into the indicated stack.
 func ImportStackDeployment(ctx context.Context, s Stack, deployment *apitype.UntypedDeployment) error {
 	return s.Backend().ImportDeployment(ctx, s, deployment)
@@ -0,0 +1,56 @@
+// Copyright 2016-2024, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+var (
+	_ = SnapshotPersister((*TeePersister)(nil))
+	_ = Syncer((*TeePersister)(nil))
+)
+
+// TeePersister is a SnapshotPersister that hands each snapshot to both Primary and Secondary, e.g. to write a stack's
+// state to a new backend alongside its current one so that the two can be compared before switching over. Only
+// Primary is authoritative: its result is returned, while a failure of Secondary is logged and otherwise ignored.
+type TeePersister struct {
+	Primary   SnapshotPersister
+	Secondary SnapshotPersister
+}
+
+func (p *TeePersister) Save(snap *deploy.Snapshot) error {
+	err := p.Primary.Save(snap)
+	if secondaryErr := p.Secondary.Save(snap); secondaryErr != nil {
+		logging.Warningf("TeePersister: failed to save snapshot to secondary persister: %v", secondaryErr)
+	}
+	return err
+}
+
+// Sync syncs each of Primary and Secondary that is a Syncer. As with Save, only the result of syncing Primary is
+// returned.
+func (p *TeePersister) Sync() error {
+	var err error
+	if syncer, ok := p.Primary.(Syncer); ok {
+		err = syncer.Sync()
+	}
+	if syncer, ok := p.Secondary.(Syncer); ok {
+		if secondaryErr := syncer.Sync(); secondaryErr != nil {
+			logging.Warningf("TeePersister: failed to sync secondary persister: %v", secondaryErr)
+		}
+	}
+	return err
+}
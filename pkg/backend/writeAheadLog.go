@@ -0,0 +1,102 @@
+// Copyright 2016-2024, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/pkg/v3/secrets"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+)
+
+// WriteAheadLog is a local file in which a SnapshotManager records each snapshot before handing it to its persister.
+// The entry is removed once the persister has saved the snapshot, so an entry that is still present when a deployment
+// starts is a snapshot whose write was interrupted, e.g. by a crash, and can be recovered with Replay. The file holds
+// a deployment in the format read by `pulumi stack import`.
+type WriteAheadLog struct {
+	Path string
+}
+
+// Replay saves the snapshot recorded in the log, if there is one, with the given persister, and then clears the log.
+// The secrets provider is used to load the snapshot's secrets manager. Replay returns whether there was an entry to
+// replay; if saving it fails, the entry is kept so that it can be replayed again.
+func (w *WriteAheadLog) Replay(
+	ctx context.Context,
+	persister SnapshotPersister,
+	secretsProvider secrets.Provider,
+) (bool, error) {
+	contents, err := os.ReadFile(w.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("reading write-ahead log: %w", err)
+	}
+
+	var untyped apitype.UntypedDeployment
+	if err := json.Unmarshal(contents, &untyped); err != nil {
+		return true, fmt.Errorf("unmarshalling write-ahead log: %w", err)
+	}
+	snap, err := stack.DeserializeUntypedDeployment(ctx, &untyped, secretsProvider)
+	if err != nil {
+		return true, fmt.Errorf("deserializing write-ahead log: %w", err)
+	}
+	if err := persister.Save(snap); err != nil {
+		return true, fmt.Errorf("saving snapshot from write-ahead log: %w", err)
+	}
+	return true, w.clear()
+}
+
+// record durably writes the given snapshot to the log in place of any entry already there. The entry is written to a
+// temporary file that is then renamed over the log, so that a crash while writing it cannot corrupt the log.
+func (w *WriteAheadLog) record(snap *deploy.Snapshot) error {
+	contents, err := marshalUntypedDeployment(snap)
+	if err != nil {
+		return err
+	}
+
+	tmp := w.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(contents); err != nil {
+		contract.IgnoreClose(f)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		contract.IgnoreClose(f)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.Path)
+}
+
+// clear removes the entry from the log, if there is one.
+func (w *WriteAheadLog) clear() error {
+	if err := os.Remove(w.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("clearing write-ahead log: %w", err)
+	}
+	return nil
+}
@@ -905,11 +905,14 @@ func listConfig(
 ) error {
 	var env *esc.Environment
 	var diags []apitype.EnvironmentDiagnostic
-	var err error
+	effective, err := withProjectEnvironment(project, ps)
+	if err != nil {
+		return err
+	}
 	if openEnvironment {
-		env, diags, err = openStackEnv(ctx, stack, ps)
+		env, diags, err = openStackEnv(ctx, stack, effective)
 	} else {
-		env, diags, err = checkStackEnv(ctx, stack, ps)
+		env, diags, err = checkStackEnv(ctx, stack, effective)
 	}
 	if err != nil {
 		return err
@@ -1083,10 +1086,14 @@ func getConfig(
 
 	var env *esc.Environment
 	var diags []apitype.EnvironmentDiagnostic
+	effective, err := withProjectEnvironment(project, ps)
+	if err != nil {
+		return err
+	}
 	if openEnvironment {
-		env, diags, err = openStackEnv(ctx, stack, ps)
+		env, diags, err = openStackEnv(ctx, stack, effective)
 	} else {
-		env, diags, err = checkStackEnv(ctx, stack, ps)
+		env, diags, err = checkStackEnv(ctx, stack, effective)
 	}
 	if err != nil {
 		return err
@@ -20,6 +20,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
 
 	"github.com/erikgeiser/promptkit/confirmation"
 	"github.com/pulumi/pulumi/pkg/v3/backend"
@@ -44,6 +46,7 @@ func newConfigEnvCmd(stackRef *string) *cobra.Command {
 		requireStack:     cmdStack.RequireStack,
 		loadProjectStack: cmdStack.LoadProjectStack,
 		saveProjectStack: cmdStack.SaveProjectStack,
+		saveProject:      saveProjectFile,
 		stackRef:         stackRef,
 	}
 
@@ -59,6 +62,7 @@ func newConfigEnvCmd(stackRef *string) *cobra.Command {
 	cmd.AddCommand(newConfigEnvAddCmd(&impl))
 	cmd.AddCommand(newConfigEnvRmCmd(&impl))
 	cmd.AddCommand(newConfigEnvLsCmd(&impl))
+	cmd.AddCommand(newConfigEnvExtractCmd(&impl))
 
 	return cmd
 }
@@ -93,9 +97,34 @@ type configEnvCmd struct {
 
 	saveProjectStack func(ctx context.Context, stack backend.Stack, ps *workspace.ProjectStack) error
 
+	saveProject func(project *workspace.Project, path string) error
+
 	stackRef *string
 }
 
+// saveProjectFile writes the given project to the project file at the given path. The project is first written to a
+// temporary file alongside it, which then replaces the original, so that the project file is never left partially
+// written.
+func saveProjectFile(project *workspace.Project, path string) error {
+	// The temporary file keeps the original's extension, which determines how the project is encoded.
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*"+filepath.Ext(path))
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	if err := tmp.Close(); err != nil {
+		return errors.Join(err, os.Remove(tmpPath))
+	}
+
+	if err := project.Save(tmpPath); err != nil {
+		return errors.Join(err, os.Remove(tmpPath))
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errors.Join(err, os.Remove(tmpPath))
+	}
+	return nil
+}
+
 func (cmd *configEnvCmd) initArgs() {
 	cmd.interactive = cmdutil.Interactive()
 	cmd.color = cmdutil.GetGlobalColorization()
@@ -125,9 +154,8 @@ func (cmd *configEnvCmd) loadEnvPreamble(ctx context.Context,
 		return nil, nil, nil, err
 	}
 
-	_, ok := stack.Backend().(backend.EnvironmentsBackend)
-	if !ok {
-		return nil, nil, nil, fmt.Errorf("backend %v does not support environments", stack.Backend().Name())
+	if _, err := requireEnvironmentsBackend(ctx, stack); err != nil {
+		return nil, nil, nil, err
 	}
 
 	projectStack, err := cmd.loadProjectStack(ctx, cmd.diags, project, stack)
@@ -138,12 +166,30 @@ func (cmd *configEnvCmd) loadEnvPreamble(ctx context.Context,
 	return projectStack, project, &stack, nil
 }
 
+// requireEnvironmentsBackend returns the stack's backend if it supports environments. The stack's reference is
+// validated first, so that a reference that is malformed or that the user may not access is reported as such rather
+// than as a failure partway through an operation.
+func requireEnvironmentsBackend(ctx context.Context, stack backend.Stack) (backend.EnvironmentsBackend, error) {
+	if err := stack.Backend().ValidateReference(ctx, stack.Ref()); err != nil {
+		return nil, err
+	}
+
+	envBackend, ok := stack.Backend().(backend.EnvironmentsBackend)
+	if !ok {
+		return nil, fmt.Errorf("backend %v does not support environments", stack.Backend().Name())
+	}
+	return envBackend, nil
+}
+
 func (cmd *configEnvCmd) listStackEnvironments(ctx context.Context, jsonOut bool) error {
-	projectStack, _, _, err := cmd.loadEnvPreamble(ctx)
+	projectStack, project, _, err := cmd.loadEnvPreamble(ctx)
 	if err != nil {
 		return err
 	}
-	imports := projectStack.Environment.Imports()
+	// The environments that the project gives to all of its stacks are imported ahead of the stack's own.
+	projectImports := project.Environment.Imports()
+	stackImports := projectStack.Environment.Imports()
+	imports := append(slices.Clip(projectImports), stackImports...)
 
 	if jsonOut {
 		if len(imports) == 0 {
@@ -155,14 +201,28 @@ func (cmd *configEnvCmd) listStackEnvironments(ctx context.Context, jsonOut bool
 			}
 		}
 	} else {
+		// The source of each environment is only shown if any come from the project, so that the output for stacks
+		// of projects without environments is unchanged.
+		headers := []string{"ENVIRONMENTS"}
+		if len(projectImports) > 0 {
+			headers = append(headers, "IMPORTED BY")
+		}
 		rows := []cmdutil.TableRow{}
-		for _, imp := range imports {
-			rows = append(rows, cmdutil.TableRow{Columns: []string{imp}})
+		for i, imp := range imports {
+			columns := []string{imp}
+			if len(projectImports) > 0 {
+				source := "stack"
+				if i < len(projectImports) {
+					source = "project"
+				}
+				columns = append(columns, source)
+			}
+			rows = append(rows, cmdutil.TableRow{Columns: columns})
 		}
 
 		if len(imports) > 0 {
 			ui.FprintTable(cmd.stdout, cmdutil.Table{
-				Headers: []string{"ENVIRONMENTS"},
+				Headers: headers,
 				Rows:    rows,
 			}, nil)
 		} else {
@@ -174,11 +234,25 @@ func (cmd *configEnvCmd) listStackEnvironments(ctx context.Context, jsonOut bool
 	return nil
 }
 
+// importedByProjectOnly returns true if the given stack imports the named environment only through its project (see
+// workspace.Project.StackEnvironment), in which case it cannot be removed from the stack's own environment.
+func importedByProjectOnly(project *workspace.Project, projectStack *workspace.ProjectStack, envName string) bool {
+	return !slices.Contains(projectStack.Environment.Imports(), envName) &&
+		slices.Contains(project.Environment.Imports(), envName)
+}
+
+// projectEnvironmentError returns the error reported when asked to remove an environment from a stack that only
+// imports it through its project.
+func projectEnvironmentError(project *workspace.Project, envName string) error {
+	return fmt.Errorf("environment %v is imported by every stack of project %v; remove it from the project file "+
+		"instead", envName, project.Name)
+}
+
 func (cmd *configEnvCmd) editStackEnvironment(
 	ctx context.Context,
 	showSecrets bool,
 	yes bool,
-	edit func(stack *workspace.ProjectStack) error,
+	edit func(project *workspace.Project, stack *workspace.ProjectStack) error,
 ) error {
 	if !yes && !cmd.interactive {
 		return errors.New("--yes must be passed in to proceed when running in non-interactive mode")
@@ -189,16 +263,29 @@ func (cmd *configEnvCmd) editStackEnvironment(
 		return err
 	}
 
-	if err := edit(projectStack); err != nil {
+	if err := edit(project, projectStack); err != nil {
 		return err
 	}
 
+	return cmd.confirmAndSaveStackEnvironment(ctx, project, *stack, projectStack, showSecrets, yes)
+}
+
+// confirmAndSaveStackEnvironment lists the given stack's configuration as it will be once its edited environment is
+// saved and, unless yes is set, asks the user to confirm before saving it.
+func (cmd *configEnvCmd) confirmAndSaveStackEnvironment(
+	ctx context.Context,
+	project *workspace.Project,
+	stack backend.Stack,
+	projectStack *workspace.ProjectStack,
+	showSecrets bool,
+	yes bool,
+) error {
 	if err := listConfig(
 		ctx,
 		cmd.ssml,
 		cmd.stdout,
 		project,
-		*stack,
+		stack,
 		projectStack,
 		showSecrets,
 		false, /*jsonOut*/
@@ -222,7 +309,7 @@ func (cmd *configEnvCmd) editStackEnvironment(
 		}
 	}
 
-	if err = cmd.saveProjectStack(ctx, *stack, projectStack); err != nil {
+	if err := cmd.saveProjectStack(ctx, stack, projectStack); err != nil {
 		return fmt.Errorf("saving stack config: %w", err)
 	}
 	return nil
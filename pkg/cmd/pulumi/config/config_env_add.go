@@ -57,7 +57,7 @@ type configEnvAddCmd struct {
 
 func (cmd *configEnvAddCmd) run(ctx context.Context, args []string) error {
 	return cmd.parent.editStackEnvironment(
-		ctx, cmd.showSecrets, cmd.yes, func(stack *workspace.ProjectStack) error {
+		ctx, cmd.showSecrets, cmd.yes, func(_ *workspace.Project, stack *workspace.ProjectStack) error {
 			stack.Environment = stack.Environment.Append(args...)
 			return nil
 		})
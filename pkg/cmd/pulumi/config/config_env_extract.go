@@ -0,0 +1,130 @@
+// Copyright 2016-2024, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+func newConfigEnvExtractCmd(parent *configEnvCmd) *cobra.Command {
+	impl := configEnvExtractCmd{parent: parent}
+
+	cmd := &cobra.Command{
+		Use:   "extract <environment-name>",
+		Short: "Copies an environment's configuration values into a stack",
+		Long: "Copies the configuration values that an environment imported by a stack provides into the stack's\n" +
+			"configuration. This is the inverse of `pulumi config env init`. Secret values are encrypted with the\n" +
+			"stack's secrets provider. Values that are already set in the stack's configuration take precedence\n" +
+			"over those from the environment, as they do when the stack is deployed.",
+		Args: cmdutil.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			parent.initArgs()
+			return impl.run(cmd.Context(), args)
+		},
+	}
+
+	cmd.Flags().BoolVar(
+		&impl.remove, "remove", false,
+		"Also remove the environment from the stack's import list")
+	cmd.Flags().BoolVar(
+		&impl.showSecrets, "show-secrets", false,
+		"Show secret values in plaintext instead of ciphertext")
+	cmd.Flags().BoolVarP(
+		&impl.yes, "yes", "y", false,
+		"True to save changes without prompting")
+
+	return cmd
+}
+
+type configEnvExtractCmd struct {
+	parent *configEnvCmd
+
+	remove      bool
+	showSecrets bool
+	yes         bool
+}
+
+func (cmd *configEnvExtractCmd) run(ctx context.Context, args []string) error {
+	if !cmd.yes && !cmd.parent.interactive {
+		return errors.New("--yes must be passed in to proceed when running in non-interactive mode")
+	}
+
+	projectStack, project, stackPtr, err := cmd.parent.loadEnvPreamble(ctx)
+	if err != nil {
+		return err
+	}
+	stack := *stackPtr
+
+	// The values of an environment that the stack imports through its project can be copied, but the environment can
+	// only be removed from the project as a whole.
+	envName := args[0]
+	if importedByProjectOnly(project, projectStack, envName) {
+		if cmd.remove {
+			return projectEnvironmentError(project, envName)
+		}
+	} else if !slices.Contains(projectStack.Environment.Imports(), envName) {
+		return fmt.Errorf("stack %v does not import environment %v", stack.Ref().Name(), envName)
+	}
+
+	// Only the named environment is opened, so that values from the stack's other environments are not copied.
+	envBackend, err := requireEnvironmentsBackend(ctx, stack)
+	if err != nil {
+		return err
+	}
+	def, err := yaml.Marshal(map[string]any{"imports": []string{envName}})
+	if err != nil {
+		return err
+	}
+	orgName := stack.(interface{ OrgName() string }).OrgName()
+	env, diags, err := envBackend.OpenYAMLEnvironment(ctx, orgName, def, 2*time.Hour)
+	if err != nil {
+		return fmt.Errorf("opening environment %v: %w", envName, err)
+	}
+	if len(diags) != 0 {
+		return fmt.Errorf("opening environment %v: %w", envName, diags)
+	}
+
+	encrypter, _, err := cmd.parent.ssml.GetEncrypter(ctx, stack, projectStack)
+	if err != nil {
+		return err
+	}
+
+	// Merging the environment's values into the stack's configuration with a project that defines no configuration of
+	// its own copies just the environment's values, resolving keys without a namespace to the project's.
+	if projectStack.Config == nil {
+		projectStack.Config = config.Map{}
+	}
+	err = workspace.ApplyProjectConfig(ctx, stack.Ref().Name().String(), &workspace.Project{Name: project.Name},
+		env.Properties["pulumiConfig"], projectStack.Config, encrypter)
+	if err != nil {
+		return fmt.Errorf("copying values from environment %v: %w", envName, err)
+	}
+
+	if cmd.remove {
+		projectStack.Environment = projectStack.Environment.Remove(envName)
+	}
+
+	return cmd.parent.confirmAndSaveStackEnvironment(ctx, project, stack, projectStack, cmd.showSecrets, cmd.yes)
+}
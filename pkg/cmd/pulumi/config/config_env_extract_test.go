@@ -0,0 +1,184 @@
+// Copyright 2016-2024, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pulumi/esc"
+	"github.com/pulumi/esc/eval"
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/display"
+	cmdBackend "github.com/pulumi/pulumi/pkg/v3/cmd/pulumi/backend"
+	cmdStack "github.com/pulumi/pulumi/pkg/v3/cmd/pulumi/stack"
+	pkgWorkspace "github.com/pulumi/pulumi/pkg/v3/workspace"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag/colors"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withOpenYAMLEnvironment makes the backend of the given command's stack open environments by evaluating them against
+// the given definitions.
+func withOpenYAMLEnvironment(t *testing.T, parent *configEnvCmd, envs envDefMap) {
+	requireStack := parent.requireStack
+	parent.requireStack = func(
+		ctx context.Context,
+		sink diag.Sink,
+		ws pkgWorkspace.Context,
+		lm cmdBackend.LoginManager,
+		stackName string,
+		lopt cmdStack.LoadOption,
+		opts display.Options,
+	) (backend.Stack, error) {
+		stack, err := requireStack(ctx, sink, ws, lm, stackName, lopt, opts)
+		require.NoError(t, err)
+		mockStack := stack.(*backend.MockStack)
+		backendF := mockStack.BackendF
+		mockStack.BackendF = func() backend.Backend {
+			envBackend := backendF().(*backend.MockEnvironmentsBackend)
+			envBackend.OpenYAMLEnvironmentF = func(
+				ctx context.Context,
+				org string,
+				yaml []byte,
+				duration time.Duration,
+			) (*esc.Environment, apitype.EnvironmentDiagnostics, error) {
+				decl, diags, err := eval.LoadYAMLBytes("<yaml>", yaml)
+				if err != nil {
+					return nil, nil, err
+				}
+				env, evalDiags := eval.EvalEnvironment(ctx, "<yaml>", decl, nil, nil, envs, &esc.ExecContext{})
+				diags.Extend(evalDiags...)
+				return env, mapEvalDiags(diags), nil
+			}
+			return envBackend
+		}
+		return mockStack, nil
+	}
+}
+
+func TestConfigEnvExtract(t *testing.T) {
+	t.Parallel()
+
+	projectYAML := `name: test
+runtime: yaml`
+
+	t.Run("round trip", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		plaintext := map[string]config.Plaintext{
+			"aws:region":   config.NewPlaintext("us-west-2"),
+			"app:password": config.NewSecurePlaintext("hunter2"),
+			"app:tags": config.NewPlaintext(map[string]config.Plaintext{
+				"env": config.NewPlaintext("testing"),
+			}),
+		}
+		cfg := make(config.Map)
+		for k, v := range plaintext {
+			cv, err := v.Encrypt(ctx, config.Base64Crypter)
+			require.NoError(t, err)
+			ns, name, _ := strings.Cut(k, ":")
+			cfg[config.MustMakeKey(ns, name)] = cv
+		}
+		stackYAML, err := encoding.YAML.Marshal(workspace.ProjectStack{Config: cfg})
+		require.NoError(t, err)
+
+		// Move the stack's configuration to an environment...
+		envs := envDefMap{}
+		var initStackYAML string
+		parent := newConfigEnvCmdForInitTest(
+			strings.NewReader("y"), &bytes.Buffer{}, projectYAML, string(stackYAML), &initStackYAML, envs)
+		init := &configEnvInitCmd{parent: parent, newCrypter: newBase64EvalCrypter, yes: true}
+		require.NoError(t, init.run(ctx, nil))
+		require.Equal(t, "environment:\n  - test/stack\n", initStackYAML)
+
+		// ...and back again.
+		var extractStackYAML string
+		parent = newConfigEnvCmdForInitTest(
+			strings.NewReader("y"), &bytes.Buffer{}, projectYAML, initStackYAML, &extractStackYAML, envs)
+		withOpenYAMLEnvironment(t, parent, envs)
+		extract := &configEnvExtractCmd{parent: parent, remove: true, yes: true}
+		require.NoError(t, extract.run(ctx, []string{"test/stack"}))
+
+		// Assert.
+		ps, err := workspace.LoadProjectStackBytes(
+			diag.DefaultSink(io.Discard, io.Discard, diag.FormatOptions{Color: colors.Never}),
+			&workspace.Project{Name: "test"}, []byte(extractStackYAML), "Pulumi.stack.yaml", encoding.YAML)
+		require.NoError(t, err)
+		assert.Empty(t, ps.Environment.Imports())
+		assert.True(t, ps.Config[config.MustMakeKey("app", "password")].Secure())
+
+		expected, err := cfg.Decrypt(config.Base64Crypter)
+		require.NoError(t, err)
+		actual, err := ps.Config.Decrypt(config.Base64Crypter)
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	})
+
+	t.Run("not imported", func(t *testing.T) {
+		t.Parallel()
+
+		var newStackYAML string
+		parent := newConfigEnvCmdForInitTest(
+			strings.NewReader("y"), &bytes.Buffer{}, projectYAML, "environment:\n  - env\n", &newStackYAML, envDefMap{})
+		extract := &configEnvExtractCmd{parent: parent, yes: true}
+		err := extract.run(context.Background(), []string{"other"})
+		assert.ErrorContains(t, err, "stack stack does not import environment other")
+		assert.Empty(t, newStackYAML)
+	})
+
+	t.Run("project import", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		const projectYAML = `name: test
+runtime: yaml
+environment:
+  - shared
+`
+		envs := envDefMap{"shared": "values:\n  pulumiConfig:\n    aws:region: us-west-2\n"}
+
+		// The values of an environment imported by the project can be copied into the stack...
+		var newStackYAML string
+		parent := newConfigEnvCmdForInitTest(
+			strings.NewReader("y"), &bytes.Buffer{}, projectYAML, "", &newStackYAML, envs)
+		withOpenYAMLEnvironment(t, parent, envs)
+		extract := &configEnvExtractCmd{parent: parent, yes: true}
+		require.NoError(t, extract.run(ctx, []string{"shared"}))
+		assert.Equal(t, "config:\n  aws:region: us-west-2\n", newStackYAML)
+
+		// ...but the environment cannot be removed from the stack alone.
+		newStackYAML = ""
+		parent = newConfigEnvCmdForInitTest(
+			strings.NewReader("y"), &bytes.Buffer{}, projectYAML, "", &newStackYAML, envs)
+		withOpenYAMLEnvironment(t, parent, envs)
+		extract = &configEnvExtractCmd{parent: parent, remove: true, yes: true}
+		err := extract.run(ctx, []string{"shared"})
+		assert.ErrorContains(t, err, "environment shared is imported by every stack of project test")
+		assert.Empty(t, newStackYAML)
+	})
+}
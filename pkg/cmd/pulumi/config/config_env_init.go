@@ -21,22 +21,28 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"path"
 	"strings"
 	"text/template"
 
 	"github.com/charmbracelet/glamour"
 	"github.com/erikgeiser/promptkit/confirmation"
+	"github.com/hexops/gotextdiff"
+	"github.com/hexops/gotextdiff/myers"
+	"github.com/hexops/gotextdiff/span"
 	"github.com/pulumi/esc"
 	"github.com/pulumi/esc/eval"
 	"github.com/pulumi/pulumi/pkg/v3/backend"
 	"github.com/pulumi/pulumi/pkg/v3/backend/display"
 	cmdBackend "github.com/pulumi/pulumi/pkg/v3/cmd/pulumi/backend"
 	cmdStack "github.com/pulumi/pulumi/pkg/v3/cmd/pulumi/stack"
+	"github.com/pulumi/pulumi/pkg/v3/cmd/pulumi/ui"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v3"
 )
@@ -45,6 +51,10 @@ func newConfigEnvInitCmd(parent *configEnvCmd) *cobra.Command {
 	impl := &configEnvInitCmd{
 		parent:     parent,
 		newCrypter: newConfigEnvInitCrypter,
+		selectKeys: func(options, defaults []string) ([]string, error) {
+			return ui.PromptUserMulti("Select the configuration values to move to the environment:",
+				options, defaults, parent.color), nil
+		},
 	}
 
 	cmd := &cobra.Command{
@@ -63,9 +73,57 @@ func newConfigEnvInitCmd(parent *configEnvCmd) *cobra.Command {
 	cmd.Flags().StringVar(
 		&impl.envName, "env", "",
 		`The name of the environment to create. Defaults to "<project name>/<stack name>"`)
+	cmd.Flags().StringVar(
+		&impl.secretsEnvName, "secrets-env", "",
+		"The name of a separate environment to create for secret configuration values. If set, the environment\n"+
+			"created for the stack holds only non-secret values and imports this one")
+	cmd.Flags().StringVar(
+		&impl.baseEnvName, "base-env", "",
+		"The name of an existing environment for the created environment to import, e.g. an organization-wide set of\n"+
+			"defaults. Values from the stack's configuration take precedence over those from the base environment")
+	cmd.Flags().StringVar(
+		&impl.fromConfig, "from-config", "",
+		"The path of a stack configuration file, e.g. a backup, to read configuration values from instead of the\n"+
+			"stack's own configuration. The stack's configuration still references the created environment")
+	cmd.Flags().StringArrayVar(
+		&impl.requiredKeys, "require-key", nil,
+		"The path of a value that the created environment must define, e.g. 'pulumiConfig[\"aws:region\"]'. The\n"+
+			"environment is checked after it is evaluated, so values from imported environments count. May be\n"+
+			"specified multiple times")
+	cmd.Flags().StringVar(
+		&impl.schemaPath, "schema", "",
+		"The path of a JSON schema that the value of the created environment must conform to. The environment is\n"+
+			"checked after it is evaluated, so values from imported environments count")
+	cmd.Flags().StringArrayVar(
+		&impl.secretPatterns, "secret-pattern", nil,
+		"A glob pattern, e.g. '*password*', for the keys of configuration values to store as secrets in the\n"+
+			"environment even if they are not secret in the stack's configuration. Patterns are matched against the\n"+
+			"whole key, including its namespace, ignoring case. May be specified multiple times")
 	cmd.Flags().BoolVar(
 		&impl.showSecrets, "show-secrets", false,
 		"Show secret values in plaintext instead of ciphertext")
+	cmd.Flags().BoolVar(
+		&impl.storePlaintext, "store-plaintext", false,
+		"Store secret configuration values in the created environment as plain values. By default they are stored\n"+
+			"as secrets, which the environment encrypts at rest. This is independent of --show-secrets, which only\n"+
+			"affects what is displayed")
+	cmd.Flags().BoolVar(
+		&impl.noPreview, "no-preview", false,
+		"Create the environment without evaluating and displaying a preview of it first. The environment is still\n"+
+			"validated when it is created. Requires --yes")
+	cmd.Flags().BoolVar(
+		&impl.projectLevel, "project-level", false,
+		"Add the created environment to the project's Pulumi.yaml, so that every stack of the project imports it,\n"+
+			"rather than to the stack's configuration")
+	cmd.Flags().BoolVar(
+		&impl.asImport, "as-import", false,
+		"Create the environment without referencing it from the stack, and print the imports stanza to add to the\n"+
+			"definition of another environment to import it instead. The stack's configuration is left unchanged")
+	cmd.Flags().BoolVar(
+		&impl.diff, "diff", false,
+		"Show the differences between the definition of the environment that would be created and that of the\n"+
+			"existing environment, without changing anything. Secret values are only compared if --show-secrets is\n"+
+			"passed")
 	cmd.Flags().BoolVar(
 		&impl.keepConfig, "keep-config", false,
 		"Do not remove configuration values from the stack after creating the environment")
@@ -83,27 +141,87 @@ var envPreviewTemplate = template.Must(template.New("env-preview").Parse("# Valu
 	"# Definition\n" +
 	"```yaml\n" +
 	"{{.Definition}}\n" +
-	"```\n"))
+	"```\n" +
+	"{{if .SecretsDefinition}}" +
+	"# Secrets Definition\n" +
+	"```yaml\n" +
+	"{{.SecretsDefinition}}\n" +
+	"```\n" +
+	"{{end}}"))
 
 type configEnvInitCmd struct {
 	parent *configEnvCmd
 
 	newCrypter func() (evalCrypter, error)
 
-	envName     string
-	showSecrets bool
-	keepConfig  bool
-	yes         bool
+	// selectKeys asks the user to choose among the given options, which are initially set to defaults.
+	selectKeys func(options, defaults []string) ([]string, error)
+
+	envName        string
+	secretsEnvName string
+	baseEnvName    string
+	fromConfig     string
+	requiredKeys   []string
+	schemaPath     string
+	secretPatterns []string
+	showSecrets    bool
+	storePlaintext bool
+	noPreview      bool
+	projectLevel   bool
+	asImport       bool
+	diff           bool
+	keepConfig     bool
+	yes            bool
 }
 
 func (cmd *configEnvInitCmd) run(ctx context.Context, args []string) error {
-	if !cmd.yes && !cmd.parent.interactive {
+	if !cmd.yes && !cmd.diff && !cmd.parent.interactive {
 		return errors.New("--yes must be passed in to proceed when running in non-interactive mode")
 	}
 
+	if cmd.noPreview {
+		if !cmd.yes {
+			return errors.New("--no-preview requires --yes")
+		}
+		if len(cmd.requiredKeys) != 0 {
+			return errors.New("--require-key cannot be used with --no-preview")
+		}
+		if cmd.schemaPath != "" {
+			return errors.New("--schema cannot be used with --no-preview")
+		}
+	}
+
+	if cmd.asImport && cmd.projectLevel {
+		return errors.New("--as-import cannot be used with --project-level")
+	}
+
+	requiredPaths := make([]resource.PropertyPath, len(cmd.requiredKeys))
+	for i, k := range cmd.requiredKeys {
+		keyPath, err := resource.ParsePropertyPath(k)
+		if err != nil {
+			return fmt.Errorf("invalid --require-key %q: %w", k, err)
+		}
+		requiredPaths[i] = keyPath
+	}
+
+	for _, pattern := range cmd.secretPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid --secret-pattern %q: %w", pattern, err)
+		}
+	}
+
+	var schema *jsonschema.Schema
+	if cmd.schemaPath != "" {
+		compiled, err := jsonschema.Compile(cmd.schemaPath)
+		if err != nil {
+			return fmt.Errorf("invalid --schema %q: %w", cmd.schemaPath, err)
+		}
+		schema = compiled
+	}
+
 	opts := display.Options{Color: cmd.parent.color}
 
-	project, _, err := cmd.parent.ws.ReadProject()
+	project, projectPath, err := cmd.parent.ws.ReadProject()
 	if err != nil {
 		return err
 	}
@@ -121,48 +239,136 @@ func (cmd *configEnvInitCmd) run(ctx context.Context, args []string) error {
 		return err
 	}
 
-	envBackend, ok := stack.Backend().(backend.EnvironmentsBackend)
-	if !ok {
-		return fmt.Errorf("backend %v does not support environments", stack.Backend().Name())
+	envBackend, err := requireEnvironmentsBackend(ctx, stack)
+	if err != nil {
+		return err
 	}
 
 	orgName := stack.(interface{ OrgName() string }).OrgName()
 
 	// Parse given environment name
-	// Try to split the given envName into project/env
 	// Default to the stack's project and name if the environment project and/or name are not provided
-	envProject := project.Name.String()
-	envName := stack.Ref().Name().String()
-	first, second, found := strings.Cut(cmd.envName, "/")
-	if found {
-		envProject = first
-		envName = second
-	} else if first != "" {
-		envName = first
-	}
+	envProject, envName := parseEnvName(cmd.envName, project.Name.String(), stack.Ref().Name().String())
 
 	fmt.Fprintf(cmd.parent.stdout, "Creating environment %v/%v for stack %v...\n", envProject, envName, stack.Ref().Name())
 
+	// If secrets are to be kept separately, they go in an environment in the same project by default.
+	splitSecrets := cmd.secretsEnvName != ""
+	var secretsEnvProject, secretsEnvName string
+	if splitSecrets {
+		secretsEnvProject, secretsEnvName = parseEnvName(cmd.secretsEnvName, envProject, "")
+		if secretsEnvName == "" {
+			return errors.New("--secrets-env must include an environment name")
+		}
+		if secretsEnvProject == envProject && secretsEnvName == envName {
+			return errors.New("--secrets-env must name a different environment from --env")
+		}
+		fmt.Fprintf(cmd.parent.stdout, "Secret values will be stored in environment %v/%v.\n",
+			secretsEnvProject, secretsEnvName)
+	}
+
+	// The base environment is imported first so that the stack's own values take precedence over its values.
+	var imports []string
+	if cmd.baseEnvName != "" {
+		baseEnvProject, baseEnvName := parseEnvName(cmd.baseEnvName, envProject, "")
+		if baseEnvName == "" {
+			return errors.New("--base-env must include an environment name")
+		}
+		if baseEnvProject == envProject && baseEnvName == envName {
+			return errors.New("--base-env must name a different environment from --env")
+		}
+		imports = append(imports, baseEnvProject+"/"+baseEnvName)
+	}
+
 	projectStack, config, err := cmd.getStackConfig(ctx, cmdutil.Diag(), project, stack)
 	if err != nil {
 		return err
 	}
+	config = cmd.applySecretPatterns(config)
+
+	// When running interactively, let the user pick which values to move. All of them are moved by default.
+	moveAll := true
+	if !cmd.yes && cmd.parent.interactive {
+		selected, err := cmd.selectConfig(config)
+		if err != nil {
+			return err
+		}
+		moveAll = len(selected) == len(config)
+		config = selected
+	}
 
 	crypter, err := cmd.newCrypter()
 	if err != nil {
 		return err
 	}
 
-	yaml, err := cmd.renderEnvironmentDefinition(ctx, envName, crypter, config, cmd.showSecrets)
+	yaml, err := cmd.renderEnvironmentDefinition(ctx, envName, crypter, imports, config, cmd.showSecrets)
 	if err != nil {
 		return err
 	}
 
-	preview, err := cmd.renderPreview(ctx, envBackend, orgName, envName, yaml, cmd.showSecrets)
-	if err != nil {
-		return err
+	// When splitting out secrets, the preview still shows the combined value that the stack will see, since the
+	// environment created for the stack imports the secrets environment.
+	var secretsYAML []byte
+	definition := yaml
+	if splitSecrets {
+		plain, secret := splitSecretConfig(config)
+		secretsYAML, err = cmd.renderEnvironmentDefinition(ctx, secretsEnvName, crypter, nil, secret, cmd.showSecrets)
+		if err != nil {
+			return err
+		}
+		imports := append(imports, secretsEnvProject+"/"+secretsEnvName)
+		definition, err = cmd.renderEnvironmentDefinition(ctx, envName, crypter, imports, plain, cmd.showSecrets)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cmd.diff {
+		if splitSecrets {
+			err = cmd.diffEnvironment(ctx, envBackend, orgName, secretsEnvProject, secretsEnvName, secretsYAML, crypter)
+			if err != nil {
+				return err
+			}
+		}
+		return cmd.diffEnvironment(ctx, envBackend, orgName, envProject, envName, definition, crypter)
+	}
+
+	// Evaluating the environment for the preview requires a round trip to the service, which can be skipped when the
+	// environment will be saved without prompting anyway.
+	if !cmd.noPreview {
+		env, diags, err := envBackend.CheckYAMLEnvironment(ctx, orgName, yaml)
+		if err != nil {
+			return err
+		}
+		if len(diags) != 0 {
+			return fmt.Errorf("internal error: %w", diags)
+		}
+
+		preview, err := cmd.renderPreview(env, definition, secretsYAML, cmd.showSecrets)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(cmd.parent.stdout, preview)
+
+		var missing []string
+		for i, keyPath := range requiredPaths {
+			if !hasEnvValue(env, keyPath) {
+				missing = append(missing, cmd.requiredKeys[i])
+			}
+		}
+		if len(missing) != 0 {
+			return fmt.Errorf("environment %v/%v is missing required keys: %v", envProject, envName,
+				strings.Join(missing, ", "))
+		}
+
+		if schema != nil {
+			if violations := validateEnvSchema(env, schema); len(violations) != 0 {
+				return fmt.Errorf("environment %v/%v does not conform to schema %v:\n  %v", envProject, envName,
+					cmd.schemaPath, strings.Join(violations, "\n  "))
+			}
+		}
 	}
-	fmt.Fprint(cmd.parent.stdout, preview)
 
 	if !cmd.yes {
 		save, err := confirmation.New("Save?", confirmation.Yes).RunPrompt()
@@ -174,12 +380,122 @@ func (cmd *configEnvInitCmd) run(ctx context.Context, args []string) error {
 		}
 	}
 
+	// The secrets environment must exist before the environment that imports it can be created. There is no way to
+	// create both atomically, so check the secrets environment up front to make it unlikely that only one is created.
+	if splitSecrets {
+		if _, diags, err := envBackend.CheckYAMLEnvironment(ctx, orgName, secretsYAML); err != nil {
+			return fmt.Errorf("checking secrets environment: %w", err)
+		} else if len(diags) != 0 {
+			return fmt.Errorf("internal error checking secrets environment: %w", diags)
+		}
+
+		err = cmd.createEnvironment(ctx, envBackend, orgName, secretsEnvProject, secretsEnvName, secretsYAML, crypter)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = cmd.createEnvironment(ctx, envBackend, orgName, envProject, envName, definition, crypter)
+	if err != nil {
+		if splitSecrets {
+			return fmt.Errorf("%w; the secrets environment %s/%s has already been created", err,
+				secretsEnvProject, secretsEnvName)
+		}
+		return err
+	}
+
+	fullName := fmt.Sprintf("%s/%s", envProject, envName)
+	if cmd.asImport {
+		return cmd.printImportStanza(fullName)
+	}
+	if cmd.projectLevel {
+		project.Environment = project.Environment.Append(fullName)
+		if err = cmd.parent.saveProject(project, projectPath); err != nil {
+			return fmt.Errorf("saving project: %w", err)
+		}
+	} else {
+		projectStack.Environment = projectStack.Environment.Append(fullName)
+	}
+	if !cmd.keepConfig {
+		// Values read from another file may not be all of the stack's values, so only those moved are removed.
+		if moveAll && cmd.fromConfig == "" {
+			projectStack.Config = nil
+		} else {
+			removeMovedConfig(projectStack, config)
+		}
+	}
+	if err = cmd.parent.saveProjectStack(ctx, stack, projectStack); err != nil {
+		// Put the project back as it was, so that neither file refers to the new environment. Removing the last import
+		// of the environment undoes appending it.
+		if cmd.projectLevel {
+			project.Environment = project.Environment.Remove(fullName)
+			if restoreErr := cmd.parent.saveProject(project, projectPath); restoreErr != nil {
+				return fmt.Errorf("saving stack config: %w; restoring the project also failed: %w", err, restoreErr)
+			}
+		}
+		return fmt.Errorf("saving stack config: %w", err)
+	}
+	return nil
+}
+
+// printImportStanza prints the imports stanza that another environment's definition needs in order to import the
+// environment with the given name.
+func (cmd *configEnvInitCmd) printImportStanza(fullName string) error {
+	var doc yaml.Node
+	if err := doc.Encode(map[string][]string{"imports": {fullName}}); err != nil {
+		return err
+	}
+	stanza, err := encodeDefinition(&doc)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.parent.stdout, "Created environment %v. To import it, add the following to the definition of "+
+		"another environment:\n\n", fullName)
+	_, err = cmd.parent.stdout.Write(stanza)
+	return err
+}
+
+// storedDefinition returns the definition that is stored for an environment created from the given definition: its
+// secrets are decrypted first if needed and, if --store-plaintext was passed, stored as plain values rather than as
+// secrets.
+func (cmd *configEnvInitCmd) storedDefinition(
+	ctx context.Context,
+	envName string,
+	yaml []byte,
+	crypter evalCrypter,
+) ([]byte, error) {
 	if !cmd.showSecrets {
+		var err error
 		yaml, err = eval.DecryptSecrets(ctx, envName, yaml, crypter)
 		if err != nil {
-			return err
+			return nil, err
+		}
+	}
+	if cmd.storePlaintext {
+		var err error
+		yaml, err = unwrapSecrets(yaml)
+		if err != nil {
+			return nil, fmt.Errorf("removing secrets: %w", err)
 		}
 	}
+	return yaml, nil
+}
+
+// createEnvironment creates an environment with the given definition (see storedDefinition).
+func (cmd *configEnvInitCmd) createEnvironment(
+	ctx context.Context,
+	envBackend backend.EnvironmentsBackend,
+	orgName string,
+	envProject string,
+	envName string,
+	yaml []byte,
+	crypter evalCrypter,
+) error {
+	yaml, err := cmd.storedDefinition(ctx, envName, yaml, crypter)
+	if err != nil {
+		return err
+	}
 
 	diags, err := envBackend.CreateEnvironment(ctx, orgName, envProject, envName, yaml)
 	if err != nil {
@@ -188,18 +504,261 @@ func (cmd *configEnvInitCmd) run(ctx context.Context, args []string) error {
 	if len(diags) != 0 {
 		return fmt.Errorf("internal error creating environment: %w", diags)
 	}
+	return nil
+}
 
-	fullName := fmt.Sprintf("%s/%s", envProject, envName)
-	projectStack.Environment = projectStack.Environment.Append(fullName)
-	if !cmd.keepConfig {
-		projectStack.Config = nil
+// diffEnvironment prints the differences between the definition of the given environment, if it exists, and the
+// definition that would be stored for it (see storedDefinition). Unless --show-secrets was passed, secret values are
+// hidden on both sides, so changes to them are not shown.
+func (cmd *configEnvInitCmd) diffEnvironment(
+	ctx context.Context,
+	envBackend backend.EnvironmentsBackend,
+	orgName string,
+	envProject string,
+	envName string,
+	yaml []byte,
+	crypter evalCrypter,
+) error {
+	fullName := envProject + "/" + envName
+
+	proposed, err := cmd.storedDefinition(ctx, envName, yaml, crypter)
+	if err != nil {
+		return err
 	}
-	if err = cmd.parent.saveProjectStack(ctx, stack, projectStack); err != nil {
-		return fmt.Errorf("saving stack config: %w", err)
+	current, err := envBackend.GetEnvironment(ctx, orgName, envProject, envName, cmd.showSecrets)
+	if err != nil {
+		return fmt.Errorf("getting environment %v: %w", fullName, err)
+	}
+	if current == nil {
+		fmt.Fprintf(cmd.parent.stdout, "Environment %v does not exist.\n", fullName)
+	}
+
+	// Both definitions are re-encoded in the same way so that only meaningful differences are shown.
+	normalize := func(def []byte) ([]byte, error) {
+		if len(def) == 0 {
+			return nil, nil
+		}
+		return rewriteSecrets(def, !cmd.showSecrets)
+	}
+	if current, err = normalize(current); err != nil {
+		return fmt.Errorf("reading environment %v: %w", fullName, err)
 	}
+	if proposed, err = normalize(proposed); err != nil {
+		return err
+	}
+
+	if bytes.Equal(current, proposed) {
+		fmt.Fprintf(cmd.parent.stdout, "No changes to environment %v.\n", fullName)
+		return nil
+	}
+	edits := myers.ComputeEdits(span.URIFromPath(fullName), string(current), string(proposed))
+	fmt.Fprint(cmd.parent.stdout, gotextdiff.ToUnified(fullName+" (current)", fullName+" (new)", string(current), edits))
 	return nil
 }
 
+// applySecretPatterns returns the given config with each value whose key matches one of the --secret-pattern patterns
+// made secret.
+func (cmd *configEnvInitCmd) applySecretPatterns(config resource.PropertyMap) resource.PropertyMap {
+	if len(cmd.secretPatterns) == 0 {
+		return config
+	}
+
+	result := make(resource.PropertyMap, len(config))
+	for k, v := range config {
+		key := strings.ToLower(string(k))
+		for _, pattern := range cmd.secretPatterns {
+			// The patterns have already been validated, so Match cannot fail.
+			if matched, _ := path.Match(strings.ToLower(pattern), key); matched && !v.IsSecret() {
+				v = resource.MakeSecret(v)
+				break
+			}
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// selectConfig asks the user which of the given configuration values to move to the environment and returns those
+// that were selected. Each value is listed along with its key, with secrets hidden unless --show-secrets was passed.
+func (cmd *configEnvInitCmd) selectConfig(config resource.PropertyMap) (resource.PropertyMap, error) {
+	keys := config.StableKeys()
+	if len(keys) == 0 {
+		return config, nil
+	}
+
+	options := make([]string, len(keys))
+	optionKeys := make(map[string]resource.PropertyKey, len(keys))
+	for i, k := range keys {
+		value := "[secret]"
+		if cmd.showSecrets || !config[k].ContainsSecrets() {
+			rendered, err := json.Marshal(cmd.render(config[k]))
+			if err != nil {
+				return nil, fmt.Errorf("rendering %v: %w", k, err)
+			}
+			value = string(rendered)
+		}
+		options[i] = fmt.Sprintf("%v: %v", k, value)
+		optionKeys[options[i]] = k
+	}
+
+	selected, err := cmd.selectKeys(options, options)
+	if err != nil {
+		return nil, err
+	}
+	if len(selected) == 0 {
+		return nil, errors.New("no configuration values were selected")
+	}
+
+	result := make(resource.PropertyMap, len(selected))
+	for _, option := range selected {
+		k, ok := optionKeys[option]
+		if !ok {
+			return nil, fmt.Errorf("unknown selection %q", option)
+		}
+		result[k] = config[k]
+	}
+	return result, nil
+}
+
+// removeMovedConfig removes the configuration values that have been moved to an environment from the given stack.
+func removeMovedConfig(ps *workspace.ProjectStack, moved resource.PropertyMap) {
+	for k := range ps.Config {
+		if _, has := moved[resource.PropertyKey(k.String())]; has {
+			delete(ps.Config, k)
+		}
+	}
+}
+
+// unwrapSecrets replaces each `fn::secret` in the given plaintext environment definition with the value it wraps.
+func unwrapSecrets(def []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(def, &doc); err != nil {
+		return nil, err
+	}
+
+	var unwrap func(node *yaml.Node)
+	unwrap = func(node *yaml.Node) {
+		for node.Kind == yaml.MappingNode && len(node.Content) == 2 && node.Content[0].Value == "fn::secret" {
+			*node = *node.Content[1]
+		}
+		for _, child := range node.Content {
+			unwrap(child)
+		}
+	}
+	unwrap(&doc)
+	return encodeDefinition(&doc)
+}
+
+// rewriteSecrets re-encodes the given environment definition, replacing the value of each `fn::secret` with
+// "[secret]" if redact is true.
+func rewriteSecrets(def []byte, redact bool) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(def, &doc); err != nil {
+		return nil, err
+	}
+
+	var rewrite func(node *yaml.Node)
+	rewrite = func(node *yaml.Node) {
+		if redact && node.Kind == yaml.MappingNode && len(node.Content) == 2 && node.Content[0].Value == "fn::secret" {
+			node.Content[1] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "[secret]"}
+			return
+		}
+		for _, child := range node.Content {
+			rewrite(child)
+		}
+	}
+	rewrite(&doc)
+	return encodeDefinition(&doc)
+}
+
+// encodeDefinition encodes the given environment definition as YAML.
+func encodeDefinition(doc *yaml.Node) ([]byte, error) {
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// hasEnvValue returns true if the given evaluated environment has a non-null value at the given path.
+func hasEnvValue(env *esc.Environment, keyPath resource.PropertyPath) bool {
+	values := resource.NewPropertyValue(esc.NewValue(env.Properties).ToJSON(true /* redact */))
+	v, ok := keyPath.Get(values)
+	return ok && !v.IsNull()
+}
+
+// validateEnvSchema validates the value of the given environment against the given JSON schema, and returns a
+// description of each violation found. Secret values are validated in plaintext so that their types are checked.
+func validateEnvSchema(env *esc.Environment, schema *jsonschema.Schema) []string {
+	// The schema validator only accepts the types produced by decoding JSON, so round-trip the value through JSON.
+	data, err := json.Marshal(esc.NewValue(env.Properties).ToJSON(false /* redact */))
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return []string{err.Error()}
+	}
+
+	err = schema.Validate(value)
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		if err != nil {
+			return []string{err.Error()}
+		}
+		return nil
+	}
+
+	var violations []string
+	var appendViolations func(err *jsonschema.ValidationError)
+	appendViolations = func(err *jsonschema.ValidationError) {
+		if len(err.Causes) == 0 {
+			violations = append(violations, fmt.Sprintf("#%v: %v", err.InstanceLocation, err.Message))
+		}
+		for _, cause := range err.Causes {
+			appendViolations(cause)
+		}
+	}
+	appendViolations(validationErr)
+	return violations
+}
+
+// parseEnvName splits the given "[project/]name" environment name into its project and name, using the given defaults
+// for any parts that are not provided.
+func parseEnvName(s, defaultProject, defaultName string) (string, string) {
+	first, second, found := strings.Cut(s, "/")
+	if found {
+		return first, second
+	} else if first != "" {
+		return defaultProject, first
+	}
+	return defaultProject, defaultName
+}
+
+// splitSecretConfig splits the given config into its non-secret and secret values. Objects are split key by key, since
+// an environment's values are merged with those of the environments it imports. Arrays that contain secrets cannot be
+// split in that way, so they are treated as secret in their entirety.
+func splitSecretConfig(config resource.PropertyMap) (plain, secret resource.PropertyMap) {
+	plain, secret = resource.PropertyMap{}, resource.PropertyMap{}
+	for k, v := range config {
+		switch {
+		case !v.ContainsSecrets():
+			plain[k] = v
+		case v.IsObject():
+			p, s := splitSecretConfig(v.ObjectValue())
+			if len(p) != 0 {
+				plain[k] = resource.NewObjectProperty(p)
+			}
+			secret[k] = resource.NewObjectProperty(s)
+		default:
+			secret[k] = v
+		}
+	}
+	return plain, secret
+}
+
 func (cmd *configEnvInitCmd) getStackConfig(
 	ctx context.Context,
 	sink diag.Sink,
@@ -222,13 +781,69 @@ func (cmd *configEnvInitCmd) getStackConfig(
 		}
 	}
 
-	m, err := ps.Config.AsDecryptedPropertyMap(ctx, decrypter)
+	configPS, configDecrypter := ps, decrypter
+	if cmd.fromConfig != "" {
+		configPS, err = workspace.LoadProjectStack(sink, project, cmd.fromConfig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("loading config from %s: %w", cmd.fromConfig, err)
+		}
+		// The file may have its own secrets configuration. Any changes made to it while setting up its decrypter are
+		// not saved, since the file is only read.
+		configDecrypter, _, err = cmd.parent.ssml.GetDecrypter(ctx, stack, configPS)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	m, err := configPS.Config.AsDecryptedPropertyMap(ctx, configDecrypter)
 	if err != nil {
 		return nil, nil, err
 	}
+	if err = keepDeclaredStrings(project, configPS.Config, configDecrypter, m); err != nil {
+		return nil, nil, err
+	}
 	return ps, m, nil
 }
 
+// keepDeclaredStrings restores as strings the values in m of the keys in cfg that the project explicitly declares to
+// be strings. Stack configuration does not record the types of its values, so AsDecryptedPropertyMap turns any that
+// look like numbers or booleans, e.g. "123", into numbers or booleans, which would fail the project's type check once
+// read back from the environment.
+func keepDeclaredStrings(
+	project *workspace.Project,
+	cfg config.Map,
+	decrypter config.Decrypter,
+	m resource.PropertyMap,
+) error {
+	for name, configType := range project.Config {
+		if !configType.IsExplicitlyTyped() || configType.TypeName() != "string" {
+			continue
+		}
+		if !strings.Contains(name, ":") {
+			name = project.Name.String() + ":" + name
+		}
+		key, err := config.ParseKey(name)
+		if err != nil {
+			// Invalid keys are reported when the project's configuration is validated.
+			continue
+		}
+		v, ok := cfg[key]
+		if !ok || v.Object() {
+			continue
+		}
+		plaintext, err := v.Value(decrypter)
+		if err != nil {
+			return err
+		}
+		value := resource.NewProperty(plaintext)
+		if v.Secure() {
+			value = resource.MakeSecret(value)
+		}
+		m[resource.PropertyKey(key.String())] = value
+	}
+	return nil
+}
+
 func (cmd *configEnvInitCmd) render(v resource.PropertyValue) any {
 	switch {
 	case v.IsBool():
@@ -264,17 +879,23 @@ func (cmd *configEnvInitCmd) renderEnvironmentDefinition(
 	ctx context.Context,
 	envName string,
 	encrypter eval.Encrypter,
+	imports []string,
 	config resource.PropertyMap,
 	showSecrets bool,
 ) ([]byte, error) {
-	var b bytes.Buffer
-	enc := yaml.NewEncoder(&b)
-	enc.SetIndent(2)
-	err := enc.Encode(map[string]any{
+	def := map[string]any{
 		"values": map[string]any{
 			"pulumiConfig": cmd.render(resource.NewObjectProperty(config)),
 		},
-	})
+	}
+	if len(imports) != 0 {
+		def["imports"] = imports
+	}
+
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	err := enc.Encode(def)
 	if err != nil {
 		return nil, err
 	}
@@ -291,21 +912,11 @@ func (cmd *configEnvInitCmd) renderEnvironmentDefinition(
 }
 
 func (cmd *configEnvInitCmd) renderPreview(
-	ctx context.Context,
-	b backend.EnvironmentsBackend,
-	org string,
-	name string,
-	yaml []byte,
+	env *esc.Environment,
+	definition []byte,
+	secretsDefinition []byte,
 	showSecrets bool,
 ) (string, error) {
-	env, diags, err := b.CheckYAMLEnvironment(ctx, org, yaml)
-	if err != nil {
-		return "", err
-	}
-	if len(diags) != 0 {
-		return "", fmt.Errorf("internal error: %w", diags)
-	}
-
 	envJSON, err := json.MarshalIndent(esc.NewValue(env.Properties).ToJSON(!showSecrets), "", "  ")
 	if err != nil {
 		return "", fmt.Errorf("encoding value: %w", err)
@@ -313,8 +924,9 @@ func (cmd *configEnvInitCmd) renderPreview(
 
 	var markdown bytes.Buffer
 	err = envPreviewTemplate.Execute(&markdown, map[string]any{
-		"Preview":    string(envJSON),
-		"Definition": string(yaml),
+		"Preview":           string(envJSON),
+		"Definition":        string(definition),
+		"SecretsDefinition": string(secretsDefinition),
 	})
 	if err != nil {
 		return "", fmt.Errorf("rendering preview: %w", err)
@@ -17,14 +17,29 @@ package config
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/pulumi/esc"
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/display"
+	cmdBackend "github.com/pulumi/pulumi/pkg/v3/cmd/pulumi/backend"
+	cmdStack "github.com/pulumi/pulumi/pkg/v3/cmd/pulumi/stack"
+	pkgWorkspace "github.com/pulumi/pulumi/pkg/v3/workspace"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
 )
 
 type base64EvalCrypter struct{}
@@ -325,4 +340,902 @@ runtime: yaml`
 `
 		assert.Equal(t, expectedYAML, newStackYAML)
 	})
+
+	t.Run("list of objects, show secrets", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		plaintext := map[string]config.Plaintext{
+			"app:servers": config.NewPlaintext([]config.Plaintext{
+				config.NewPlaintext(map[string]config.Plaintext{
+					"host": config.NewPlaintext("alpha"),
+					"port": config.NewPlaintext(int64(80)),
+				}),
+				config.NewPlaintext(map[string]config.Plaintext{
+					"host":     config.NewPlaintext("beta"),
+					"password": config.NewSecurePlaintext("hunter2"),
+					"port":     config.NewPlaintext(int64(443)),
+					"tls":      config.NewPlaintext(true),
+				}),
+			}),
+		}
+		cfg := make(config.Map)
+		for k, v := range plaintext {
+			cv, err := v.Encrypt(ctx, config.Base64Crypter)
+			require.NoError(t, err)
+			ns, name, _ := strings.Cut(k, ":")
+			cfg[config.MustMakeKey(ns, name)] = cv
+		}
+
+		stackYAML, err := encoding.YAML.Marshal(workspace.ProjectStack{Config: cfg})
+		require.NoError(t, err)
+
+		var newStackYAML string
+		stdin := strings.NewReader("y")
+		var stdout bytes.Buffer
+		envs := envDefMap{}
+		parent := newConfigEnvCmdForInitTest(stdin, &stdout, projectYAML, string(stackYAML), &newStackYAML, envs)
+		init := &configEnvInitCmd{parent: parent, newCrypter: newBase64EvalCrypter, showSecrets: true, yes: true}
+		err = init.run(ctx, nil)
+		require.NoError(t, err)
+
+		const expectedOut = "Creating environment test/stack for stack stack...\n" +
+			"# Value\n" +
+			"```json\n" +
+			"{\n" +
+			"  \"pulumiConfig\": {\n" +
+			"    \"app:servers\": [\n" +
+			"      {\n" +
+			"        \"host\": \"alpha\",\n" +
+			"        \"port\": 80\n" +
+			"      },\n" +
+			"      {\n" +
+			"        \"host\": \"beta\",\n" +
+			"        \"password\": \"hunter2\",\n" +
+			"        \"port\": 443,\n" +
+			"        \"tls\": true\n" +
+			"      }\n" +
+			"    ]\n" +
+			"  }\n" +
+			"}\n" +
+			"```\n" +
+			"# Definition\n" +
+			"```yaml\n" +
+			"values:\n" +
+			"  pulumiConfig:\n" +
+			"    app:servers:\n" +
+			"      - host: alpha\n" +
+			"        port: 80\n" +
+			"      - host: beta\n" +
+			"        password:\n" +
+			"          fn::secret: hunter2\n" +
+			"        port: 443\n" +
+			"        tls: true\n" +
+			"\n" +
+			"```\n" +
+			""
+
+		assert.Equal(t, expectedOut, cleanStdoutIncludingPrompt(stdout.String()))
+
+		// The environment that was created must nest the list of objects rather than flattening or stringifying it.
+		var def struct {
+			Values struct {
+				PulumiConfig map[string]any `yaml:"pulumiConfig"`
+			} `yaml:"values"`
+		}
+		require.NoError(t, yaml.Unmarshal([]byte(envs["stack"]), &def))
+		servers, ok := def.Values.PulumiConfig["app:servers"].([]any)
+		require.True(t, ok, "expected app:servers to be a list, got %T", def.Values.PulumiConfig["app:servers"])
+		require.Len(t, servers, 2)
+		assert.Equal(t, map[string]any{"host": "alpha", "port": 80}, servers[0])
+		beta, ok := servers[1].(map[string]any)
+		require.True(t, ok, "expected app:servers[1] to be an object, got %T", servers[1])
+		assert.Equal(t, "beta", beta["host"])
+		assert.Equal(t, 443, beta["port"])
+		assert.Equal(t, true, beta["tls"])
+		assert.Contains(t, beta["password"], "fn::secret")
+
+		const expectedYAML = `environment:
+  - test/stack
+`
+		assert.Equal(t, expectedYAML, newStackYAML)
+	})
+
+	t.Run("secrets env", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		plaintext := map[string]config.Plaintext{
+			"aws:region":   config.NewPlaintext("us-west-2"),
+			"app:password": config.NewSecurePlaintext("hunter2"),
+			"app:tags": config.NewPlaintext(map[string]config.Plaintext{
+				"env":   config.NewPlaintext("testing"),
+				"token": config.NewSecurePlaintext("s3cr3t"),
+			}),
+		}
+		cfg := make(config.Map)
+		for k, v := range plaintext {
+			cv, err := v.Encrypt(ctx, config.Base64Crypter)
+			require.NoError(t, err)
+			ns, name, _ := strings.Cut(k, ":")
+			cfg[config.MustMakeKey(ns, name)] = cv
+		}
+
+		stackYAML, err := encoding.YAML.Marshal(workspace.ProjectStack{Config: cfg})
+		require.NoError(t, err)
+
+		var newStackYAML string
+		stdin := strings.NewReader("y")
+		var stdout bytes.Buffer
+		envs := envDefMap{}
+		parent := newConfigEnvCmdForInitTest(stdin, &stdout, projectYAML, string(stackYAML), &newStackYAML, envs)
+		init := &configEnvInitCmd{
+			parent:         parent,
+			newCrypter:     newBase64EvalCrypter,
+			secretsEnvName: "stack-secrets",
+			yes:            true,
+		}
+		err = init.run(ctx, nil)
+		require.NoError(t, err)
+
+		out := cleanStdoutIncludingPrompt(stdout.String())
+		assert.Contains(t, out, "Secret values will be stored in environment test/stack-secrets.\n")
+		assert.Contains(t, out, "# Secrets Definition\n")
+
+		// The stack's environment holds only the non-secret values, and imports the secrets environment.
+		var env map[string]any
+		require.NoError(t, yaml.Unmarshal([]byte(envs["stack"]), &env))
+		assert.Equal(t, map[string]any{
+			"imports": []any{"test/stack-secrets"},
+			"values": map[string]any{
+				"pulumiConfig": map[string]any{
+					"app:tags":   map[string]any{"env": "testing"},
+					"aws:region": "us-west-2",
+				},
+			},
+		}, env)
+
+		// The secrets environment holds only the secret values.
+		var secretsEnv map[string]any
+		require.NoError(t, yaml.Unmarshal([]byte(envs["stack-secrets"]), &secretsEnv))
+		assert.Equal(t, map[string]any{
+			"values": map[string]any{
+				"pulumiConfig": map[string]any{
+					"app:password": map[string]any{"fn::secret": "hunter2"},
+					"app:tags": map[string]any{
+						"token": map[string]any{"fn::secret": "s3cr3t"},
+					},
+				},
+			},
+		}, secretsEnv)
+
+		const expectedYAML = `environment:
+  - test/stack
+`
+		assert.Equal(t, expectedYAML, newStackYAML)
+	})
+
+	t.Run("base env", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		cv, err := config.NewPlaintext("us-west-2").Encrypt(ctx, config.Base64Crypter)
+		require.NoError(t, err)
+		stackYAML, err := encoding.YAML.Marshal(workspace.ProjectStack{Config: config.Map{
+			config.MustMakeKey("aws", "region"): cv,
+		}})
+		require.NoError(t, err)
+
+		var newStackYAML string
+		stdin := strings.NewReader("y")
+		var stdout bytes.Buffer
+		envs := envDefMap{
+			"platform/defaults": `values:
+  pulumiConfig:
+    aws:region: us-east-1
+    app:owner: platform
+`,
+		}
+		parent := newConfigEnvCmdForInitTest(stdin, &stdout, projectYAML, string(stackYAML), &newStackYAML, envs)
+		init := &configEnvInitCmd{
+			parent:      parent,
+			newCrypter:  newBase64EvalCrypter,
+			baseEnvName: "platform/defaults",
+			yes:         true,
+		}
+		err = init.run(ctx, nil)
+		require.NoError(t, err)
+
+		// The preview shows the merged value, with the stack's values taking precedence over the base environment's.
+		out := cleanStdoutIncludingPrompt(stdout.String())
+		assert.Contains(t, out, "\"app:owner\": \"platform\"")
+		assert.Contains(t, out, "\"aws:region\": \"us-west-2\"")
+
+		// The created environment imports the base environment and holds only the stack's values.
+		var env map[string]any
+		require.NoError(t, yaml.Unmarshal([]byte(envs["stack"]), &env))
+		assert.Equal(t, map[string]any{
+			"imports": []any{"platform/defaults"},
+			"values": map[string]any{
+				"pulumiConfig": map[string]any{
+					"aws:region": "us-west-2",
+				},
+			},
+		}, env)
+
+		const expectedYAML = `environment:
+  - test/stack
+`
+		assert.Equal(t, expectedYAML, newStackYAML)
+	})
+
+	t.Run("show secrets but store encrypted", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		cfg := make(config.Map)
+		for k, v := range map[string]config.Plaintext{
+			"aws:region":   config.NewPlaintext("us-west-2"),
+			"app:password": config.NewSecurePlaintext("hunter2"),
+		} {
+			cv, err := v.Encrypt(ctx, config.Base64Crypter)
+			require.NoError(t, err)
+			ns, name, _ := strings.Cut(k, ":")
+			cfg[config.MustMakeKey(ns, name)] = cv
+		}
+		stackYAML, err := encoding.YAML.Marshal(workspace.ProjectStack{Config: cfg})
+		require.NoError(t, err)
+
+		run := func(storePlaintext bool) (string, map[string]any) {
+			var newStackYAML string
+			stdin := strings.NewReader("y")
+			var stdout bytes.Buffer
+			envs := envDefMap{}
+			parent := newConfigEnvCmdForInitTest(stdin, &stdout, projectYAML, string(stackYAML), &newStackYAML, envs)
+			init := &configEnvInitCmd{
+				parent:         parent,
+				newCrypter:     newBase64EvalCrypter,
+				showSecrets:    true,
+				storePlaintext: storePlaintext,
+				yes:            true,
+			}
+			require.NoError(t, init.run(ctx, nil))
+
+			var env map[string]any
+			require.NoError(t, yaml.Unmarshal([]byte(envs["stack"]), &env))
+			return cleanStdoutIncludingPrompt(stdout.String()), env
+		}
+
+		// The preview shows the secret in plaintext, but it is still stored as a secret.
+		out, env := run(false)
+		assert.Contains(t, out, `"app:password": "hunter2"`)
+		assert.Equal(t, map[string]any{
+			"values": map[string]any{
+				"pulumiConfig": map[string]any{
+					"app:password": map[string]any{"fn::secret": "hunter2"},
+					"aws:region":   "us-west-2",
+				},
+			},
+		}, env)
+
+		// Storing plaintext is a separate choice.
+		_, env = run(true)
+		assert.Equal(t, map[string]any{
+			"values": map[string]any{
+				"pulumiConfig": map[string]any{
+					"app:password": "hunter2",
+					"aws:region":   "us-west-2",
+				},
+			},
+		}, env)
+	})
+
+	t.Run("required keys", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		cv, err := config.NewPlaintext("us-west-2").Encrypt(ctx, config.Base64Crypter)
+		require.NoError(t, err)
+		stackYAML, err := encoding.YAML.Marshal(workspace.ProjectStack{Config: config.Map{
+			config.MustMakeKey("aws", "region"): cv,
+		}})
+		require.NoError(t, err)
+
+		run := func(baseEnvName string) (map[string]string, string, error) {
+			var newStackYAML string
+			stdin := strings.NewReader("y")
+			var stdout bytes.Buffer
+			envs := envDefMap{
+				"platform/defaults": `values:
+  pulumiConfig:
+    app:owner: platform
+`,
+			}
+			parent := newConfigEnvCmdForInitTest(stdin, &stdout, projectYAML, string(stackYAML), &newStackYAML, envs)
+			init := &configEnvInitCmd{
+				parent:       parent,
+				newCrypter:   newBase64EvalCrypter,
+				baseEnvName:  baseEnvName,
+				requiredKeys: []string{`pulumiConfig["aws:region"]`, `pulumiConfig["app:owner"]`},
+				yes:          true,
+			}
+			return envs, newStackYAML, init.run(ctx, nil)
+		}
+
+		// The stack's config lacks app:owner, so nothing is created.
+		envs, newStackYAML, err := run("")
+		assert.EqualError(t, err, `environment test/stack is missing required keys: pulumiConfig["app:owner"]`)
+		assert.NotContains(t, envs, "stack")
+		assert.Empty(t, newStackYAML)
+
+		// A value from an imported environment satisfies the requirement.
+		envs, _, err = run("platform/defaults")
+		require.NoError(t, err)
+		assert.Contains(t, envs, "stack")
+	})
+
+	t.Run("schema", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		schemaPath := filepath.Join(t.TempDir(), "schema.json")
+		err := os.WriteFile(schemaPath, []byte(`{
+  "type": "object",
+  "properties": {
+    "pulumiConfig": {
+      "type": "object",
+      "properties": {
+        "app:port": {"type": "integer"}
+      },
+      "required": ["app:port"]
+    }
+  }
+}`), 0o600)
+		require.NoError(t, err)
+
+		run := func(port config.Plaintext) (map[string]string, string, error) {
+			cv, err := port.Encrypt(ctx, config.Base64Crypter)
+			require.NoError(t, err)
+			stackYAML, err := encoding.YAML.Marshal(workspace.ProjectStack{Config: config.Map{
+				config.MustMakeKey("app", "port"): cv,
+			}})
+			require.NoError(t, err)
+
+			var newStackYAML string
+			var stdout bytes.Buffer
+			envs := envDefMap{}
+			parent := newConfigEnvCmdForInitTest(
+				strings.NewReader(""), &stdout, projectYAML, string(stackYAML), &newStackYAML, envs)
+			init := &configEnvInitCmd{
+				parent:     parent,
+				newCrypter: newBase64EvalCrypter,
+				schemaPath: schemaPath,
+				yes:        true,
+			}
+			return envs, newStackYAML, init.run(ctx, nil)
+		}
+
+		// A port that is not an integer violates the schema, so nothing is created.
+		envs, newStackYAML, err := run(config.NewPlaintext("eighty"))
+		assert.EqualError(t, err, "environment test/stack does not conform to schema "+schemaPath+":\n"+
+			"  #/pulumiConfig/app:port: expected integer, but got string")
+		assert.NotContains(t, envs, "stack")
+		assert.Empty(t, newStackYAML)
+
+		// The same goes for a secret port, which is checked in plaintext.
+		_, _, err = run(config.NewSecurePlaintext("eighty"))
+		assert.ErrorContains(t, err, "#/pulumiConfig/app:port: expected integer, but got string")
+
+		envs, _, err = run(config.NewPlaintext(int64(80)))
+		require.NoError(t, err)
+		assert.Contains(t, envs, "stack")
+
+		// A schema is of no use without evaluating the environment.
+		init := &configEnvInitCmd{schemaPath: schemaPath, noPreview: true, yes: true}
+		assert.EqualError(t, init.run(ctx, nil), "--schema cannot be used with --no-preview")
+	})
+
+	t.Run("secret pattern", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		cfg := make(config.Map)
+		for k, v := range map[string]config.Plaintext{
+			"aws:region":     config.NewPlaintext("us-west-2"),
+			"app:apiKey":     config.NewPlaintext("abc123"),
+			"app:signingKey": config.NewSecurePlaintext("def456"),
+		} {
+			cv, err := v.Encrypt(ctx, config.Base64Crypter)
+			require.NoError(t, err)
+			ns, name, _ := strings.Cut(k, ":")
+			cfg[config.MustMakeKey(ns, name)] = cv
+		}
+		stackYAML, err := encoding.YAML.Marshal(workspace.ProjectStack{Config: cfg})
+		require.NoError(t, err)
+
+		var newStackYAML string
+		stdin := strings.NewReader("y")
+		var stdout bytes.Buffer
+		envs := envDefMap{}
+		parent := newConfigEnvCmdForInitTest(stdin, &stdout, projectYAML, string(stackYAML), &newStackYAML, envs)
+		init := &configEnvInitCmd{
+			parent:         parent,
+			newCrypter:     newBase64EvalCrypter,
+			secretPatterns: []string{"*key*"},
+			yes:            true,
+		}
+		require.NoError(t, init.run(ctx, nil))
+
+		// The plaintext value whose key matches the pattern is hidden in the preview and stored as a secret.
+		out := cleanStdoutIncludingPrompt(stdout.String())
+		assert.NotContains(t, out, "abc123")
+
+		var env map[string]any
+		require.NoError(t, yaml.Unmarshal([]byte(envs["stack"]), &env))
+		assert.Equal(t, map[string]any{
+			"values": map[string]any{
+				"pulumiConfig": map[string]any{
+					"app:apiKey":     map[string]any{"fn::secret": "abc123"},
+					"app:signingKey": map[string]any{"fn::secret": "def456"},
+					"aws:region":     "us-west-2",
+				},
+			},
+		}, env)
+	})
+
+	t.Run("declared string types", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		// The project declares zip and test:flag to be strings, but says nothing of app:count.
+		const typedProjectYAML = `name: test
+runtime: yaml
+config:
+  zip:
+    type: string
+  test:flag:
+    type: string
+`
+		const stackYAML = `config:
+  test:zip: "123"
+  test:flag: "true"
+  app:count: "123"
+`
+
+		var newStackYAML string
+		var stdout bytes.Buffer
+		envs := envDefMap{}
+		parent := newConfigEnvCmdForInitTest(
+			strings.NewReader(""), &stdout, typedProjectYAML, stackYAML, &newStackYAML, envs)
+		init := &configEnvInitCmd{
+			parent:     parent,
+			newCrypter: newBase64EvalCrypter,
+			yes:        true,
+		}
+		require.NoError(t, init.run(ctx, nil))
+
+		// Values declared to be strings stay strings, even though they look like a number and a boolean.
+		var env map[string]any
+		require.NoError(t, yaml.Unmarshal([]byte(envs["stack"]), &env))
+		assert.Equal(t, map[string]any{
+			"values": map[string]any{
+				"pulumiConfig": map[string]any{
+					"test:zip":  "123",
+					"test:flag": "true",
+					"app:count": 123,
+				},
+			},
+		}, env)
+	})
+
+	t.Run("from config", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		const stackYAML = `config:
+  aws:region: us-west-2
+  app:other: kept
+`
+
+		var newStackYAML string
+		stdin := strings.NewReader("y")
+		var stdout bytes.Buffer
+		envs := envDefMap{}
+		parent := newConfigEnvCmdForInitTest(stdin, &stdout, projectYAML, stackYAML, &newStackYAML, envs)
+		init := &configEnvInitCmd{
+			parent:     parent,
+			newCrypter: newBase64EvalCrypter,
+			fromConfig: filepath.Join("testdata", "Pulumi.backup.yaml"),
+			yes:        true,
+		}
+		require.NoError(t, init.run(ctx, nil))
+
+		// The environment is seeded from the file rather than the stack's configuration.
+		var env map[string]any
+		require.NoError(t, yaml.Unmarshal([]byte(envs["stack"]), &env))
+		assert.Equal(t, map[string]any{
+			"values": map[string]any{
+				"pulumiConfig": map[string]any{
+					"app:password": map[string]any{"fn::secret": "hunter2"},
+					"aws:region":   "us-east-1",
+				},
+			},
+		}, env)
+
+		// The stack references the environment, and only keeps the values that were not moved.
+		var newStack map[string]any
+		require.NoError(t, yaml.Unmarshal([]byte(newStackYAML), &newStack))
+		assert.Equal(t, map[string]any{
+			"config":      map[string]any{"app:other": "kept"},
+			"environment": []any{"test/stack"},
+		}, newStack)
+	})
+
+	t.Run("no preview", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		cv, err := config.NewPlaintext("us-west-2").Encrypt(ctx, config.Base64Crypter)
+		require.NoError(t, err)
+		stackYAML, err := encoding.YAML.Marshal(workspace.ProjectStack{
+			Config: config.Map{config.MustMakeKey("aws", "region"): cv},
+		})
+		require.NoError(t, err)
+
+		var created string
+		var newStackYAML string
+		var stdout bytes.Buffer
+		parent := newConfigEnvCmdForTestWithCheckYAMLEnvironment(
+			nil,
+			&stdout,
+			projectYAML,
+			string(stackYAML),
+			func(ctx context.Context, org, project, name string, yaml []byte) (apitype.EnvironmentDiagnostics, error) {
+				created = string(yaml)
+				return nil, nil
+			},
+			func(ctx context.Context, org string, yaml []byte) (*esc.Environment, apitype.EnvironmentDiagnostics, error) {
+				t.Error("CheckYAMLEnvironment should not be called")
+				return nil, nil, nil
+			},
+			&newStackYAML,
+		)
+		init := &configEnvInitCmd{parent: parent, newCrypter: newBase64EvalCrypter, noPreview: true, yes: true}
+		require.NoError(t, init.run(ctx, nil))
+
+		assert.Equal(t, "Creating environment test/stack for stack stack...\n", stdout.String())
+		assert.Contains(t, created, "aws:region: us-west-2")
+		assert.Equal(t, "environment:\n  - test/stack\n", newStackYAML)
+	})
+
+	t.Run("project level", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		cv, err := config.NewPlaintext("us-west-2").Encrypt(ctx, config.Base64Crypter)
+		require.NoError(t, err)
+		stackYAML, err := encoding.YAML.Marshal(workspace.ProjectStack{
+			Config: config.Map{config.MustMakeKey("aws", "region"): cv},
+		})
+		require.NoError(t, err)
+
+		var newStackYAML, newProjectYAML string
+		stdin := strings.NewReader("y")
+		var stdout bytes.Buffer
+		envs := envDefMap{}
+		parent := newConfigEnvCmdForInitTest(stdin, &stdout, projectYAML, string(stackYAML), &newStackYAML, envs)
+		parent.saveProject = func(project *workspace.Project, _ string) error {
+			b, err := encoding.YAML.Marshal(project)
+			if err != nil {
+				return err
+			}
+			newProjectYAML = string(b)
+			return nil
+		}
+		init := &configEnvInitCmd{parent: parent, newCrypter: newBase64EvalCrypter, projectLevel: true, yes: true}
+		require.NoError(t, init.run(ctx, nil))
+
+		// The project gains the reference to the environment in place of the stack, whose values are still moved.
+		var project map[string]any
+		require.NoError(t, yaml.Unmarshal([]byte(newProjectYAML), &project))
+		assert.Equal(t, "test", project["name"])
+		assert.Equal(t, []any{"test/stack"}, project["environment"])
+		assert.Equal(t, "{}\n", newStackYAML)
+		assert.Contains(t, envs["stack"], "aws:region: us-west-2")
+	})
+
+	t.Run("project level, saving stack fails", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		cv, err := config.NewPlaintext("us-west-2").Encrypt(ctx, config.Base64Crypter)
+		require.NoError(t, err)
+		stackYAML, err := encoding.YAML.Marshal(workspace.ProjectStack{
+			Config: config.Map{config.MustMakeKey("aws", "region"): cv},
+		})
+		require.NoError(t, err)
+
+		var newStackYAML string
+		var projectYAMLs []string
+		stdin := strings.NewReader("y")
+		var stdout bytes.Buffer
+		parent := newConfigEnvCmdForInitTest(stdin, &stdout, projectYAML, string(stackYAML), &newStackYAML, envDefMap{})
+		parent.saveProject = func(project *workspace.Project, _ string) error {
+			b, err := encoding.YAML.Marshal(project)
+			if err != nil {
+				return err
+			}
+			projectYAMLs = append(projectYAMLs, string(b))
+			return nil
+		}
+		parent.saveProjectStack = func(context.Context, backend.Stack, *workspace.ProjectStack) error {
+			return errors.New("disk full")
+		}
+		init := &configEnvInitCmd{parent: parent, newCrypter: newBase64EvalCrypter, projectLevel: true, yes: true}
+		err = init.run(ctx, nil)
+		assert.ErrorContains(t, err, "saving stack config: disk full")
+
+		// The project is saved with the reference to the environment, and then without it again.
+		require.Len(t, projectYAMLs, 2)
+		assert.Contains(t, projectYAMLs[0], "test/stack")
+		var project map[string]any
+		require.NoError(t, yaml.Unmarshal([]byte(projectYAMLs[1]), &project))
+		assert.Equal(t, "test", project["name"])
+		assert.NotContains(t, project, "environment")
+	})
+
+	t.Run("as import", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		cv, err := config.NewPlaintext("us-west-2").Encrypt(ctx, config.Base64Crypter)
+		require.NoError(t, err)
+		stackYAML, err := encoding.YAML.Marshal(workspace.ProjectStack{
+			Config: config.Map{config.MustMakeKey("aws", "region"): cv},
+		})
+		require.NoError(t, err)
+
+		var newStackYAML string
+		var stdout bytes.Buffer
+		envs := envDefMap{}
+		parent := newConfigEnvCmdForInitTest(
+			strings.NewReader(""), &stdout, projectYAML, string(stackYAML), &newStackYAML, envs)
+		init := &configEnvInitCmd{
+			parent:     parent,
+			newCrypter: newBase64EvalCrypter,
+			envName:    "shared/aws",
+			asImport:   true,
+			noPreview:  true,
+			yes:        true,
+		}
+		require.NoError(t, init.run(ctx, nil))
+
+		// The environment is created and the stanza that imports it printed, but the stack is left alone.
+		assert.Contains(t, envs["shared/aws"], "aws:region: us-west-2")
+		assert.Equal(t, "Creating environment shared/aws for stack stack...\n"+
+			"Created environment shared/aws. To import it, add the following to the definition of another "+
+			"environment:\n\n"+
+			"imports:\n"+
+			"  - shared/aws\n", stdout.String())
+		assert.Empty(t, newStackYAML)
+	})
+
+	t.Run("unauthorized reference", func(t *testing.T) {
+		t.Parallel()
+
+		var newStackYAML string
+		stdin := strings.NewReader("y")
+		var stdout bytes.Buffer
+		parent := newConfigEnvCmdForInitTest(stdin, &stdout, projectYAML, "", &newStackYAML, envDefMap{})
+
+		// Swap in a backend that rejects the stack's reference.
+		requireStack := parent.requireStack
+		parent.requireStack = func(
+			ctx context.Context,
+			sink diag.Sink,
+			ws pkgWorkspace.Context,
+			lm cmdBackend.LoginManager,
+			stackName string,
+			lopt cmdStack.LoadOption,
+			opts display.Options,
+		) (backend.Stack, error) {
+			stack, err := requireStack(ctx, sink, ws, lm, stackName, lopt, opts)
+			require.NoError(t, err)
+			mockStack := stack.(*backend.MockStack)
+			mockStack.BackendF = func() backend.Backend {
+				return &backend.MockEnvironmentsBackend{
+					MockBackend: backend.MockBackend{
+						ValidateReferenceF: func(_ context.Context, ref backend.StackReference) error {
+							return fmt.Errorf("user %q is not a member of organization %q, which owns stack %v",
+								"alice", "org", ref)
+						},
+					},
+				}
+			}
+			return mockStack, nil
+		}
+
+		init := &configEnvInitCmd{parent: parent, newCrypter: newBase64EvalCrypter, yes: true}
+		err := init.run(context.Background(), nil)
+		assert.EqualError(t, err, `user "alice" is not a member of organization "org", which owns stack org/stack`)
+		assert.Empty(t, stdout.String())
+		assert.Empty(t, newStackYAML)
+	})
+}
+
+// withGetEnvironment makes the backend of the given command's stack return the definitions of existing environments
+// from the given definitions.
+func withGetEnvironment(t *testing.T, parent *configEnvCmd, envs envDefMap) {
+	requireStack := parent.requireStack
+	parent.requireStack = func(
+		ctx context.Context,
+		sink diag.Sink,
+		ws pkgWorkspace.Context,
+		lm cmdBackend.LoginManager,
+		stackName string,
+		lopt cmdStack.LoadOption,
+		opts display.Options,
+	) (backend.Stack, error) {
+		stack, err := requireStack(ctx, sink, ws, lm, stackName, lopt, opts)
+		require.NoError(t, err)
+		mockStack := stack.(*backend.MockStack)
+		backendF := mockStack.BackendF
+		mockStack.BackendF = func() backend.Backend {
+			envBackend := backendF().(*backend.MockEnvironmentsBackend)
+			envBackend.GetEnvironmentF = func(
+				ctx context.Context,
+				org string,
+				projectName string,
+				envName string,
+				decrypt bool,
+			) ([]byte, error) {
+				def, ok := envs[projectName+"/"+envName]
+				if !ok {
+					return nil, nil
+				}
+				return []byte(def), nil
+			}
+			return envBackend
+		}
+		return mockStack, nil
+	}
+}
+
+func TestConfigEnvInitDiff(t *testing.T) {
+	t.Parallel()
+
+	projectYAML := `name: test
+runtime: yaml`
+
+	ctx := context.Background()
+	cfg := make(config.Map)
+	for k, v := range map[string]config.Plaintext{
+		"aws:region":   config.NewPlaintext("us-east-1"),
+		"app:password": config.NewSecurePlaintext("hunter3"),
+	} {
+		cv, err := v.Encrypt(ctx, config.Base64Crypter)
+		require.NoError(t, err)
+		ns, name, _ := strings.Cut(k, ":")
+		cfg[config.MustMakeKey(ns, name)] = cv
+	}
+	stackYAML, err := encoding.YAML.Marshal(workspace.ProjectStack{Config: cfg})
+	require.NoError(t, err)
+
+	// diff runs `config env init --diff` against the given existing environments, which it must leave unchanged.
+	diff := func(t *testing.T, envs envDefMap) string {
+		before := maps.Clone(envs)
+		var newStackYAML string
+		var stdout bytes.Buffer
+		parent := newConfigEnvCmdForInitTest(
+			strings.NewReader(""), &stdout, projectYAML, string(stackYAML), &newStackYAML, envs)
+		parent.interactive = false
+		withGetEnvironment(t, parent, envs)
+
+		init := &configEnvInitCmd{parent: parent, newCrypter: newBase64EvalCrypter, diff: true}
+		require.NoError(t, init.run(ctx, nil))
+		assert.Equal(t, before, envs)
+		assert.Empty(t, newStackYAML)
+		return stdout.String()
+	}
+
+	t.Run("changed", func(t *testing.T) {
+		t.Parallel()
+
+		out := diff(t, envDefMap{"test/stack": "values:\n" +
+			"  pulumiConfig:\n" +
+			"    app:password:\n" +
+			"      fn::secret: hunter2\n" +
+			"    aws:region: us-west-2\n"})
+
+		assert.Contains(t, out, "--- test/stack (current)\n+++ test/stack (new)\n")
+		assert.Contains(t, out, "\n-    aws:region: us-west-2\n+    aws:region: us-east-1\n")
+		// Secrets are hidden, so the changed password does not show up.
+		assert.Contains(t, out, "\n       fn::secret: '[secret]'\n")
+		assert.NotContains(t, out, "hunter")
+	})
+
+	t.Run("unchanged", func(t *testing.T) {
+		t.Parallel()
+
+		out := diff(t, envDefMap{"test/stack": "values:\n" +
+			"  pulumiConfig:\n" +
+			"    app:password:\n" +
+			"      fn::secret: hunter2\n" +
+			"    aws:region: us-east-1\n"})
+
+		assert.Equal(t, "Creating environment test/stack for stack stack...\n"+
+			"No changes to environment test/stack.\n", out)
+	})
+
+	t.Run("does not exist", func(t *testing.T) {
+		t.Parallel()
+
+		out := diff(t, envDefMap{})
+
+		assert.Contains(t, out, "Environment test/stack does not exist.\n")
+		assert.Contains(t, out, "\n+    aws:region: us-east-1\n")
+		assert.NotContains(t, out, "hunter")
+	})
+}
+
+func TestConfigEnvInitSelectConfig(t *testing.T) {
+	t.Parallel()
+
+	cfg := resource.PropertyMap{
+		"aws:region":   resource.NewStringProperty("us-west-2"),
+		"app:password": resource.MakeSecret(resource.NewStringProperty("hunter2")),
+		"app:replicas": resource.NewNumberProperty(3),
+	}
+
+	var gotOptions, gotDefaults []string
+	init := &configEnvInitCmd{
+		selectKeys: func(options, defaults []string) ([]string, error) {
+			gotOptions, gotDefaults = options, defaults
+			return []string{"app:password: [secret]", "aws:region: \"us-west-2\""}, nil
+		},
+	}
+	selected, err := init.selectConfig(cfg)
+	require.NoError(t, err)
+
+	// Every value is offered, and selected by default, with secrets hidden.
+	expectedOptions := []string{
+		"app:password: [secret]",
+		"app:replicas: 3",
+		"aws:region: \"us-west-2\"",
+	}
+	assert.Equal(t, expectedOptions, gotOptions)
+	assert.Equal(t, expectedOptions, gotDefaults)
+	assert.Equal(t, resource.PropertyMap{
+		"aws:region":   cfg["aws:region"],
+		"app:password": cfg["app:password"],
+	}, selected)
+
+	// Only the selected values are removed from the stack.
+	ps := &workspace.ProjectStack{Config: config.Map{
+		config.MustMakeKey("aws", "region"):   config.NewValue("us-west-2"),
+		config.MustMakeKey("app", "password"): config.NewSecureValue("aHVudGVyMg=="),
+		config.MustMakeKey("app", "replicas"): config.NewValue("3"),
+	}}
+	removeMovedConfig(ps, selected)
+	assert.Equal(t, config.Map{config.MustMakeKey("app", "replicas"): config.NewValue("3")}, ps.Config)
+
+	// Selecting nothing is an error rather than an empty environment.
+	init.selectKeys = func(options, defaults []string) ([]string, error) {
+		return nil, nil
+	}
+	_, err = init.selectConfig(cfg)
+	assert.ErrorContains(t, err, "no configuration values were selected")
 }
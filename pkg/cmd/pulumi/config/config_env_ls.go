@@ -29,8 +29,9 @@ func newConfigEnvLsCmd(parent *configEnvCmd) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "ls",
 		Short: "Lists imported environments.",
-		Long:  "Lists the environments imported into a stack's configuration.",
-		Args:  cmdutil.NoArgs,
+		Long: "Lists the environments imported into a stack's configuration, including those that the\n" +
+			"project imports into the configuration of every stack.",
+		Args: cmdutil.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			parent.initArgs()
 			return impl.run(cmd.Context(), args)
@@ -60,6 +60,41 @@ runtime: yaml`
 		assert.Equal(t, expectedOut, cleanStdoutIncludingPrompt(stdout.String()))
 	})
 
+	t.Run("project imports", func(t *testing.T) {
+		t.Parallel()
+
+		const projectYAML = `name: test
+runtime: yaml
+environment:
+  - shared
+`
+		const stackYAML = `environment:
+    - env
+`
+
+		for _, jsonOut := range []bool{false, true} {
+			stdin := strings.NewReader("")
+			var stdout bytes.Buffer
+			parent := newConfigEnvCmdForTest(stdin, &stdout, projectYAML, stackYAML, nil, nil, nil)
+			ls := &configEnvLsCmd{parent: parent, jsonOut: boolPtr(jsonOut)}
+			require.NoError(t, ls.run(context.Background(), nil))
+
+			// The project's environments are imported ahead of the stack's own.
+			expectedOut := `ENVIRONMENTS  IMPORTED BY
+shared        project
+env           stack
+`
+			if jsonOut {
+				expectedOut = `[
+  "shared",
+  "env"
+]
+`
+			}
+			assert.Equal(t, expectedOut, cleanStdoutIncludingPrompt(stdout.String()))
+		}
+	})
+
 	t.Run("no imports, json", func(t *testing.T) {
 		t.Parallel()
 
@@ -28,8 +28,9 @@ func newConfigEnvRmCmd(parent *configEnvCmd) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "rm <environment-name>",
 		Short: "Remove environment from a stack",
-		Long:  "Removes an environment from a stack's import list.",
-		Args:  cmdutil.ExactArgs(1),
+		Long: "Removes an environment from a stack's import list. Environments that the project imports into\n" +
+			"every stack must be removed from the project file instead.",
+		Args: cmdutil.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			parent.initArgs()
 			return impl.run(cmd.Context(), args)
@@ -55,7 +56,10 @@ type configEnvRmCmd struct {
 
 func (cmd *configEnvRmCmd) run(ctx context.Context, args []string) error {
 	return cmd.parent.editStackEnvironment(
-		ctx, cmd.showSecrets, cmd.yes, func(stack *workspace.ProjectStack) error {
+		ctx, cmd.showSecrets, cmd.yes, func(project *workspace.Project, stack *workspace.ProjectStack) error {
+			if importedByProjectOnly(project, stack, args[0]) {
+				return projectEnvironmentError(project, args[0])
+			}
 			stack.Environment = stack.Environment.Remove(args[0])
 			return nil
 		})
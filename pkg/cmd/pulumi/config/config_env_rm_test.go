@@ -100,6 +100,25 @@ Save? Yes
 		assert.Equal(t, expectedYAML, newStackYAML)
 	})
 
+	t.Run("project import", func(t *testing.T) {
+		t.Parallel()
+
+		const projectYAML = `name: test
+runtime: yaml
+environment:
+  - shared
+`
+
+		var newStackYAML string
+		stdin := strings.NewReader("y")
+		var stdout bytes.Buffer
+		parent := newConfigEnvCmdForTest(stdin, &stdout, projectYAML, "", nil, nil, &newStackYAML)
+		rm := &configEnvRmCmd{parent: parent, yes: true}
+		err := rm.run(context.Background(), []string{"shared"})
+		assert.ErrorContains(t, err, "environment shared is imported by every stack of project test")
+		assert.Empty(t, newStackYAML)
+	})
+
 	t.Run("effects -> no effects", func(t *testing.T) {
 		t.Parallel()
 
@@ -121,6 +121,11 @@ func newConfigEnvCmdForTestWithCheckYAMLEnvironment(
 				},
 				BackendF: func() backend.Backend {
 					return &backend.MockEnvironmentsBackend{
+						MockBackend: backend.MockBackend{
+							ValidateReferenceF: func(context.Context, backend.StackReference) error {
+								return nil
+							},
+						},
 						CreateEnvironmentF:    createEnvironment,
 						CheckYAMLEnvironmentF: checkYAMLEnvironment,
 					}
@@ -224,6 +229,7 @@ func newConfigEnvCmdForInitTest(
 				return mapEvalDiags(diags), nil
 			}
 			envs[name] = string(yaml)
+			envs[project+"/"+name] = string(yaml)
 			return nil, nil
 		},
 		func(
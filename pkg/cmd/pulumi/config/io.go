@@ -117,6 +117,10 @@ func getStackConfigurationFromProjectStack(
 	sm secrets.Manager,
 	workspaceStack *workspace.ProjectStack,
 ) (backend.StackConfiguration, error) {
+	workspaceStack, err := withProjectEnvironment(project, workspaceStack)
+	if err != nil {
+		return backend.StackConfiguration{}, err
+	}
 	env, diags, err := openStackEnv(ctx, stack, workspaceStack)
 	if err != nil {
 		return backend.StackConfiguration{}, fmt.Errorf("opening environment: %w", err)
@@ -216,6 +220,18 @@ func needsCrypter(cfg config.Map, env esc.Value) bool {
 	return cfg.HasSecureValue() || hasSecrets(env)
 }
 
+// withProjectEnvironment returns a copy of the given stack's configuration whose environment also imports the
+// environments that the project gives to all of its stacks.
+func withProjectEnvironment(project *workspace.Project, ps *workspace.ProjectStack) (*workspace.ProjectStack, error) {
+	env, err := project.StackEnvironment(ps)
+	if err != nil {
+		return nil, err
+	}
+	effective := *ps
+	effective.Environment = env
+	return &effective, nil
+}
+
 func openStackEnv(
 	ctx context.Context,
 	stack backend.Stack,
@@ -110,6 +110,7 @@ func NewStackCmd() *cobra.Command {
 	cmd.AddCommand(newStackChangeSecretsProviderCmd())
 	cmd.AddCommand(newStackHistoryCmd())
 	cmd.AddCommand(newStackUnselectCmd())
+	cmd.AddCommand(newStackValidateCmd())
 
 	return cmd
 }
@@ -0,0 +1,159 @@
+// Copyright 2016-2024, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/slice"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
+)
+
+func newStackValidateCmd() *cobra.Command {
+	var svcmd stackValidateCmd
+	cmd := &cobra.Command{
+		Use:   "validate <file>",
+		Args:  cmdutil.ExactArgs(1),
+		Short: "Check the integrity of an exported deployment file",
+		Long: "Check the integrity of an exported deployment file.\n" +
+			"\n" +
+			"This command reads a deployment that was exported using `pulumi stack export`\n" +
+			"and checks it for the same problems that would cause `pulumi stack import` or\n" +
+			"an update to fail, such as missing or out-of-order dependencies. It does not\n" +
+			"require a backend or a stack, and secrets in the deployment are not decrypted.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return svcmd.Run(cmd.Context(), args)
+		},
+	}
+
+	return cmd
+}
+
+type stackValidateCmd struct {
+	Stdout io.Writer // defaults to os.Stdout
+}
+
+func (cmd *stackValidateCmd) Run(ctx context.Context, args []string) error {
+	stdout := io.Writer(os.Stdout)
+	if cmd.Stdout != nil {
+		stdout = cmd.Stdout
+	}
+
+	path := args[0]
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open file: %w", err)
+	}
+	defer f.Close()
+
+	var deployment apitype.UntypedDeployment
+	if err := json.NewDecoder(f).Decode(&deployment); err != nil {
+		return fmt.Errorf("could not read deployment from %s: %w", path, err)
+	}
+
+	snap, err := deserializeDeploymentForValidation(ctx, &deployment)
+	if err != nil {
+		return checkDeploymentVersionError(err, path)
+	}
+
+	if err := snap.VerifyIntegrity(); err != nil {
+		var integrityErr *deploy.SnapshotIntegrityError
+		if errors.As(err, &integrityErr) && snap.Metadata.IntegrityErrorMetadata != nil {
+			metadata := snap.Metadata.IntegrityErrorMetadata
+			fmt.Fprintf(stdout, "The deployment was last written with a known integrity error by `%s` (version %s):\n",
+				metadata.Command, metadata.Version)
+			fmt.Fprintf(stdout, "  %s\n", metadata.Error)
+		}
+		return fmt.Errorf("deployment %s is invalid: %w", path, err)
+	}
+
+	fmt.Fprintf(stdout, "Deployment %s is valid (%d resources, %d pending operations).\n",
+		path, len(snap.Resources), len(snap.PendingOperations))
+	return nil
+}
+
+// deserializeDeploymentForValidation deserializes the given deployment into a snapshot without decrypting any of its
+// secrets, so that it can be checked without access to the secrets provider that it was written with.
+func deserializeDeploymentForValidation(
+	ctx context.Context, deployment *apitype.UntypedDeployment,
+) (*deploy.Snapshot, error) {
+	v3deployment, err := stack.UnmarshalUntypedDeployment(ctx, deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := deploy.DeserializeManifest(v3deployment.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := blindingJSONDecrypter{}
+	resources := slice.Prealloc[*resource.State](len(v3deployment.Resources))
+	for _, res := range v3deployment.Resources {
+		desres, err := stack.DeserializeResource(res, dec)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := resource.ParseURN(string(desres.URN)); err != nil {
+			return nil, err
+		}
+		resources = append(resources, desres)
+	}
+
+	ops := slice.Prealloc[resource.Operation](len(v3deployment.PendingOperations))
+	for _, op := range v3deployment.PendingOperations {
+		desop, err := stack.DeserializeOperation(op, dec)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, desop)
+	}
+
+	var metadata deploy.SnapshotMetadata
+	if m := v3deployment.Metadata.IntegrityErrorMetadata; m != nil {
+		metadata.IntegrityErrorMetadata = &deploy.SnapshotIntegrityErrorMetadata{
+			Version: m.Version,
+			Command: m.Command,
+			Error:   m.Error,
+		}
+	}
+
+	return deploy.NewSnapshot(*manifest, nil, resources, ops, metadata), nil
+}
+
+// blindingJSONDecrypter is a config.Decrypter that replaces every secret with the string "[secret]". Unlike
+// config.NewBlindingDecrypter, the plaintexts it produces are valid JSON, so they can be used when deserializing a
+// deployment's secret property values.
+type blindingJSONDecrypter struct{}
+
+func (blindingJSONDecrypter) DecryptValue(context.Context, string) (string, error) {
+	return `"[secret]"`, nil
+}
+
+func (d blindingJSONDecrypter) BatchDecrypt(ctx context.Context, ciphertexts []string) ([]string, error) {
+	return config.DefaultBatchDecrypt(ctx, d, ciphertexts)
+}
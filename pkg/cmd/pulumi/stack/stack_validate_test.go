@@ -0,0 +1,118 @@
+// Copyright 2016-2024, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+func writeDeploymentFile(t *testing.T, resources []apitype.ResourceV3) string {
+	t.Helper()
+
+	deployment, err := json.Marshal(apitype.DeploymentV3{Resources: resources})
+	require.NoError(t, err)
+	untyped, err := json.Marshal(apitype.UntypedDeployment{
+		Version:    3,
+		Deployment: deployment,
+	})
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "deployment.json")
+	require.NoError(t, os.WriteFile(path, untyped, 0o600))
+	return path
+}
+
+func TestStackValidate(t *testing.T) {
+	t.Parallel()
+
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+
+		path := writeDeploymentFile(t, []apitype.ResourceV3{
+			{URN: "urn:pulumi:stack::project::t::a", Type: "t"},
+			{
+				URN:          "urn:pulumi:stack::project::t::b",
+				Type:         "t",
+				Dependencies: []resource.URN{"urn:pulumi:stack::project::t::a"},
+				Outputs: map[string]interface{}{
+					"password": apitype.SecretV1{Sig: resource.SecretSig, Ciphertext: "not-decryptable"},
+				},
+			},
+		})
+
+		var stdout bytes.Buffer
+		cmd := stackValidateCmd{Stdout: &stdout}
+		err := cmd.Run(context.Background(), []string{path})
+
+		require.NoError(t, err)
+		assert.Contains(t, stdout.String(), "is valid (2 resources, 0 pending operations)")
+	})
+
+	t.Run("missing dependency", func(t *testing.T) {
+		t.Parallel()
+
+		path := writeDeploymentFile(t, []apitype.ResourceV3{
+			{
+				URN:          "urn:pulumi:stack::project::t::b",
+				Type:         "t",
+				Dependencies: []resource.URN{"urn:pulumi:stack::project::t::a"},
+			},
+		})
+
+		var stdout bytes.Buffer
+		cmd := stackValidateCmd{Stdout: &stdout}
+		err := cmd.Run(context.Background(), []string{path})
+
+		assert.ErrorContains(t, err, "deployment "+path+" is invalid: resource "+
+			"urn:pulumi:stack::project::t::b's dependency urn:pulumi:stack::project::t::a refers to missing resource")
+		assert.NotContains(t, stdout.String(), "is valid")
+	})
+
+	t.Run("malformed URN", func(t *testing.T) {
+		t.Parallel()
+
+		path := writeDeploymentFile(t, []apitype.ResourceV3{
+			{URN: "urn:pulumi:stack:project:t:a", Type: "t"},
+		})
+
+		var stdout bytes.Buffer
+		cmd := stackValidateCmd{Stdout: &stdout}
+		err := cmd.Run(context.Background(), []string{path})
+
+		assert.ErrorContains(t, err, `could not deserialize deployment: invalid URN "urn:pulumi:stack:project:t:a": `+
+			`must have a stack, project, type and name separated by "::"`)
+		assert.NotContains(t, stdout.String(), "is valid")
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		t.Parallel()
+
+		cmd := stackValidateCmd{Stdout: &bytes.Buffer{}}
+		err := cmd.Run(context.Background(), []string{filepath.Join(t.TempDir(), "missing.json")})
+
+		assert.ErrorContains(t, err, "could not open file")
+	})
+}
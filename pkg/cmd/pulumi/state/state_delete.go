@@ -77,7 +77,11 @@ To see the list of URNs in a stack, use ` + "`pulumi stack --show-urns`" + `.
 						return fmt.Errorf("failed to select resource: %w", err)
 					}
 				} else {
-					urn = resource.URN(args[0])
+					var err error
+					urn, err = resource.ParseURN(args[0])
+					if err != nil {
+						return err
+					}
 				}
 			}
 			// Show the confirmation prompt if the user didn't pass the --yes parameter to skip it.
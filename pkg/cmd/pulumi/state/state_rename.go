@@ -206,19 +206,20 @@ To see the list of URNs in a stack, use ` + "`pulumi stack --show-urns`" + `.
 					return err
 				}
 			case 1: // We got the urn but not the name
-				urn = resource.URN(args[0])
-				if !urn.IsValid() {
-					return errors.New("The provided input URN is not valid")
-				}
 				var err error
+				urn, err = resource.ParseURN(args[0])
+				if err != nil {
+					return fmt.Errorf("The provided input URN is not valid: %w", err)
+				}
 				newResourceName, err = getNewResourceName()
 				if err != nil {
 					return err
 				}
 			case 2: // We got the URN and the name.
-				urn = resource.URN(args[0])
-				if !urn.IsValid() {
-					return errors.New("The provided input URN is not valid")
+				var err error
+				urn, err = resource.ParseURN(args[0])
+				if err != nil {
+					return fmt.Errorf("The provided input URN is not valid: %w", err)
 				}
 				newResourceName = args[1]
 			}
@@ -723,6 +723,93 @@ func TestImportIgnoreChanges(t *testing.T) {
 	assert.Equal(t, resource.NewStringProperty("bar"), snap.Resources[1].Outputs["foo"])
 }
 
+// TestImportedFlag checks that a resource is recorded as imported by the import step, that the flag is carried forward
+// by a subsequent update, and that it is cleared when the resource is replaced, since the replacement was created by
+// Pulumi.
+func TestImportedFlag(t *testing.T) {
+	t.Parallel()
+
+	loaders := []*deploytest.ProviderLoader{
+		deploytest.NewProviderLoader("pkgA", semver.MustParse("1.0.0"), func() (plugin.Provider, error) {
+			return &deploytest.Provider{
+				DiffF: func(_ context.Context, req plugin.DiffRequest) (plugin.DiffResult, error) {
+					if !req.OldOutputs["replace"].DeepEquals(req.NewInputs["replace"]) {
+						return plugin.DiffResult{Changes: plugin.DiffSome, ReplaceKeys: []resource.PropertyKey{"replace"}}, nil
+					}
+					if !req.OldOutputs["foo"].DeepEquals(req.NewInputs["foo"]) {
+						return plugin.DiffResult{Changes: plugin.DiffSome}, nil
+					}
+					return plugin.DiffResult{Changes: plugin.DiffNone}, nil
+				},
+				CreateF: func(_ context.Context, req plugin.CreateRequest) (plugin.CreateResponse, error) {
+					return plugin.CreateResponse{
+						ID:         "created-id",
+						Properties: req.Properties,
+						Status:     resource.StatusOK,
+					}, nil
+				},
+				UpdateF: func(_ context.Context, req plugin.UpdateRequest) (plugin.UpdateResponse, error) {
+					return plugin.UpdateResponse{
+						Properties: req.NewInputs,
+						Status:     resource.StatusOK,
+					}, nil
+				},
+				ReadF: func(context.Context, plugin.ReadRequest) (plugin.ReadResponse, error) {
+					props := resource.PropertyMap{
+						"foo":     resource.NewStringProperty("bar"),
+						"replace": resource.NewStringProperty("a"),
+					}
+					return plugin.ReadResponse{
+						ReadResult: plugin.ReadResult{Inputs: props, Outputs: props},
+						Status:     resource.StatusOK,
+					}, nil
+				},
+			}, nil
+		}),
+	}
+
+	importID, foo, replace := resource.ID("import-id"), "bar", "a"
+	programF := deploytest.NewLanguageRuntimeF(func(_ plugin.RunInfo, monitor *deploytest.ResourceMonitor) error {
+		_, err := monitor.RegisterResource("pkgA:m:typA", "resA", true, deploytest.ResourceOptions{
+			Inputs: resource.PropertyMap{
+				"foo":     resource.NewStringProperty(foo),
+				"replace": resource.NewStringProperty(replace),
+			},
+			ImportID: importID,
+		})
+		assert.NoError(t, err)
+		return nil
+	})
+	hostF := deploytest.NewPluginHostF(nil, nil, programF, loaders...)
+
+	p := &lt.TestPlan{
+		Options: lt.TestUpdateOptions{T: t, HostF: hostF},
+	}
+	project := p.GetProject()
+
+	// The import step marks the resource as imported.
+	snap, err := lt.TestOp(Update).Run(project, p.GetTarget(t, nil), p.Options, false, p.BackendClient, nil)
+	require.NoError(t, err)
+	require.Len(t, snap.Resources, 2)
+	assert.True(t, snap.Resources[1].Imported)
+
+	// An update keeps the flag.
+	importID, foo = "", "baz"
+	snap, err = lt.TestOp(Update).Run(project, p.GetTarget(t, snap), p.Options, false, p.BackendClient, nil)
+	require.NoError(t, err)
+	require.Len(t, snap.Resources, 2)
+	assert.Equal(t, resource.NewStringProperty("baz"), snap.Resources[1].Outputs["foo"])
+	assert.True(t, snap.Resources[1].Imported)
+
+	// A replacement is created by Pulumi, so it is not imported.
+	replace = "b"
+	snap, err = lt.TestOp(Update).Run(project, p.GetTarget(t, snap), p.Options, false, p.BackendClient, nil)
+	require.NoError(t, err)
+	require.Len(t, snap.Resources, 2)
+	assert.Equal(t, resource.ID("created-id"), snap.Resources[1].ID)
+	assert.False(t, snap.Resources[1].Imported)
+}
+
 func TestImportPlanExistingImport(t *testing.T) {
 	t.Parallel()
 
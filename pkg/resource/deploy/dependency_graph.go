@@ -0,0 +1,136 @@
+// Copyright 2016-2024, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"slices"
+
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy/providers"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// DependencyGraph is an index of the dependencies between a list of resources, such as those of a snapshot. Unlike
+// graph.DependencyGraph, which tracks individual states, resources are identified by URN, so that all the states which
+// share a URN (e.g. a resource and the old version it is replacing) are a single node whose dependencies are the union
+// of theirs. A resource depends on another if it refers to it through its provider, Parent, Dependencies,
+// PropertyDependencies or DeletedWith. References to URNs that are not in the graph are ignored. It backs the
+// snapshot's Dependents and DeletionClosure queries, and the ordering done by SortDependenciesFirst.
+type DependencyGraph struct {
+	// The position of each URN in the resource list at which it first appears.
+	index map[resource.URN]int
+	// The URNs that each URN refers to directly.
+	dependencies map[resource.URN]map[resource.URN]bool
+	// The URNs that refer directly to each URN.
+	dependents map[resource.URN]map[resource.URN]bool
+}
+
+// NewDependencyGraph creates a dependency graph of the given resources.
+func NewDependencyGraph(resources []*resource.State) *DependencyGraph {
+	dg := &DependencyGraph{
+		index:        make(map[resource.URN]int, len(resources)),
+		dependencies: make(map[resource.URN]map[resource.URN]bool),
+		dependents:   make(map[resource.URN]map[resource.URN]bool),
+	}
+	for i, res := range resources {
+		if _, has := dg.index[res.URN]; !has {
+			dg.index[res.URN] = i
+		}
+	}
+
+	addEdge := func(edges map[resource.URN]map[resource.URN]bool, from, to resource.URN) {
+		if edges[from] == nil {
+			edges[from] = make(map[resource.URN]bool)
+		}
+		edges[from][to] = true
+	}
+	for _, res := range resources {
+		for _, dep := range dependencyURNs(res) {
+			if _, has := dg.index[dep]; !has || dep == res.URN {
+				continue
+			}
+			addEdge(dg.dependencies, res.URN, dep)
+			addEdge(dg.dependents, dep, res.URN)
+		}
+	}
+	return dg
+}
+
+// DependingOn returns the URNs of the resources that depend directly on the resource with the given URN, in the order
+// in which they first appear in the graph's resources.
+func (dg *DependencyGraph) DependingOn(urn resource.URN) []resource.URN {
+	return dg.ordered(dg.dependents[urn])
+}
+
+// DependenciesOf returns the URNs of the resources that the resource with the given URN depends on directly, in the
+// order in which they first appear in the graph's resources.
+func (dg *DependencyGraph) DependenciesOf(urn resource.URN) []resource.URN {
+	return dg.ordered(dg.dependencies[urn])
+}
+
+// TransitiveClosure returns the URN of the resource with the given URN along with the URNs of all the resources that
+// depend on it, whether directly or through other resources. These are the resources that are affected by a change to
+// it, e.g. that must be deleted along with it. The URNs are in the order in which they first appear in the graph's
+// resources. It returns nil if the URN is not in the graph.
+func (dg *DependencyGraph) TransitiveClosure(urn resource.URN) []resource.URN {
+	if _, has := dg.index[urn]; !has {
+		return nil
+	}
+
+	closure := map[resource.URN]bool{urn: true}
+	worklist := []resource.URN{urn}
+	for len(worklist) > 0 {
+		next := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+		for dependent := range dg.dependents[next] {
+			if !closure[dependent] {
+				closure[dependent] = true
+				worklist = append(worklist, dependent)
+			}
+		}
+	}
+	return dg.ordered(closure)
+}
+
+// ordered returns the given URNs sorted by their position in the graph's resources.
+func (dg *DependencyGraph) ordered(urns map[resource.URN]bool) []resource.URN {
+	if len(urns) == 0 {
+		return nil
+	}
+	result := make([]resource.URN, 0, len(urns))
+	for urn := range urns {
+		result = append(result, urn)
+	}
+	slices.SortFunc(result, func(a, b resource.URN) int {
+		return dg.index[a] - dg.index[b]
+	})
+	return result
+}
+
+// dependencyURNs returns the URNs of the resources that the given resource refers to: its provider, if its reference
+// can be parsed, followed by its parent, dependencies, property dependencies and deleted-with resource. The same URN
+// may be returned more than once.
+func dependencyURNs(res *resource.State) []resource.URN {
+	provider, allDeps := res.GetAllDependencies()
+	urns := make([]resource.URN, 0, len(allDeps)+1)
+	if provider != "" {
+		if ref, err := providers.ParseReference(provider); err == nil {
+			urns = append(urns, ref.URN())
+		}
+	}
+	for _, dep := range allDeps {
+		urns = append(urns, dep.URN)
+	}
+	return urns
+}
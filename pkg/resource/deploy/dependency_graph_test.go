@@ -0,0 +1,83 @@
+// Copyright 2016-2024, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDependencyGraph(t *testing.T) {
+	t.Parallel()
+
+	// The vexing graph (see TestSnapshotDependents), with a provider for a and a replacement of c that is pending
+	// deletion:
+	//
+	//   a -> p (provider)
+	//   b -> a
+	//   c -> a, b
+	//   d -> c (parent)
+	//   e -> c (property dependency)
+	urn := func(name string) resource.URN {
+		return resource.URN("urn:pulumi:stack::project::t::" + name)
+	}
+	p := &resource.State{URN: "urn:pulumi:stack::project::pulumi:providers:pkg::p", ID: "id"}
+	a := &resource.State{URN: urn("a"), Provider: string(p.URN) + "::id"}
+	b := &resource.State{URN: urn("b"), Dependencies: []resource.URN{a.URN}}
+	c := &resource.State{URN: urn("c"), Dependencies: []resource.URN{a.URN, b.URN}}
+	oldC := &resource.State{URN: urn("c"), Delete: true, Dependencies: []resource.URN{a.URN}}
+	d := &resource.State{URN: urn("d"), Parent: c.URN}
+	e := &resource.State{
+		URN: urn("e"),
+		PropertyDependencies: map[resource.PropertyKey][]resource.URN{
+			"p1": {c.URN},
+			"p2": {c.URN, urn("missing")},
+		},
+	}
+	graph := NewDependencyGraph([]*resource.State{p, a, b, c, d, e, oldC})
+
+	t.Run("DependingOn", func(t *testing.T) {
+		t.Parallel()
+
+		assert.Equal(t, []resource.URN{a.URN}, graph.DependingOn(p.URN))
+		assert.Equal(t, []resource.URN{b.URN, c.URN}, graph.DependingOn(a.URN))
+		assert.Equal(t, []resource.URN{d.URN, e.URN}, graph.DependingOn(c.URN))
+		assert.Empty(t, graph.DependingOn(e.URN))
+		assert.Empty(t, graph.DependingOn(urn("missing")))
+	})
+
+	t.Run("DependenciesOf", func(t *testing.T) {
+		t.Parallel()
+
+		assert.Empty(t, graph.DependenciesOf(p.URN))
+		assert.Equal(t, []resource.URN{p.URN}, graph.DependenciesOf(a.URN))
+		assert.Equal(t, []resource.URN{a.URN, b.URN}, graph.DependenciesOf(c.URN))
+		assert.Equal(t, []resource.URN{c.URN}, graph.DependenciesOf(d.URN))
+		// References to resources outside the graph are ignored.
+		assert.Equal(t, []resource.URN{c.URN}, graph.DependenciesOf(e.URN))
+	})
+
+	t.Run("TransitiveClosure", func(t *testing.T) {
+		t.Parallel()
+
+		assert.Equal(t, []resource.URN{p.URN, a.URN, b.URN, c.URN, d.URN, e.URN}, graph.TransitiveClosure(p.URN))
+		assert.Equal(t, []resource.URN{b.URN, c.URN, d.URN, e.URN}, graph.TransitiveClosure(b.URN))
+		assert.Equal(t, []resource.URN{c.URN, d.URN, e.URN}, graph.TransitiveClosure(c.URN))
+		assert.Equal(t, []resource.URN{d.URN}, graph.TransitiveClosure(d.URN))
+		assert.Nil(t, graph.TransitiveClosure(urn("missing")))
+	})
+}
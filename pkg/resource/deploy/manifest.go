@@ -26,18 +26,22 @@ import (
 
 // Manifest captures versions for all binaries used to construct this snapshot.
 type Manifest struct {
-	Time    time.Time              // the time this snapshot was taken.
-	Magic   string                 // a magic cookie.
-	Version string                 // the pulumi command version.
-	Plugins []workspace.PluginInfo // the plugin versions also loaded.
+	Time     time.Time              // the time this snapshot was taken.
+	Magic    string                 // a magic cookie.
+	Version  string                 // the pulumi command version.
+	Plugins  []workspace.PluginInfo // the plugin versions also loaded.
+	Language string                 // the language runtime of the program, if known.
+	Runtime  string                 // a description of the runtime that executed the program, if known.
 }
 
 // Serialize turns a manifest into a data structure suitable for serialization.
 func (m Manifest) Serialize() apitype.ManifestV1 {
 	manifest := apitype.ManifestV1{
-		Time:    m.Time,
-		Magic:   m.Magic,
-		Version: m.Version,
+		Time:     m.Time,
+		Magic:    m.Magic,
+		Version:  m.Version,
+		Language: m.Language,
+		Runtime:  m.Runtime,
 	}
 	for _, plug := range m.Plugins {
 		var version string
@@ -57,9 +61,11 @@ func (m Manifest) Serialize() apitype.ManifestV1 {
 // DeserializeManifest deserializes a typed ManifestV1 into a `deploy.Manifest`.
 func DeserializeManifest(m apitype.ManifestV1) (*Manifest, error) {
 	manifest := Manifest{
-		Time:    m.Time,
-		Magic:   m.Magic,
-		Version: m.Version,
+		Time:     m.Time,
+		Magic:    m.Magic,
+		Version:  m.Version,
+		Language: m.Language,
+		Runtime:  m.Runtime,
 	}
 	for _, plug := range m.Plugins {
 		var version *semver.Version
@@ -43,12 +43,16 @@ func TestManifest(t *testing.T) {
 					Version: &ver,
 				},
 			},
+			Language: "nodejs",
+			Runtime:  "node v20.11.0",
 		}
 		assert.Equal(t, apitype.ManifestV1{
 			Plugins: []apitype.PluginInfoV1{
 				{Name: "plug-1", Path: "/foo", Type: "language", Version: "1.0.0"},
 				{Name: "plug-2", Path: "/bar", Type: "resource", Version: "1.0.0"},
 			},
+			Language: "nodejs",
+			Runtime:  "node v20.11.0",
 		}, m.Serialize())
 	})
 	t.Run("DeserializeManifest", func(t *testing.T) {
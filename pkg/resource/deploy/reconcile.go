@@ -0,0 +1,124 @@
+// Copyright 2016-2024, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// Reconcile returns the steps that transform the resources in the current snapshot into those in the desired snapshot.
+// Resources are matched by URN: a resource only in desired is created, a resource only in current is deleted, and a
+// resource in both is updated if its state differs and is the same otherwise. External resources in desired are read
+// rather than created or updated.
+//
+// The steps only describe changes to state, and must never be applied: they are intended to drive a SnapshotManager
+// (by beginning and ending a mutation for each step in turn) in order to write the desired state without touching any
+// infrastructure. Creates, updates and sames are returned in the order their resources appear in desired, followed by
+// deletes in the reverse of the order their resources appear in current, so that the steps respect the dependencies
+// of both snapshots. Either snapshot may be nil, which is treated as having no resources.
+func Reconcile(current, desired *Snapshot) ([]Step, error) {
+	var currentResources, desiredResources []*resource.State
+	if current != nil {
+		currentResources = current.Resources
+	}
+	if desired != nil {
+		desiredResources = desired.Resources
+	}
+
+	// Resources pending deletion in current have already been replaced, so they are only ever deleted.
+	olds := make(map[resource.URN]*resource.State, len(currentResources))
+	for _, res := range currentResources {
+		if res.Delete {
+			continue
+		}
+		if _, has := olds[res.URN]; has {
+			return nil, fmt.Errorf("current snapshot has duplicate resource %s", res.URN)
+		}
+		olds[res.URN] = res
+	}
+
+	var steps []Step
+	matched := make(map[*resource.State]bool, len(desiredResources))
+	seen := make(map[resource.URN]bool, len(desiredResources))
+	for _, new := range desiredResources {
+		if new.Delete {
+			return nil, fmt.Errorf("desired snapshot has resource %s pending deletion", new.URN)
+		}
+		if seen[new.URN] {
+			return nil, fmt.Errorf("desired snapshot has duplicate resource %s", new.URN)
+		}
+		seen[new.URN] = true
+
+		old, has := olds[new.URN]
+		if has {
+			matched[old] = true
+		}
+
+		// These steps are constructed directly rather than through their constructors, which require that new states
+		// have no ID yet since it is normally assigned when the step is applied.
+		switch {
+		case new.External:
+			steps = append(steps, &ReadStep{old: old, new: new})
+		case !has:
+			steps = append(steps, &CreateStep{new: new})
+		default:
+			diffs := changedProperties(old, new)
+			if len(diffs) == 0 && sameMetadata(old, new) {
+				steps = append(steps, &SameStep{old: old, new: new})
+			} else {
+				steps = append(steps, &UpdateStep{old: old, new: new, diffs: diffs})
+			}
+		}
+	}
+
+	deletes := make(map[resource.URN]bool)
+	for _, old := range currentResources {
+		if !matched[old] {
+			deletes[old.URN] = true
+		}
+	}
+	for i := len(currentResources) - 1; i >= 0; i-- {
+		old := currentResources[i]
+		if !matched[old] {
+			steps = append(steps, &DeleteStep{old: old, otherDeletions: deletes})
+		}
+	}
+	return steps, nil
+}
+
+// changedProperties returns the keys of the input and output properties that differ between the two states.
+func changedProperties(old, new *resource.State) []resource.PropertyKey {
+	var keys []resource.PropertyKey
+	seen := make(map[resource.PropertyKey]bool)
+	for _, diff := range []*resource.ObjectDiff{old.Inputs.Diff(new.Inputs), old.Outputs.Diff(new.Outputs)} {
+		for _, k := range diff.ChangedKeys() {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
+
+// sameMetadata returns true if the two states are identical in everything but their input and output properties.
+func sameMetadata(old, new *resource.State) bool {
+	return reflect.DeepEqual(
+		old.Clone(resource.OnlyMetadata(), resource.ShareCollections()),
+		new.Clone(resource.OnlyMetadata(), resource.ShareCollections()))
+}
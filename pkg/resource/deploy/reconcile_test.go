@@ -0,0 +1,113 @@
+// Copyright 2016-2024, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"testing"
+
+	"github.com/pulumi/pulumi/pkg/v3/display"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcile(t *testing.T) {
+	t.Parallel()
+
+	newResource := func(name, value string) *resource.State {
+		return &resource.State{
+			Type:    "pkg:index:t",
+			URN:     resource.URN("urn:pulumi:stack::project::pkg:index:t::" + name),
+			Inputs:  resource.PropertyMap{"value": resource.NewStringProperty(value)},
+			Outputs: resource.PropertyMap{"value": resource.NewStringProperty(value)},
+		}
+	}
+	ops := func(steps []Step) []display.StepOp {
+		result := make([]display.StepOp, len(steps))
+		for i, step := range steps {
+			result[i] = step.Op()
+		}
+		return result
+	}
+
+	t.Run("missing resource is created", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		a, b := newResource("a", "a"), newResource("b", "b")
+		current := &Snapshot{Resources: []*resource.State{a}}
+		desired := &Snapshot{Resources: []*resource.State{newResource("a", "a"), b}}
+
+		// Act.
+		steps, err := Reconcile(current, desired)
+
+		// Assert.
+		require.NoError(t, err)
+		assert.Equal(t, []display.StepOp{OpSame, OpCreate}, ops(steps))
+		assert.Same(t, a, steps[0].Old())
+		assert.Nil(t, steps[1].Old())
+		assert.Same(t, b, steps[1].New())
+	})
+
+	t.Run("updates and deletes", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		a, b, c := newResource("a", "a"), newResource("b", "b"), newResource("c", "c")
+		current := &Snapshot{Resources: []*resource.State{a, b, c}}
+		aNew := newResource("a", "changed")
+		bNew := newResource("b", "b")
+		bNew.Protect = true
+		desired := &Snapshot{Resources: []*resource.State{aNew, bNew}}
+
+		// Act.
+		steps, err := Reconcile(current, desired)
+
+		// Assert.
+		require.NoError(t, err)
+		assert.Equal(t, []display.StepOp{OpUpdate, OpUpdate, OpDelete}, ops(steps))
+		assert.Equal(t, []resource.PropertyKey{"value"}, steps[0].(*UpdateStep).Diffs())
+		assert.Empty(t, steps[1].(*UpdateStep).Diffs())
+		assert.Same(t, c, steps[2].Old())
+	})
+
+	t.Run("identical snapshots", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		current := &Snapshot{Resources: []*resource.State{newResource("a", "a"), newResource("b", "b")}}
+		desired := &Snapshot{Resources: []*resource.State{newResource("a", "a"), newResource("b", "b")}}
+
+		// Act.
+		steps, err := Reconcile(current, desired)
+
+		// Assert.
+		require.NoError(t, err)
+		assert.Equal(t, []display.StepOp{OpSame, OpSame}, ops(steps))
+	})
+
+	t.Run("duplicate resources", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		desired := &Snapshot{Resources: []*resource.State{newResource("a", "a"), newResource("a", "b")}}
+
+		// Act.
+		_, err := Reconcile(nil, desired)
+
+		// Assert.
+		assert.ErrorContains(t, err, "duplicate resource")
+	})
+}
@@ -15,13 +15,19 @@
 package deploy
 
 import (
+	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"runtime/debug"
+	"slices"
+	"strings"
 
 	"github.com/pulumi/pulumi/pkg/v3/resource/deploy/providers"
 	"github.com/pulumi/pulumi/pkg/v3/secrets"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
 )
@@ -35,12 +41,72 @@ type Snapshot struct {
 	Resources         []*resource.State    // fetches all resources and their associated states.
 	PendingOperations []resource.Operation // all currently pending resource operations.
 	Metadata          SnapshotMetadata     // metadata associated with the snapshot.
+
+	// ResourceSecretsManagers records, for resources whose secrets are encrypted with a manager other than
+	// SecretsManager, the manager that should be used for them instead. This allows a stack that is migrating between
+	// secrets providers to hold resources encrypted under both the old and the new provider, with resources moving to
+	// SecretsManager as they are touched. Resources that are not present in the map use SecretsManager. The resources of
+	// pending operations may also be present, so that an operation recorded before a migration can still be decrypted
+	// after it.
+	ResourceSecretsManagers map[*resource.State]secrets.Manager
+
+	// SerializeProgress, if set, is called as this snapshot is serialized with the number of resources and pending
+	// operations serialized so far and the total number to serialize. It is not persisted.
+	SerializeProgress func(done, total int)
+
+	// RedactSecrets, if true, causes this snapshot to be serialized with every secret value replaced by a "[secret]"
+	// marker and without its secrets manager configuration, regardless of whether secrets were requested in plaintext.
+	// The result cannot be imported, but holds no secret data in any form, so it is safe to share. It is not persisted.
+	RedactSecrets bool
+
+	// CompressResourcesAbove, if positive, causes each resource whose serialized form is larger than this many bytes to
+	// be serialized with its inputs and outputs compressed (see stack.CompressedPropertiesKey), so that a few very large
+	// resources can be stored compactly without spending time compressing the many small ones. The root stack resource
+	// and provider resources are never compressed. It is not persisted.
+	CompressResourcesAbove int
+
+	// QuarantinedResources holds the resources that could not be deserialized when this snapshot was loaded in tolerant
+	// mode (see stack.DeserializeDeploymentV3Tolerant). They are not part of Resources, and writing the snapshot would
+	// lose them, so the snapshot manager refuses to persist a snapshot based on one that has quarantined resources.
+	// Callers resolve them by repairing the state and removing them from this list.
+	QuarantinedResources []QuarantinedResource
+
+	// PendingImports lists resources that are to be imported but whose state has not yet been read. Each is removed
+	// once a read or import of its URN succeeds, so an import that is interrupted part way through can be resumed.
+	PendingImports []PendingImport
+}
+
+// PendingImport is a resource that is to be imported into a stack, identified before its state is known.
+type PendingImport struct {
+	URN  resource.URN // the URN the resource will have once imported.
+	Type tokens.Type  // the type of the resource.
+	ID   resource.ID  // the provider-assigned ID of the resource to import.
+}
+
+// QuarantinedResource is a resource that could not be deserialized when loading a snapshot.
+type QuarantinedResource struct {
+	URN resource.URN    // the URN of the resource, if it could be determined.
+	Raw json.RawMessage // the resource's serialized state.
+	Err error           // the error that prevented the resource from being deserialized.
 }
 
 // SnapshotMetadata contains metadata about a snapshot.
 type SnapshotMetadata struct {
 	// Metadata associated with any integrity error affecting the snapshot.
 	IntegrityErrorMetadata *SnapshotIntegrityErrorMetadata
+	// Resources that have been removed from the stack without being deleted, because they were marked RetainOnDelete.
+	RetainedResources []RetainedResource
+}
+
+// RetainedResource records a resource that was removed from the stack without its provider deleting it, because it was
+// marked RetainOnDelete. The resource itself still exists, but is no longer managed by Pulumi.
+type RetainedResource struct {
+	// The URN of the resource when it was removed from the stack.
+	URN resource.URN
+	// The type of the resource.
+	Type tokens.Type
+	// The provider-assigned ID of the resource, if any.
+	ID resource.ID
 }
 
 // SnapshotIntegrityErrorMetadata contains metadata about a snapshot integrity error, such as the version
@@ -205,6 +271,280 @@ type PruneResult struct {
 	RemovedDependencies []resource.StateDependency
 }
 
+// Dependents returns the URNs of all resources in this snapshot that depend directly on the resource with the given
+// URN, whether through their provider, Dependencies, Parent, PropertyDependencies, or DeletedWith. The result is in
+// snapshot order and contains each URN at most once.
+func (snap *Snapshot) Dependents(urn resource.URN) []resource.URN {
+	return NewDependencyGraph(snap.Resources).DependingOn(urn)
+}
+
+// UnreferencedByProgram returns the URNs of the resources in this snapshot that are not in seen, which holds the URNs
+// of the resources registered by the program during the latest deployment. Such resources may have been orphaned, e.g.
+// by an update that was targeted at other resources. Resources pending deletion are not expected to be registered, and
+// views are registered by their owners rather than by the program, so neither is included. The result is in snapshot
+// order and contains each URN at most once.
+func (snap *Snapshot) UnreferencedByProgram(seen map[resource.URN]bool) []resource.URN {
+	var unreferenced []resource.URN
+	added := map[resource.URN]bool{}
+	for _, state := range snap.Resources {
+		if state.Delete || state.ViewOf != "" || seen[state.URN] || added[state.URN] {
+			continue
+		}
+		unreferenced = append(unreferenced, state.URN)
+		added[state.URN] = true
+	}
+	return unreferenced
+}
+
+// PendingDeletions returns the resources in this snapshot that are pending deletion, i.e. those marked with Delete
+// because they have been replaced but not yet deleted. They will be deleted by the next deployment. The result is in
+// snapshot order.
+func (snap *Snapshot) PendingDeletions() []*resource.State {
+	var pending []*resource.State
+	for _, state := range snap.Resources {
+		if state.Delete {
+			pending = append(pending, state)
+		}
+	}
+	return pending
+}
+
+// DeletionClosure returns the URNs of all resources in this snapshot that would have to be deleted in order to delete
+// the resources with the given target URNs: the targets themselves, along with every resource that transitively
+// depends on one of them through its provider, Parent, Dependencies, PropertyDependencies or DeletedWith. Resources
+// that are protected cannot be deleted, and are returned in blocked rather than toDelete; if blocked is non-empty, the
+// deletion cannot proceed until they are unprotected. Both lists are in the order in which the resources would be
+// deleted, i.e. with dependents before their dependencies. It is an error for a target not to be in the snapshot.
+func (snap *Snapshot) DeletionClosure(
+	targets []resource.URN,
+) (toDelete []resource.URN, blocked []resource.URN, err error) {
+	graph := NewDependencyGraph(snap.Resources)
+	closure := make(map[resource.URN]bool, len(targets))
+	for _, target := range targets {
+		affected := graph.TransitiveClosure(target)
+		if affected == nil {
+			return nil, nil, fmt.Errorf("no resource with URN %s in the snapshot", target)
+		}
+		for _, urn := range affected {
+			closure[urn] = true
+		}
+	}
+
+	// Walk the snapshot backwards so that dependents come before their dependencies. A URN may be shared by several
+	// resources (e.g. one that is pending deletion), in which case it is blocked if any of them is protected.
+	protected := make(map[resource.URN]bool)
+	for _, state := range snap.Resources {
+		if closure[state.URN] && state.Protect {
+			protected[state.URN] = true
+		}
+	}
+	seen := make(map[resource.URN]bool, len(closure))
+	for i := len(snap.Resources) - 1; i >= 0; i-- {
+		urn := snap.Resources[i].URN
+		if !closure[urn] || seen[urn] {
+			continue
+		}
+		seen[urn] = true
+		if protected[urn] {
+			blocked = append(blocked, urn)
+		} else {
+			toDelete = append(toDelete, urn)
+		}
+	}
+	return toDelete, blocked, nil
+}
+
+// ExportPendingOperations returns the operations that were in flight when this snapshot was taken, in the order in
+// which they are recorded. The resource of each operation is a clone, so the result may be modified without affecting
+// the snapshot. It returns nil if there are no pending operations.
+func (snap *Snapshot) ExportPendingOperations() []resource.Operation {
+	if len(snap.PendingOperations) == 0 {
+		return nil
+	}
+	ops := make([]resource.Operation, len(snap.PendingOperations))
+	for i, op := range snap.PendingOperations {
+		if op.Resource != nil {
+			op.Resource = op.Resource.Clone()
+		}
+		ops[i] = op
+	}
+	return ops
+}
+
+// SecretPaths returns, for each resource in this snapshot that holds secret values, the paths to those values within
+// the resource's state. Each path begins with "inputs" or "outputs", according to the property map in which the secret
+// was found, followed by the path to the secret within that map. Secrets nested within other secrets are not reported
+// separately. Secret values are located without being decrypted. Paths are returned in a stable order.
+func (snap *Snapshot) SecretPaths() map[resource.URN][]resource.PropertyPath {
+	paths := make(map[resource.URN][]resource.PropertyPath)
+	for _, res := range snap.Resources {
+		var found []resource.PropertyPath
+		found = appendSecretPaths(found, resource.PropertyPath{"inputs"}, resource.NewObjectProperty(res.Inputs))
+		found = appendSecretPaths(found, resource.PropertyPath{"outputs"}, resource.NewObjectProperty(res.Outputs))
+		if len(found) != 0 {
+			paths[res.URN] = append(paths[res.URN], found...)
+		}
+	}
+	return paths
+}
+
+// appendSecretPaths appends the paths to the secret values within v, which is found at the given path, to paths.
+func appendSecretPaths(
+	paths []resource.PropertyPath, path resource.PropertyPath, v resource.PropertyValue,
+) []resource.PropertyPath {
+	child := func(key interface{}) resource.PropertyPath {
+		return append(append(resource.PropertyPath{}, path...), key)
+	}
+
+	switch {
+	case v.IsSecret():
+		return append(paths, path)
+	case v.IsOutput():
+		output := v.OutputValue()
+		if output.Secret {
+			return append(paths, path)
+		}
+		return appendSecretPaths(paths, path, output.Element)
+	case v.IsArray():
+		for i, elem := range v.ArrayValue() {
+			paths = appendSecretPaths(paths, child(i), elem)
+		}
+	case v.IsObject():
+		obj := v.ObjectValue()
+		for _, k := range obj.StableKeys() {
+			paths = appendSecretPaths(paths, child(string(k)), obj[k])
+		}
+	}
+	return paths
+}
+
+// Reorder sorts the resources in this snapshot so that every resource appears after the resources it depends on, using
+// a stable sort (see SortDependenciesFirst): no resource is changed, and resources that are already correctly ordered
+// keep their relative order. This can be used to repair a snapshot whose order has been broken, e.g. by manual edits.
+// If the resources' dependencies form a cycle, no valid order exists; an error is returned and the snapshot is left
+// unchanged.
+func (snap *Snapshot) Reorder() error {
+	sorted, err := SortDependenciesFirst(snap.Resources)
+	if err != nil {
+		return err
+	}
+	snap.Resources = sorted
+	return nil
+}
+
+// ToDOT writes the snapshot's resource graph to w in the Graphviz DOT format, with a node for each resource labelled with
+// its URN. Every edge runs from a resource to a resource that it depends on: dependency edges are solid, and the edge
+// to a resource's parent is dotted. Resources that are pending deletion are drawn dashed. As elsewhere, a reference to
+// a URN is taken to be to the latest resource with that URN that precedes the referring resource, so that a resource
+// and its replacement pending deletion can be told apart. A reference that no earlier resource satisfies is drawn to
+// the first later resource with the URN, so that a snapshot whose resources are out of order can still be inspected.
+func (snap *Snapshot) ToDOT(w io.Writer) error {
+	// Write errors are latching, so they are only checked when the buffer is flushed.
+	b := bufio.NewWriter(w)
+	quote := func(s string) string {
+		return `"` + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `"`, `\"`) + `"`
+	}
+
+	// The indices of the resources with each URN, in ascending order.
+	indices := make(map[resource.URN][]int, len(snap.Resources))
+	for i, res := range snap.Resources {
+		indices[res.URN] = append(indices[res.URN], i)
+	}
+	resolve := func(i int, urn resource.URN) (int, bool) {
+		// n is the number of resources with the URN that precede the referring resource.
+		candidates := indices[urn]
+		n, self := slices.BinarySearch(candidates, i)
+		if n > 0 {
+			return candidates[n-1], true
+		}
+		if self {
+			n++
+		}
+		if n < len(candidates) {
+			return candidates[n], true
+		}
+		return 0, false
+	}
+
+	fmt.Fprintln(b, "strict digraph {")
+	for i, res := range snap.Resources {
+		fmt.Fprintf(b, "    Resource%d [label=%s", i, quote(string(res.URN)))
+		if res.Delete {
+			fmt.Fprint(b, ", style=dashed")
+		}
+		fmt.Fprintln(b, "];")
+	}
+	for i, res := range snap.Resources {
+		for _, dep := range res.Dependencies {
+			if j, ok := resolve(i, dep); ok {
+				fmt.Fprintf(b, "    Resource%d -> Resource%d;\n", i, j)
+			}
+		}
+		if res.Parent != "" {
+			if j, ok := resolve(i, res.Parent); ok {
+				fmt.Fprintf(b, "    Resource%d -> Resource%d [style=dotted];\n", i, j)
+			}
+		}
+	}
+	fmt.Fprintln(b, "}")
+	return b.Flush()
+}
+
+// SortDependenciesFirst returns the given resources in an order in which every resource appears after the resources it
+// depends on, whether through its provider, parent, dependencies, property dependencies or deleted-with relationship.
+// The order is otherwise preserved, so resources that are already correctly ordered are returned as they are. A
+// dependency is satisfied by any earlier resource with the dependency's URN; if there is none, the first resource with
+// that URN is moved ahead of the dependent resource. If the dependencies form a cycle, the cycle is broken arbitrarily
+// and an error is returned along with the resources. Views are ordered in the same way, so a view that depends on
+// another view of the same resource comes after it.
+func SortDependenciesFirst(resources []*resource.State) ([]*resource.State, error) {
+	dg := NewDependencyGraph(resources)
+
+	sorted := make([]*resource.State, 0, len(resources))
+	emitted := make([]bool, len(resources))
+	emittedURNs := make(map[resource.URN]bool, len(resources))
+	visiting := make([]bool, len(resources))
+	var cycle *resource.State
+
+	var visit func(i int)
+	visit = func(i int) {
+		if emitted[i] {
+			return
+		}
+		if visiting[i] {
+			if cycle == nil {
+				cycle = resources[i]
+			}
+			return
+		}
+		visiting[i] = true
+
+		res := resources[i]
+		var deps []int
+		for _, urn := range dependencyURNs(res) {
+			if j, has := dg.index[urn]; has && !emittedURNs[urn] {
+				deps = append(deps, j)
+			}
+		}
+		slices.Sort(deps)
+		for _, dep := range deps {
+			visit(dep)
+		}
+
+		emitted[i] = true
+		emittedURNs[res.URN] = true
+		sorted = append(sorted, res)
+	}
+	for i := range resources {
+		visit(i)
+	}
+
+	if cycle != nil {
+		return sorted, fmt.Errorf("resource %s has cyclic dependencies", cycle.URN)
+	}
+	return sorted, nil
+}
+
 // Toposort attempts sorts this snapshot so that it is topologically sorted with respect to dependencies (where a
 // dependency could be a provider, parent-child relationship, dependency, and so on). Resources in the resulting
 // snapshot will appear in an order such that all dependencies of a resource will appear before the resource itself.
@@ -410,6 +750,120 @@ func (snap *Snapshot) NormalizeURNReferences() (*Snapshot, error) {
 	return snap.withUpdatedResources(fixResource), nil
 }
 
+// RewriteStack renames the stack to which this snapshot belongs from oldStack to newStack by rewriting the stack
+// component of every URN in the snapshot: those of its resources and pending operations, along with their parents,
+// dependencies, property dependencies, DeletedWith targets, provider references and aliases, and those of its pending
+// imports and retained resources. The root stack resource is also renamed, since its name is derived from the stack's.
+// Rewritten resources are replaced by copies rather than modified in place. It returns the number of resources and
+// pending operations that were rewritten. If any resource does not belong to oldStack, the snapshot is left unchanged
+// and an error is returned.
+func (snap *Snapshot) RewriteStack(oldStack, newStack tokens.QName) (int, error) {
+	if !tokens.IsQName(string(newStack)) {
+		return 0, fmt.Errorf("invalid stack name %q", newStack)
+	}
+	if snap == nil || oldStack == newStack {
+		return 0, nil
+	}
+
+	for _, state := range snap.Resources {
+		if state.URN.Stack() != oldStack {
+			return 0, fmt.Errorf("resource %s does not belong to stack %s", state.URN, oldStack)
+		}
+	}
+	for _, op := range snap.PendingOperations {
+		if op.Resource.URN.Stack() != oldStack {
+			return 0, fmt.Errorf("pending operation on %s does not belong to stack %s", op.Resource.URN, oldStack)
+		}
+	}
+
+	rewriteURN := func(urn resource.URN) resource.URN {
+		if !urn.IsValid() || urn.Stack() != oldStack {
+			return urn
+		}
+		name := urn.Name()
+		if urn.QualifiedType() == resource.RootStackType && name == string(urn.Project())+"-"+string(oldStack) {
+			name = string(urn.Project()) + "-" + string(newStack)
+		}
+		return resource.NewURN(newStack, urn.Project(), "", urn.QualifiedType(), name)
+	}
+
+	var providerErr error
+	rewriteProvider := func(provider string) string {
+		ref, err := providers.ParseReference(provider)
+		if err != nil {
+			providerErr = err
+			return provider
+		}
+		ref, err = providers.NewReference(rewriteURN(ref.URN()), ref.ID())
+		contract.AssertNoErrorf(err, "could not create provider reference with ID %s", ref.ID())
+		return ref.String()
+	}
+
+	rewritten := 0
+	rewrite := func(state *resource.State) *resource.State {
+		state.Lock.Lock()
+		defer state.Lock.Unlock()
+
+		newState := newStateBuilder(state).
+			withUpdatedURN(rewriteURN).
+			withAllUpdatedDependencies(rewriteProvider, rewriteURN, nil).
+			withUpdatedAliasURNs(rewriteURN).
+			build()
+		if newState != state {
+			rewritten++
+		}
+		return newState
+	}
+
+	resources := make([]*resource.State, len(snap.Resources))
+	for i, state := range snap.Resources {
+		resources[i] = rewrite(state)
+	}
+	operations := make([]resource.Operation, len(snap.PendingOperations))
+	for i, op := range snap.PendingOperations {
+		op.Resource = rewrite(op.Resource)
+		operations[i] = op
+	}
+	if providerErr != nil {
+		return 0, fmt.Errorf("rewriting provider reference: %w", providerErr)
+	}
+
+	// Any rewritten resources must keep the secrets manager of the resource they replace.
+	if len(snap.ResourceSecretsManagers) != 0 {
+		resourceSecretsManagers := make(map[*resource.State]secrets.Manager, len(snap.ResourceSecretsManagers))
+		for i, state := range snap.Resources {
+			if sm, has := snap.ResourceSecretsManagers[state]; has {
+				resourceSecretsManagers[resources[i]] = sm
+			}
+		}
+		for i, op := range snap.PendingOperations {
+			if sm, has := snap.ResourceSecretsManagers[op.Resource]; has {
+				resourceSecretsManagers[operations[i].Resource] = sm
+			}
+		}
+		snap.ResourceSecretsManagers = resourceSecretsManagers
+	}
+	snap.Resources, snap.PendingOperations = resources, operations
+
+	if snap.PendingImports != nil {
+		pendingImports := make([]PendingImport, len(snap.PendingImports))
+		for i, pending := range snap.PendingImports {
+			pending.URN = rewriteURN(pending.URN)
+			pendingImports[i] = pending
+		}
+		snap.PendingImports = pendingImports
+	}
+	if snap.Metadata.RetainedResources != nil {
+		retained := make([]RetainedResource, len(snap.Metadata.RetainedResources))
+		for i, res := range snap.Metadata.RetainedResources {
+			res.URN = rewriteURN(res.URN)
+			retained[i] = res
+		}
+		snap.Metadata.RetainedResources = retained
+	}
+	return rewritten, nil
+}
+
 // VerifyIntegrity checks a snapshot to ensure it is well-formed.  Because of the cost of this operation,
 // integrity verification is only performed on demand, and not automatically during snapshot construction.
 //
@@ -420,12 +874,20 @@ func (snap *Snapshot) NormalizeURNReferences() (*Snapshot, error) {
 //  4. Dependents must precede their dependencies in the resource list
 //  5. For every URN in the snapshot, there must be at most one resource with that URN that is not pending deletion
 //  6. The magic manifest number should change every time the snapshot is mutated
+//  7. Views must refer to an owning resource that exists in the snapshot
+//  8. No resource may be its own ancestor, i.e. the resources' parents must not form a cycle
+//  9. If RequiresUniqueIDs is set, no two custom resources of a type for which it returns true may share an ID unless
+//     they are managed by different providers
 //
 // N.B. Constraints 2 does NOT apply for resources that are pending deletion. This is because they may have
 // had their provider replaced but not yet be replaced themselves yet (due to a partial update). Pending
 // replacement resources also can't just be wholly removed from the snapshot because they may have dependents
 // that are not being replaced and thus would fail validation if the pending replacement resource was removed
 // and not re-created (again due to partial updates).
+//
+// Constraint 3 does NOT apply to a view whose parent is also its owner, since views are recorded while their owner's
+// operation is still in flight. For the same reason, a view's owner may be the subject of a pending operation rather
+// than a member of the resource list.
 func (snap *Snapshot) VerifyIntegrity() error {
 	if snap != nil {
 		// Ensure the magic cookie checks out.
@@ -433,6 +895,16 @@ func (snap *Snapshot) VerifyIntegrity() error {
 			return SnapshotIntegrityErrorf("magic cookie mismatch; possible tampering/corruption detected")
 		}
 
+		// A parent cycle would otherwise be reported as a parent that comes after its child, which is misleading since
+		// no order of the resources could satisfy it.
+		if cycle := findParentCycle(snap.Resources); cycle != nil {
+			chain := make([]string, len(cycle))
+			for i, urn := range cycle {
+				chain[i] = string(urn)
+			}
+			return SnapshotIntegrityErrorf("resources have a parent cycle: %s", strings.Join(chain, " -> "))
+		}
+
 		// Now check the resources.  For now, we just verify that parents come before children, and that there aren't
 		// any duplicate URNs.
 		urns := make(map[resource.URN]*resource.State)
@@ -450,12 +922,8 @@ func (snap *Snapshot) VerifyIntegrity() error {
 
 			provider, allDeps := state.GetAllDependencies()
 			if provider != "" {
-				ref, err := providers.ParseReference(provider)
-				if err != nil {
-					return SnapshotIntegrityErrorf("failed to parse provider reference for resource %s: %w", urn, err)
-				}
-				if _, has := provs[ref]; !has && !state.PendingReplacement {
-					return SnapshotIntegrityErrorf("resource %s refers to unknown provider %s", urn, ref)
+				if _, resolved := resolveProvider(provs, state); !resolved {
+					return providerIntegrityError(snap.Resources, i)
 				}
 			}
 
@@ -471,17 +939,17 @@ func (snap *Snapshot) VerifyIntegrity() error {
 			// outcome.
 
 			for _, dep := range allDeps {
-				switch dep.Type {
-				case resource.ResourceParent:
-					if _, has := urns[dep.URN]; !has {
-						for _, other := range snap.Resources[i+1:] {
-							if other.URN == dep.URN {
-								return SnapshotIntegrityErrorf("child resource %s's parent %s comes after it", urn, dep.URN)
-							}
-						}
-						return SnapshotIntegrityErrorf("child resource %s refers to missing parent %s", urn, dep.URN)
+				if _, has := urns[dep.URN]; !has {
+					// Views are published by their owning resource while that resource's own operation is still in
+					// progress, so a view may legitimately be recorded before an owner that is also its parent. The
+					// owner's existence is checked separately below.
+					if dep.Type == resource.ResourceParent && dep.URN == state.ViewOf {
+						continue
 					}
+					return dependencyIntegrityError(snap.Resources, i, dep)
+				}
 
+				if dep.Type == resource.ResourceParent {
 					// Ensure that our URN is a child of the parent's URN.
 					expectedType := urn.Type()
 					if dep.URN.QualifiedType() != resource.RootStackType {
@@ -493,54 +961,6 @@ func (snap *Snapshot) VerifyIntegrity() error {
 						// TODO: Change this to an error once we're sure users won't hit this in the wild.
 						// return fmt.Errorf("child resource %s has parent %s but its URN doesn't match", urn, dep.URN)
 					}
-				case resource.ResourceDependency:
-					if _, has := urns[dep.URN]; !has {
-						for _, other := range snap.Resources[i+1:] {
-							if other.URN == dep.URN {
-								return SnapshotIntegrityErrorf(
-									"resource %s's dependency %s comes after it",
-									urn, other.URN,
-								)
-							}
-						}
-
-						return SnapshotIntegrityErrorf(
-							"resource %s's dependency %s refers to missing resource",
-							urn, dep.URN,
-						)
-					}
-				case resource.ResourcePropertyDependency:
-					if _, has := urns[dep.URN]; !has {
-						for _, other := range snap.Resources[i+1:] {
-							if other.URN == dep.URN {
-								return SnapshotIntegrityErrorf(
-									"resource %s's property dependency %s (from property %s) comes after it",
-									urn, other.URN, dep.Key,
-								)
-							}
-						}
-
-						return SnapshotIntegrityErrorf(
-							"resource %s's property dependency %s (from property %s) refers to missing resource",
-							urn, dep.URN, dep.Key,
-						)
-					}
-				case resource.ResourceDeletedWith:
-					if _, has := urns[dep.URN]; !has {
-						for _, other := range snap.Resources[i+1:] {
-							if other.URN == dep.URN {
-								return SnapshotIntegrityErrorf(
-									"resource %s is specified as being deleted with %s, which comes after it",
-									urn, dep.URN,
-								)
-							}
-						}
-
-						return SnapshotIntegrityErrorf(
-							"resource %s is specified as being deleted with %s, which is missing",
-							urn, dep.URN,
-						)
-					}
 				}
 			}
 
@@ -551,8 +971,359 @@ func (snap *Snapshot) VerifyIntegrity() error {
 
 			urns[urn] = state
 		}
+
+		if err := verifyUniqueIDs(snap.Resources); err != nil {
+			return err
+		}
+
+		// Pending imports are not yet resources, so they may name URNs that are absent from the resource list. They
+		// must still be well-formed and distinct, however, so that each can be matched to the import that completes it.
+		pendingImports := make(map[resource.URN]bool, len(snap.PendingImports))
+		for _, pending := range snap.PendingImports {
+			if !pending.URN.IsValid() {
+				return SnapshotIntegrityErrorf("pending import has invalid URN %q", pending.URN)
+			}
+			if pending.ID == "" {
+				return SnapshotIntegrityErrorf("pending import %s has no ID", pending.URN)
+			}
+			if pendingImports[pending.URN] {
+				return SnapshotIntegrityErrorf("duplicate pending import %s", pending.URN)
+			}
+			pendingImports[pending.URN] = true
+		}
+
+		// Finally, ensure that every view refers to an owning resource that exists, either in the resource list or as
+		// the subject of a pending operation (e.g. an owner that is still being created).
+		for _, state := range snap.Resources {
+			if state.ViewOf == "" {
+				continue
+			}
+			if _, has := urns[state.ViewOf]; has {
+				continue
+			}
+			if !slices.ContainsFunc(snap.PendingOperations, func(op resource.Operation) bool {
+				return op.Resource != nil && op.Resource.URN == state.ViewOf
+			}) {
+				return SnapshotIntegrityErrorf("view %s refers to missing owner %s", state.URN, state.ViewOf)
+			}
+		}
+	}
+
+	return nil
+}
+
+// VerifyIntegrityDelta checks the parts of a snapshot that may have been affected by changes to the resources with the
+// given URNs, on the assumption that the rest of the snapshot passed VerifyIntegrity before the changes were made. It
+// checks the magic cookie; that the provider, parent and other dependencies of each changed resource precede it; that
+// no changed resource duplicates the URN of a resource that is not pending deletion; and that every resource that
+// depends on a changed resource, or is a view of one, can still find it. The URN of a resource that has been removed
+// from the snapshot may be given, so that the resources that depended on it are checked. If RequiresUniqueIDs is set,
+// the uniqueness of IDs is checked across the whole snapshot.
+//
+// This is cheaper than VerifyIntegrity when a small part of a large snapshot has changed, but it cannot catch the
+// corruption of resources outside the changed set, so a full verification should still be done from time to time.
+func (snap *Snapshot) VerifyIntegrityDelta(changed []resource.URN) error {
+	if snap == nil {
+		return nil
+	}
+	if snap.Manifest.Magic != snap.Manifest.NewMagic() {
+		return SnapshotIntegrityErrorf("magic cookie mismatch; possible tampering/corruption detected")
+	}
+
+	isChanged := make(map[resource.URN]bool, len(changed))
+	for _, urn := range changed {
+		isChanged[urn] = true
+	}
+
+	// Every resource must still be indexed so that the edges of the changed resources can be checked, but only the
+	// edges that start or end at a changed resource are checked.
+	urns := make(map[resource.URN]bool, len(snap.Resources))
+	provs := make(map[providers.Reference]struct{})
+	for i, state := range snap.Resources {
+		urn := state.URN
+
+		if providers.IsProviderType(state.Type) {
+			ref, err := providers.NewReference(urn, state.ID)
+			if err != nil {
+				if isChanged[urn] {
+					return SnapshotIntegrityErrorf("provider %s is not referenceable: %w", urn, err)
+				}
+			} else {
+				provs[ref] = struct{}{}
+			}
+		}
+
+		provider, allDeps := state.GetAllDependencies()
+		if provider != "" {
+			ref, resolved := resolveProvider(provs, state)
+			if !resolved && (isChanged[urn] || ref.URN() != "" && isChanged[ref.URN()]) {
+				return providerIntegrityError(snap.Resources, i)
+			}
+		}
+
+		for _, dep := range allDeps {
+			if urns[dep.URN] || !isChanged[urn] && !isChanged[dep.URN] {
+				continue
+			}
+			if dep.Type == resource.ResourceParent && dep.URN == state.ViewOf {
+				continue
+			}
+			return dependencyIntegrityError(snap.Resources, i, dep)
+		}
+
+		if isChanged[urn] && urns[urn] && !state.Delete {
+			return SnapshotIntegrityErrorf("duplicate resource %s (not marked for deletion)", urn)
+		}
+		urns[urn] = true
+	}
+
+	if err := verifyUniqueIDs(snap.Resources); err != nil {
+		return err
+	}
+
+	for _, state := range snap.Resources {
+		if state.ViewOf == "" || urns[state.ViewOf] || !isChanged[state.URN] && !isChanged[state.ViewOf] {
+			continue
+		}
+		if !slices.ContainsFunc(snap.PendingOperations, func(op resource.Operation) bool {
+			return op.Resource != nil && op.Resource.URN == state.ViewOf
+		}) {
+			return SnapshotIntegrityErrorf("view %s refers to missing owner %s", state.URN, state.ViewOf)
+		}
+	}
+
+	return nil
+}
+
+// dependencyIntegrityError describes a dependency of the resource at index i of the given resources that is not
+// satisfied by any resource before it, distinguishing a dependency that comes after the resource from a missing one.
+func dependencyIntegrityError(resources []*resource.State, i int, dep resource.StateDependency) error {
+	urn := resources[i].URN
+	later := slices.ContainsFunc(resources[i+1:], func(other *resource.State) bool {
+		return other.URN == dep.URN
+	})
+
+	switch dep.Type {
+	case resource.ResourceParent:
+		if later {
+			return outOfOrderErrorf("child resource %s's parent %s comes after it", urn, dep.URN)
+		}
+		return SnapshotIntegrityErrorf("child resource %s refers to missing parent %s", urn, dep.URN)
+	case resource.ResourcePropertyDependency:
+		if later {
+			return outOfOrderErrorf(
+				"resource %s's property dependency %s (from property %s) comes after it",
+				urn, dep.URN, dep.Key,
+			)
+		}
+		return SnapshotIntegrityErrorf(
+			"resource %s's property dependency %s (from property %s) refers to missing resource",
+			urn, dep.URN, dep.Key,
+		)
+	case resource.ResourceDeletedWith:
+		if later {
+			return outOfOrderErrorf(
+				"resource %s is specified as being deleted with %s, which comes after it",
+				urn, dep.URN,
+			)
+		}
+		return SnapshotIntegrityErrorf(
+			"resource %s is specified as being deleted with %s, which is missing",
+			urn, dep.URN,
+		)
+	default:
+		if later {
+			return outOfOrderErrorf("resource %s's dependency %s comes after it", urn, dep.URN)
+		}
+		return SnapshotIntegrityErrorf("resource %s's dependency %s refers to missing resource", urn, dep.URN)
+	}
+}
+
+// VerifyProviders checks that every custom resource in the snapshot refers to a provider that comes before it, and
+// returns an error describing the first that does not. Unlike VerifyIntegrity, which accepts custom resources without
+// a provider reference since state written before default providers were introduced has none, this also reports such
+// resources, as they can no longer be managed.
+func (snap *Snapshot) VerifyProviders() error {
+	if snap == nil {
+		return nil
+	}
+	provs := make(map[providers.Reference]struct{})
+	for i, state := range snap.Resources {
+		if providers.IsProviderType(state.Type) {
+			if ref, err := providers.NewReference(state.URN, state.ID); err == nil {
+				provs[ref] = struct{}{}
+			}
+			continue
+		}
+		if !state.Custom && state.Provider == "" {
+			continue
+		}
+		if _, resolved := resolveProvider(provs, state); !resolved {
+			return providerIntegrityError(snap.Resources, i)
+		}
+	}
+	return nil
+}
+
+// resolveProvider returns the parsed provider reference of the given resource and whether it resolves to one of the
+// given providers. A resource that is pending replacement may refer to a provider that has since been removed.
+func resolveProvider(provs map[providers.Reference]struct{}, state *resource.State) (providers.Reference, bool) {
+	if state.Provider == "" {
+		return providers.Reference{}, false
+	}
+	ref, err := providers.ParseReference(state.Provider)
+	if err != nil {
+		return providers.Reference{}, false
+	}
+	_, has := provs[ref]
+	return ref, has || state.PendingReplacement
+}
+
+// providerIntegrityError describes why the provider reference of the custom resource at index i of the given resources
+// does not resolve to a provider before it. This is reported separately from other missing dependencies since a
+// custom resource without a provider cannot be refreshed, updated or deleted.
+func providerIntegrityError(resources []*resource.State, i int) error {
+	state := resources[i]
+	if state.Provider == "" {
+		return SnapshotIntegrityErrorf("custom resource %s has no provider reference", state.URN)
+	}
+	ref, err := providers.ParseReference(state.Provider)
+	if err != nil {
+		return SnapshotIntegrityErrorf("failed to parse provider reference for resource %s: %w", state.URN, err)
+	}
+
+	later := slices.ContainsFunc(resources[i+1:], func(other *resource.State) bool {
+		return other.URN == ref.URN() && other.ID == ref.ID()
+	})
+	if later {
+		return outOfOrderErrorf("resource %s's provider %s comes after it", state.URN, ref)
+	}
+	for _, other := range resources[:i] {
+		if other.URN == ref.URN() {
+			return SnapshotIntegrityErrorf(
+				"resource %s refers to unknown provider %s: provider %s has ID %s, not %s",
+				state.URN, ref, ref.URN(), other.ID, ref.ID(),
+			)
+		}
+	}
+	return SnapshotIntegrityErrorf("resource %s refers to unknown provider %s", state.URN, ref)
+}
+
+// RequiresUniqueIDs, if set, reports whether the provider of resources of the given type requires each of them to have
+// a distinct ID, in which case VerifyIntegrity checks that no two such resources managed by the same provider share
+// one. Such collisions can be introduced by tools that splice resources between stacks. It is unset by default, since
+// many providers allow IDs to be shared, e.g. by resources that differ only in a property that is not part of the ID.
+var RequiresUniqueIDs func(typ tokens.Type) bool
+
+// HasID returns true if this snapshot contains a custom resource of the given type with the given ID, including one
+// that is pending deletion.
+func (snap *Snapshot) HasID(typ tokens.Type, id resource.ID) bool {
+	for _, state := range snap.Resources {
+		if state.Custom && state.Type == typ && state.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// ProviderUsage returns the URNs of the resources in this snapshot that use each provider package and version, keyed by
+// "package@version", e.g. "aws@6.0.0". Resources whose provider does not record a version, or whose provider is not in
+// the snapshot, are keyed by the package alone. Resources that reference an invalid provider are not included. The URNs
+// for each key are in snapshot order. This can be used to find the resources that an upgrade of a provider will affect.
+func (snap *Snapshot) ProviderUsage() map[string][]resource.URN {
+	// Work out the key for each provider in the snapshot from its type and inputs.
+	keys := make(map[string]string)
+	for _, state := range snap.Resources {
+		if !providers.IsProviderType(state.Type) {
+			continue
+		}
+		ref, err := providers.NewReference(state.URN, state.ID)
+		if err != nil {
+			continue
+		}
+		key := string(providers.GetProviderPackage(state.Type))
+		if version, err := providers.GetProviderVersion(state.Inputs); err == nil && version != nil {
+			key += "@" + version.String()
+		}
+		keys[ref.String()] = key
 	}
 
+	usage := make(map[string][]resource.URN)
+	for _, state := range snap.Resources {
+		if state.Provider == "" {
+			continue
+		}
+		ref, err := providers.ParseReference(state.Provider)
+		if err != nil {
+			logging.V(7).Infof("ProviderUsage: ignoring invalid provider reference %q of %v: %v", state.Provider,
+				state.URN, err)
+			continue
+		}
+		key, has := keys[ref.String()]
+		if !has {
+			key = string(providers.GetProviderPackage(ref.URN().Type()))
+		}
+		usage[key] = append(usage[key], state.URN)
+	}
+	return usage
+}
+
+// verifyUniqueIDs checks that no two of the given resources share an ID if RequiresUniqueIDs says that their type needs
+// it. Resources pending deletion or replacement may share an ID with the resource replacing them, and external
+// resources are only read, so none of them are checked.
+func verifyUniqueIDs(resources []*resource.State) error {
+	if RequiresUniqueIDs == nil {
+		return nil
+	}
+
+	type key struct {
+		typ      tokens.Type
+		provider string
+		id       resource.ID
+	}
+	seen := make(map[key]resource.URN)
+	for _, state := range resources {
+		if !state.Custom || state.ID == "" || state.Delete || state.PendingReplacement || state.External ||
+			state.ViewOf != "" || !RequiresUniqueIDs(state.Type) {
+			continue
+		}
+
+		k := key{typ: state.Type, provider: state.Provider, id: state.ID}
+		if other, has := seen[k]; has {
+			return SnapshotIntegrityErrorf("resources %s and %s of type %s share ID %s", other, state.URN, state.Type, state.ID)
+		}
+		seen[k] = state.URN
+	}
+	return nil
+}
+
+// findParentCycle returns a chain of URNs, each the parent of the one before it, that begins and ends with the same
+// resource, or nil if the parents of the given resources form no cycle. Where several resources share a URN, the
+// parent of the one that is not pending deletion is used.
+func findParentCycle(resources []*resource.State) []resource.URN {
+	parents := make(map[resource.URN]resource.URN, len(resources))
+	for _, state := range resources {
+		if _, has := parents[state.URN]; !has || !state.Delete {
+			parents[state.URN] = state.Parent
+		}
+	}
+
+	// Resources whose ancestry has been fully walked without finding a cycle.
+	acyclic := make(map[resource.URN]bool, len(resources))
+	for _, state := range resources {
+		var chain []resource.URN
+		onChain := map[resource.URN]int{}
+		for urn := state.URN; urn != "" && !acyclic[urn]; urn = parents[urn] {
+			if i, has := onChain[urn]; has {
+				return append(chain[i:], urn)
+			}
+			onChain[urn] = len(chain)
+			chain = append(chain, urn)
+		}
+		for _, urn := range chain {
+			acyclic[urn] = true
+		}
+	}
 	return nil
 }
 
@@ -574,6 +1345,22 @@ func (snap *Snapshot) withUpdatedResources(update func(*resource.State) *resourc
 	}
 	newSnap := *snap // shallow copy
 	newSnap.Resources = new
+
+	// Any edited resources must keep the secrets manager of the resource they replace.
+	if len(snap.ResourceSecretsManagers) != 0 {
+		newSnap.ResourceSecretsManagers = make(map[*resource.State]secrets.Manager, len(snap.ResourceSecretsManagers))
+		for i, s := range old {
+			if sm, has := snap.ResourceSecretsManagers[s]; has {
+				newSnap.ResourceSecretsManagers[new[i]] = sm
+			}
+		}
+		// Pending operations are not edited, so their resources keep their secrets managers as they are.
+		for _, op := range snap.PendingOperations {
+			if sm, has := snap.ResourceSecretsManagers[op.Resource]; has {
+				newSnap.ResourceSecretsManagers[op.Resource] = sm
+			}
+		}
+	}
 	return &newSnap
 }
 
@@ -642,6 +1429,25 @@ func (s *SnapshotIntegrityError) ForRead(snap *Snapshot) *SnapshotIntegrityError
 	}
 }
 
+// ErrOutOfOrder matches the snapshot integrity errors that report a resource which comes before its provider, parent
+// or another of its dependencies. Unlike other integrity errors, these can be fixed by reordering the snapshot's
+// resources (see Snapshot.Reorder).
+var ErrOutOfOrder = errors.New("resource comes before its dependency")
+
+// outOfOrderError is an error that matches ErrOutOfOrder.
+type outOfOrderError struct {
+	error
+}
+
+func (*outOfOrderError) Is(target error) bool {
+	return target == ErrOutOfOrder
+}
+
+// outOfOrderErrorf is like SnapshotIntegrityErrorf, but the error it returns also matches ErrOutOfOrder.
+func outOfOrderErrorf(format string, args ...interface{}) error {
+	return SnapshotIntegrityErrorf("%w", &outOfOrderError{fmt.Errorf(format, args...)})
+}
+
 // Returns a tuple in which the second element is true if and only if any error
 // in the given error's tree is a SnapshotIntegrityError. In that case, the
 // first element will be the first SnapshotIntegrityError in the tree. In the
@@ -15,11 +15,17 @@
 package deploy
 
 import (
+	"bytes"
+	"math/rand"
+	"slices"
 	"sort"
 	"testing"
 
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy/providers"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func createSnapshot() Snapshot {
@@ -861,6 +867,158 @@ func TestSnapshotToposort_PreservesValidSnapshots(t *testing.T) {
 	}
 }
 
+func TestSortDependenciesFirst_Views(t *testing.T) {
+	t.Parallel()
+
+	// Arrange: two views of the same owner, where the second depends on the first. Views record such dependencies in
+	// their Dependencies like any other resource. Views are published while their owner is being operated upon, so the
+	// dependent view may be recorded first.
+	owner := &resource.State{URN: "urn:pulumi:stack::project::t::owner"}
+	first := &resource.State{
+		URN:    "urn:pulumi:stack::project::t$v::first",
+		Parent: owner.URN,
+		ViewOf: owner.URN,
+	}
+	second := &resource.State{
+		URN:          "urn:pulumi:stack::project::t$v::second",
+		Parent:       owner.URN,
+		ViewOf:       owner.URN,
+		Dependencies: []resource.URN{first.URN},
+	}
+
+	// Act.
+	sorted, err := SortDependenciesFirst([]*resource.State{owner, second, first})
+
+	// Assert.
+	require.NoError(t, err)
+	assert.Equal(t, []*resource.State{owner, first, second}, sorted)
+	assert.NoError(t, (&Snapshot{Resources: sorted}).VerifyIntegrity())
+}
+
+func TestSnapshotToDOT(t *testing.T) {
+	t.Parallel()
+
+	// Arrange: the snapshot written by the vexing deployment (see TestVexingDeployment in the backend package), in
+	// which c has been replaced but the old c, which is pending deletion, still depends on a and b. A parent
+	// relationship is added to check that parent edges are drawn too, and f depends on g, which comes after it.
+	urn := func(name string) resource.URN { return resource.URN("urn:pulumi:stack::project::t::" + name) }
+	snap := &Snapshot{Resources: []*resource.State{
+		{URN: urn("b")},
+		{URN: urn("c"), Dependencies: []resource.URN{urn("b")}},
+		{URN: urn("d"), Dependencies: []resource.URN{urn("c")}},
+		{URN: urn("a")},
+		{URN: urn("c"), Dependencies: []resource.URN{urn("a"), urn("b")}, Delete: true},
+		{URN: urn("e"), Dependencies: []resource.URN{urn("c")}, Parent: urn("a")},
+		{URN: urn("f"), Dependencies: []resource.URN{urn("g")}},
+		{URN: urn("g")},
+	}}
+
+	// Act.
+	var buf bytes.Buffer
+	err := snap.ToDOT(&buf)
+
+	// Assert.
+	require.NoError(t, err)
+	assert.Equal(t, `strict digraph {
+    Resource0 [label="urn:pulumi:stack::project::t::b"];
+    Resource1 [label="urn:pulumi:stack::project::t::c"];
+    Resource2 [label="urn:pulumi:stack::project::t::d"];
+    Resource3 [label="urn:pulumi:stack::project::t::a"];
+    Resource4 [label="urn:pulumi:stack::project::t::c", style=dashed];
+    Resource5 [label="urn:pulumi:stack::project::t::e"];
+    Resource6 [label="urn:pulumi:stack::project::t::f"];
+    Resource7 [label="urn:pulumi:stack::project::t::g"];
+    Resource1 -> Resource0;
+    Resource2 -> Resource1;
+    Resource4 -> Resource3;
+    Resource4 -> Resource0;
+    Resource5 -> Resource4;
+    Resource5 -> Resource3 [style=dotted];
+    Resource6 -> Resource7;
+}
+`, buf.String())
+}
+
+func TestSnapshotReorder(t *testing.T) {
+	t.Parallel()
+
+	newResources := func() []*resource.State {
+		return []*resource.State{
+			{
+				Type: "pulumi:providers:p",
+				URN:  "urn:pulumi:stack::project::pulumi:providers:p::p",
+				ID:   "id",
+			},
+			{URN: "urn:pulumi:stack::project::t::a", Provider: "urn:pulumi:stack::project::pulumi:providers:p::p::id"},
+			{URN: "urn:pulumi:stack::project::t::b", Dependencies: []resource.URN{"urn:pulumi:stack::project::t::a"}},
+			{URN: "urn:pulumi:stack::project::t$t::c", Parent: "urn:pulumi:stack::project::t::b"},
+			{
+				URN: "urn:pulumi:stack::project::t::d",
+				PropertyDependencies: map[resource.PropertyKey][]resource.URN{
+					"p": {"urn:pulumi:stack::project::t$t::c"},
+				},
+			},
+			{URN: "urn:pulumi:stack::project::t::e", DeletedWith: "urn:pulumi:stack::project::t::d"},
+			{URN: "urn:pulumi:stack::project::t::f"},
+		}
+	}
+
+	t.Run("valid snapshot is unchanged", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		snap := &Snapshot{Resources: newResources()}
+		require.NoError(t, snap.VerifyIntegrity())
+		expected := slices.Clone(snap.Resources)
+
+		// Act.
+		err := snap.Reorder()
+
+		// Assert.
+		require.NoError(t, err)
+		assert.Equal(t, expected, snap.Resources)
+	})
+
+	t.Run("shuffled snapshot is repaired", func(t *testing.T) {
+		t.Parallel()
+
+		for seed := int64(0); seed < 20; seed++ {
+			// Arrange.
+			resources := newResources()
+			rand.New(rand.NewSource(seed)).Shuffle(len(resources), func(i, j int) {
+				resources[i], resources[j] = resources[j], resources[i]
+			})
+			snap := &Snapshot{Resources: slices.Clone(resources)}
+
+			// Act.
+			err := snap.Reorder()
+
+			// Assert.
+			require.NoError(t, err, "seed %d", seed)
+			assert.NoError(t, snap.VerifyIntegrity(), "seed %d", seed)
+			assert.ElementsMatch(t, resources, snap.Resources, "seed %d", seed)
+		}
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		resources := []*resource.State{
+			{URN: "urn:pulumi:stack::project::t::a", Dependencies: []resource.URN{"urn:pulumi:stack::project::t::b"}},
+			{URN: "urn:pulumi:stack::project::t::b", Dependencies: []resource.URN{"urn:pulumi:stack::project::t::a"}},
+		}
+		snap := &Snapshot{Resources: slices.Clone(resources)}
+
+		// Act.
+		err := snap.Reorder()
+
+		// Assert.
+		assert.ErrorContains(t, err, "cyclic dependencies")
+		assert.Equal(t, resources, snap.Resources)
+	})
+}
+
 func TestSnapshotToposort_FixesOrderInvalidSnapshots(t *testing.T) {
 	t.Parallel()
 
@@ -1124,3 +1282,994 @@ func TestSnapshotToposort_DetectsCycles(t *testing.T) {
 		})
 	}
 }
+
+func TestSnapshotVerifyIntegrity_Views(t *testing.T) {
+	t.Parallel()
+
+	owner := "urn:pulumi:stack::project::t::owner"
+
+	cases := []struct {
+		name    string
+		given   []*resource.State
+		pending []resource.Operation
+		err     string
+	}{
+		{
+			name: "owner present",
+			given: []*resource.State{
+				{URN: resource.URN(owner)},
+				{
+					URN:    "urn:pulumi:stack::project::t$v::view",
+					Parent: resource.URN(owner),
+					ViewOf: resource.URN(owner),
+				},
+			},
+		},
+		{
+			name: "owner present after its view",
+			given: []*resource.State{
+				{
+					URN:    "urn:pulumi:stack::project::t$v::view",
+					Parent: resource.URN(owner),
+					ViewOf: resource.URN(owner),
+				},
+				{URN: resource.URN(owner)},
+			},
+		},
+		{
+			name: "owner pending creation",
+			given: []*resource.State{
+				{
+					URN:    "urn:pulumi:stack::project::t$v::view",
+					Parent: resource.URN(owner),
+					ViewOf: resource.URN(owner),
+				},
+			},
+			pending: []resource.Operation{
+				resource.NewOperation(&resource.State{URN: resource.URN(owner)}, resource.OperationTypeCreating),
+			},
+		},
+		{
+			name: "owner missing",
+			given: []*resource.State{
+				{
+					URN:    "urn:pulumi:stack::project::t$v::view",
+					Parent: resource.URN(owner),
+					ViewOf: resource.URN(owner),
+				},
+			},
+			err: "view urn:pulumi:stack::project::t$v::view refers to missing owner " + owner,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Arrange.
+			snap := &Snapshot{Resources: c.given, PendingOperations: c.pending}
+
+			// Act.
+			err := snap.VerifyIntegrity()
+
+			// Assert.
+			if c.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, c.err)
+			}
+		})
+	}
+}
+
+func TestSnapshotVerifyIntegrity_DeletedWith(t *testing.T) {
+	t.Parallel()
+
+	a := resource.URN("urn:pulumi:stack::project::t::a")
+	b := resource.URN("urn:pulumi:stack::project::t::b")
+
+	cases := []struct {
+		name  string
+		given []*resource.State
+		err   string
+	}{
+		{
+			name: "target present",
+			given: []*resource.State{
+				{URN: a},
+				{URN: b, DeletedWith: a},
+			},
+		},
+		{
+			name: "target after",
+			given: []*resource.State{
+				{URN: b, DeletedWith: a},
+				{URN: a},
+			},
+			err: "resource " + string(b) + " is specified as being deleted with " + string(a) + ", which comes after it",
+		},
+		{
+			name: "target dangling",
+			given: []*resource.State{
+				{URN: b, DeletedWith: a},
+			},
+			err: "resource " + string(b) + " is specified as being deleted with " + string(a) + ", which is missing",
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Arrange.
+			snap := &Snapshot{Resources: c.given}
+
+			// Act.
+			err := snap.VerifyIntegrity()
+
+			// Assert.
+			if c.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, c.err)
+			}
+		})
+	}
+}
+
+func TestSnapshotVerifyIntegrity_OutOfOrder(t *testing.T) {
+	t.Parallel()
+
+	a := resource.URN("urn:pulumi:stack::project::t::a")
+	b := resource.URN("urn:pulumi:stack::project::t::b")
+
+	// A dependency that comes after its dependent can be fixed by reordering the resources.
+	snap := &Snapshot{Resources: []*resource.State{{URN: b, Dependencies: []resource.URN{a}}, {URN: a}}}
+	err := snap.VerifyIntegrity()
+	assert.ErrorIs(t, err, ErrOutOfOrder)
+	_, isIntegrityError := AsSnapshotIntegrityError(err)
+	assert.True(t, isIntegrityError)
+
+	require.NoError(t, snap.Reorder())
+	assert.NoError(t, snap.VerifyIntegrity())
+
+	// A missing dependency cannot.
+	snap = &Snapshot{Resources: []*resource.State{{URN: b, Dependencies: []resource.URN{a}}}}
+	err = snap.VerifyIntegrity()
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrOutOfOrder)
+}
+
+func TestSnapshotVerifyIntegrity_Providers(t *testing.T) {
+	t.Parallel()
+
+	p := resource.URN("urn:pulumi:stack::project::pulumi:providers:pkg::p")
+	a := resource.URN("urn:pulumi:stack::project::pkg:index:t::a")
+	provider := &resource.State{URN: p, Type: "pulumi:providers:pkg", Custom: true, ID: "id"}
+
+	cases := []struct {
+		name  string
+		given []*resource.State
+		err   string
+	}{
+		{
+			name: "provider present",
+			given: []*resource.State{
+				provider,
+				{URN: a, Type: "pkg:index:t", Custom: true, ID: "a", Provider: string(p) + "::id"},
+			},
+		},
+		{
+			name: "provider after",
+			given: []*resource.State{
+				{URN: a, Type: "pkg:index:t", Custom: true, ID: "a", Provider: string(p) + "::id"},
+				provider,
+			},
+			err: "resource " + string(a) + "'s provider " + string(p) + "::id comes after it",
+		},
+		{
+			name: "provider with another ID",
+			given: []*resource.State{
+				provider,
+				{URN: a, Type: "pkg:index:t", Custom: true, ID: "a", Provider: string(p) + "::other"},
+			},
+			err: "resource " + string(a) + " refers to unknown provider " + string(p) + "::other: provider " +
+				string(p) + " has ID id, not other",
+		},
+		{
+			name: "provider dangling",
+			given: []*resource.State{
+				{URN: a, Type: "pkg:index:t", Custom: true, ID: "a", Provider: string(p) + "::id"},
+			},
+			err: "resource " + string(a) + " refers to unknown provider " + string(p) + "::id",
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Arrange.
+			snap := &Snapshot{Resources: c.given}
+
+			// Act.
+			err := snap.VerifyIntegrity()
+			providersErr := snap.VerifyProviders()
+
+			// Assert.
+			if c.err == "" {
+				assert.NoError(t, err)
+				assert.NoError(t, providersErr)
+			} else {
+				assert.ErrorContains(t, err, c.err)
+				assert.ErrorContains(t, providersErr, c.err)
+			}
+		})
+	}
+
+	t.Run("no provider reference", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		snap := &Snapshot{Resources: []*resource.State{
+			{URN: a, Type: "pkg:index:t", Custom: true, ID: "a"},
+		}}
+
+		// Act.
+		err := snap.VerifyIntegrity()
+		providersErr := snap.VerifyProviders()
+
+		// Assert: state from before default providers has no provider references, so only VerifyProviders flags it.
+		assert.NoError(t, err)
+		assert.ErrorContains(t, providersErr, "custom resource "+string(a)+" has no provider reference")
+	})
+}
+
+func TestSnapshotRewriteStack(t *testing.T) {
+	t.Parallel()
+
+	newSnapshot := func() *Snapshot {
+		stack := &resource.State{
+			Type: resource.RootStackType,
+			URN:  resource.NewURN("dev", "proj", "", resource.RootStackType, "proj-dev"),
+		}
+		provider := &resource.State{
+			Type:   "pulumi:providers:pkg",
+			URN:    resource.NewURN("dev", "proj", "", "pulumi:providers:pkg", "provider"),
+			Custom: true,
+			ID:     "provider-id",
+			Parent: stack.URN,
+		}
+		parent := &resource.State{
+			Type:   "my:component:Parent",
+			URN:    resource.NewURN("dev", "proj", "", "my:component:Parent", "parent"),
+			Parent: stack.URN,
+		}
+		child := &resource.State{
+			Type:         "pkg:index:Child",
+			URN:          resource.NewURN("dev", "proj", "my:component:Parent", "pkg:index:Child", "child"),
+			Custom:       true,
+			ID:           "child-id",
+			Parent:       parent.URN,
+			Provider:     string(provider.URN) + "::provider-id",
+			Dependencies: []resource.URN{provider.URN},
+			PropertyDependencies: map[resource.PropertyKey][]resource.URN{
+				"p": {provider.URN},
+			},
+			Aliases: []resource.URN{resource.NewURN("dev", "proj", "", "pkg:index:Child", "child")},
+		}
+		creating := &resource.State{
+			Type:     "pkg:index:Child",
+			URN:      resource.NewURN("dev", "proj", "", "pkg:index:Child", "creating"),
+			Custom:   true,
+			Parent:   stack.URN,
+			Provider: string(provider.URN) + "::provider-id",
+		}
+		return NewSnapshot(Manifest{}, nil, []*resource.State{stack, provider, parent, child},
+			[]resource.Operation{resource.NewOperation(creating, resource.OperationTypeCreating)}, SnapshotMetadata{})
+	}
+
+	t.Run("rewrites every URN", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		snap := newSnapshot()
+		child := snap.Resources[3]
+
+		// Act.
+		rewritten, err := snap.RewriteStack("dev", "prod")
+
+		// Assert.
+		require.NoError(t, err)
+		assert.Equal(t, 5, rewritten)
+		require.NoError(t, snap.VerifyIntegrity())
+
+		stackURN := resource.NewURN("prod", "proj", "", resource.RootStackType, "proj-prod")
+		providerURN := resource.NewURN("prod", "proj", "", "pulumi:providers:pkg", "provider")
+		parentURN := resource.NewURN("prod", "proj", "", "my:component:Parent", "parent")
+		assert.Equal(t, stackURN, snap.Resources[0].URN)
+		assert.Equal(t, stackURN, snap.Resources[1].Parent)
+
+		newChild := snap.Resources[3]
+		assert.Equal(t, resource.NewURN("prod", "proj", "my:component:Parent", "pkg:index:Child", "child"), newChild.URN)
+		assert.Equal(t, parentURN, newChild.Parent)
+		assert.Equal(t, string(providerURN)+"::provider-id", newChild.Provider)
+		assert.Equal(t, []resource.URN{providerURN}, newChild.Dependencies)
+		assert.Equal(t, map[resource.PropertyKey][]resource.URN{"p": {providerURN}}, newChild.PropertyDependencies)
+		assert.Equal(t, []resource.URN{resource.NewURN("prod", "proj", "", "pkg:index:Child", "child")}, newChild.Aliases)
+
+		require.Len(t, snap.PendingOperations, 1)
+		assert.Equal(t, tokens.QName("prod"), snap.PendingOperations[0].Resource.URN.Stack())
+		assert.Equal(t, string(providerURN)+"::provider-id", snap.PendingOperations[0].Resource.Provider)
+
+		// The original states are not modified.
+		assert.Equal(t, tokens.QName("dev"), child.URN.Stack())
+	})
+
+	t.Run("other stack", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		snap := newSnapshot()
+		resources := snap.Resources
+
+		// Act.
+		_, err := snap.RewriteStack("staging", "prod")
+
+		// Assert.
+		assert.ErrorContains(t, err, "does not belong to stack staging")
+		assert.Equal(t, resources, snap.Resources)
+	})
+}
+
+func TestSnapshotVerifyIntegrity_ParentCycles(t *testing.T) {
+	t.Parallel()
+
+	a := resource.URN("urn:pulumi:stack::project::t::a")
+	b := resource.URN("urn:pulumi:stack::project::t::b")
+	child := resource.URN("urn:pulumi:stack::project::t::child")
+
+	cases := []struct {
+		name  string
+		given []*resource.State
+		err   string
+	}{
+		{
+			name: "parent chain",
+			given: []*resource.State{
+				{URN: a},
+				{URN: b, Parent: a},
+				{URN: child, Parent: b},
+			},
+		},
+		{
+			name: "two-node cycle",
+			given: []*resource.State{
+				{URN: a, Parent: b},
+				{URN: b, Parent: a},
+			},
+			err: "resources have a parent cycle: " + string(a) + " -> " + string(b) + " -> " + string(a),
+		},
+		{
+			name: "cycle above a child",
+			given: []*resource.State{
+				{URN: child, Parent: b},
+				{URN: a, Parent: b},
+				{URN: b, Parent: a},
+			},
+			err: "resources have a parent cycle: " + string(b) + " -> " + string(a) + " -> " + string(b),
+		},
+		{
+			name: "own parent",
+			given: []*resource.State{
+				{URN: a, Parent: a},
+			},
+			err: "resources have a parent cycle: " + string(a) + " -> " + string(a),
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Arrange.
+			snap := &Snapshot{Resources: c.given}
+
+			// Act.
+			err := snap.VerifyIntegrity()
+
+			// Assert.
+			if c.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, c.err)
+			}
+		})
+	}
+}
+
+//nolint:paralleltest // mutates global state
+func TestSnapshotVerifyIntegrity_UniqueIDs(t *testing.T) {
+	old := RequiresUniqueIDs
+	RequiresUniqueIDs = func(typ tokens.Type) bool { return typ == "pkg:index:Bucket" }
+	defer func() { RequiresUniqueIDs = old }()
+
+	provider := "urn:pulumi:stack::project::pulumi:providers:pkg::default::provider-id"
+	otherProvider := "urn:pulumi:stack::project::pulumi:providers:pkg::other::other-id"
+	newResource := func(name string, typ tokens.Type, id resource.ID) *resource.State {
+		return &resource.State{
+			URN:      resource.NewURN("stack", "project", "", typ, name),
+			Type:     typ,
+			Custom:   true,
+			ID:       id,
+			Provider: provider,
+		}
+	}
+	newProviders := func() []*resource.State {
+		return []*resource.State{
+			{
+				URN:    "urn:pulumi:stack::project::pulumi:providers:pkg::default",
+				Type:   "pulumi:providers:pkg",
+				Custom: true,
+				ID:     "provider-id",
+			},
+			{
+				URN:    "urn:pulumi:stack::project::pulumi:providers:pkg::other",
+				Type:   "pulumi:providers:pkg",
+				Custom: true,
+				ID:     "other-id",
+			},
+		}
+	}
+
+	cases := []struct {
+		name  string
+		given []*resource.State
+		err   string
+	}{
+		{
+			name: "distinct IDs",
+			given: []*resource.State{
+				newResource("a", "pkg:index:Bucket", "id-a"),
+				newResource("b", "pkg:index:Bucket", "id-b"),
+			},
+		},
+		{
+			name: "shared ID",
+			given: []*resource.State{
+				newResource("a", "pkg:index:Bucket", "id"),
+				newResource("b", "pkg:index:Bucket", "id"),
+			},
+			err: "resources urn:pulumi:stack::project::pkg:index:Bucket::a and " +
+				"urn:pulumi:stack::project::pkg:index:Bucket::b of type pkg:index:Bucket share ID id",
+		},
+		{
+			name: "shared ID of type that allows it",
+			given: []*resource.State{
+				newResource("a", "pkg:index:Object", "id"),
+				newResource("b", "pkg:index:Object", "id"),
+			},
+		},
+		{
+			name: "shared ID with different providers",
+			given: func() []*resource.State {
+				a, b := newResource("a", "pkg:index:Bucket", "id"), newResource("b", "pkg:index:Bucket", "id")
+				b.Provider = otherProvider
+				return []*resource.State{a, b}
+			}(),
+		},
+		{
+			name: "shared ID with resource pending deletion",
+			given: func() []*resource.State {
+				old, new := newResource("a", "pkg:index:Bucket", "id"), newResource("a", "pkg:index:Bucket", "id")
+				old.Delete = true
+				return []*resource.State{new, old}
+			}(),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Arrange.
+			snap := &Snapshot{Resources: append(newProviders(), c.given...)}
+
+			// Act.
+			err := snap.VerifyIntegrity()
+
+			// Assert.
+			if c.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, c.err)
+			}
+		})
+	}
+}
+
+func TestSnapshotHasID(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	snap := &Snapshot{Resources: []*resource.State{
+		{URN: "urn:pulumi:stack::project::pkg:index:Bucket::a", Type: "pkg:index:Bucket", Custom: true, ID: "id-a"},
+		{URN: "urn:pulumi:stack::project::pkg:index:Bucket::b", Type: "pkg:index:Bucket", Custom: true, ID: "id-b",
+			Delete: true},
+	}}
+
+	// Act and assert.
+	assert.True(t, snap.HasID("pkg:index:Bucket", "id-a"))
+	assert.True(t, snap.HasID("pkg:index:Bucket", "id-b"))
+	assert.False(t, snap.HasID("pkg:index:Bucket", "id-c"))
+	assert.False(t, snap.HasID("pkg:index:Object", "id-a"))
+}
+
+func TestSnapshotProviderUsage(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	provider := func(name, id, version string) *resource.State {
+		return &resource.State{
+			URN:    resource.NewURN("stack", "project", "", "pulumi:providers:pkg", name),
+			Type:   "pulumi:providers:pkg",
+			Custom: true,
+			ID:     resource.ID(id),
+			Inputs: resource.PropertyMap{"version": resource.NewStringProperty(version)},
+		}
+	}
+	bucket := func(name string, provider *resource.State) *resource.State {
+		ref, err := providers.NewReference(provider.URN, provider.ID)
+		require.NoError(t, err)
+		return &resource.State{
+			URN:      resource.NewURN("stack", "project", "", "pkg:index:Bucket", name),
+			Type:     "pkg:index:Bucket",
+			Custom:   true,
+			ID:       resource.ID(name),
+			Provider: ref.String(),
+		}
+	}
+	v1 := provider("v1", "id-v1", "1.2.3")
+	v2 := provider("v2", "id-v2", "2.0.0")
+	a, b, c := bucket("a", v1), bucket("b", v2), bucket("c", v1)
+	snap := &Snapshot{Resources: []*resource.State{v1, v2, a, b, c}}
+
+	// Act.
+	usage := snap.ProviderUsage()
+
+	// Assert.
+	assert.Equal(t, map[string][]resource.URN{
+		"pkg@1.2.3": {a.URN, c.URN},
+		"pkg@2.0.0": {b.URN},
+	}, usage)
+}
+
+func TestSnapshotVerifyIntegrity_PropertyDependencies(t *testing.T) {
+	t.Parallel()
+
+	a := resource.URN("urn:pulumi:stack::project::t::a")
+	b := resource.URN("urn:pulumi:stack::project::t::b")
+	missing := resource.URN("urn:pulumi:stack::project::t::missing")
+
+	cases := []struct {
+		name  string
+		given []*resource.State
+		err   string
+	}{
+		{
+			name: "target present",
+			given: []*resource.State{
+				{URN: a},
+				{URN: b, PropertyDependencies: map[resource.PropertyKey][]resource.URN{"p": {a}}},
+			},
+		},
+		{
+			name: "target after",
+			given: []*resource.State{
+				{URN: b, PropertyDependencies: map[resource.PropertyKey][]resource.URN{"p": {a}}},
+				{URN: a},
+			},
+			err: "resource " + string(b) + "'s property dependency " + string(a) + " (from property p) comes after it",
+		},
+		{
+			name: "target dangling",
+			given: []*resource.State{
+				{URN: a},
+				{URN: b, PropertyDependencies: map[resource.PropertyKey][]resource.URN{"p": {a}, "q": {missing}}},
+			},
+			err: "resource " + string(b) + "'s property dependency " + string(missing) +
+				" (from property q) refers to missing resource",
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Arrange.
+			snap := &Snapshot{Resources: c.given}
+
+			// Act.
+			err := snap.VerifyIntegrity()
+
+			// Assert.
+			if c.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, c.err)
+			}
+		})
+	}
+}
+
+func TestSnapshotVerifyIntegrityDelta(t *testing.T) {
+	t.Parallel()
+
+	a := resource.URN("urn:pulumi:stack::project::t::a")
+	b := resource.URN("urn:pulumi:stack::project::t::b")
+	other := resource.URN("urn:pulumi:stack::project::t::other")
+	missing := resource.URN("urn:pulumi:stack::project::t::missing")
+
+	cases := []struct {
+		name    string
+		given   []*resource.State
+		changed []resource.URN
+		err     string
+	}{
+		{
+			name:    "changed resource valid",
+			given:   []*resource.State{{URN: a}, {URN: b, Dependencies: []resource.URN{a}}},
+			changed: []resource.URN{b},
+		},
+		{
+			name:    "changed resource dependency after it",
+			given:   []*resource.State{{URN: b, Dependencies: []resource.URN{a}}, {URN: a}},
+			changed: []resource.URN{b},
+			err:     "resource " + string(b) + "'s dependency " + string(a) + " comes after it",
+		},
+		{
+			name:    "dependent of removed resource",
+			given:   []*resource.State{{URN: b, Dependencies: []resource.URN{a}}},
+			changed: []resource.URN{a},
+			err:     "resource " + string(b) + "'s dependency " + string(a) + " refers to missing resource",
+		},
+		{
+			name:    "changed resource duplicated",
+			given:   []*resource.State{{URN: a}, {URN: a}},
+			changed: []resource.URN{a},
+			err:     "duplicate resource " + string(a),
+		},
+		{
+			// Corruption outside of the changed set is not detected.
+			name:    "unchanged resource corrupt",
+			given:   []*resource.State{{URN: a}, {URN: b, Dependencies: []resource.URN{missing}}, {URN: other}},
+			changed: []resource.URN{other},
+		},
+	}
+	for _, c := range cases {
+		c := c
+
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Arrange.
+			snap := &Snapshot{Resources: c.given}
+
+			// Act.
+			err := snap.VerifyIntegrityDelta(c.changed)
+
+			// Assert.
+			if c.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, c.err)
+			}
+		})
+	}
+}
+
+func TestSnapshotDependents(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	//
+	// This is the same graph as is used by TestVexingDeployment in the backend package:
+	//
+	//   b -> a
+	//   c -> a, b
+	//   d -> c
+	//   e -> c
+	//
+	// with each of the relationships onto c expressed through a different kind of dependency.
+	urn := func(name string) resource.URN {
+		return resource.URN("urn:pulumi:stack::project::t::" + name)
+	}
+	a := &resource.State{URN: urn("a")}
+	b := &resource.State{URN: urn("b"), Dependencies: []resource.URN{a.URN}}
+	c := &resource.State{URN: urn("c"), Dependencies: []resource.URN{a.URN, b.URN}}
+	d := &resource.State{URN: urn("d"), Parent: c.URN}
+	e := &resource.State{
+		URN: urn("e"),
+		PropertyDependencies: map[resource.PropertyKey][]resource.URN{
+			"p1": {c.URN},
+			"p2": {c.URN},
+		},
+	}
+	prov := &resource.State{URN: "urn:pulumi:stack::project::pulumi:providers:p::prov", ID: "prov-id"}
+	f := &resource.State{URN: urn("f"), Provider: string(prov.URN) + "::" + string(prov.ID)}
+	snap := &Snapshot{Resources: []*resource.State{a, b, c, d, e, prov, f}}
+
+	// Act.
+	dependentsOfA := snap.Dependents(a.URN)
+	dependentsOfC := snap.Dependents(c.URN)
+	dependentsOfE := snap.Dependents(e.URN)
+	dependentsOfProv := snap.Dependents(prov.URN)
+
+	// Assert.
+	assert.Equal(t, []resource.URN{b.URN, c.URN}, dependentsOfA)
+	assert.Equal(t, []resource.URN{d.URN, e.URN}, dependentsOfC)
+	assert.Empty(t, dependentsOfE)
+	assert.Equal(t, []resource.URN{f.URN}, dependentsOfProv)
+}
+
+func TestSnapshotExportPendingOperations(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	a := &resource.State{
+		URN:    "urn:pulumi:stack::project::t::a",
+		Inputs: resource.PropertyMap{"value": resource.NewStringProperty("a")},
+	}
+	b := &resource.State{URN: "urn:pulumi:stack::project::t::b", ID: "b-id"}
+	timedOut := resource.NewOperation(b, resource.OperationTypeDeleting)
+	timedOut.TimedOut = true
+	snap := &Snapshot{
+		Resources: []*resource.State{b},
+		PendingOperations: []resource.Operation{
+			resource.NewOperation(a, resource.OperationTypeCreating),
+			timedOut,
+		},
+	}
+
+	// Act.
+	ops := snap.ExportPendingOperations()
+
+	// Assert.
+	require.Len(t, ops, 2)
+	assert.Equal(t, resource.OperationTypeCreating, ops[0].Type)
+	assert.Equal(t, a.URN, ops[0].Resource.URN)
+	assert.False(t, ops[0].TimedOut)
+	assert.Equal(t, resource.OperationTypeDeleting, ops[1].Type)
+	assert.Equal(t, b.URN, ops[1].Resource.URN)
+	assert.True(t, ops[1].TimedOut)
+
+	// The exported resources are copies.
+	assert.NotSame(t, a, ops[0].Resource)
+	ops[0].Resource.Inputs["value"] = resource.NewStringProperty("changed")
+	assert.Equal(t, resource.NewStringProperty("a"), a.Inputs["value"])
+
+	assert.Nil(t, (&Snapshot{}).ExportPendingOperations())
+}
+
+func TestSnapshotUnreferencedByProgram(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	stack := resource.URN("urn:pulumi:stack::project::pulumi:pulumi:Stack::project-stack")
+	a := resource.URN("urn:pulumi:stack::project::t::a")
+	b := resource.URN("urn:pulumi:stack::project::t::b")
+	c := resource.URN("urn:pulumi:stack::project::t::c")
+	view := resource.URN("urn:pulumi:stack::project::t::view")
+	snap := &Snapshot{Resources: []*resource.State{
+		{URN: stack},
+		{URN: a, Delete: true},
+		{URN: a},
+		{URN: b},
+		{URN: view, ViewOf: b},
+		{URN: c},
+	}}
+	seen := map[resource.URN]bool{stack: true, a: true}
+
+	// Act.
+	unreferenced := snap.UnreferencedByProgram(seen)
+
+	// Assert.
+	assert.Equal(t, []resource.URN{b, c}, unreferenced)
+}
+
+func TestSnapshotPendingDeletions(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	a := resource.URN("urn:pulumi:stack::project::t::a")
+	b := resource.URN("urn:pulumi:stack::project::t::b")
+	c := resource.URN("urn:pulumi:stack::project::t::c")
+	newA, oldA := &resource.State{URN: a}, &resource.State{URN: a, Delete: true}
+	oldB := &resource.State{URN: b, Delete: true}
+	snap := &Snapshot{Resources: []*resource.State{
+		newA,
+		oldA,
+		oldB,
+		{URN: c, PendingReplacement: true},
+	}}
+
+	// Act.
+	pending := snap.PendingDeletions()
+
+	// Assert.
+	require.Len(t, pending, 2)
+	assert.Same(t, oldA, pending[0])
+	assert.Same(t, oldB, pending[1])
+
+	assert.Empty(t, (&Snapshot{Resources: []*resource.State{newA}}).PendingDeletions())
+}
+
+func TestSnapshotDeletionClosure(t *testing.T) {
+	t.Parallel()
+
+	// The vexing graph again (see TestSnapshotDependents):
+	//
+	//   b -> a
+	//   c -> a, b
+	//   d -> c (parent)
+	//   e -> c (property dependency)
+	urn := func(name string) resource.URN {
+		return resource.URN("urn:pulumi:stack::project::t::" + name)
+	}
+	newSnap := func(protected ...string) *Snapshot {
+		a := &resource.State{URN: urn("a")}
+		b := &resource.State{URN: urn("b"), Dependencies: []resource.URN{a.URN}}
+		c := &resource.State{URN: urn("c"), Dependencies: []resource.URN{a.URN, b.URN}}
+		d := &resource.State{URN: urn("d"), Parent: c.URN}
+		e := &resource.State{
+			URN:                  urn("e"),
+			PropertyDependencies: map[resource.PropertyKey][]resource.URN{"p": {c.URN}},
+		}
+		resources := []*resource.State{a, b, c, d, e}
+		for _, res := range resources {
+			res.Protect = slices.Contains(protected, res.URN.Name())
+		}
+		return &Snapshot{Resources: resources}
+	}
+
+	t.Run("transitive closure", func(t *testing.T) {
+		t.Parallel()
+
+		// Act.
+		toDelete, blocked, err := newSnap().DeletionClosure([]resource.URN{urn("b")})
+
+		// Assert.
+		require.NoError(t, err)
+		assert.Equal(t, []resource.URN{urn("e"), urn("d"), urn("c"), urn("b")}, toDelete)
+		assert.Empty(t, blocked)
+	})
+
+	t.Run("leaf", func(t *testing.T) {
+		t.Parallel()
+
+		// Act.
+		toDelete, blocked, err := newSnap().DeletionClosure([]resource.URN{urn("d")})
+
+		// Assert.
+		require.NoError(t, err)
+		assert.Equal(t, []resource.URN{urn("d")}, toDelete)
+		assert.Empty(t, blocked)
+	})
+
+	t.Run("protected dependent blocks deletion", func(t *testing.T) {
+		t.Parallel()
+
+		// Act.
+		toDelete, blocked, err := newSnap("e").DeletionClosure([]resource.URN{urn("a")})
+
+		// Assert.
+		require.NoError(t, err)
+		assert.Equal(t, []resource.URN{urn("d"), urn("c"), urn("b"), urn("a")}, toDelete)
+		assert.Equal(t, []resource.URN{urn("e")}, blocked)
+	})
+
+	t.Run("protected resource outside the closure", func(t *testing.T) {
+		t.Parallel()
+
+		// Act.
+		toDelete, blocked, err := newSnap("a").DeletionClosure([]resource.URN{urn("c")})
+
+		// Assert.
+		require.NoError(t, err)
+		assert.Equal(t, []resource.URN{urn("e"), urn("d"), urn("c")}, toDelete)
+		assert.Empty(t, blocked)
+	})
+
+	t.Run("deleted with", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		//
+		// The sibling is neither a child of the parent nor a dependent of the child, but it is deleted along with the
+		// child, so it must be deleted before the child is.
+		parent := &resource.State{URN: urn("parent")}
+		child := &resource.State{URN: urn("child"), Parent: parent.URN}
+		sibling := &resource.State{URN: urn("sibling"), DeletedWith: child.URN}
+		unrelated := &resource.State{URN: urn("unrelated")}
+		snap := &Snapshot{Resources: []*resource.State{parent, child, sibling, unrelated}}
+
+		// Act.
+		toDelete, blocked, err := snap.DeletionClosure([]resource.URN{parent.URN})
+
+		// Assert.
+		require.NoError(t, err)
+		assert.Equal(t, []resource.URN{sibling.URN, child.URN, parent.URN}, toDelete)
+		assert.Empty(t, blocked)
+	})
+
+	t.Run("missing target", func(t *testing.T) {
+		t.Parallel()
+
+		// Act.
+		_, _, err := newSnap().DeletionClosure([]resource.URN{urn("z")})
+
+		// Assert.
+		assert.ErrorContains(t, err, "no resource with URN "+string(urn("z")))
+	})
+}
+
+func TestSnapshotSecretPaths(t *testing.T) {
+	t.Parallel()
+
+	// Arrange.
+	urnA := resource.URN("urn:pulumi:stack::project::t::a")
+	urnB := resource.URN("urn:pulumi:stack::project::t::b")
+	secret := func(v resource.PropertyValue) resource.PropertyValue {
+		return resource.MakeSecret(v)
+	}
+	a := &resource.State{
+		URN: urnA,
+		Inputs: resource.PropertyMap{
+			"password": secret(resource.NewStringProperty("hunter2")),
+			"plain":    resource.NewStringProperty("plain"),
+		},
+		Outputs: resource.PropertyMap{
+			"nested": resource.NewObjectProperty(resource.PropertyMap{
+				"list": resource.NewArrayProperty([]resource.PropertyValue{
+					resource.NewStringProperty("plain"),
+					secret(resource.NewObjectProperty(resource.PropertyMap{
+						"inner": secret(resource.NewStringProperty("doubly secret")),
+					})),
+				}),
+			}),
+			"output": resource.NewOutputProperty(resource.Output{
+				Element: resource.NewStringProperty("token"),
+				Known:   true,
+				Secret:  true,
+			}),
+			"password": secret(resource.NewStringProperty("hunter2")),
+		},
+	}
+	b := &resource.State{
+		URN:     urnB,
+		Inputs:  resource.PropertyMap{"plain": resource.NewStringProperty("plain")},
+		Outputs: resource.PropertyMap{"plain": resource.NewStringProperty("plain")},
+	}
+	snap := &Snapshot{Resources: []*resource.State{a, b}}
+
+	// Act.
+	paths := snap.SecretPaths()
+
+	// Assert.
+	assert.Equal(t, map[resource.URN][]resource.PropertyPath{
+		urnA: {
+			{"inputs", "password"},
+			{"outputs", "nested", "list", 1},
+			{"outputs", "output"},
+			{"outputs", "password"},
+		},
+	}, paths)
+}
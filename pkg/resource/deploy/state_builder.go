@@ -109,6 +109,25 @@ func (sb *stateBuilder) withUpdatedAliases() *stateBuilder {
 	return sb
 }
 
+// withUpdatedAliasURNs updates each of the aliases of the state being modified using the given function.
+func (sb *stateBuilder) withUpdatedAliasURNs(update func(resource.URN) resource.URN) *stateBuilder {
+	var aliases []resource.URN
+	for i, alias := range sb.state.Aliases {
+		if newAlias := update(alias); newAlias != alias {
+			if aliases == nil {
+				aliases = make([]resource.URN, len(sb.state.Aliases))
+				copy(aliases, sb.state.Aliases)
+			}
+			aliases[i] = newAlias
+		}
+	}
+	if aliases != nil {
+		sb.state.Aliases = aliases
+		sb.edited = true
+	}
+	return sb
+}
+
 // build returns the resulting state object. If no visible changes have been made, build will return the original object
 // unmodified.
 func (sb *stateBuilder) build() *resource.State {
@@ -357,6 +357,8 @@ func (s *CreateStep) Apply() (resource.Status, StepCompleteFunc, error) {
 	now := time.Now().UTC()
 	s.new.Created = &now
 	s.new.Modified = &now
+	// The resource has been created by Pulumi, even if the resource it replaces was imported.
+	s.new.Imported = false
 
 	// Mark the old resource as pending deletion if necessary.
 	if s.replacing && s.pendingDelete {
@@ -1545,6 +1547,8 @@ func (s *ImportStep) Apply() (_ resource.Status, _ StepCompleteFunc, err error)
 	s.new.Modified = &now
 	// Set Created to now as the resource has been created in the state.
 	s.new.Created = &now
+	// Record that the resource was adopted rather than created by Pulumi.
+	s.new.Imported = true
 
 	// If this is a component we don't need to do the rest of the input validation
 	if !s.new.Custom {
@@ -656,10 +656,13 @@ func (sg *stepGenerator) generateSteps(event RegisterResourceEvent) ([]Step, boo
 		retainOnDelete = *goal.RetainOnDelete
 	}
 
-	// Carry the refreshBeforeUpdate flag forward if present in the old state.
-	var refreshBeforeUpdate bool
+	// Carry the refreshBeforeUpdate and imported flags and the sequence number forward if present in the old state.
+	var refreshBeforeUpdate, imported bool
+	var sequenceNumber int
 	if old != nil {
 		refreshBeforeUpdate = old.RefreshBeforeUpdate
+		imported = old.Imported
+		sequenceNumber = old.SequenceNumber
 	}
 
 	new := resource.NewState(
@@ -668,6 +671,8 @@ func (sg *stepGenerator) generateSteps(event RegisterResourceEvent) ([]Step, boo
 		goal.AdditionalSecretOutputs, aliasUrns, &goal.CustomTimeouts, goal.ID, retainOnDelete, goal.DeletedWith,
 		createdAt, modifiedAt, goal.SourcePosition, goal.IgnoreChanges, goal.ReplaceOnChanges,
 		refreshBeforeUpdate, "")
+	new.Imported = imported
+	new.SequenceNumber = sequenceNumber
 
 	if providers.IsProviderType(goal.Type) {
 		sg.providers[urn] = new
@@ -890,6 +895,8 @@ func (sg *stepGenerator) continueStepsFromRefresh(event ContinueResourceRefreshE
 					goal.AdditionalSecretOutputs, new.Aliases, &goal.CustomTimeouts, "", new.RetainOnDelete, goal.DeletedWith,
 					new.Created, new.Modified, goal.SourcePosition, goal.IgnoreChanges, goal.ReplaceOnChanges,
 					new.RefreshBeforeUpdate, "")
+				newnew.Imported = new.Imported
+				newnew.SequenceNumber = new.SequenceNumber
 			}
 
 			sg.events <- &continueResourceImportEvent{
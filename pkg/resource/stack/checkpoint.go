@@ -67,7 +67,7 @@ func UnmarshalVersionedCheckpointToLatestCheckpoint(m encoding.Marshaler, bytes
 
 		v3checkpoint := migrate.UpToCheckpointV3(v2checkpoint)
 		return &v3checkpoint, nil
-	case 3:
+	case 3, apitype.DeploymentSchemaVersionCompressedResources:
 		var v3checkpoint apitype.CheckpointV3
 		if err := json.Unmarshal(versionedCheckpoint.Checkpoint, &v3checkpoint); err != nil {
 			return nil, err
@@ -125,7 +125,7 @@ func SerializeCheckpoint(stack tokens.QName, snap *deploy.Snapshot,
 	}
 
 	return &apitype.VersionedCheckpoint{
-		Version:    apitype.DeploymentSchemaVersionCurrent,
+		Version:    DeploymentSchemaVersion(latest),
 		Checkpoint: json.RawMessage(b),
 	}, nil
 }
@@ -15,7 +15,10 @@
 package stack
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -24,6 +27,7 @@ import (
 	"strings"
 
 	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy/providers"
 	"github.com/pulumi/pulumi/pkg/v3/secrets"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype/migrate"
@@ -50,6 +54,12 @@ const (
 	computedValuePlaceholder = "04da6b54-80e4-46f7-96ec-b56ff0331ba9"
 )
 
+// CompressedPropertiesKey is the key of the only output of a serialized resource whose inputs and outputs have been
+// compressed (see deploy.Snapshot.CompressResourcesAbove). Its value is the base64 encoding of the gzipped JSON object
+// that holds the serialized inputs and outputs under the keys "inputs" and "outputs". Such a resource has no inputs of
+// its own, and is restored to its usual form when deserialized.
+const CompressedPropertiesKey = "__pulumiCompressed"
+
 var (
 	// ErrDeploymentSchemaVersionTooOld is returned from `DeserializeDeployment` if the
 	// untyped deployment being deserialized is too old to understand.
@@ -107,10 +117,18 @@ func SerializeDeployment(ctx context.Context, snap *deploy.Snapshot, showSecrets
 	// Capture the version information into a manifest.
 	manifest := snap.Manifest.Serialize()
 
+	// When redacting secrets, neither the secrets manager nor any plaintext may make it into the deployment.
 	sm := snap.SecretsManager
+	if snap.RedactSecrets {
+		sm = nil
+		showSecrets = false
+	}
+
 	var enc config.Encrypter
 	var completeBatch CompleteCrypterBatch
-	if sm != nil {
+	if snap.RedactSecrets {
+		enc = config.NewBlindingCrypter()
+	} else if sm != nil {
 		// If the secrets manager supports batching, start the batch operation.
 		if batchingSecretsManager, ok := sm.(BatchingSecretsManager); ok {
 			enc, completeBatch = batchingSecretsManager.BeginBatchEncryption()
@@ -121,23 +139,65 @@ func SerializeDeployment(ctx context.Context, snap *deploy.Snapshot, showSecrets
 		enc = config.NewPanicCrypter()
 	}
 
+	// Report progress as each resource and pending operation is serialized, if anyone is listening.
+	total, done := len(snap.Resources)+len(snap.PendingOperations), 0
+	progress := func() {
+		if snap.SerializeProgress != nil {
+			done++
+			snap.SerializeProgress(done, total)
+		}
+	}
+
 	// Serialize all vertices and only include a vertex section if non-empty.
 	resources := slice.Prealloc[apitype.ResourceV3](len(snap.Resources))
 	for _, res := range snap.Resources {
-		sres, err := SerializeResource(ctx, res, enc, showSecrets)
+		resEnc := enc
+		resSM, hasResSM := snap.ResourceSecretsManagers[res]
+		hasResSM = hasResSM && !snap.RedactSecrets
+		if hasResSM {
+			resEnc = resSM.Encrypter()
+		}
+
+		sres, err := SerializeResource(ctx, res, resEnc, showSecrets)
 		if err != nil {
 			return nil, fmt.Errorf("serializing resources: %w", err)
 		}
+		if snap.CompressResourcesAbove > 0 && isCompressible(res) {
+			if sres, err = compressLargeResource(sres, snap.CompressResourcesAbove); err != nil {
+				return nil, fmt.Errorf("compressing resource %v: %w", res.URN, err)
+			}
+		}
+		if hasResSM {
+			sres.SecretsProviders = &apitype.SecretsProvidersV1{
+				Type:  resSM.Type(),
+				State: resSM.State(),
+			}
+		}
 		resources = append(resources, sres)
+		progress()
 	}
 
 	operations := slice.Prealloc[apitype.OperationV2](len(snap.PendingOperations))
 	for _, op := range snap.PendingOperations {
-		sop, err := SerializeOperation(ctx, op, enc, showSecrets)
+		opEnc := enc
+		opSM, hasOpSM := snap.ResourceSecretsManagers[op.Resource]
+		hasOpSM = hasOpSM && !snap.RedactSecrets
+		if hasOpSM {
+			opEnc = opSM.Encrypter()
+		}
+
+		sop, err := SerializeOperation(ctx, op, opEnc, showSecrets)
 		if err != nil {
 			return nil, err
 		}
+		if hasOpSM {
+			sop.Resource.SecretsProviders = &apitype.SecretsProvidersV1{
+				Type:  opSM.Type(),
+				State: opSM.State(),
+			}
+		}
 		operations = append(operations, sop)
+		progress()
 	}
 
 	var secretsProvider *apitype.SecretsProvidersV1
@@ -156,6 +216,22 @@ func SerializeDeployment(ctx context.Context, snap *deploy.Snapshot, showSecrets
 			Error:   snap.Metadata.IntegrityErrorMetadata.Error,
 		}
 	}
+	for _, retained := range snap.Metadata.RetainedResources {
+		metadata.RetainedResources = append(metadata.RetainedResources, apitype.RetainedResourceV1{
+			URN:  retained.URN,
+			Type: retained.Type,
+			ID:   retained.ID,
+		})
+	}
+
+	var pendingImports []apitype.PendingImportV1
+	for _, pending := range snap.PendingImports {
+		pendingImports = append(pendingImports, apitype.PendingImportV1{
+			URN:  pending.URN,
+			Type: pending.Type,
+			ID:   pending.ID,
+		})
+	}
 
 	if completeBatch != nil { // If we started a batch operation, complete it.
 		if err := completeBatch(ctx); err != nil {
@@ -169,9 +245,46 @@ func SerializeDeployment(ctx context.Context, snap *deploy.Snapshot, showSecrets
 		SecretsProviders:  secretsProvider,
 		PendingOperations: operations,
 		Metadata:          metadata,
+		PendingImports:    pendingImports,
 	}, nil
 }
 
+// MarshalOptions controls how MarshalDeployment encodes a deployment.
+type MarshalOptions struct {
+	// Canonical, if true, encodes the deployment in a canonical form: object keys are sorted, there is no insignificant
+	// whitespace, and characters that are special to HTML are not escaped. Identical deployments always produce
+	// identical bytes in this form, which makes it suitable for e.g. signing.
+	Canonical bool
+}
+
+// MarshalDeployment encodes the given deployment as JSON.
+func MarshalDeployment(deployment *apitype.DeploymentV3, opts MarshalOptions) ([]byte, error) {
+	contract.Requiref(deployment != nil, "deployment", "must not be nil")
+
+	encoded, err := json.Marshal(deployment)
+	if err != nil || !opts.Canonical {
+		return encoded, err
+	}
+
+	// Go encodes struct fields in declaration order, so round-trip the encoded deployment through an untyped value
+	// (whose object keys are always encoded in sorted order) to get a canonical form. Numbers are preserved as they
+	// were originally encoded.
+	dec := json.NewDecoder(bytes.NewReader(encoded))
+	dec.UseNumber()
+	var raw interface{}
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(raw); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
 // UnmarshalUntypedDeployment unmarshals a raw untyped deployment into an up to date deployment object.
 func UnmarshalUntypedDeployment(
 	ctx context.Context,
@@ -179,7 +292,7 @@ func UnmarshalUntypedDeployment(
 ) (*apitype.DeploymentV3, error) {
 	contract.Requiref(deployment != nil, "deployment", "must not be nil")
 	switch {
-	case deployment.Version > apitype.DeploymentSchemaVersionCurrent:
+	case deployment.Version > apitype.DeploymentSchemaVersionCompressedResources:
 		return nil, ErrDeploymentSchemaVersionTooNew
 	case deployment.Version < DeploymentSchemaVersionOldestSupported:
 		return nil, ErrDeploymentSchemaVersionTooOld
@@ -200,7 +313,7 @@ func UnmarshalUntypedDeployment(
 			return nil, err
 		}
 		v3deployment = migrate.UpToDeploymentV3(v2deployment)
-	case 3:
+	case 3, apitype.DeploymentSchemaVersionCompressedResources:
 		if err := json.Unmarshal([]byte(deployment.Deployment), &v3deployment); err != nil {
 			return nil, err
 		}
@@ -231,6 +344,27 @@ func DeserializeDeploymentV3(
 	ctx context.Context,
 	deployment apitype.DeploymentV3,
 	secretsProv secrets.Provider,
+) (*deploy.Snapshot, error) {
+	return deserializeDeploymentV3(ctx, deployment, secretsProv, false /* tolerant */)
+}
+
+// DeserializeDeploymentV3Tolerant deserializes a typed DeploymentV3 into a `deploy.Snapshot` like
+// DeserializeDeploymentV3, except that a resource that cannot be deserialized does not cause the whole load to fail.
+// Instead, the resource is left out of the snapshot's resources and recorded in its QuarantinedResources along with
+// its serialized form and the error encountered, so that the rest of the stack remains accessible.
+func DeserializeDeploymentV3Tolerant(
+	ctx context.Context,
+	deployment apitype.DeploymentV3,
+	secretsProv secrets.Provider,
+) (*deploy.Snapshot, error) {
+	return deserializeDeploymentV3(ctx, deployment, secretsProv, true /* tolerant */)
+}
+
+func deserializeDeploymentV3(
+	ctx context.Context,
+	deployment apitype.DeploymentV3,
+	secretsProv secrets.Provider,
+	tolerant bool,
 ) (*deploy.Snapshot, error) {
 	// Unpack the versions.
 	manifest, err := deploy.DeserializeManifest(deployment.Manifest)
@@ -265,22 +399,83 @@ func DeserializeDeploymentV3(
 		dec = config.NewErrorCrypter("snapshot contains encrypted secrets but no secrets manager could be found")
 	}
 
-	// For every serialized resource vertex, create a ResourceDeployment out of it.
+	// For every serialized resource vertex, create a ResourceDeployment out of it. Resources that record their own
+	// secrets provider are decrypted with that provider instead, and remember it so that it is used again if they are
+	// reserialized. The same goes for the resources of pending operations.
 	resources := slice.Prealloc[*resource.State](len(deployment.Resources))
+	var resourceSecretsManagers map[*resource.State]secrets.Manager
+	var quarantined []deploy.QuarantinedResource
+	resourceSecretsManagersByState := map[string]secrets.Manager{}
+	resourceSecretsManager := func(res apitype.ResourceV3) (secrets.Manager, error) {
+		sp := res.SecretsProviders
+		if sp == nil || sp.Type == "" {
+			return nil, nil
+		}
+		if secretsProv == nil {
+			return nil, fmt.Errorf("resource '%s' uses a SecretsProvider but no SecretsProvider was provided", res.URN)
+		}
+
+		key := sp.Type + ":" + string(sp.State)
+		if sm, has := resourceSecretsManagersByState[key]; has {
+			return sm, nil
+		}
+		sm, err := secretsProv.OfType(sp.Type, sp.State)
+		if err != nil {
+			return nil, err
+		}
+		resourceSecretsManagersByState[key] = sm
+		return sm, nil
+	}
 	for _, res := range deployment.Resources {
-		desres, err := DeserializeResource(res, dec)
+		resDec := dec
+		resSM, err := resourceSecretsManager(res)
 		if err != nil {
 			return nil, err
 		}
+		if resSM != nil {
+			resDec = resSM.Decrypter()
+		}
+
+		desres, err := DeserializeResource(res, resDec)
+		if err != nil {
+			if !tolerant {
+				return nil, err
+			}
+			raw, marshalErr := json.Marshal(res)
+			contract.AssertNoErrorf(marshalErr, "failed to marshal resource %s", res.URN)
+			quarantined = append(quarantined, deploy.QuarantinedResource{URN: res.URN, Raw: raw, Err: err})
+			continue
+		}
+		if resSM != nil {
+			if resourceSecretsManagers == nil {
+				resourceSecretsManagers = map[*resource.State]secrets.Manager{}
+			}
+			resourceSecretsManagers[desres] = resSM
+		}
 		resources = append(resources, desres)
 	}
 
 	ops := slice.Prealloc[resource.Operation](len(deployment.PendingOperations))
 	for _, op := range deployment.PendingOperations {
-		desop, err := DeserializeOperation(op, dec)
+		opDec := dec
+		opSM, err := resourceSecretsManager(op.Resource)
+		if err != nil {
+			return nil, err
+		}
+		if opSM != nil {
+			opDec = opSM.Decrypter()
+		}
+
+		desop, err := DeserializeOperation(op, opDec)
 		if err != nil {
 			return nil, err
 		}
+		if opSM != nil {
+			if resourceSecretsManagers == nil {
+				resourceSecretsManagers = map[*resource.State]secrets.Manager{}
+			}
+			resourceSecretsManagers[desop.Resource] = opSM
+		}
 		ops = append(ops, desop)
 	}
 
@@ -299,8 +494,25 @@ func DeserializeDeploymentV3(
 			Error:   deployment.Metadata.IntegrityErrorMetadata.Error,
 		}
 	}
+	for _, retained := range deployment.Metadata.RetainedResources {
+		metadata.RetainedResources = append(metadata.RetainedResources, deploy.RetainedResource{
+			URN:  retained.URN,
+			Type: retained.Type,
+			ID:   retained.ID,
+		})
+	}
 
-	return deploy.NewSnapshot(*manifest, secretsManager, resources, ops, metadata), nil
+	snap := deploy.NewSnapshot(*manifest, secretsManager, resources, ops, metadata)
+	snap.ResourceSecretsManagers = resourceSecretsManagers
+	snap.QuarantinedResources = quarantined
+	for _, pending := range deployment.PendingImports {
+		snap.PendingImports = append(snap.PendingImports, deploy.PendingImport{
+			URN:  pending.URN,
+			Type: pending.Type,
+			ID:   pending.ID,
+		})
+	}
+	return snap, nil
 }
 
 // SerializeResource turns a resource into a structure suitable for serialization.
@@ -359,6 +571,10 @@ func SerializeResource(
 		ReplaceOnChanges:        res.ReplaceOnChanges,
 		RefreshBeforeUpdate:     res.RefreshBeforeUpdate,
 		ViewOf:                  res.ViewOf,
+		StepID:                  res.StepID,
+		Imported:                res.Imported,
+		SequenceNumber:          res.SequenceNumber,
+		Annotations:             res.Annotations,
 	}
 
 	if res.CustomTimeouts.IsNotEmpty() {
@@ -379,6 +595,7 @@ func SerializeOperation(
 	return apitype.OperationV2{
 		Resource: res,
 		Type:     apitype.OperationType(op.Type),
+		TimedOut: op.TimedOut,
 	}, nil
 }
 
@@ -496,8 +713,108 @@ func SerializePropertyValue(ctx context.Context, prop resource.PropertyValue, en
 	return prop.V, nil
 }
 
+// compressedProperties is the form of the properties held by a compressed resource (see CompressedPropertiesKey).
+type compressedProperties struct {
+	Inputs  map[string]interface{} `json:"inputs,omitempty"`
+	Outputs map[string]interface{} `json:"outputs,omitempty"`
+}
+
+// isCompressible returns true if the given resource may be serialized with its inputs and outputs compressed. The
+// root stack resource and provider resources never are, since their outputs are read directly from the deployment by
+// tools that do not expand compressed resources (such as stack references and older versions of the CLI).
+func isCompressible(res *resource.State) bool {
+	return res.Type != resource.RootStackType && !providers.IsProviderType(res.Type)
+}
+
+// DeploymentSchemaVersion returns the schema version with which the given deployment should be written. This is
+// apitype.DeploymentSchemaVersionCompressedResources if the deployment holds any compressed resources (see
+// CompressedPropertiesKey), so that readers which cannot expand them fail rather than misreading them, and
+// apitype.DeploymentSchemaVersionCurrent otherwise.
+func DeploymentSchemaVersion(deployment *apitype.DeploymentV3) int {
+	if deployment != nil {
+		for _, res := range deployment.Resources {
+			if isCompressedResource(res) {
+				return apitype.DeploymentSchemaVersionCompressedResources
+			}
+		}
+	}
+	return apitype.DeploymentSchemaVersionCurrent
+}
+
+// isCompressedResource returns true if the given serialized resource has its inputs and outputs compressed.
+func isCompressedResource(res apitype.ResourceV3) bool {
+	if len(res.Outputs) != 1 {
+		return false
+	}
+	_, ok := res.Outputs[CompressedPropertiesKey].(string)
+	return ok
+}
+
+// compressLargeResource returns the given serialized resource with its inputs and outputs compressed if its JSON
+// encoding is larger than limit bytes, or the resource unchanged otherwise.
+func compressLargeResource(res apitype.ResourceV3, limit int) (apitype.ResourceV3, error) {
+	encoded, err := json.Marshal(res)
+	if err != nil {
+		return apitype.ResourceV3{}, err
+	}
+	if len(encoded) <= limit || (len(res.Inputs) == 0 && len(res.Outputs) == 0) {
+		return res, nil
+	}
+
+	props, err := json.Marshal(compressedProperties{Inputs: res.Inputs, Outputs: res.Outputs})
+	if err != nil {
+		return apitype.ResourceV3{}, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(props); err != nil {
+		return apitype.ResourceV3{}, err
+	}
+	if err := zw.Close(); err != nil {
+		return apitype.ResourceV3{}, err
+	}
+
+	res.Inputs = nil
+	res.Outputs = map[string]interface{}{
+		CompressedPropertiesKey: base64.StdEncoding.EncodeToString(buf.Bytes()),
+	}
+	return res, nil
+}
+
+// DecompressResource returns the given serialized resource with its inputs and outputs restored if they have been
+// compressed (see CompressedPropertiesKey), or the resource unchanged otherwise.
+func DecompressResource(res apitype.ResourceV3) (apitype.ResourceV3, error) {
+	if !isCompressedResource(res) {
+		return res, nil
+	}
+	data := res.Outputs[CompressedPropertiesKey].(string)
+
+	compressed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return apitype.ResourceV3{}, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return apitype.ResourceV3{}, err
+	}
+	defer zr.Close()
+	var props compressedProperties
+	if err := json.NewDecoder(zr).Decode(&props); err != nil {
+		return apitype.ResourceV3{}, err
+	}
+
+	res.Inputs, res.Outputs = props.Inputs, props.Outputs
+	return res, nil
+}
+
 // DeserializeResource turns a serialized resource back into its usual form.
 func DeserializeResource(res apitype.ResourceV3, dec config.Decrypter) (*resource.State, error) {
+	decompressed, err := DecompressResource(res)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing resource '%s': %w", res.URN, err)
+	}
+	res = decompressed
+
 	// Deserialize the resource properties, if they exist.
 	inputs, err := DeserializeProperties(res.Inputs, dec)
 	if err != nil {
@@ -520,7 +837,7 @@ func DeserializeResource(res apitype.ResourceV3, dec config.Decrypter) (*resourc
 		return nil, fmt.Errorf("resource '%s' has 'custom' false but non-empty ID", res.URN)
 	}
 
-	return resource.NewState(
+	state := resource.NewState(
 		res.Type, res.URN, res.Custom, res.Delete, res.ID,
 		inputs, outputs, res.Parent, res.Protect, res.External, res.Dependencies, res.InitErrors, res.Provider,
 		res.PropertyDependencies, res.PendingReplacement, res.AdditionalSecretOutputs, res.Aliases, res.CustomTimeouts,
@@ -528,7 +845,12 @@ func DeserializeResource(res apitype.ResourceV3, dec config.Decrypter) (*resourc
 		res.ReplaceOnChanges,
 		res.RefreshBeforeUpdate,
 		res.ViewOf,
-	), nil
+	)
+	state.StepID = res.StepID
+	state.Imported = res.Imported
+	state.SequenceNumber = res.SequenceNumber
+	state.Annotations = res.Annotations
+	return state, nil
 }
 
 // DeserializeOperation hydrates a pending resource/operation pair.
@@ -538,7 +860,82 @@ func DeserializeOperation(op apitype.OperationV2, dec config.Decrypter,
 	if err != nil {
 		return resource.Operation{}, err
 	}
-	return resource.NewOperation(res, resource.OperationType(op.Type)), nil
+	desop := resource.NewOperation(res, resource.OperationType(op.Type))
+	desop.TimedOut = op.TimedOut
+	return desop, nil
+}
+
+// DeserializePendingOperations deserializes only the pending operations of an untyped deployment, i.e. the operations
+// that were in flight when it was written. Its resources are neither deserialized nor decrypted, which makes this much
+// cheaper than deserializing the whole deployment for a large stack.
+func DeserializePendingOperations(
+	ctx context.Context,
+	deployment *apitype.UntypedDeployment,
+	secretsProv secrets.Provider,
+) ([]resource.Operation, error) {
+	contract.Requiref(deployment != nil, "deployment", "must not be nil")
+
+	// Older deployments must be migrated as a whole, but the current version can be decoded selectively.
+	var secretsProviders *apitype.SecretsProvidersV1
+	var operations []apitype.OperationV2
+	if deployment.Version == apitype.DeploymentSchemaVersionCurrent ||
+		deployment.Version == apitype.DeploymentSchemaVersionCompressedResources {
+		var partial struct {
+			SecretsProviders  *apitype.SecretsProvidersV1 `json:"secrets_providers,omitempty"`
+			PendingOperations []apitype.OperationV2       `json:"pending_operations,omitempty"`
+		}
+		if err := json.Unmarshal([]byte(deployment.Deployment), &partial); err != nil {
+			return nil, err
+		}
+		secretsProviders, operations = partial.SecretsProviders, partial.PendingOperations
+	} else {
+		v3deployment, err := UnmarshalUntypedDeployment(ctx, deployment)
+		if err != nil {
+			return nil, err
+		}
+		secretsProviders, operations = v3deployment.SecretsProviders, v3deployment.PendingOperations
+	}
+	if len(operations) == 0 {
+		return nil, nil
+	}
+
+	decrypterFor := func(sp *apitype.SecretsProvidersV1) (config.Decrypter, error) {
+		if sp == nil || sp.Type == "" {
+			return nil, nil
+		}
+		if secretsProv == nil {
+			return nil, errors.New("deployment uses a SecretsProvider but no SecretsProvider was provided")
+		}
+		sm, err := secretsProv.OfType(sp.Type, sp.State)
+		if err != nil {
+			return nil, err
+		}
+		return sm.Decrypter(), nil
+	}
+	dec, err := decrypterFor(secretsProviders)
+	if err != nil {
+		return nil, err
+	}
+	if dec == nil {
+		dec = config.NewErrorCrypter("pending operations contain encrypted secrets but no secrets manager could be found")
+	}
+
+	ops := make([]resource.Operation, 0, len(operations))
+	for _, op := range operations {
+		opDec := dec
+		if resDec, err := decrypterFor(op.Resource.SecretsProviders); err != nil {
+			return nil, err
+		} else if resDec != nil {
+			opDec = resDec
+		}
+
+		desop, err := DeserializeOperation(op, opDec)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, desop)
+	}
+	return ops, nil
 }
 
 // DeserializeProperties deserializes an entire map of deploy properties into a resource property map.
@@ -28,6 +28,7 @@ import (
 	"pgregory.net/rapid"
 
 	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/pkg/v3/secrets"
 	"github.com/pulumi/pulumi/pkg/v3/secrets/b64"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
@@ -199,12 +200,55 @@ func TestDeploymentSerialization(t *testing.T) {
 	assert.Equal(t, 0, len(dep.Outputs["out-empty-map"].(map[string]interface{})))
 }
 
+func TestMarshalDeploymentCanonical(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	newSnapshot := func() *deploy.Snapshot {
+		res := &resource.State{
+			Type: "pkg:index:type",
+			URN:  "urn:pulumi:stack::project::pkg:index:type::a",
+			Inputs: resource.PropertyMap{
+				"zeta":  resource.NewStringProperty("<&>"),
+				"alpha": resource.NewNumberProperty(1.5),
+				"mu": resource.NewObjectProperty(resource.PropertyMap{
+					"y": resource.NewBoolProperty(true),
+					"x": resource.NewArrayProperty([]resource.PropertyValue{resource.NewNumberProperty(1e21)}),
+				}),
+			},
+			Outputs: resource.PropertyMap{},
+		}
+		return deploy.NewSnapshot(deploy.Manifest{Time: time.Unix(0, 0).UTC(), Version: "1.0.0"},
+			b64.NewBase64SecretsManager(), []*resource.State{res}, nil, deploy.SnapshotMetadata{})
+	}
+
+	marshal := func() []byte {
+		deployment, err := SerializeDeployment(ctx, newSnapshot(), false /* showSecrets */)
+		require.NoError(t, err)
+		bytes, err := MarshalDeployment(deployment, MarshalOptions{Canonical: true})
+		require.NoError(t, err)
+		return bytes
+	}
+
+	first, second := marshal(), marshal()
+	assert.Equal(t, first, second)
+
+	// Keys are sorted, there is no insignificant whitespace and HTML characters are not escaped.
+	canonical := string(first)
+	assert.NotContains(t, canonical, "\n")
+	assert.NotContains(t, canonical, ": ")
+	assert.Contains(t, canonical, `"inputs":{"alpha":1.5,"mu":{"x":[1e+21],"y":true},"zeta":"<&>"}`)
+	assert.Less(t, strings.Index(canonical, `"manifest"`), strings.Index(canonical, `"metadata"`))
+	assert.Less(t, strings.Index(canonical, `"metadata"`), strings.Index(canonical, `"resources"`))
+	assert.Less(t, strings.Index(canonical, `"resources"`), strings.Index(canonical, `"secrets_providers"`))
+}
+
 func TestLoadTooNewDeployment(t *testing.T) {
 	t.Parallel()
 	ctx := context.Background()
 
 	untypedDeployment := &apitype.UntypedDeployment{
-		Version: apitype.DeploymentSchemaVersionCurrent + 1,
+		Version: apitype.DeploymentSchemaVersionCompressedResources + 1,
 	}
 
 	deployment, err := DeserializeUntypedDeployment(ctx, untypedDeployment, b64.Base64SecretsProvider)
@@ -227,6 +271,62 @@ func TestLoadTooOldDeployment(t *testing.T) {
 	assert.Equal(t, ErrDeploymentSchemaVersionTooOld, err)
 }
 
+func TestCompressedResourcesSchemaVersion(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	large := resource.PropertyMap{"blob": resource.NewStringProperty(strings.Repeat("x", 4096))}
+	newState := func(typ tokens.Type, name string) *resource.State {
+		return &resource.State{
+			Type:    typ,
+			URN:     resource.NewURN("stack", "project", "", typ, name),
+			Custom:  typ != resource.RootStackType,
+			Inputs:  large.Copy(),
+			Outputs: large.Copy(),
+		}
+	}
+	root := newState(resource.RootStackType, "project-stack")
+	provider := newState("pulumi:providers:pkg", "provider")
+	custom := newState("pkg:index:type", "custom")
+
+	// Without compressed resources, deployments are written at the current version.
+	snap := deploy.NewSnapshot(deploy.Manifest{}, b64.NewBase64SecretsManager(),
+		[]*resource.State{root, provider, custom}, nil, deploy.SnapshotMetadata{})
+	deployment, err := SerializeDeployment(ctx, snap, false /* showSecrets */)
+	require.NoError(t, err)
+	assert.Equal(t, apitype.DeploymentSchemaVersionCurrent, DeploymentSchemaVersion(deployment))
+
+	// Only the custom resource is compressed: the root stack and provider keep their outputs readable.
+	snap.CompressResourcesAbove = 1024
+	deployment, err = SerializeDeployment(ctx, snap, false /* showSecrets */)
+	require.NoError(t, err)
+	require.Len(t, deployment.Resources, 3)
+	for _, res := range deployment.Resources[:2] {
+		assert.Contains(t, res.Outputs, "blob", "outputs of %v", res.URN)
+		assert.NotContains(t, res.Outputs, CompressedPropertiesKey, "outputs of %v", res.URN)
+	}
+	assert.Nil(t, deployment.Resources[2].Inputs)
+	require.Len(t, deployment.Resources[2].Outputs, 1)
+	assert.Contains(t, deployment.Resources[2].Outputs, CompressedPropertiesKey)
+
+	// Such a deployment is written at a version that readers which predate compressed resources reject.
+	version := DeploymentSchemaVersion(deployment)
+	assert.Equal(t, apitype.DeploymentSchemaVersionCompressedResources, version)
+	assert.Greater(t, version, apitype.DeploymentSchemaVersionCurrent)
+
+	raw, err := json.Marshal(deployment)
+	require.NoError(t, err)
+	untyped := &apitype.UntypedDeployment{Version: version, Deployment: raw}
+	deserialized, err := DeserializeUntypedDeployment(ctx, untyped, b64.Base64SecretsProvider)
+	require.NoError(t, err)
+	require.Len(t, deserialized.Resources, 3)
+	assert.True(t, large.DeepEquals(deserialized.Resources[2].Outputs))
+
+	chk, err := SerializeCheckpoint("stack", snap, false /* showSecrets */)
+	require.NoError(t, err)
+	assert.Equal(t, apitype.DeploymentSchemaVersionCompressedResources, chk.Version)
+}
+
 func TestUnsupportedSecret(t *testing.T) {
 	t.Parallel()
 
@@ -456,6 +556,197 @@ func TestDeserializeDeploymentSecretCache(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestDeploymentWithResourceSecretsManagers(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	// Build a snapshot in the middle of a secrets provider migration: a is encrypted with the snapshot's secrets
+	// manager, while b is still encrypted with its own.
+	newState := func(name, password string) *resource.State {
+		return &resource.State{
+			Type:   "pkg:index:type",
+			URN:    resource.URN("urn:pulumi:stack::project::pkg:index:type::" + name),
+			Inputs: resource.PropertyMap{},
+			Outputs: resource.PropertyMap{
+				"password": resource.MakeSecret(resource.NewStringProperty(password)),
+			},
+		}
+	}
+	a, b := newState("a", "hunter2"), newState("b", "hunter3")
+	snap := deploy.NewSnapshot(deploy.Manifest{}, b64.NewBase64SecretsManager(), []*resource.State{a, b}, nil,
+		deploy.SnapshotMetadata{})
+	snap.ResourceSecretsManagers = map[*resource.State]secrets.Manager{b: b64.NewBase64SecretsManager()}
+	require.NoError(t, snap.VerifyIntegrity())
+
+	deployment, err := SerializeDeployment(ctx, snap, false /* showSecrets */)
+	require.NoError(t, err)
+	require.Len(t, deployment.Resources, 2)
+	assert.Nil(t, deployment.Resources[0].SecretsProviders)
+	assert.Equal(t, &apitype.SecretsProvidersV1{Type: b64.Type}, deployment.Resources[1].SecretsProviders)
+
+	// Round-trip the deployment through JSON and back. Both resources' secrets should decrypt correctly, and b should
+	// remember its secrets manager.
+	bytes, err := json.Marshal(deployment)
+	require.NoError(t, err)
+	var roundTripped apitype.DeploymentV3
+	require.NoError(t, json.Unmarshal(bytes, &roundTripped))
+
+	deserialized, err := DeserializeDeploymentV3(ctx, roundTripped, b64.Base64SecretsProvider)
+	require.NoError(t, err)
+	require.NoError(t, deserialized.VerifyIntegrity())
+	require.Len(t, deserialized.Resources, 2)
+	assert.Equal(t, a.Outputs, deserialized.Resources[0].Outputs)
+	assert.Equal(t, b.Outputs, deserialized.Resources[1].Outputs)
+	require.Len(t, deserialized.ResourceSecretsManagers, 1)
+	assert.Equal(t, b64.Type, deserialized.ResourceSecretsManagers[deserialized.Resources[1]].Type())
+}
+
+func TestSerializeDeploymentRedactSecrets(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	// Secrets appear at the top level and nested within objects and arrays, in resources with and without their own
+	// secrets manager, and in pending operations.
+	newState := func(name, password string) *resource.State {
+		return &resource.State{
+			Type: "pkg:index:type",
+			URN:  resource.URN("urn:pulumi:stack::project::pkg:index:type::" + name),
+			Inputs: resource.PropertyMap{
+				"password": resource.MakeSecret(resource.NewStringProperty(password)),
+			},
+			Outputs: resource.PropertyMap{
+				"nested": resource.NewObjectProperty(resource.PropertyMap{
+					"list": resource.NewArrayProperty([]resource.PropertyValue{
+						resource.MakeSecret(resource.NewStringProperty(password)),
+					}),
+				}),
+				"public": resource.NewStringProperty("visible"),
+			},
+		}
+	}
+	a, b, c := newState("a", "hunter2"), newState("b", "hunter3"), newState("c", "hunter4")
+	snap := deploy.NewSnapshot(deploy.Manifest{}, b64.NewBase64SecretsManager(), []*resource.State{a, b},
+		[]resource.Operation{resource.NewOperation(c, resource.OperationTypeCreating)}, deploy.SnapshotMetadata{})
+	snap.ResourceSecretsManagers = map[*resource.State]secrets.Manager{b: b64.NewBase64SecretsManager()}
+	snap.RedactSecrets = true
+
+	for _, showSecrets := range []bool{false, true} {
+		deployment, err := SerializeDeployment(ctx, snap, showSecrets)
+		require.NoError(t, err)
+		assert.Nil(t, deployment.SecretsProviders)
+		for _, res := range deployment.Resources {
+			assert.Nil(t, res.SecretsProviders)
+		}
+
+		bytes, err := json.Marshal(deployment)
+		require.NoError(t, err)
+		out := string(bytes)
+		assert.Contains(t, out, `"ciphertext":"[secret]"`)
+		assert.Contains(t, out, "visible")
+		for _, password := range []string{"hunter2", "hunter3", "hunter4"} {
+			assert.NotContains(t, out, password)
+			ciphertext, err := config.Base64Crypter.EncryptValue(ctx, fmt.Sprintf("%q", password))
+			require.NoError(t, err)
+			assert.NotContains(t, out, ciphertext)
+		}
+	}
+}
+
+func TestDeploymentRoundTripsTimestamps(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	modified := created.Add(time.Hour)
+	res := &resource.State{
+		Type:     "pkg:index:type",
+		URN:      resource.URN("urn:pulumi:stack::project::pkg:index:type::a"),
+		Created:  &created,
+		Modified: &modified,
+	}
+	snap := deploy.NewSnapshot(deploy.Manifest{}, b64.NewBase64SecretsManager(), []*resource.State{res}, nil,
+		deploy.SnapshotMetadata{})
+
+	deployment, err := SerializeDeployment(ctx, snap, false /* showSecrets */)
+	require.NoError(t, err)
+	bytes, err := json.Marshal(deployment)
+	require.NoError(t, err)
+	var roundTripped apitype.DeploymentV3
+	require.NoError(t, json.Unmarshal(bytes, &roundTripped))
+
+	deserialized, err := DeserializeDeploymentV3(ctx, roundTripped, b64.Base64SecretsProvider)
+	require.NoError(t, err)
+	require.Len(t, deserialized.Resources, 1)
+	require.NotNil(t, deserialized.Resources[0].Created)
+	require.NotNil(t, deserialized.Resources[0].Modified)
+	assert.True(t, created.Equal(*deserialized.Resources[0].Created))
+	assert.True(t, modified.Equal(*deserialized.Resources[0].Modified))
+}
+
+func TestDeploymentRoundTripsCustomTimeouts(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	timeouts := resource.CustomTimeouts{Create: 60, Update: 120, Delete: 180}
+	withTimeouts := &resource.State{
+		Type:           "pkg:index:type",
+		URN:            resource.URN("urn:pulumi:stack::project::pkg:index:type::a"),
+		CustomTimeouts: timeouts,
+	}
+	withoutTimeouts := &resource.State{
+		Type: "pkg:index:type",
+		URN:  resource.URN("urn:pulumi:stack::project::pkg:index:type::b"),
+	}
+	snap := deploy.NewSnapshot(deploy.Manifest{}, b64.NewBase64SecretsManager(),
+		[]*resource.State{withTimeouts, withoutTimeouts}, nil, deploy.SnapshotMetadata{})
+
+	deployment, err := SerializeDeployment(ctx, snap, false /* showSecrets */)
+	require.NoError(t, err)
+	require.Len(t, deployment.Resources, 2)
+	assert.Nil(t, deployment.Resources[1].CustomTimeouts)
+	bytes, err := json.Marshal(deployment)
+	require.NoError(t, err)
+	var roundTripped apitype.DeploymentV3
+	require.NoError(t, json.Unmarshal(bytes, &roundTripped))
+
+	deserialized, err := DeserializeDeploymentV3(ctx, roundTripped, b64.Base64SecretsProvider)
+	require.NoError(t, err)
+	require.Len(t, deserialized.Resources, 2)
+	assert.Equal(t, timeouts, deserialized.Resources[0].CustomTimeouts)
+	assert.Equal(t, resource.CustomTimeouts{}, deserialized.Resources[1].CustomTimeouts)
+}
+
+func TestDeploymentRoundTripsAnnotations(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	annotations := map[string]string{"owner": "platform", "cost-center": "1234"}
+	annotated := &resource.State{
+		Type:        "pkg:index:type",
+		URN:         resource.URN("urn:pulumi:stack::project::pkg:index:type::a"),
+		Annotations: annotations,
+	}
+	snap := deploy.NewSnapshot(deploy.Manifest{}, b64.NewBase64SecretsManager(),
+		[]*resource.State{annotated}, nil, deploy.SnapshotMetadata{})
+
+	deployment, err := SerializeDeployment(ctx, snap, false /* showSecrets */)
+	require.NoError(t, err)
+	bytes, err := json.Marshal(deployment)
+	require.NoError(t, err)
+	var roundTripped apitype.DeploymentV3
+	require.NoError(t, json.Unmarshal(bytes, &roundTripped))
+
+	deserialized, err := DeserializeDeploymentV3(ctx, roundTripped, b64.Base64SecretsProvider)
+	require.NoError(t, err)
+	require.Len(t, deserialized.Resources, 1)
+	assert.Equal(t, annotations, deserialized.Resources[0].Annotations)
+}
+
 func TestDeserializeInvalidResourceErrors(t *testing.T) {
 	t.Parallel()
 
@@ -494,6 +785,89 @@ func TestDeserializeInvalidResourceErrors(t *testing.T) {
 	assert.EqualError(t, err, fmt.Sprintf("resource '%s' has 'custom' false but non-empty ID", urn))
 }
 
+func TestDeserializeDeploymentV3Tolerant(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	newResource := func(name string, outputs map[string]interface{}) apitype.ResourceV3 {
+		return apitype.ResourceV3{
+			URN:     resource.URN("urn:pulumi:stack::project::pkg:index:type::" + name),
+			Type:    "pkg:index:type",
+			Outputs: outputs,
+		}
+	}
+	deployment := apitype.DeploymentV3{
+		Resources: []apitype.ResourceV3{
+			newResource("a", map[string]interface{}{"value": "a"}),
+			newResource("b", map[string]interface{}{
+				// A secret must have exactly one of a ciphertext or a plaintext.
+				"password": map[string]interface{}{resource.SigKey: resource.SecretSig},
+			}),
+			newResource("c", map[string]interface{}{"value": "c"}),
+		},
+	}
+
+	// A strict load fails outright.
+	_, err := DeserializeDeploymentV3(ctx, deployment, b64.Base64SecretsProvider)
+	assert.ErrorContains(t, err, "malformed secret value")
+
+	// A tolerant load quarantines b and loads the rest.
+	snap, err := DeserializeDeploymentV3Tolerant(ctx, deployment, b64.Base64SecretsProvider)
+	require.NoError(t, err)
+	require.Len(t, snap.Resources, 2)
+	assert.Equal(t, deployment.Resources[0].URN, snap.Resources[0].URN)
+	assert.Equal(t, deployment.Resources[2].URN, snap.Resources[1].URN)
+
+	require.Len(t, snap.QuarantinedResources, 1)
+	quarantined := snap.QuarantinedResources[0]
+	assert.Equal(t, deployment.Resources[1].URN, quarantined.URN)
+	assert.ErrorContains(t, quarantined.Err, "malformed secret value")
+	var raw apitype.ResourceV3
+	require.NoError(t, json.Unmarshal(quarantined.Raw, &raw))
+	assert.Equal(t, deployment.Resources[1], raw)
+}
+
+func TestDeserializePendingOperations(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	newResource := func(name string, outputs map[string]interface{}) apitype.ResourceV3 {
+		return apitype.ResourceV3{
+			URN:     resource.URN("urn:pulumi:stack::project::pkg:index:type::" + name),
+			Type:    "pkg:index:type",
+			Outputs: outputs,
+		}
+	}
+	deployment := apitype.DeploymentV3{
+		SecretsProviders: &apitype.SecretsProvidersV1{Type: b64.Type},
+		// The resources are never deserialized, so a malformed one does not matter.
+		Resources: []apitype.ResourceV3{
+			newResource("a", map[string]interface{}{
+				"password": map[string]interface{}{resource.SigKey: resource.SecretSig},
+			}),
+		},
+		PendingOperations: []apitype.OperationV2{
+			{Resource: newResource("b", map[string]interface{}{"value": "b"}), Type: apitype.OperationTypeCreating},
+			{Resource: newResource("c", nil), Type: apitype.OperationTypeDeleting, TimedOut: true},
+		},
+	}
+	serialized, err := json.Marshal(deployment)
+	require.NoError(t, err)
+	untyped := &apitype.UntypedDeployment{Version: apitype.DeploymentSchemaVersionCurrent, Deployment: serialized}
+
+	ops, err := DeserializePendingOperations(ctx, untyped, b64.Base64SecretsProvider)
+	require.NoError(t, err)
+	require.Len(t, ops, 2)
+	assert.Equal(t, resource.OperationTypeCreating, ops[0].Type)
+	assert.Equal(t, deployment.PendingOperations[0].Resource.URN, ops[0].Resource.URN)
+	assert.Equal(t, resource.NewStringProperty("b"), ops[0].Resource.Outputs["value"])
+	assert.Equal(t, resource.OperationTypeDeleting, ops[1].Type)
+	assert.Equal(t, deployment.PendingOperations[1].Resource.URN, ops[1].Resource.URN)
+	assert.True(t, ops[1].TimedOut)
+}
+
 func TestDeserializeMissingSecretsManager(t *testing.T) {
 	t.Parallel()
 
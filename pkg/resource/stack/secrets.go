@@ -16,6 +16,7 @@ package stack
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"sync"
@@ -120,19 +121,30 @@ type BatchingSecretsManager interface {
 	BeginBatchDecryption() (BatchDecrypter, CompleteCrypterBatch)
 }
 
+// DecryptedCiphertexts is implemented by secrets managers that remember the ciphertext from which each secret they have
+// decrypted was read, so that an unchanged secret can be written back out with its original ciphertext.
+type DecryptedCiphertexts interface {
+	// DecryptedCiphertext returns the ciphertext from which the given plaintext was most recently decrypted, if any.
+	DecryptedCiphertext(plaintext string) (string, bool)
+}
+
 type batchingCachingSecretsManager struct {
-	manager secrets.Manager
-	cache   SecretCache
+	manager   secrets.Manager
+	cache     SecretCache
+	decrypted *decryptedCiphertextCache
 }
 
+var _ DecryptedCiphertexts = (*batchingCachingSecretsManager)(nil)
+
 // NewBatchingCachingSecretsManager returns a new BatchingSecretsManager that caches the ciphertext for secret property
 // values. A secrets.Manager that will be used to encrypt and decrypt values stored in a serialized deployment can be
 // wrapped in a caching secrets manager in order to avoid re-encrypting secrets each time the deployment is serialized.
 // When secrets values are not cached, then operations can be batched when using the batch transaction methods.
 func NewBatchingCachingSecretsManager(manager secrets.Manager) BatchingSecretsManager {
 	sm := &batchingCachingSecretsManager{
-		manager: manager,
-		cache:   NewSecretCache(),
+		manager:   manager,
+		cache:     NewSecretCache(),
+		decrypted: &decryptedCiphertextCache{},
 	}
 	return sm
 }
@@ -158,8 +170,43 @@ func (csm *batchingCachingSecretsManager) BeginBatchEncryption() (BatchEncrypter
 }
 
 func (csm *batchingCachingSecretsManager) BeginBatchDecryption() (BatchDecrypter, CompleteCrypterBatch) {
-	// We don't use the cache here to ensure that we always re-encrypt all secrets at least once per operation.
-	return BeginDecryptionBatch(csm.manager.Decrypter())
+	// We don't use the cache here to ensure that we always re-encrypt all secrets at least once per operation. The
+	// ciphertexts are only recorded so that callers can opt in to reusing them (see DecryptedCiphertexts).
+	return BeginBatchDecryptionWithCache(csm.manager.Decrypter(), csm.decrypted)
+}
+
+func (csm *batchingCachingSecretsManager) DecryptedCiphertext(plaintext string) (string, bool) {
+	return csm.decrypted.lookup(plaintext)
+}
+
+// decryptedCiphertextCache is a write-only SecretCache that records the ciphertext from which each plaintext was
+// decrypted, keyed by a hash of the plaintext so that plaintexts are not retained. Its lookups always miss, so it does
+// not change how secrets are decrypted or encrypted.
+type decryptedCiphertextCache struct {
+	ciphertexts sync.Map
+}
+
+func (c *decryptedCiphertextCache) Write(plaintext, ciphertext string, secret *resource.Secret) {
+	if env.DisableSecretCache.Value() {
+		return
+	}
+	c.ciphertexts.Store(sha256.Sum256([]byte(plaintext)), ciphertext)
+}
+
+func (c *decryptedCiphertextCache) LookupCiphertext(secret *resource.Secret, plaintext string) (string, bool) {
+	return "", false
+}
+
+func (c *decryptedCiphertextCache) LookupPlaintext(ciphertext string) (string, bool) {
+	return "", false
+}
+
+func (c *decryptedCiphertextCache) lookup(plaintext string) (string, bool) {
+	ciphertext, ok := c.ciphertexts.Load(sha256.Sum256([]byte(plaintext)))
+	if !ok {
+		return "", false
+	}
+	return ciphertext.(string), true
 }
 
 // SecretCache allows the bidirectional cached conversion between: `ciphertext <-> plaintext + secret pointer`.
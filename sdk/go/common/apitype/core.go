@@ -74,8 +74,15 @@ func PropertyValueSchema() string {
 
 const (
 	// DeploymentSchemaVersionCurrent is the current version of the `Deployment` schema.
-	// Any deployments newer than this version will be rejected.
+	// Any deployments newer than this version, other than those at DeploymentSchemaVersionCompressedResources, will
+	// be rejected.
 	DeploymentSchemaVersionCurrent = 3
+
+	// DeploymentSchemaVersionCompressedResources is the version of a `Deployment` that holds resources whose inputs
+	// and outputs have been compressed. Its schema is otherwise that of DeploymentSchemaVersionCurrent, and it is only
+	// written for deployments that hold such a resource, so that readers which cannot expand them reject the deployment
+	// instead of reading the compressed form as the resource's outputs.
+	DeploymentSchemaVersionCompressedResources = 4
 )
 
 // VersionedCheckpoint is a version number plus a json document. The version number describes what
@@ -150,6 +157,18 @@ type DeploymentV3 struct {
 	PendingOperations []OperationV2 `json:"pending_operations,omitempty" yaml:"pending_operations,omitempty"`
 	// Metadata associated with the snapshot.
 	Metadata SnapshotMetadataV1 `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+	// PendingImports are resources that are to be imported but whose state has not yet been read.
+	PendingImports []PendingImportV1 `json:"pending_imports,omitempty" yaml:"pending_imports,omitempty"`
+}
+
+// PendingImportV1 identifies a resource that is to be imported into a stack.
+type PendingImportV1 struct {
+	// URN is the URN the resource will have once imported.
+	URN resource.URN `json:"urn" yaml:"urn"`
+	// Type is the type of the resource.
+	Type tokens.Type `json:"type" yaml:"type"`
+	// ID is the provider-assigned ID of the resource to import.
+	ID resource.ID `json:"id" yaml:"id"`
 }
 
 type SecretsProvidersV1 struct {
@@ -161,6 +180,19 @@ type SecretsProvidersV1 struct {
 type SnapshotMetadataV1 struct {
 	// Metadata associated with any integrity error affecting the snapshot.
 	IntegrityErrorMetadata *SnapshotIntegrityErrorMetadataV1 `json:"integrity_error,omitempty" yaml:"integrity_error,omitempty"`
+	// Resources that have been removed from the stack without being deleted, because they were marked RetainOnDelete.
+	RetainedResources []RetainedResourceV1 `json:"retained_resources,omitempty" yaml:"retained_resources,omitempty"`
+}
+
+// RetainedResourceV1 records a resource that was removed from the stack without its provider deleting it, because it
+// was marked RetainOnDelete.
+type RetainedResourceV1 struct {
+	// The URN of the resource when it was removed from the stack.
+	URN resource.URN `json:"urn" yaml:"urn"`
+	// The type of the resource.
+	Type tokens.Type `json:"type" yaml:"type"`
+	// The provider-assigned ID of the resource, if any.
+	ID resource.ID `json:"id,omitempty" yaml:"id,omitempty"`
 }
 
 // SnapshotIntegrityErrorMetadataV1 contains metadata about a snapshot integrity error, such as the version
@@ -207,6 +239,8 @@ type OperationV2 struct {
 	Resource ResourceV3 `json:"resource" yaml:"resource"`
 	// Status is a string representation of the operation that the engine is performing.
 	Type OperationType `json:"type" yaml:"type"`
+	// TimedOut is true if the operation was still outstanding after the engine's step timeout had elapsed.
+	TimedOut bool `json:"timedOut,omitempty" yaml:"timedOut,omitempty"`
 }
 
 // UntypedDeployment contains an inner, untyped deployment structure.
@@ -362,6 +396,19 @@ type ResourceV3 struct {
 	RefreshBeforeUpdate bool `json:"refreshBeforeUpdate,omitempty" yaml:"replaceOnChanges,omitempty"`
 	// ViewOf is a reference to the resource that this resource is a view of.
 	ViewOf resource.URN `json:"viewOf,omitempty" yaml:"viewOf,omitempty"`
+	// StepID is the ID of the engine step that last wrote this resource's state, if it was recorded.
+	StepID string `json:"stepID,omitempty" yaml:"stepID,omitempty"`
+	// Imported is true if this resource was brought under management by an import rather than created by Pulumi.
+	Imported bool `json:"imported,omitempty" yaml:"imported,omitempty"`
+	// SequenceNumber is the number of times this resource has been replaced. Providers may use it to generate names
+	// that are stable for a given incarnation of the resource but differ between replacements.
+	SequenceNumber int `json:"sequenceNumber,omitempty" yaml:"sequenceNumber,omitempty"`
+	// Annotations are free-form key/value pairs, such as an owner or cost center, attached to this resource. They are
+	// recorded in state only and are never sent to the resource's provider.
+	Annotations map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+	// SecretsProviders is the secrets provider that this resource's secrets are encrypted with, if it differs from that
+	// of the deployment. This is only set while a stack is migrating between secrets providers.
+	SecretsProviders *SecretsProvidersV1 `json:"secretsProviders,omitempty" yaml:"secretsProviders,omitempty"`
 }
 
 // ManifestV1 captures meta-information about this checkpoint file, such as versions of binaries, etc.
@@ -374,6 +421,10 @@ type ManifestV1 struct {
 	Version string `json:"version" yaml:"version"`
 	// Plugins contains the binary version info of plug-ins used.
 	Plugins []PluginInfoV1 `json:"plugins,omitempty" yaml:"plugins,omitempty"`
+	// Language is the name of the language runtime of the program that produced the checkpoint, e.g. "nodejs".
+	Language string `json:"language,omitempty" yaml:"language,omitempty"`
+	// Runtime describes the runtime that executed the program, e.g. "node v20.11.0".
+	Runtime string `json:"runtime,omitempty" yaml:"runtime,omitempty"`
 }
 
 // PluginInfoV1 captures the version and information about a plugin.
@@ -88,6 +88,11 @@ func NewBlindingDecrypter() Decrypter {
 	return blindingCrypter{}
 }
 
+// NewBlindingCrypter returns a crypter that encrypts and decrypts every value to "[secret]".
+func NewBlindingCrypter() Crypter {
+	return blindingCrypter{}
+}
+
 type blindingCrypter struct{}
 
 func (b blindingCrypter) DecryptValue(ctx context.Context, _ string) (string, error) {
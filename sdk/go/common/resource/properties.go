@@ -182,6 +182,20 @@ func (props PropertyMap) ContainsSecrets() bool {
 	return false
 }
 
+// Redacted returns a copy of the property map in which every secret value, however deeply nested, is replaced by the
+// string RedactedSecret. Other values are preserved. The result is suitable for logs and error messages, but since a
+// redacted value cannot be told apart from a string that happens to match the marker it must not be persisted.
+func (props PropertyMap) Redacted() PropertyMap {
+	if props == nil {
+		return nil
+	}
+	redacted := make(PropertyMap, len(props))
+	for k, v := range props {
+		redacted[k] = v.Redacted()
+	}
+	return redacted
+}
+
 // Mappable returns a mapper-compatible object map, suitable for deserialization into structures.
 func (props PropertyMap) Mappable() map[string]interface{} {
 	return props.MapRepl(nil, nil)
@@ -440,6 +454,36 @@ func (v PropertyValue) ContainsSecrets() bool {
 	return false
 }
 
+// RedactedSecret is the marker that Redacted puts in place of secret values.
+const RedactedSecret = "[secret]"
+
+// Redacted returns a copy of the property value in which every secret value is replaced by the string RedactedSecret.
+// See PropertyMap.Redacted.
+func (v PropertyValue) Redacted() PropertyValue {
+	switch {
+	case v.IsSecret():
+		return NewProperty(RedactedSecret)
+	case v.IsComputed():
+		return MakeComputed(v.Input().Element.Redacted())
+	case v.IsOutput():
+		out := v.OutputValue()
+		if out.Secret {
+			return NewProperty(RedactedSecret)
+		}
+		out.Element = out.Element.Redacted()
+		return NewProperty(out)
+	case v.IsArray():
+		arr := make([]PropertyValue, len(v.ArrayValue()))
+		for i, e := range v.ArrayValue() {
+			arr[i] = e.Redacted()
+		}
+		return NewProperty(arr)
+	case v.IsObject():
+		return NewProperty(v.ObjectValue().Redacted())
+	}
+	return v
+}
+
 // BoolValue fetches the underlying bool value (panicking if it isn't a bool).
 func (v PropertyValue) BoolValue() bool { return v.V.(bool) }
 
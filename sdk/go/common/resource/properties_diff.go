@@ -266,6 +266,59 @@ func (v PropertyValue) Diff(other PropertyValue, ignoreKeys ...IgnoreKeyFunc) *V
 	return &ValueDiff{Old: v, New: other}
 }
 
+// DiffProperties returns a diffset by comparing the old property map to the new one in the same manner as
+// PropertyMap.Diff, except that a value whose only change is being wrapped in (or unwrapped from) a secret is considered
+// the same. This is useful when deciding whether a change is meaningful, where a value that is now marked as secret
+// but is otherwise equal does not need to be acted upon immediately. It returns nil if there are no diffs.
+func DiffProperties(old, new PropertyMap) *ObjectDiff {
+	return ignoreSecretWrapping(old.Diff(new))
+}
+
+// ignoreSecretWrapping moves any updates in the given diff that only change the secretness of a value to the diff's
+// sames, returning nil if no changes remain.
+func ignoreSecretWrapping(diff *ObjectDiff) *ObjectDiff {
+	if diff == nil {
+		return nil
+	}
+	for k, update := range diff.Updates {
+		if update.Old.withoutSecrets().DeepEquals(update.New.withoutSecrets()) {
+			delete(diff.Updates, k)
+			diff.Sames[k] = update.Old
+		} else if update.Object != nil {
+			update.Object = ignoreSecretWrapping(update.Object)
+			diff.Updates[k] = update
+		}
+	}
+	if !diff.AnyChanges() {
+		return nil
+	}
+	return diff
+}
+
+// withoutSecrets returns a copy of the given value with all secrets replaced by the values they wrap.
+func (v PropertyValue) withoutSecrets() PropertyValue {
+	switch {
+	case v.IsSecret():
+		return v.SecretValue().Element.withoutSecrets()
+	case v.IsArray():
+		arr := v.ArrayValue()
+		result := make([]PropertyValue, len(arr))
+		for i, elem := range arr {
+			result[i] = elem.withoutSecrets()
+		}
+		return NewArrayProperty(result)
+	case v.IsObject():
+		obj := v.ObjectValue()
+		result := make(PropertyMap, len(obj))
+		for k, elem := range obj {
+			result[k] = elem.withoutSecrets()
+		}
+		return NewObjectProperty(result)
+	default:
+		return v
+	}
+}
+
 // DeepEquals returns true if this property map is deeply equal to the other property map; and false otherwise.
 func (props PropertyMap) DeepEquals(other PropertyMap) bool {
 	// If any in props either doesn't exist, or is of a different value, return false.
@@ -358,6 +358,48 @@ func TestArchivePropertyValueDiffs(t *testing.T) {
 	assert.True(t, d3.New.IsNull())
 }
 
+func TestAssetPropertyValueDiffsByHash(t *testing.T) {
+	t.Parallel()
+
+	writeTemp := func(contents string) string {
+		f, err := os.CreateTemp(t.TempDir(), "asset")
+		assert.NoError(t, err)
+		defer contract.IgnoreClose(f)
+		_, err = f.WriteString(contents)
+		assert.NoError(t, err)
+		return f.Name()
+	}
+
+	path1, path2 := writeTemp("contents"), writeTemp("contents")
+	a1, err := asset.FromPath(path1)
+	assert.NoError(t, err)
+	a2, err := asset.FromPath(path2)
+	assert.NoError(t, err)
+	assert.NotEqual(t, a1.Path, a2.Path)
+
+	// Assets with the same contents at different paths are equal.
+	assert.True(t, NewProperty(a1).DeepEquals(NewProperty(a2)))
+	assert.Nil(t, NewProperty(a1).Diff(NewProperty(a2)))
+	assert.Nil(t, PropertyMap{"a": NewProperty(a1)}.Diff(PropertyMap{"a": NewProperty(a2)}))
+
+	// So are archives built from them.
+	ar1, err := archive.FromAssets(map[string]interface{}{"file": a1})
+	assert.NoError(t, err)
+	ar2, err := archive.FromAssets(map[string]interface{}{"file": a2})
+	assert.NoError(t, err)
+	assert.True(t, NewProperty(ar1).DeepEquals(NewProperty(ar2)))
+	assert.Nil(t, NewProperty(ar1).Diff(NewProperty(ar2)))
+
+	// Assets whose contents differ are not.
+	a3, err := asset.FromPath(writeTemp("other contents"))
+	assert.NoError(t, err)
+	assert.False(t, NewProperty(a1).DeepEquals(NewProperty(a3)))
+	assertDeepEqualsIffEmptyDiff(t, NewProperty(a1), NewProperty(a3))
+	ar3, err := archive.FromAssets(map[string]interface{}{"file": a3})
+	assert.NoError(t, err)
+	assert.False(t, NewProperty(ar1).DeepEquals(NewProperty(ar3)))
+}
+
 func TestMismatchedPropertyValueDiff(t *testing.T) {
 	t.Parallel()
 
@@ -384,3 +426,41 @@ func TestComputedProperyValueDiff(t *testing.T) {
 	a4 := NewPropertyValue("a")
 	assert.False(t, a1.DeepEquals(a4))
 }
+
+func TestDiffPropertiesIgnoresSecretWrapping(t *testing.T) {
+	t.Parallel()
+
+	plain := NewPropertyValue("a")
+	secret := MakeSecret(NewPropertyValue("a"))
+
+	// Plaintext to secret and back again, both at the top level and nested inside objects and arrays.
+	assert.Nil(t, DiffProperties(PropertyMap{"p": plain}, PropertyMap{"p": secret}))
+	assert.Nil(t, DiffProperties(PropertyMap{"p": secret}, PropertyMap{"p": plain}))
+	assert.Nil(t, DiffProperties(
+		PropertyMap{"o": NewObjectProperty(PropertyMap{"p": plain})},
+		PropertyMap{"o": MakeSecret(NewObjectProperty(PropertyMap{"p": plain}))}))
+	assert.Nil(t, DiffProperties(
+		PropertyMap{"o": NewObjectProperty(PropertyMap{"p": secret})},
+		PropertyMap{"o": NewObjectProperty(PropertyMap{"p": plain})}))
+	assert.Nil(t, DiffProperties(
+		PropertyMap{"a": NewArrayProperty([]PropertyValue{plain, plain})},
+		PropertyMap{"a": NewArrayProperty([]PropertyValue{plain, secret})}))
+
+	// The regular diff still reports these as updates.
+	assert.NotNil(t, PropertyMap{"p": plain}.Diff(PropertyMap{"p": secret}))
+
+	// Changes to the underlying value are still meaningful, whether or not the secretness also changes.
+	diff := DiffProperties(PropertyMap{"p": plain}, PropertyMap{"p": MakeSecret(NewPropertyValue("b"))})
+	assert.NotNil(t, diff)
+	assert.Equal(t, []PropertyKey{"p"}, diff.ChangedKeys())
+
+	// Secret-only changes are reported as sames alongside real changes, including within nested objects.
+	diff = DiffProperties(
+		PropertyMap{"o": NewObjectProperty(PropertyMap{"p": plain, "q": plain})},
+		PropertyMap{"o": NewObjectProperty(PropertyMap{"p": secret, "q": NewPropertyValue("b")})})
+	assert.NotNil(t, diff)
+	assert.True(t, diff.Updated("o"))
+	nested := diff.Updates["o"].Object
+	assert.True(t, nested.Same("p"))
+	assert.True(t, nested.Updated("q"))
+}
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -601,3 +602,88 @@ func (p PropertyPath) String() string {
 	}
 	return buf.String()
 }
+
+// Flatten returns the leaf values of the map keyed by their paths, e.g. `{"a": {"b": [1]}}` is flattened to
+// `{"a.b[0]": 1}`. Secrets, empty objects and empty arrays are leaves, so that they survive a round trip through
+// UnflattenPropertyMap.
+func (props PropertyMap) Flatten() map[string]PropertyValue {
+	flat := map[string]PropertyValue{}
+	var flatten func(path PropertyPath, v PropertyValue)
+	flatten = func(path PropertyPath, v PropertyValue) {
+		switch {
+		case v.IsObject() && len(v.ObjectValue()) != 0:
+			for k, e := range v.ObjectValue() {
+				flatten(append(path[:len(path):len(path)], string(k)), e)
+			}
+		case v.IsArray() && len(v.ArrayValue()) != 0:
+			for i, e := range v.ArrayValue() {
+				flatten(append(path[:len(path):len(path)], i), e)
+			}
+		default:
+			flat[path.String()] = v
+		}
+	}
+	for k, v := range props {
+		flatten(PropertyPath{string(k)}, v)
+	}
+	return flat
+}
+
+// UnflattenPropertyMap is the inverse of PropertyMap.Flatten: it builds a map from values keyed by their paths, e.g.
+// `{"a.b[0]": 1}` is unflattened to `{"a": {"b": [1]}}`. A key that is not a valid path, or whose path conflicts with
+// that of another key, is kept as a top-level key as-is.
+func UnflattenPropertyMap(flat map[string]PropertyValue) PropertyMap {
+	type entry struct {
+		key  string
+		path PropertyPath
+	}
+	entries := make([]entry, 0, len(flat))
+	for k := range flat {
+		path, err := ParsePropertyPath(k)
+		if err != nil || len(path) == 0 {
+			path = PropertyPath{k}
+		}
+		entries = append(entries, entry{key: k, path: path})
+	}
+
+	// Add grows arrays by inserting elements at their front, so the elements of each array are added starting from the
+	// highest index: the array is then allocated at its final size before any element is set.
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].path, entries[j].path
+		for n := 0; n < len(a) && n < len(b); n++ {
+			switch ak := a[n].(type) {
+			case int:
+				bk, ok := b[n].(int)
+				if !ok {
+					return true
+				}
+				if ak != bk {
+					return ak > bk
+				}
+			case string:
+				bk, ok := b[n].(string)
+				if !ok {
+					return false
+				}
+				if ak != bk {
+					return ak < bk
+				}
+			}
+		}
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return entries[i].key < entries[j].key
+	})
+
+	props := PropertyMap{}
+	dest := NewObjectProperty(props)
+	for _, e := range entries {
+		if _, isKey := e.path[0].(string); !isKey {
+			props[PropertyKey(e.key)] = flat[e.key]
+		} else if _, ok := e.path.Add(dest, flat[e.key]); !ok {
+			props[PropertyKey(e.key)] = flat[e.key]
+		}
+	}
+	return props
+}
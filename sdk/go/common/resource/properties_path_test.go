@@ -889,3 +889,135 @@ func TestReset(t *testing.T) {
 		})
 	}
 }
+
+func TestFlattenPropertyMap(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		m    PropertyMap
+		flat map[string]PropertyValue
+	}{
+		{
+			name: "nested objects",
+			m: NewPropertyMapFromMap(map[string]interface{}{
+				"a": map[string]interface{}{
+					"b": map[string]interface{}{"c": "d"},
+					"e": true,
+				},
+				"f": 1.0,
+			}),
+			flat: map[string]PropertyValue{
+				"a.b.c": NewProperty("d"),
+				"a.e":   NewProperty(true),
+				"f":     NewProperty(1.0),
+			},
+		},
+		{
+			name: "arrays",
+			m: NewPropertyMapFromMap(map[string]interface{}{
+				"a": []interface{}{
+					"b",
+					map[string]interface{}{"c": []interface{}{1.0, 2.0}},
+					[]interface{}{"d"},
+				},
+			}),
+			flat: map[string]PropertyValue{
+				"a[0]":      NewProperty("b"),
+				"a[1].c[0]": NewProperty(1.0),
+				"a[1].c[1]": NewProperty(2.0),
+				"a[2][0]":   NewProperty("d"),
+			},
+		},
+		{
+			name: "long arrays",
+			m: PropertyMap{
+				"a": NewProperty([]PropertyValue{
+					NewProperty(0.0), NewProperty(1.0), NewProperty(2.0), NewProperty(3.0), NewProperty(4.0),
+					NewProperty(5.0), NewProperty(6.0), NewProperty(7.0), NewProperty(8.0), NewProperty(9.0),
+					NewProperty(10.0), NewProperty(11.0),
+				}),
+			},
+			flat: map[string]PropertyValue{
+				"a[0]": NewProperty(0.0), "a[1]": NewProperty(1.0), "a[2]": NewProperty(2.0),
+				"a[3]": NewProperty(3.0), "a[4]": NewProperty(4.0), "a[5]": NewProperty(5.0),
+				"a[6]": NewProperty(6.0), "a[7]": NewProperty(7.0), "a[8]": NewProperty(8.0),
+				"a[9]": NewProperty(9.0), "a[10]": NewProperty(10.0), "a[11]": NewProperty(11.0),
+			},
+		},
+		{
+			name: "leaves",
+			m: PropertyMap{
+				"secret": MakeSecret(NewProperty(PropertyMap{"a": NewProperty("b")})),
+				"object": NewProperty(PropertyMap{}),
+				"array":  NewProperty([]PropertyValue{}),
+				"null":   NewNullProperty(),
+			},
+			flat: map[string]PropertyValue{
+				"secret": MakeSecret(NewProperty(PropertyMap{"a": NewProperty("b")})),
+				"object": NewProperty(PropertyMap{}),
+				"array":  NewProperty([]PropertyValue{}),
+				"null":   NewNullProperty(),
+			},
+		},
+		{
+			name: "quoted keys",
+			m: NewPropertyMapFromMap(map[string]interface{}{
+				"aws:region": "us-west-2",
+				"app:tags":   map[string]interface{}{"a.b": "c"},
+			}),
+			flat: map[string]PropertyValue{
+				`["aws:region"]`:      NewProperty("us-west-2"),
+				`["app:tags"]["a.b"]`: NewProperty("c"),
+			},
+		},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			flat := c.m.Flatten()
+			assert.Equal(t, c.flat, flat)
+			assert.Equal(t, c.m, UnflattenPropertyMap(flat))
+		})
+	}
+}
+
+func TestUnflattenPropertyMap(t *testing.T) {
+	t.Parallel()
+
+	t.Run("dotted keys", func(t *testing.T) {
+		t.Parallel()
+
+		actual := UnflattenPropertyMap(map[string]PropertyValue{
+			"aws:tags.env": NewProperty("test"),
+			"aws:region":   NewProperty("us-west-2"),
+		})
+		assert.Equal(t, NewPropertyMapFromMap(map[string]interface{}{
+			"aws:tags":   map[string]interface{}{"env": "test"},
+			"aws:region": "us-west-2",
+		}), actual)
+	})
+
+	t.Run("conflicts", func(t *testing.T) {
+		t.Parallel()
+
+		actual := UnflattenPropertyMap(map[string]PropertyValue{
+			"a":      NewProperty("b"),
+			"a.c":    NewProperty("d"),
+			"[0]":    NewProperty("e"),
+			"f[":     NewProperty("g"),
+			"h[0].i": NewProperty("j"),
+		})
+		assert.Equal(t, PropertyMap{
+			"a":   NewProperty("b"),
+			"a.c": NewProperty("d"),
+			"[0]": NewProperty("e"),
+			"f[":  NewProperty("g"),
+			"h": NewProperty([]PropertyValue{
+				NewProperty(PropertyMap{"i": NewProperty("j")}),
+			}),
+		}, actual)
+	})
+}
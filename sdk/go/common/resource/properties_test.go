@@ -361,6 +361,39 @@ func TestContainsSecrets(t *testing.T) {
 	}
 }
 
+func TestRedacted(t *testing.T) {
+	t.Parallel()
+
+	props := PropertyMap{
+		"name":     NewProperty("a"),
+		"port":     NewProperty(80.0),
+		"password": MakeSecret(NewProperty("hunter2")),
+		"nested": NewProperty(PropertyMap{
+			"token": MakeSecret(NewProperty(PropertyMap{"value": NewProperty("s3cr3t")})),
+			"tags":  NewProperty([]PropertyValue{NewProperty("x"), MakeSecret(NewProperty("y"))}),
+		}),
+		"known":   NewProperty(Output{Element: NewProperty("z"), Known: true, Secret: true}),
+		"unknown": MakeComputed(NewProperty("")),
+	}
+
+	assert.Equal(t, PropertyMap{
+		"name":     NewProperty("a"),
+		"port":     NewProperty(80.0),
+		"password": NewProperty(RedactedSecret),
+		"nested": NewProperty(PropertyMap{
+			"token": NewProperty(RedactedSecret),
+			"tags":  NewProperty([]PropertyValue{NewProperty("x"), NewProperty(RedactedSecret)}),
+		}),
+		"known":   NewProperty(RedactedSecret),
+		"unknown": MakeComputed(NewProperty("")),
+	}, props.Redacted())
+	assert.False(t, props.Redacted().ContainsSecrets())
+
+	// The original map is left as it was.
+	assert.Equal(t, MakeSecret(NewProperty("hunter2")), props["password"])
+	assert.Nil(t, PropertyMap(nil).Redacted())
+}
+
 func TestHasValue(t *testing.T) {
 	t.Parallel()
 
@@ -35,9 +35,13 @@ const (
 type Operation struct {
 	Resource *State
 	Type     OperationType
+
+	// TimedOut is true if the operation was still outstanding after the engine's step timeout had elapsed, which
+	// suggests that the provider performing it has hung.
+	TimedOut bool
 }
 
 // NewOperation constructs a new Operation from a state and an operation name.
 func NewOperation(state *State, op OperationType) Operation {
-	return Operation{state, op}
+	return Operation{Resource: state, Type: op}
 }
@@ -15,6 +15,8 @@
 package resource
 
 import (
+	"maps"
+	"slices"
 	"sync"
 	"time"
 
@@ -61,6 +63,10 @@ type State struct {
 	ReplaceOnChanges        []string              // If set, the list of properties that if changed trigger a replace.
 	RefreshBeforeUpdate     bool                  // true if this resource should always be refreshed prior to updates.
 	ViewOf                  URN                   // If set, the URN of the resource this resource is a view of.
+	StepID                  string                // If set, the ID of the engine step that last wrote this state.
+	Imported                bool                  // true if this resource was imported rather than created by Pulumi.
+	SequenceNumber          int                   // the number of times this resource has been replaced.
+	Annotations             map[string]string     // free-form annotations (e.g. owner or cost center) kept in state.
 }
 
 // Copy creates a deep copy of the resource state, except without copying the lock.
@@ -94,9 +100,92 @@ func (s *State) Copy() *State {
 		ReplaceOnChanges:        s.ReplaceOnChanges,
 		RefreshBeforeUpdate:     s.RefreshBeforeUpdate,
 		ViewOf:                  s.ViewOf,
+		StepID:                  s.StepID,
+		Imported:                s.Imported,
+		SequenceNumber:          s.SequenceNumber,
+		Annotations:             s.Annotations,
 	}
 }
 
+// CloneOption configures which fields are carried over by State.Clone.
+type CloneOption func(*cloneOptions)
+
+type cloneOptions struct {
+	withoutInputs    bool
+	withoutOutputs   bool
+	shareCollections bool
+}
+
+// WithoutOutputs omits the resource's outputs from the clone, leaving Outputs nil.
+func WithoutOutputs() CloneOption {
+	return func(opts *cloneOptions) {
+		opts.withoutOutputs = true
+	}
+}
+
+// OnlyMetadata omits both the resource's inputs and outputs from the clone, leaving Inputs and Outputs nil. All other
+// fields (identity, dependencies, options and so on) are carried over.
+func OnlyMetadata() CloneOption {
+	return func(opts *cloneOptions) {
+		opts.withoutInputs = true
+		opts.withoutOutputs = true
+	}
+}
+
+// ShareCollections makes the clone share its maps and slices with the original state rather than copying them, in the
+// same manner as Copy. This is the cheapest form of clone but callers must not mutate the shared collections.
+func ShareCollections() CloneOption {
+	return func(opts *cloneOptions) {
+		opts.shareCollections = true
+	}
+}
+
+// Clone creates a copy of the resource state, except without copying the lock. By default the top-level maps and
+// slices of the state (e.g. Inputs, Outputs and Dependencies) are copied so that they may be modified independently of
+// the original; the property values within them are shared. Options may be given to omit or share fields in order to
+// make the clone cheaper when callers only need part of the state.
+func (s *State) Clone(opts ...CloneOption) *State {
+	var o cloneOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	c := s.Copy()
+	if o.withoutInputs {
+		c.Inputs = nil
+	}
+	if o.withoutOutputs {
+		c.Outputs = nil
+	}
+	if !o.shareCollections {
+		c.Inputs = copyPropertyMap(c.Inputs)
+		c.Outputs = copyPropertyMap(c.Outputs)
+		c.Dependencies = slices.Clone(c.Dependencies)
+		c.InitErrors = slices.Clone(c.InitErrors)
+		c.AdditionalSecretOutputs = slices.Clone(c.AdditionalSecretOutputs)
+		c.Aliases = slices.Clone(c.Aliases)
+		c.IgnoreChanges = slices.Clone(c.IgnoreChanges)
+		c.ReplaceOnChanges = slices.Clone(c.ReplaceOnChanges)
+		c.Annotations = maps.Clone(c.Annotations)
+		if c.PropertyDependencies != nil {
+			propDeps := make(map[PropertyKey][]URN, len(c.PropertyDependencies))
+			for k, deps := range c.PropertyDependencies {
+				propDeps[k] = slices.Clone(deps)
+			}
+			c.PropertyDependencies = propDeps
+		}
+	}
+	return c
+}
+
+// copyPropertyMap makes a shallow copy of the given map, preserving nil-ness.
+func copyPropertyMap(props PropertyMap) PropertyMap {
+	if props == nil {
+		return nil
+	}
+	return props.Copy()
+}
+
 func (s *State) GetAliasURNs() []URN {
 	return s.Aliases
 }
@@ -217,3 +217,126 @@ func TestGetAllDependencies(t *testing.T) {
 		})
 	}
 }
+
+func newCloneTestState() *State {
+	return &State{
+		Type:         "pkg:index:typ",
+		URN:          "urn:pulumi:stack::project::pkg:index:typ::a",
+		Custom:       true,
+		ID:           "id",
+		Inputs:       PropertyMap{"in": NewStringProperty("input")},
+		Outputs:      PropertyMap{"out": NewStringProperty("output")},
+		Protect:      true,
+		Dependencies: []URN{"urn:pulumi:stack::project::pkg:index:typ::b"},
+		PropertyDependencies: map[PropertyKey][]URN{
+			"in": {"urn:pulumi:stack::project::pkg:index:typ::b"},
+		},
+		Aliases: []URN{"urn:pulumi:stack::project::pkg:index:typ::old"},
+	}
+}
+
+func TestStateClone(t *testing.T) {
+	t.Parallel()
+
+	t.Run("default", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		original := newCloneTestState()
+
+		// Act.
+		clone := original.Clone()
+
+		// Assert.
+		assert.Equal(t, original.Copy(), clone)
+
+		// The collections of the clone must be independent of those of the original.
+		clone.Inputs["in"] = NewStringProperty("changed")
+		clone.Outputs["out"] = NewStringProperty("changed")
+		clone.Dependencies[0] = "changed"
+		clone.PropertyDependencies["in"][0] = "changed"
+		clone.Aliases[0] = "changed"
+		assert.Equal(t, newCloneTestState().Copy(), original.Copy())
+	})
+
+	t.Run("without outputs", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		original := newCloneTestState()
+
+		// Act.
+		clone := original.Clone(WithoutOutputs())
+
+		// Assert.
+		assert.Nil(t, clone.Outputs)
+		assert.Equal(t, original.Inputs, clone.Inputs)
+		assert.Equal(t, original.URN, clone.URN)
+		assert.Equal(t, original.Dependencies, clone.Dependencies)
+
+		// The original must retain its outputs, and the inputs must be independent.
+		assert.Equal(t, PropertyMap{"out": NewStringProperty("output")}, original.Outputs)
+		clone.Inputs["in"] = NewStringProperty("changed")
+		assert.Equal(t, NewStringProperty("input"), original.Inputs["in"])
+	})
+
+	t.Run("only metadata", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		original := newCloneTestState()
+
+		// Act.
+		clone := original.Clone(OnlyMetadata())
+
+		// Assert.
+		assert.Nil(t, clone.Inputs)
+		assert.Nil(t, clone.Outputs)
+		assert.Equal(t, original.Type, clone.Type)
+		assert.Equal(t, original.URN, clone.URN)
+		assert.Equal(t, original.ID, clone.ID)
+		assert.Equal(t, original.Custom, clone.Custom)
+		assert.Equal(t, original.Protect, clone.Protect)
+		assert.Equal(t, original.Dependencies, clone.Dependencies)
+		assert.Equal(t, original.PropertyDependencies, clone.PropertyDependencies)
+		assert.Equal(t, original.Aliases, clone.Aliases)
+
+		clone.Dependencies[0] = "changed"
+		assert.Equal(t, URN("urn:pulumi:stack::project::pkg:index:typ::b"), original.Dependencies[0])
+	})
+
+	t.Run("share collections", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		original := newCloneTestState()
+
+		// Act.
+		clone := original.Clone(ShareCollections())
+
+		// Assert.
+		assert.Equal(t, original.Copy(), clone)
+
+		// The collections of the clone must be shared with those of the original.
+		clone.Inputs["in"] = NewStringProperty("changed")
+		clone.Dependencies[0] = "changed"
+		assert.Equal(t, NewStringProperty("changed"), original.Inputs["in"])
+		assert.Equal(t, URN("changed"), original.Dependencies[0])
+	})
+
+	t.Run("share collections without outputs", func(t *testing.T) {
+		t.Parallel()
+
+		// Arrange.
+		original := newCloneTestState()
+
+		// Act.
+		clone := original.Clone(ShareCollections(), WithoutOutputs())
+
+		// Assert.
+		assert.Nil(t, clone.Outputs)
+		assert.NotNil(t, original.Outputs)
+		clone.Inputs["in"] = NewStringProperty("changed")
+		assert.Equal(t, NewStringProperty("changed"), original.Inputs["in"])
+	})
+}
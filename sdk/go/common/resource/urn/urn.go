@@ -61,10 +61,17 @@ func Parse(s string) (URN, error) {
 		return "", errors.New("missing required URN")
 	}
 
-	urn := URN(s)
-	if !urn.IsValid() {
-		return "", fmt.Errorf("invalid URN %q", s)
+	// These checks must accept exactly the URNs accepted by IsValid, but explain why a URN is rejected.
+	if !strings.HasPrefix(s, Prefix) {
+		return "", fmt.Errorf("invalid URN %q: must begin with %q", s, Prefix)
+	}
+	if strings.Count(s, NameDelimiter) < 3 {
+		return "", fmt.Errorf("invalid URN %q: must have a stack, project, type and name separated by %q",
+			s, NameDelimiter)
 	}
+
+	urn := URN(s)
+	contract.Assertf(urn.IsValid(), "parsed URN %q must be valid", s)
 	return urn, nil
 }
 
@@ -221,3 +228,22 @@ func (urn URN) RenameProject(project tokens.PackageName) URN {
 		urn.Name(),
 	)
 }
+
+// WithParent returns a new URN for a resource with the same stack, project, type and name as this one, but parented
+// to a resource of the given qualified type, such as that returned by QualifiedType on the parent's URN. Any parent
+// type already in this URN is replaced, and an empty or root stack parent type yields an unparented URN.
+func (urn URN) WithParent(parentType tokens.Type) URN {
+	return New(
+		urn.Stack(),
+		urn.Project(),
+		parentType,
+		urn.Type(),
+		urn.Name(),
+	)
+}
+
+// WithName returns a new URN with the same stack, project and qualified type as this one, but the given name. It is
+// equivalent to Rename, and reads more naturally when chained with WithParent.
+func (urn URN) WithName(name string) URN {
+	return urn.Rename(name)
+}
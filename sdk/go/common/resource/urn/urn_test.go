@@ -267,6 +267,50 @@ func TestURNParse(t *testing.T) {
 	})
 }
 
+func TestParseURNErrors(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		urn string
+		err string
+	}{
+		{
+			urn: "urn:not-pulumi:stack::project::type::name",
+			err: `invalid URN "urn:not-pulumi:stack::project::type::name": must begin with "urn:pulumi:"`,
+		},
+		{
+			urn: "stack::project::type::name",
+			err: `invalid URN "stack::project::type::name": must begin with "urn:pulumi:"`,
+		},
+		{
+			urn: "urn:pulumi:stack::project::type",
+			err: `invalid URN "urn:pulumi:stack::project::type": ` +
+				`must have a stack, project, type and name separated by "::"`,
+		},
+		{
+			urn: "urn:pulumi:stack:project:type:name",
+			err: `invalid URN "urn:pulumi:stack:project:type:name": ` +
+				`must have a stack, project, type and name separated by "::"`,
+		},
+		{
+			urn: "urn:pulumi:stack/project/type/name",
+			err: `invalid URN "urn:pulumi:stack/project/type/name": ` +
+				`must have a stack, project, type and name separated by "::"`,
+		},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.urn, func(t *testing.T) {
+			t.Parallel()
+
+			u, err := urn.Parse(c.urn)
+			assert.EqualError(t, err, c.err)
+			assert.Empty(t, u)
+			assert.False(t, urn.URN(c.urn).IsValid())
+		})
+	}
+}
+
 func TestParseOptionalURN(t *testing.T) {
 	t.Parallel()
 
@@ -373,3 +417,45 @@ func TestRenameProject(t *testing.T) {
 		urn.New(stack, "a-better-project", parentType, typ, name),
 		renamed)
 }
+
+func TestWithParent(t *testing.T) {
+	t.Parallel()
+
+	stack := tokens.QName("stack")
+	proj := tokens.PackageName("foo/bar/baz")
+	typ := tokens.Type("bang:boom/fizzle:MajorResource")
+	name := "a-swell-resource"
+
+	parent := urn.New(stack, proj, "grand$parent", "pkg:index:Parent", "parent")
+	child := urn.New(stack, proj, "old$parent", typ, name)
+
+	// The parented URN matches one assembled by hand from the parts of the two URNs.
+	assert.Equal(t,
+		urn.New(child.Stack(), child.Project(), parent.QualifiedType(), child.Type(), child.Name()),
+		child.WithParent(parent.QualifiedType()))
+	assert.Equal(t,
+		tokens.Type("grand$parent$pkg:index:Parent$bang:boom/fizzle:MajorResource"),
+		child.WithParent(parent.QualifiedType()).QualifiedType())
+
+	// An empty or root stack parent type removes the parent.
+	assert.Equal(t, urn.New(stack, proj, "", typ, name), child.WithParent(""))
+	assert.Equal(t, urn.New(stack, proj, "", typ, name), child.WithParent(tokens.RootStackType))
+}
+
+func TestWithName(t *testing.T) {
+	t.Parallel()
+
+	stack := tokens.QName("stack")
+	proj := tokens.PackageName("foo/bar/baz")
+	parentType := tokens.Type("parent$type")
+	typ := tokens.Type("bang:boom/fizzle:MajorResource")
+
+	oldURN := urn.New(stack, proj, parentType, typ, "a-swell-resource")
+
+	assert.Equal(t,
+		urn.New(stack, proj, parentType, typ, "a::better::resource"),
+		oldURN.WithName("a::better::resource"))
+	assert.Equal(t,
+		urn.New(stack, proj, "other$parent", typ, "a-better-resource"),
+		oldURN.WithParent("other$parent").WithName("a-better-resource"))
+}
@@ -264,6 +264,10 @@ type Project struct {
 
 	Plugins *Plugins `json:"plugins,omitempty" yaml:"plugins,omitempty"`
 
+	// Environment is an optional list of environments that every stack of the project imports, ahead of the stack's own
+	// environment (see StackEnvironment).
+	Environment *Environment `json:"environment,omitempty" yaml:"environment,omitempty"`
+
 	// Handle additional keys, albeit in a way that will remove comments and trivia.
 	AdditionalKeys map[string]interface{} `yaml:",inline"`
 
@@ -873,6 +877,51 @@ func (proj *PluginProject) Validate() error {
 	return nil
 }
 
+// StackEnvironment returns the environment of the given stack as the stack's program sees it. The environments imported
+// by the project, if any, are imported ahead of the stack's own environment, so that values from the stack's
+// environment take precedence. A project's environment may only import other environments; an error is returned if
+// it defines values inline, or if the stack's own environment definition cannot be parsed.
+func (proj *Project) StackEnvironment(ps *ProjectStack) (*Environment, error) {
+	var imports []string
+	if proj != nil {
+		for _, name := range proj.Environment.Imports() {
+			// Imports reports inline values as an import named "yaml".
+			if name == "yaml" {
+				return nil, errors.New("the project's environment may only import environments, not define values")
+			}
+			imports = append(imports, name)
+		}
+	}
+	if len(imports) == 0 {
+		return ps.Environment, nil
+	}
+
+	def := ps.Environment.Definition()
+	if len(def) == 0 {
+		return NewEnvironment(imports), nil
+	}
+
+	// The stack's definition may be JSON or YAML, both of which decode as YAML.
+	var m map[string]any
+	if err := yaml.Unmarshal(def, &m); err != nil {
+		return nil, fmt.Errorf("parsing the stack's environment: %w", err)
+	}
+	if m == nil {
+		m = map[string]any{}
+	}
+	own, _ := m["imports"].([]any)
+	combined := make([]any, 0, len(imports)+len(own))
+	for _, name := range imports {
+		combined = append(combined, name)
+	}
+	m["imports"] = append(combined, own...)
+	message, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("encoding the stack's environment: %w", err)
+	}
+	return &Environment{message: message}, nil
+}
+
 type Environment struct {
 	envs    []string
 	message json.RawMessage
@@ -2357,3 +2357,91 @@ func TestAddPackage(t *testing.T) {
 		require.True(t, isSpec, "Package should be converted to PackageSpec when parameters are added")
 	})
 }
+
+func TestProjectStackEnvironment(t *testing.T) {
+	t.Parallel()
+
+	projectYaml := `name: test
+runtime: yaml
+environment:
+  - org/shared
+`
+	project, err := loadProjectFromText(t, projectYaml)
+	require.NoError(t, err)
+
+	t.Run("no stack environment", func(t *testing.T) {
+		t.Parallel()
+
+		stack := &ProjectStack{}
+
+		env, err := project.StackEnvironment(stack)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"org/shared"}, env.Imports())
+		assert.Nil(t, stack.Environment)
+	})
+
+	t.Run("stack environment list", func(t *testing.T) {
+		t.Parallel()
+
+		stack := &ProjectStack{Environment: NewEnvironment([]string{"org/stack"})}
+
+		env, err := project.StackEnvironment(stack)
+		require.NoError(t, err)
+
+		// The project's environments come first, so the stack's own take precedence.
+		assert.Equal(t, []string{"org/shared", "org/stack"}, env.Imports())
+		assert.Equal(t, []string{"org/stack"}, stack.Environment.Imports())
+	})
+
+	t.Run("stack environment literal", func(t *testing.T) {
+		t.Parallel()
+
+		var stdout, stderr bytes.Buffer
+		sink := diagtest.MockSink(&stdout, &stderr)
+		stack, err := loadProjectStackFromText(t, sink, project, `environment:
+  imports:
+    - org/stack
+  values:
+    pulumiConfig:
+      aws:region: us-west-2
+`)
+		require.NoError(t, err)
+
+		env, err := project.StackEnvironment(stack)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"org/shared", "org/stack", "yaml"}, env.Imports())
+	})
+
+	t.Run("no project environment", func(t *testing.T) {
+		t.Parallel()
+
+		plain, err := loadProjectFromText(t, "name: test\nruntime: yaml")
+		require.NoError(t, err)
+		stack := &ProjectStack{Environment: NewEnvironment([]string{"org/stack"})}
+
+		env, err := plain.StackEnvironment(stack)
+		require.NoError(t, err)
+		assert.Same(t, stack.Environment, env)
+	})
+
+	t.Run("project environment values", func(t *testing.T) {
+		t.Parallel()
+
+		inline := &Project{Environment: &Environment{message: json.RawMessage(`{"values":{"a":"b"}}`)}}
+		stack := &ProjectStack{Environment: NewEnvironment([]string{"org/stack"})}
+
+		_, err := inline.StackEnvironment(stack)
+		assert.ErrorContains(t, err, "may only import environments")
+	})
+
+	t.Run("invalid stack environment", func(t *testing.T) {
+		t.Parallel()
+
+		stack := &ProjectStack{Environment: &Environment{message: json.RawMessage(`{"imports": [`)}}
+
+		_, err := project.StackEnvironment(stack)
+		assert.ErrorContains(t, err, "parsing the stack's environment")
+	})
+}